@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -35,3 +36,249 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrNotLeader struct {
+	// the address of the leader's RPC server, empty if it isn't known
+	LeaderAddr string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("not the leader, leader: %q", e.LeaderAddr),
+	)
+	msg := fmt.Sprintf(
+		"This server isn't the leader, send the request to: %q",
+		e.LeaderAddr,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNotEnoughReplicas struct {
+	InSync    int
+	MinInSync int
+}
+
+func (e ErrNotEnoughReplicas) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.Unavailable,
+		fmt.Sprintf("not enough in-sync replicas: %d < %d", e.InSync, e.MinInSync),
+	)
+	msg := fmt.Sprintf(
+		"The write needs %d in-sync replicas but only %d are in sync",
+		e.MinInSync,
+		e.InSync,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotEnoughReplicas) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrReplicationTimeout struct {
+	Offset uint64
+}
+
+func (e ErrReplicationTimeout) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DeadlineExceeded,
+		fmt.Sprintf("replication timed out: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record was appended at offset %d but wasn't replicated in time, it may still be committed",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrReplicationTimeout) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrStaleEpoch struct {
+	Epoch       uint64
+	LatestEpoch uint64
+}
+
+func (e ErrStaleEpoch) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("stale leader epoch: %d < %d", e.Epoch, e.LatestEpoch),
+	)
+	msg := fmt.Sprintf(
+		"Leader epoch %d has been superseded by epoch %d, the leader was fenced",
+		e.Epoch,
+		e.LatestEpoch,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrStaleEpoch) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOutOfOrderSequence struct {
+	ProducerId string
+	Sequence   uint64
+	// the sequence the log expected next from the producer
+	Expected uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("out of order sequence from producer %s: %d, expected %d", e.ProducerId, e.Sequence, e.Expected),
+	)
+	msg := fmt.Sprintf(
+		"Producer %s sent sequence %d but the log expected %d, records were lost or reordered",
+		e.ProducerId,
+		e.Sequence,
+		e.Expected,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidSchema struct {
+	// the schema the record's value said it was written with, zero when it
+	// didn't say
+	SchemaID uint32
+	Reason   string
+}
+
+func (e ErrInvalidSchema) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid record for schema %d: %s", e.SchemaID, e.Reason),
+	)
+	msg := fmt.Sprintf(
+		"The record's value doesn't match schema %d: %s",
+		e.SchemaID,
+		e.Reason,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidSchema) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTransactionNotOpen struct {
+	TransactionId string
+}
+
+func (e ErrTransactionNotOpen) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("transaction %s isn't open", e.TransactionId),
+	)
+	msg := fmt.Sprintf(
+		"Transaction %s isn't open, it ended, timed out or the node restarted since it began",
+		e.TransactionId,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTransactionNotOpen) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrRedactionTooLarge struct {
+	Max int
+}
+
+func (e ErrRedactionTooLarge) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("a redaction erases at most %d records", e.Max),
+	)
+	msg := fmt.Sprintf(
+		"The redaction matches more than %d records, split its range",
+		e.Max,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrRedactionTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
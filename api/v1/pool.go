@@ -0,0 +1,24 @@
+package log_v1
+
+import "sync"
+
+// records are pooled for the node's own paths that read one record after
+// another, e.g. loading its producers or catching up a follower, so they don't
+// allocate one per record
+var recordPool = sync.Pool{
+	New: func() any {
+		return &Record{}
+	},
+}
+
+// returns an empty record from the pool, hand it back with Release
+func GetRecord() *Record {
+	return recordPool.Get().(*Record)
+}
+
+// empties the record and puts it back in the pool. the record, and its value,
+// mustn't be used afterwards, so only release records nothing else holds on to
+func (x *Record) Release() {
+	x.Reset()
+	recordPool.Put(x)
+}
@@ -0,0 +1,37 @@
+// the gencert command generates the CA and certificates the tests and dev
+// clusters use, without needing cfssl
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"proglog/internal/config"
+)
+
+func main() {
+	home, _ := os.UserHomeDir()
+	dir := flag.String("dir", filepath.Join(home, ".proglog"), "Directory to write the certificates to.")
+	hosts := flag.String("hosts", "127.0.0.1,localhost", "Comma-separated hosts the server certificate is valid for.")
+	clients := flag.String("clients", "root,nobody", "Comma-separated names to generate more client certificates for.")
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := config.GenerateCerts(*dir, strings.Split(*hosts, ",")); err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range strings.Split(*clients, ",") {
+		if name == "" {
+			continue
+		}
+		if err := config.GenerateClientCert(*dir, name); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("wrote certificates to %s", *dir)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	api "proglog/api/v1"
+
+	"github.com/spf13/cobra"
+)
+
+func apiKeyCmd() *cobra.Command {
+	c := &clientConfig{}
+	cmd := &cobra.Command{
+		Use:   "apikey",
+		Short: "Manage a node's API keys",
+		Long: `Manage a node's API keys.
+
+Clients send an API key with --api-key in place of a client certificate. A key
+may only do what its scopes allow: produce, consume or admin.`,
+	}
+	c.addFlags(cmd.PersistentFlags())
+	var scopes []string
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a key and print its token, which can't be retrieved again",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return apiKeyCreate(cmd.Context(), c, args[0], scopes, cmd.OutOrStdout())
+		},
+	}
+	createCmd.Flags().StringSliceVar(&scopes, "scope", nil, "What the key may do: produce, consume or admin.")
+	createCmd.MarkFlagRequired("scope")
+	cmd.AddCommand(
+		createCmd,
+		&cobra.Command{
+			Use:   "revoke <id>",
+			Short: "Revoke a key",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return apiKeyRevoke(cmd.Context(), c, args[0], cmd.OutOrStdout())
+			},
+		},
+		&cobra.Command{
+			Use:   "list",
+			Short: "List the keys, revoked ones included",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return apiKeyList(cmd.Context(), c, cmd.OutOrStdout())
+			},
+		},
+	)
+	return cmd
+}
+
+func apiKeyCreate(ctx context.Context, c *clientConfig, name string, scopes []string, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := client.CreateAPIKey(ctx, &api.CreateAPIKeyRequest{Name: name, Scopes: scopes})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "created %s (%s)\n", res.Key.Id, res.Key.Name)
+	_, err = fmt.Fprintf(out, "token: %s\n", res.Token)
+	return err
+}
+
+func apiKeyRevoke(ctx context.Context, c *clientConfig, id string, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := client.RevokeAPIKey(ctx, &api.RevokeAPIKeyRequest{Id: id}); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "revoked %s\n", id)
+	return err
+}
+
+func apiKeyList(ctx context.Context, c *clientConfig, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := client.ListAPIKeys(ctx, &api.ListAPIKeysRequest{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tREVOKED")
+	for _, k := range res.Keys {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%t\n",
+			k.Id,
+			k.Name,
+			strings.Join(k.Scopes, ","),
+			formatTimestamp(k.Created),
+			k.Revoked,
+		)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"proglog/internal/backup"
+	"proglog/internal/log"
+	"proglog/internal/migrate"
+	"proglog/internal/s3"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// the flags of the commands that read or write backups, the credentials come
+// from the environment like the AWS tools'
+type bucketConfig struct {
+	S3     s3.Config
+	Prefix string
+}
+
+func (c *bucketConfig) addFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&c.S3.Endpoint, "s3-endpoint", "", "The S3-compatible store, e.g. https://s3.us-east-1.amazonaws.com or https://storage.googleapis.com, required.")
+	flags.StringVar(&c.S3.Region, "s3-region", "us-east-1", "The store's region.")
+	flags.StringVar(&c.S3.Bucket, "s3-bucket", "", "The bucket, required.")
+	flags.StringVar(&c.Prefix, "s3-prefix", "proglog/", "What the names of the backup's objects start with.")
+	flags.BoolVar(&c.S3.PathStyle, "s3-path-style", false, "Address the bucket in the path, as most stores other than S3 need.")
+}
+
+func (c *bucketConfig) setup() error {
+	if c.S3.Endpoint == "" || c.S3.Bucket == "" {
+		return errors.New("s3-endpoint and s3-bucket are required")
+	}
+	c.S3.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	c.S3.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	c.S3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	return nil
+}
+
+type backupConfig struct {
+	clientConfig
+	bucketConfig
+	Full bool
+}
+
+func backupCmd() *cobra.Command {
+	c := &backupConfig{}
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Back the leader's sealed segments up to an S3-compatible bucket",
+		Long: `Back the leader's sealed, committed segments up to an S3-compatible bucket
+(S3, GCS through its interoperability API, MinIO...), copying them over the
+node's RPCs rather than from its data dir. Only the segments after the last
+backup's are uploaded, or all of them with --full. The active segment's records
+are backed up once it's sealed. Nodes back themselves up with serve's
+--backup-interval.
+
+The credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+AWS_SESSION_TOKEN. --addr has to be the leader's, and an API key needs the admin
+scope.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return c.bucketConfig.setup()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, conn, err := c.dial()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			b, err := backup.New(backup.Remote{Client: client}, backup.Config{
+				S3:     c.S3,
+				Prefix: c.Prefix,
+			})
+			if err != nil {
+				return err
+			}
+			defer b.Close()
+			m, err := b.Run(cmd.Context(), c.Full)
+			if err != nil {
+				return err
+			}
+			return printManifest(cmd.OutOrStdout(), m)
+		},
+	}
+	c.clientConfig.addFlags(cmd.Flags())
+	c.bucketConfig.addFlags(cmd.Flags())
+	cmd.Flags().BoolVar(&c.Full, "full", false, "Upload every sealed segment rather than the ones after the last backup's.")
+	return cmd
+}
+
+type restoreConfig struct {
+	bucketConfig
+	DataDir  string
+	ToOffset uint64
+	ToTime   string
+
+	at backup.PointInTime
+}
+
+func restoreCmd() *cobra.Command {
+	c := &restoreConfig{}
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore a node's log from a backup",
+		Long: `Restore a node's log from the backup under --s3-prefix into --data-dir, which
+mustn't have a log yet, checking each segment against its checksum. Start the
+node on the data dir with --bootstrap to lead the restored log, the other nodes
+copy it from there.
+
+--to-offset and --to-time restore the log as it was at a point in time, for
+recovering from bad data: only the records before the offset, and appended at or
+before the time, are restored. --to-time takes a time (RFC 3339) or a duration
+before now (e.g. 2h).
+
+The credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+AWS_SESSION_TOKEN.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return c.setup(time.Now())
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := migrate.Check(c.DataDir); err != nil {
+				return err
+			}
+			bucket, err := s3.New(c.S3)
+			if err != nil {
+				return err
+			}
+			m, err := backup.Restore(cmd.Context(), bucket, c.Prefix, filepath.Join(c.DataDir, "log"), log.Config{}, c.at)
+			if err != nil {
+				return err
+			}
+			return printManifest(cmd.OutOrStdout(), m)
+		},
+	}
+	c.bucketConfig.addFlags(cmd.Flags())
+	flags := cmd.Flags()
+	flags.StringVar(&c.DataDir, "data-dir", "", "The node's data dir.")
+	flags.Uint64Var(&c.ToOffset, "to-offset", 0, "Only restore the records before this offset, 0 restores them all.")
+	flags.StringVar(&c.ToTime, "to-time", "", "Only restore the records appended at or before this time.")
+	cmd.MarkFlagRequired("data-dir")
+	return cmd
+}
+
+func (c *restoreConfig) setup(now time.Time) error {
+	if err := c.bucketConfig.setup(); err != nil {
+		return err
+	}
+	c.at.Offset = c.ToOffset
+	var err error
+	if c.at.Time, err = parseTime(c.ToTime, now); err != nil {
+		return fmt.Errorf("to-time: %w", err)
+	}
+	return nil
+}
+
+func printManifest(out io.Writer, m *backup.Manifest) error {
+	var lowest uint64
+	if len(m.Segments) > 0 {
+		lowest = m.Segments[0].BaseOffset
+	}
+	_, err := fmt.Fprintf(
+		out,
+		"%d segments, offsets [%d, %d), backed up at %s\n",
+		len(m.Segments),
+		lowest,
+		m.End(),
+		m.Time.Format(time.RFC3339),
+	)
+	return err
+}
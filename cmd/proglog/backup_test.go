@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreConfig(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	c := &restoreConfig{ToOffset: 10, ToTime: "2h"}
+	require.ErrorContains(t, c.setup(now), "s3-endpoint and s3-bucket are required")
+
+	c.S3.Endpoint = "http://127.0.0.1:9000"
+	c.S3.Bucket = "backups"
+	require.NoError(t, c.setup(now))
+	require.Equal(t, uint64(10), c.at.Offset)
+	require.Equal(t, now.Add(-2*time.Hour), c.at.Time)
+	require.Equal(t, "id", c.S3.AccessKeyID)
+
+	c.ToTime = "yesterday"
+	require.ErrorContains(t, c.setup(now), "to-time")
+}
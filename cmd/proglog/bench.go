@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type benchConfig struct {
+	clientConfig
+	Producers  int
+	Consumers  int
+	RecordSize int
+	Duration   time.Duration
+}
+
+func benchCmd() *cobra.Command {
+	c := &benchConfig{}
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Drive producer and consumer load against a node and report throughput and latency",
+		Long: `Drive producer and consumer load against a node and report throughput and latency.
+
+Every producer appends records of --record-size bytes one at a time, waiting for
+each to be committed. Every consumer follows the log from where it ended when the
+benchmark started.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if c.Producers < 0 || c.Consumers < 0 || c.Producers+c.Consumers == 0 {
+				return fmt.Errorf("bench needs at least one producer or consumer")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			res, err := c.run(cmd.Context())
+			if err != nil {
+				return err
+			}
+			res.print(cmd.OutOrStdout())
+			return nil
+		},
+	}
+	c.addFlags(cmd.Flags())
+	flags := cmd.Flags()
+	flags.IntVar(&c.Producers, "producers", 1, "Concurrent producers.")
+	flags.IntVar(&c.Consumers, "consumers", 0, "Concurrent consumers.")
+	flags.IntVar(&c.RecordSize, "record-size", 1024, "Bytes per record.")
+	flags.DurationVar(&c.Duration, "duration", 10*time.Second, "How long to drive load.")
+	return cmd
+}
+
+type benchResult struct {
+	elapsed    time.Duration
+	recordSize int
+	produced   uint64
+	consumed   uint64
+	// the latency of every produce, sorted
+	latencies []time.Duration
+	errors    uint64
+}
+
+func (c *benchConfig) run(ctx context.Context) (*benchResult, error) {
+	client, conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Duration)
+	defer cancel()
+	res := &benchResult{recordSize: c.RecordSize}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		consumed atomic.Uint64
+		failed   atomic.Uint64
+	)
+	value := bytes.Repeat([]byte("x"), c.RecordSize)
+	start := time.Now()
+	for i := 0; i < c.Producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var latencies []time.Duration
+			for ctx.Err() == nil {
+				sent := time.Now()
+				_, err := client.Produce(ctx, &api.ProduceRequest{
+					Record: &api.Record{Value: value},
+				})
+				if err != nil {
+					if ctx.Err() == nil {
+						failed.Add(1)
+					}
+					continue
+				}
+				latencies = append(latencies, time.Since(sent))
+			}
+			mu.Lock()
+			res.latencies = append(res.latencies, latencies...)
+			mu.Unlock()
+		}()
+	}
+	for i := 0; i < c.Consumers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+				Offset: offsets.EndOffset,
+			})
+			if err != nil {
+				failed.Add(1)
+				return
+			}
+			for {
+				if _, err := stream.Recv(); err != nil {
+					if status.Code(err) != codes.Canceled && status.Code(err) != codes.DeadlineExceeded {
+						failed.Add(1)
+					}
+					return
+				}
+				consumed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	res.elapsed = time.Since(start)
+	res.produced = uint64(len(res.latencies))
+	res.consumed = consumed.Load()
+	res.errors = failed.Load()
+	sort.Slice(res.latencies, func(i, j int) bool {
+		return res.latencies[i] < res.latencies[j]
+	})
+	return res, nil
+}
+
+// returns the latency below which p of the produces completed
+func (r *benchResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(r.latencies)-1))
+	return r.latencies[i]
+}
+
+func (r *benchResult) print(out io.Writer) {
+	seconds := r.elapsed.Seconds()
+	throughput := func(n uint64) string {
+		return fmt.Sprintf(
+			"%d records, %.1f records/s, %.2f MB/s",
+			n,
+			float64(n)/seconds,
+			float64(n)*float64(r.recordSize)/seconds/1e6,
+		)
+	}
+	fmt.Fprintf(out, "elapsed:  %s\n", r.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(out, "produced: %s\n", throughput(r.produced))
+	fmt.Fprintf(out, "consumed: %s\n", throughput(r.consumed))
+	fmt.Fprintf(out, "errors:   %d\n", r.errors)
+	if len(r.latencies) > 0 {
+		fmt.Fprintf(
+			out,
+			"produce latency: p50 %s, p90 %s, p99 %s, max %s\n",
+			r.percentile(0.5),
+			r.percentile(0.9),
+			r.percentile(0.99),
+			r.latencies[len(r.latencies)-1],
+		)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBench(t *testing.T) {
+	_, addr := setupServer(t)
+	c := &benchConfig{
+		Producers:  2,
+		Consumers:  1,
+		RecordSize: 16,
+		Duration:   200 * time.Millisecond,
+	}
+	c.Addr = addr
+	res, err := c.run(context.Background())
+	require.NoError(t, err)
+	require.NotZero(t, res.produced)
+	require.NotZero(t, res.consumed)
+	require.Zero(t, res.errors)
+	require.LessOrEqual(t, res.percentile(0.5), res.percentile(0.99))
+
+	var out bytes.Buffer
+	res.print(&out)
+	require.Contains(t, out.String(), "produce latency: p50")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	api "proglog/api/v1"
+	"proglog/internal/config"
+	"proglog/pkg/client"
+
+	"github.com/spf13/pflag"
+)
+
+// the flags every command that talks to a node shares
+type clientConfig struct {
+	Addr      string
+	TLSConfig config.TLSConfig
+	// an ID token for nodes that check admin RPCs' callers
+	Token string
+	// an API key, in place of a client certificate
+	APIKey string
+	// gzip, snappy or zstd, nothing's compressed when empty
+	Compression string
+}
+
+func (c *clientConfig) addFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&c.Addr, "addr", "127.0.0.1:8400", "The node's RPC address.")
+	flags.StringVar(&c.TLSConfig.CertFile, "tls-cert-file", "", "Path to the client tls cert.")
+	flags.StringVar(&c.TLSConfig.KeyFile, "tls-key-file", "", "Path to the client tls key.")
+	flags.StringVar(&c.TLSConfig.CAFile, "tls-ca-file", "", "Path to the certificate authority, enables TLS.")
+	flags.StringVar(&c.Token, "token", os.Getenv("PROGLOG_TOKEN"), "ID token for admin RPCs, needs TLS. Defaults to $PROGLOG_TOKEN.")
+	flags.StringVar(&c.APIKey, "api-key", os.Getenv("PROGLOG_API_KEY"), "API key to authenticate with, needs TLS. Defaults to $PROGLOG_API_KEY.")
+	flags.StringVar(&c.Compression, "compression", "", "Compress requests and responses with gzip, snappy or zstd, for slow links.")
+}
+
+// the connection's closed through the io.Closer
+func (c *clientConfig) dial() (api.LogClient, io.Closer, error) {
+	cc, err := c.config()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := client.New(cc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn.API(), conn, nil
+}
+
+func (c *clientConfig) config() (client.Config, error) {
+	cc := client.Config{
+		Addr:        c.Addr,
+		Token:       c.Token,
+		APIKey:      c.APIKey,
+		Compression: c.Compression,
+	}
+	if c.TLSConfig.CAFile != "" {
+		tlsConfig, err := config.SetupTLSConfig(c.TLSConfig)
+		if err != nil {
+			return cc, err
+		}
+		cc.TLSConfig = tlsConfig
+	}
+	return cc, nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/spf13/cobra"
+)
+
+func clusterCmd() *cobra.Command {
+	c := &clientConfig{}
+	cmd := &cobra.Command{
+		Use:   "cluster",
+		Short: "Inspect and manage the cluster a node belongs to",
+	}
+	c.addFlags(cmd.PersistentFlags())
+	var auditLimit uint32
+	auditCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "List the node's most recent security audit events",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return clusterAudit(cmd.Context(), c, auditLimit, cmd.OutOrStdout())
+		},
+	}
+	auditCmd.Flags().Uint32Var(&auditLimit, "limit", 20, "How many events to list.")
+	req := &api.DescribeSegmentsRequest{}
+	segmentsCmd := &cobra.Command{
+		Use:   "segments",
+		Short: "List the node's segments, and optionally one segment's index entries",
+		Long: `List the node's segments: their offsets, file sizes and whether they're
+sealed or active. With --index, also print the index entries of the segment
+starting at that base offset, so a corrupted segment can be looked into
+without copying the node's data directory. Needs an admin client.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req.IndexEntries = cmd.Flags().Changed("index")
+			return clusterSegments(cmd.Context(), c, req, cmd.OutOrStdout())
+		},
+	}
+	segmentsCmd.Flags().Uint64Var(&req.BaseOffset, "index", 0, "Print the index entries of the segment starting at this base offset.")
+	var readOnlyReason string
+	readOnlyCmd := &cobra.Command{
+		Use:   "read-only on|off",
+		Short: "Put the node in or out of read-only mode",
+		Long: `Put the node in or out of read-only mode. A read-only node rejects produces,
+telling producers --reason, and carries on serving consumers and replicating,
+e.g. during a migration or while its disk's filling up. The mode lasts until
+it's turned off or the node restarts, see serve's --read-only. Needs an admin
+client.`,
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"on", "off"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return clusterReadOnly(cmd.Context(), c, args[0], readOnlyReason, cmd.OutOrStdout())
+		},
+	}
+	readOnlyCmd.Flags().StringVar(&readOnlyReason, "reason", "", "Why, told to the producers the node rejects.")
+	var drainTimeout time.Duration
+	drainCmd := &cobra.Command{
+		Use:   "drain",
+		Short: "Ready the node for maintenance, waiting until it can be shut down",
+		Long: `Ready the node for maintenance: it reports it's unready, refuses new streams,
+ends the ones following the log so their clients move to another node, and
+waits for the requests it's serving and, on the leader, for the in-sync
+followers to have every record. It exits with an error when the node hasn't
+settled within --timeout. The node stays unready until it's restarted.
+
+The leader's fixed, it's the node started with --bootstrap, so draining it
+doesn't hand leadership to another node: produces fail until it's back.
+Needs an admin client.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return clusterDrain(cmd.Context(), c, drainTimeout, cmd.OutOrStdout())
+		},
+	}
+	drainCmd.Flags().DurationVar(&drainTimeout, "timeout", 30*time.Second, "How long to wait for the node to settle.")
+	var redactReq api.RedactRequest
+	var startKey, endKey string
+	redactCmd := &cobra.Command{
+		Use:   "redact",
+		Short: "Erase the keys and values of records on every replica",
+		Long: `Erase the keys and values of records on every replica, for legal deletion
+requests: those in [--start-offset, --end-offset), or, when --start-key is set,
+those with a key in [--start-key, --end-key). The records keep their offsets
+and consumers read them with an empty key and value. It prints the offsets
+erased.
+
+The key index drops the erased keys, and erases them from its own files too.
+Backups taken before keep the records. Needs an admin client, and must be sent
+to the leader.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			redactReq.StartKey, redactReq.EndKey = []byte(startKey), []byte(endKey)
+			return clusterRedact(cmd.Context(), c, &redactReq, cmd.OutOrStdout())
+		},
+	}
+	redactCmd.Flags().Uint64Var(&redactReq.StartOffset, "start-offset", 0, "The first record to erase.")
+	redactCmd.Flags().Uint64Var(&redactReq.EndOffset, "end-offset", 0, "The record after the last one to erase.")
+	redactCmd.Flags().StringVar(&startKey, "start-key", "", "Erase the records with a key from this one on, instead of an offset range.")
+	redactCmd.Flags().StringVar(&endKey, "end-key", "", "Erase the records with a key below this one, no end when empty.")
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "status",
+			Short: "Print the replication status from the node's point of view",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return clusterStatus(cmd.Context(), c, cmd.OutOrStdout())
+			},
+		},
+		&cobra.Command{
+			Use:   "describe",
+			Short: "Print the node's offsets, size on disk and when its newest record was appended",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return clusterDescribe(cmd.Context(), c, cmd.OutOrStdout())
+			},
+		},
+		&cobra.Command{
+			Use:   "members",
+			Short: "List the nodes the node knows about",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return clusterMembers(cmd.Context(), c, cmd.OutOrStdout())
+			},
+		},
+		&cobra.Command{
+			Use:   "remove <id>",
+			Short: "Force a failed node out of the cluster",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return clusterRemove(cmd.Context(), c, args[0], cmd.OutOrStdout())
+			},
+		},
+		auditCmd,
+		segmentsCmd,
+		readOnlyCmd,
+		drainCmd,
+		redactCmd,
+	)
+	return cmd
+}
+
+func clusterStatus(ctx context.Context, c *clientConfig, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := client.GetClusterStatus(ctx, &api.GetClusterStatusRequest{})
+	if err != nil {
+		return err
+	}
+
+	s := res.Status
+	fmt.Fprintf(out, "node:           %s\n", s.NodeId)
+	fmt.Fprintf(out, "leader:         %s (%s)\n", s.LeaderId, s.LeaderAddr)
+	fmt.Fprintf(out, "epoch:          %d\n", s.Epoch)
+	fmt.Fprintf(out, "high watermark: %d\n", s.HighWatermark)
+	fmt.Fprintf(out, "log end:        %d\n\n", s.LogEndOffset)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tROLE\tHEALTHY\tIN SYNC\tLOG END\tLAST CONTACT")
+	for _, n := range s.Nodes {
+		role := "follower"
+		if n.IsLeader {
+			role = "leader"
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%t\t%t\t%d\t%s\n",
+			n.Id,
+			role,
+			n.Healthy,
+			n.InSync,
+			n.LogEndOffset,
+			time.Duration(n.LastContactMs)*time.Millisecond,
+		)
+	}
+	return w.Flush()
+}
+
+func clusterDescribe(ctx context.Context, c *clientConfig, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := client.DescribeLog(ctx, &api.DescribeLogRequest{})
+	if err != nil {
+		return err
+	}
+
+	d := res.Log
+	fmt.Fprintf(out, "leader:         %s\n", d.LeaderId)
+	fmt.Fprintf(out, "replicas:       %s\n", strings.Join(d.ReplicaIds, ", "))
+	fmt.Fprintf(out, "lowest offset:  %d\n", d.LowestOffset)
+	fmt.Fprintf(out, "high watermark: %d\n", d.HighWatermark)
+	fmt.Fprintf(out, "log end:        %d\n", d.LogEndOffset)
+	fmt.Fprintf(out, "segments:       %d\n", d.Segments)
+	fmt.Fprintf(out, "size:           %d bytes\n", d.SizeBytes)
+	if d.ReadOnlyReason != "" {
+		fmt.Fprintf(out, "read-only:      %t (%s)\n", d.ReadOnly, d.ReadOnlyReason)
+	} else {
+		fmt.Fprintf(out, "read-only:      %t\n", d.ReadOnly)
+	}
+	fmt.Fprintf(out, "oldest record:  %s\n", formatTimestamp(d.OldestTimestamp))
+	_, err = fmt.Fprintf(out, "newest record:  %s\n", formatTimestamp(d.NewestTimestamp))
+	return err
+}
+
+func clusterMembers(ctx context.Context, c *clientConfig, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := client.ListMembers(ctx, &api.ListMembersRequest{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDR\tRPC ADDR\tSTATUS\tLEADER")
+	for _, m := range res.Members {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", m.Id, m.Addr, m.RpcAddr, m.Status, m.IsLeader)
+	}
+	return w.Flush()
+}
+
+func clusterRemove(ctx context.Context, c *clientConfig, id string, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := client.RemoveMember(ctx, &api.RemoveMemberRequest{Id: id}); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "removed %s\n", id)
+	return err
+}
+
+func clusterReadOnly(ctx context.Context, c *clientConfig, mode, reason string, out io.Writer) error {
+	var readOnly bool
+	switch mode {
+	case "on":
+		readOnly = true
+	case "off":
+	default:
+		return fmt.Errorf("the mode is on or off, not %q", mode)
+	}
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req := &api.SetReadOnlyRequest{ReadOnly: readOnly, Reason: reason}
+	if _, err := client.SetReadOnly(ctx, req); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "read-only %s\n", mode)
+	return err
+}
+
+func clusterDrain(ctx context.Context, c *clientConfig, timeout time.Duration, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := client.Drain(ctx, &api.DrainRequest{TimeoutMs: uint32(timeout.Milliseconds())})
+	if err != nil {
+		return err
+	}
+	if !res.Settled {
+		return fmt.Errorf(
+			"the node didn't settle within %s: %d requests in flight, %d records unreplicated",
+			timeout,
+			res.InFlight,
+			res.Unreplicated,
+		)
+	}
+	_, err = fmt.Fprintln(out, "drained, the node can be shut down")
+	return err
+}
+
+func clusterRedact(ctx context.Context, c *clientConfig, req *api.RedactRequest, out io.Writer) error {
+	if len(req.StartKey) == 0 && len(req.EndKey) > 0 {
+		return errors.New("--end-key needs --start-key")
+	}
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := client.Redact(ctx, req)
+	if err != nil {
+		return err
+	}
+	if len(res.Offsets) == 0 {
+		_, err = fmt.Fprintln(out, "nothing to erase")
+		return err
+	}
+	for _, off := range res.Offsets {
+		fmt.Fprintln(out, off)
+	}
+	_, err = fmt.Fprintf(out, "erased %d records, redaction at %d\n", len(res.Offsets), res.Offset)
+	return err
+}
+
+func clusterAudit(ctx context.Context, c *clientConfig, limit uint32, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := client.ListAuditEvents(ctx, &api.ListAuditEventsRequest{Limit: limit})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tPRINCIPAL\tADDR\tACTION\tRESOURCE\tALLOWED\tERROR")
+	for _, e := range res.Events {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%t\t%s\n",
+			formatTimestamp(e.Time),
+			e.Principal,
+			e.Addr,
+			e.Action,
+			e.Resource,
+			e.Allowed,
+			e.Error,
+		)
+	}
+	return w.Flush()
+}
+
+func clusterSegments(ctx context.Context, c *clientConfig, req *api.DescribeSegmentsRequest, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := client.DescribeSegments(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BASE OFFSET\tNEXT OFFSET\tSTORE BYTES\tINDEX BYTES\tSTATE")
+	for _, s := range res.Segments {
+		state := "sealed"
+		if s.Active {
+			state = "active"
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%s\n", s.BaseOffset, s.NextOffset, s.StoreBytes, s.IndexBytes, state)
+	}
+	if !req.IndexEntries {
+		return w.Flush()
+	}
+	fmt.Fprintf(w, "\nINDEX OF %d\n", req.BaseOffset)
+	fmt.Fprintln(w, "OFFSET\tRELATIVE\tPOSITION")
+	for _, e := range res.IndexEntries {
+		fmt.Fprintf(w, "%d\t%d\t%d\n", req.BaseOffset+uint64(e.RelativeOffset), e.RelativeOffset, e.Position)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+func configCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Check and write serve's config files",
+	}
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "validate <file>",
+			Short: "Check a config file the way serve would load it",
+			Long: `Check a config file the way serve would load it, with the defaults and
+PROGLOG_ environment variables applied, and print every problem found.`,
+			Args: cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return validateConfig(args[0], cmd.OutOrStdout())
+			},
+		},
+		&cobra.Command{
+			Use:   "defaults",
+			Short: "Print serve's default settings as a config file",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return printDefaults(cmd.OutOrStdout())
+			},
+		},
+	)
+	return cmd
+}
+
+func validateConfig(file string, out io.Writer) error {
+	v := viper.New()
+	if err := setupFlags(&cobra.Command{}, v); err != nil {
+		return err
+	}
+	v.Set("config-file", file)
+	if err := (&serveConfig{}).load(v); err != nil {
+		return fmt.Errorf("%s is invalid:\n%w", file, err)
+	}
+	fmt.Fprintf(out, "%s is valid\n", file)
+	return nil
+}
+
+func printDefaults(out io.Writer) error {
+	cmd := &cobra.Command{}
+	v := viper.New()
+	if err := setupFlags(cmd, v); err != nil {
+		return err
+	}
+	settings := map[string]interface{}{}
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config-file" {
+			return
+		}
+		// typed so the YAML reads back the same, viper only has strings for some flags
+		switch f.Value.Type() {
+		case "uint64":
+			settings[f.Name] = v.GetUint64(f.Name)
+		case "float64":
+			settings[f.Name] = v.GetFloat64(f.Name)
+		case "duration":
+			settings[f.Name] = v.GetDuration(f.Name).String()
+		default:
+			settings[f.Name] = v.Get(f.Name)
+		}
+	})
+	b, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(b)
+	return err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, printDefaults(&out))
+	require.Contains(t, out.String(), "rpc-port: 8400\n")
+	require.NotContains(t, out.String(), "config-file")
+
+	// the defaults are a valid config file for a leader
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	defaults := bytes.Replace(out.Bytes(), []byte("bootstrap: false"), []byte("bootstrap: true"), 1)
+	require.NoError(t, os.WriteFile(file, defaults, 0644))
+	out.Reset()
+	require.NoError(t, validateConfig(file, &out))
+	require.Contains(t, out.String(), "is valid")
+}
+
+func TestConfigValidate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+rpc-port: 8401
+min-in-sync-replicas: 0
+server-tls-ca-file: /does/not/exist.pem
+`), 0644))
+
+	var out bytes.Buffer
+	err := validateConfig(file, &out)
+	require.ErrorContains(t, err, "rpc-port 8401 is the bind-addr's port")
+	require.ErrorContains(t, err, "min-in-sync-replicas must be at least 1")
+	require.ErrorContains(t, err, "server-tls-ca-file")
+	require.ErrorContains(t, err, "start-join-addrs is required")
+
+	require.Error(t, validateConfig(filepath.Join(t.TempDir(), "missing.yaml"), &out))
+}
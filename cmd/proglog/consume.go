@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	api "proglog/api/v1"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type consumeConfig struct {
+	clientConfig
+	From     string
+	Follow   bool
+	Max      uint64
+	Output   string
+	Since    string
+	Until    string
+	Filter   string
+	Priority string
+
+	since, until time.Time
+	priority     api.ConsumeRequest_Priority
+}
+
+func consumeCmd() *cobra.Command {
+	c := &consumeConfig{}
+	cmd := &cobra.Command{
+		Use:   "consume",
+		Short: "Print the log's records",
+		Long: `Print the log's records, from --from up to the end of the log, or as they're
+appended with --follow.
+
+--since and --until take a time (RFC 3339) or a duration before now (e.g. 10m).
+Records appended before the log stamped them with a time are always older than
+--since.
+
+--filter takes a CEL expression the node only sends the records it's true for,
+over offset, timestamp, producer_id, key, value and json (the value parsed as
+JSON), e.g. json.level == "error".`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return c.setup(time.Now())
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.run(cmd.Context(), cmd.OutOrStdout())
+		},
+	}
+	c.addFlags(cmd.Flags())
+	flags := cmd.Flags()
+	flags.StringVar(&c.From, "from", "earliest", "The offset to start from: a number, earliest or latest.")
+	flags.BoolVar(&c.Follow, "follow", false, "Keep printing records as they're appended.")
+	flags.Uint64Var(&c.Max, "max", 0, "Stop after printing this many records, 0 doesn't stop.")
+	flags.StringVar(&c.Output, "output", "json", "How records are printed: json or raw (the values, one per line).")
+	flags.StringVar(&c.Since, "since", "", "Only print records appended at or after this time.")
+	flags.StringVar(&c.Until, "until", "", "Only print records appended at or before this time, and stop after it.")
+	flags.StringVar(&c.Filter, "filter", "", "Only print the records this CEL expression is true for, filtered by the node.")
+	flags.StringVar(&c.Priority, "priority", "normal", "The lane the node's reads from disk wait in while they're limited: normal, high or bulk.")
+	return cmd
+}
+
+func (c *consumeConfig) setup(now time.Time) error {
+	if c.Output != "json" && c.Output != "raw" {
+		return fmt.Errorf("output %q isn't json or raw", c.Output)
+	}
+	var err error
+	if c.since, err = parseTime(c.Since, now); err != nil {
+		return fmt.Errorf("since: %w", err)
+	}
+	if c.until, err = parseTime(c.Until, now); err != nil {
+		return fmt.Errorf("until: %w", err)
+	}
+	if c.Priority != "" {
+		priority, ok := api.ConsumeRequest_Priority_value[strings.ToUpper(c.Priority)]
+		if !ok {
+			return fmt.Errorf("priority %q isn't normal, high or bulk", c.Priority)
+		}
+		c.priority = api.ConsumeRequest_Priority(priority)
+	}
+	return nil
+}
+
+// parses an RFC 3339 time or a duration before now, an empty string is the zero time
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func (c *consumeConfig) run(ctx context.Context, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if err != nil {
+		return err
+	}
+	var off uint64
+	switch c.From {
+	case "earliest":
+		off = offsets.LowestOffset
+	case "latest":
+		off = offsets.EndOffset
+	default:
+		if off, err = strconv.ParseUint(c.From, 10, 64); err != nil {
+			return fmt.Errorf("from %q isn't an offset, earliest or latest", c.From)
+		}
+	}
+	if !c.Follow && off >= offsets.EndOffset {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req := &api.ConsumeRequest{Offset: off, Filter: c.Filter, Priority: c.priority}
+	if !c.Follow {
+		// a filtered stream's last record needn't be the log's
+		req.EndOffset = offsets.EndOffset
+	}
+	stream, err := client.ConsumeStream(ctx, req)
+	if err != nil {
+		return err
+	}
+	var printed uint64
+	for {
+		res, err := stream.Recv()
+		if status.Code(err) == codes.Canceled || err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record := res.Record
+		appended := time.Unix(0, record.Timestamp)
+		if !c.until.IsZero() && record.Timestamp != 0 && appended.After(c.until) {
+			return nil
+		}
+		if c.since.IsZero() || (record.Timestamp != 0 && !appended.Before(c.since)) {
+			if err := c.print(out, record); err != nil {
+				return err
+			}
+			printed++
+		}
+		if c.Max > 0 && printed == c.Max {
+			return nil
+		}
+		if !c.Follow && record.Offset+1 >= offsets.EndOffset {
+			return nil
+		}
+	}
+}
+
+type consumedRecord struct {
+	Offset    uint64 `json:"offset"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Value     string `json:"value,omitempty"`
+	// values that aren't UTF-8 are printed base64 encoded
+	ValueBase64 string `json:"value_base64,omitempty"`
+}
+
+func (c *consumeConfig) print(out io.Writer, record *api.Record) error {
+	return printRecord(out, c.Output, record)
+}
+
+// prints the record as json or raw, the value alone
+func printRecord(out io.Writer, output string, record *api.Record) error {
+	if output == "raw" {
+		_, err := fmt.Fprintf(out, "%s\n", record.Value)
+		return err
+	}
+	r := consumedRecord{Offset: record.Offset}
+	if record.Timestamp != 0 {
+		r.Timestamp = time.Unix(0, record.Timestamp).UTC().Format(time.RFC3339Nano)
+	}
+	if utf8.Valid(record.Value) {
+		r.Value = string(record.Value)
+	} else {
+		r.ValueBase64 = base64.StdEncoding.EncodeToString(record.Value)
+	}
+	return json.NewEncoder(out).Encode(r)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsume(t *testing.T) {
+	clog, addr := setupServer(t)
+	for _, value := range []string{"first", "second", "third"} {
+		_, err := clog.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	consume := func(c *consumeConfig) string {
+		c.Addr = addr
+		if c.Output == "" {
+			c.Output = "json"
+		}
+		require.NoError(t, c.setup(time.Now()))
+		var out bytes.Buffer
+		require.NoError(t, c.run(context.Background(), &out))
+		return out.String()
+	}
+
+	out := consume(&consumeConfig{From: "1"})
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+	var record consumedRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, uint64(1), record.Offset)
+	require.Equal(t, "second", record.Value)
+	require.NotEmpty(t, record.Timestamp)
+
+	out = consume(&consumeConfig{From: "earliest", Output: "raw", Max: 2})
+	require.Equal(t, "first\nsecond\n", out)
+
+	require.Empty(t, consume(&consumeConfig{From: "latest"}))
+	require.Empty(t, consume(&consumeConfig{From: "earliest", Until: "1h"}))
+	require.Len(t, strings.Fields(consume(&consumeConfig{From: "earliest", Since: "1h", Output: "raw"})), 3)
+
+	// the node filters, and the stream ends though the last record doesn't match
+	out = consume(&consumeConfig{From: "earliest", Filter: `string(value).startsWith("s")`, Output: "raw"})
+	require.Equal(t, "second\n", out)
+
+	// following prints records as they're appended
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		clog.Append(&api.Record{Value: []byte("fourth")})
+	}()
+	out = consume(&consumeConfig{From: "latest", Follow: true, Max: 1, Output: "raw"})
+	require.Equal(t, "fourth\n", out)
+}
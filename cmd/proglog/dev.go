@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"proglog/internal/agent"
+	"proglog/internal/config"
+
+	"github.com/spf13/cobra"
+)
+
+type devConfig struct {
+	Nodes             int
+	DataDir           string
+	BasePort          int
+	MinInSyncReplicas int
+}
+
+func devCmd() *cobra.Command {
+	c := &devConfig{}
+	cmd := &cobra.Command{
+		Use:   "dev",
+		Short: "Run a local cluster in one process",
+		Long: `Run a local cluster in one process until it's interrupted.
+
+Node 0 leads and the others follow it. Node i serves RPCs on base-port+3i,
+gossips on base-port+3i+1 and serves its health probes on base-port+3i+2.
+The nodes use TLS certificates generated into the data dir's tls directory,
+which clients can use too.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.run(cmd.OutOrStdout())
+		},
+	}
+	flags := cmd.Flags()
+	flags.IntVar(&c.Nodes, "nodes", 3, "Number of nodes to run.")
+	flags.StringVar(&c.DataDir, "data-dir", "", "Directory for the nodes' data, a temporary one removed on exit when empty.")
+	flags.IntVar(&c.BasePort, "base-port", 8400, "First port the nodes use.")
+	flags.IntVar(&c.MinInSyncReplicas, "min-in-sync-replicas", 1, "In-sync replicas (counting the leader) a write needs.")
+	return cmd
+}
+
+func (c *devConfig) run(out io.Writer) error {
+	if c.Nodes < 1 {
+		return fmt.Errorf("nodes must be at least 1")
+	}
+	if c.DataDir == "" {
+		dir, err := os.MkdirTemp("", "proglog-dev")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		c.DataDir = dir
+	}
+	tlsDir := filepath.Join(c.DataDir, "tls")
+	if err := os.MkdirAll(tlsDir, 0755); err != nil {
+		return err
+	}
+	if err := config.GenerateCerts(tlsDir, []string{"127.0.0.1", "localhost"}); err != nil {
+		return err
+	}
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: filepath.Join(tlsDir, "server.pem"),
+		KeyFile:  filepath.Join(tlsDir, "server-key.pem"),
+		CAFile:   filepath.Join(tlsDir, "ca.pem"),
+		Server:   true,
+	})
+	if err != nil {
+		return err
+	}
+	var agents []*agent.Agent
+	// followers shut down first so the leader doesn't wait on them meanwhile
+	defer func() {
+		for i := len(agents) - 1; i >= 0; i-- {
+			agents[i].Shutdown()
+		}
+	}()
+	for i := 0; i < c.Nodes; i++ {
+		// the leader serves fetches to peers whose certificate names a member
+		name := fmt.Sprintf("node-%d", i)
+		if err := config.GenerateClientCert(tlsDir, name); err != nil {
+			return err
+		}
+		peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile: filepath.Join(tlsDir, name+".pem"),
+			KeyFile:  filepath.Join(tlsDir, name+"-key.pem"),
+			CAFile:   filepath.Join(tlsDir, "ca.pem"),
+		})
+		if err != nil {
+			return err
+		}
+		port := c.BasePort + 3*i
+		ac := agent.Config{
+			ServerTLSConfig:   serverTLSConfig,
+			PeerTLSConfig:     peerTLSConfig,
+			DataDir:           filepath.Join(c.DataDir, name),
+			BindAddr:          fmt.Sprintf("127.0.0.1:%d", port+1),
+			RPCPort:           port,
+			HTTPPort:          port + 2,
+			NodeName:          name,
+			Bootstrap:         i == 0,
+			MinInSyncReplicas: c.MinInSyncReplicas,
+		}
+		if i > 0 {
+			ac.StartJoinAddrs = []string{agents[0].BindAddr}
+		}
+		a, err := agent.New(ac)
+		if err != nil {
+			return err
+		}
+		agents = append(agents, a)
+		rpcAddr, _ := ac.RPCAddr()
+		role := "follower"
+		if ac.Bootstrap {
+			role = "leader"
+		}
+		fmt.Fprintf(out, "%s: %s on %s, data in %s\n", ac.NodeName, role, rpcAddr, ac.DataDir)
+	}
+	fmt.Fprintf(out, "TLS certificates (ca.pem, client.pem, client-key.pem) in %s\n", tlsDir)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	<-sigc
+	return nil
+}
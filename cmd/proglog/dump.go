@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"proglog/internal/log"
+
+	"github.com/spf13/cobra"
+)
+
+type dumpSegmentConfig struct {
+	// how much of each record's value to print, all of it when 0
+	MaxValueBytes int
+}
+
+func dumpSegmentCmd() *cobra.Command {
+	c := &dumpSegmentConfig{}
+	cmd := &cobra.Command{
+		Use:   "dump-segment <file.store|file.index>",
+		Short: "Print a segment's store or index file in human-readable form",
+		Long: `Print a segment's store or index file in human-readable form.
+
+For a store file, prints each record's offset, position, length, CRC-32
+(Castagnoli, computed from the record's bytes), timestamp and value. For an
+index file, prints each entry's offset and the position it points to. The
+file is only read, but stop the node first so it isn't appended meanwhile.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.run(args[0], cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().IntVar(&c.MaxValueBytes, "max-value-bytes", 64, "How much of each record's value to print, all of it when 0.")
+	return cmd
+}
+
+func (c *dumpSegmentConfig) run(path string, out io.Writer) error {
+	ext := filepath.Ext(path)
+	// segments' files are named after their base offset
+	baseOffset, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ext), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s isn't named after a base offset: %w", path, err)
+	}
+	switch ext {
+	case ".store":
+		return c.dumpStore(path, baseOffset, out)
+	case ".index":
+		return c.dumpIndex(path, baseOffset, out)
+	default:
+		return fmt.Errorf("%s is neither a .store nor a .index file", path)
+	}
+}
+
+func (c *dumpSegmentConfig) dumpStore(path string, baseOffset uint64, out io.Writer) error {
+	fmt.Fprintf(out, "store %s, base offset %d\n", path, baseOffset)
+	var records int
+	err := log.ScanStore(path, func(e log.StoreEntry) error {
+		records++
+		fmt.Fprintf(out, "pos=%d len=%d crc=%08x", e.Pos, e.Len, e.CRC)
+		if e.Err != nil {
+			fmt.Fprintf(out, " undecodable: %v\n", e.Err)
+			return nil
+		}
+		r := e.Record
+		value := r.Value
+		truncated := ""
+		if c.MaxValueBytes > 0 && len(value) > c.MaxValueBytes {
+			value = value[:c.MaxValueBytes]
+			truncated = "..."
+		}
+		fmt.Fprintf(
+			out,
+			" offset=%d epoch=%d timestamp=%s value=%q%s\n",
+			r.Offset,
+			r.Epoch,
+			formatTimestamp(r.Timestamp),
+			value,
+			truncated,
+		)
+		return nil
+	})
+	var torn log.ErrTornStore
+	if errors.As(err, &torn) {
+		fmt.Fprintf(out, "torn record at pos=%d, the store ends partway through it\n", torn.Pos)
+	}
+	fmt.Fprintf(out, "%d records\n", records)
+	return err
+}
+
+func (c *dumpSegmentConfig) dumpIndex(path string, baseOffset uint64, out io.Writer) error {
+	fmt.Fprintf(out, "index %s, base offset %d\n", path, baseOffset)
+	var entries int
+	err := log.ScanIndex(path, func(e log.IndexEntry) error {
+		entries++
+		fmt.Fprintf(out, "offset=%d rel=%d pos=%d\n", baseOffset+uint64(e.RelOffset), e.RelOffset, e.Pos)
+		return nil
+	})
+	fmt.Fprintf(out, "%d entries\n", entries)
+	return err
+}
+
+func formatTimestamp(ns int64) string {
+	if ns == 0 {
+		return "-"
+	}
+	return time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+}
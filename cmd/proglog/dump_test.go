@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpSegment(t *testing.T) {
+	dir := t.TempDir()
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	for _, value := range []string{"first", "second"} {
+		_, err := clog.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, clog.Close())
+
+	c := &dumpSegmentConfig{MaxValueBytes: 3}
+	var out bytes.Buffer
+	require.NoError(t, c.run(filepath.Join(dir, "0.store"), &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 4)
+	require.Contains(t, lines[1], "pos=0 ")
+	require.Contains(t, lines[1], `offset=0 `)
+	require.Contains(t, lines[1], `value="fir"...`)
+	require.Contains(t, lines[2], `offset=1 `)
+	require.Equal(t, "2 records", lines[3])
+
+	out.Reset()
+	require.NoError(t, c.run(filepath.Join(dir, "0.index"), &out))
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Equal(t, []string{
+		"index " + filepath.Join(dir, "0.index") + ", base offset 0",
+		"offset=0 rel=0 pos=0",
+		lines[2],
+		"2 entries",
+	}, lines)
+	require.True(t, strings.HasPrefix(lines[2], "offset=1 rel=1 pos="))
+
+	// a store cut off partway through a record is reported as torn
+	store := filepath.Join(dir, "0.store")
+	fi, err := os.Stat(store)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(store, fi.Size()-2))
+	out.Reset()
+	var torn log.ErrTornStore
+	require.ErrorAs(t, c.run(store, &out), &torn)
+	require.Contains(t, out.String(), "1 records")
+
+	require.Error(t, c.run(filepath.Join(dir, "log.txt"), &out))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/proto"
+)
+
+type exportConfig struct {
+	clientConfig
+	From   string
+	To     string
+	Format string
+	Output string
+}
+
+func exportCmd() *cobra.Command {
+	c := &exportConfig{}
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write the log's records to a file, for backfills and moving data",
+		Long: `Write the log's records from --from up to --to to a file, which import reads.
+
+With --format=jsonl every line is a record as JSON, its value base64 encoded.
+With --format=proto every record is an api.Record, prefixed with its length as
+a uvarint.
+
+The file's its own progress: an export to a file that already holds records
+resumes after its last one, dropping a record a stopped export only wrote part
+of, so it can be run again until it's done.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return c.validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.run(cmd.Context(), cmd.OutOrStdout())
+		},
+	}
+	c.addFlags(cmd.Flags())
+	flags := cmd.Flags()
+	flags.StringVar(&c.From, "from", "earliest", "The offset to start from: a number or earliest.")
+	flags.StringVar(&c.To, "to", "", "The offset to stop before, the log's end when the export started when empty.")
+	flags.StringVar(&c.Format, "format", "jsonl", "How records are written: jsonl or proto.")
+	flags.StringVar(&c.Output, "output", "", "The file records are written to, required.")
+	return cmd
+}
+
+func (c *exportConfig) validate() error {
+	if err := validateFileFormat(c.Format); err != nil {
+		return err
+	}
+	if c.Output == "" {
+		return errors.New("output is required")
+	}
+	return nil
+}
+
+func validateFileFormat(format string) error {
+	if format != "jsonl" && format != "proto" {
+		return fmt.Errorf("format %q isn't jsonl or proto", format)
+	}
+	return nil
+}
+
+func (c *exportConfig) run(ctx context.Context, out io.Writer) error {
+	f, err := os.OpenFile(c.Output, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	last, written, err := c.resume(f)
+	if err != nil {
+		return err
+	}
+
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if err != nil {
+		return err
+	}
+	off := offsets.LowestOffset
+	if c.From != "earliest" {
+		if off, err = strconv.ParseUint(c.From, 10, 64); err != nil {
+			return fmt.Errorf("from %q isn't an offset or earliest", c.From)
+		}
+	}
+	if last != nil {
+		off = *last + 1
+	}
+	to := offsets.EndOffset
+	if c.To != "" {
+		if to, err = strconv.ParseUint(c.To, 10, 64); err != nil {
+			return fmt.Errorf("to %q isn't an offset", c.To)
+		}
+	}
+	var exported uint64
+	done := func() error {
+		_, err := fmt.Fprintf(out, "exported %d records, %s holds %d\n", exported, c.Output, written+exported)
+		return err
+	}
+	if off >= to {
+		return done()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset: off,
+		// exports are backfills, they give way to the other consumers
+		Priority: api.ConsumeRequest_BULK,
+	})
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			w.Flush()
+			return err
+		}
+		if res.Record.Offset >= to {
+			break
+		}
+		if err := writeRecord(w, c.Format, res.Record); err != nil {
+			return err
+		}
+		exported++
+		if res.Record.Offset+1 >= to {
+			break
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return done()
+}
+
+// reads the records the file already holds, returning the last one's offset and
+// how many there are, and leaves the file positioned after them, cutting off a
+// record that was only partly written
+func (c *exportConfig) resume(f *os.File) (*uint64, uint64, error) {
+	r := bufio.NewReader(f)
+	var last *uint64
+	var n uint64
+	var pos int64
+	for {
+		record, size, err := readRecord(r, c.Format)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: record %d: %w", c.Output, n, err)
+		}
+		last = &record.Offset
+		n++
+		pos += size
+	}
+	if err := f.Truncate(pos); err != nil {
+		return nil, 0, err
+	}
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	return last, n, nil
+}
+
+// a record, as it's written to jsonl files
+type exportedRecord struct {
+	Offset     uint64    `json:"offset"`
+	Timestamp  time.Time `json:"timestamp"`
+	ProducerID string    `json:"producer_id,omitempty"`
+	Key        []byte    `json:"key,omitempty"`
+	Value      []byte    `json:"value"`
+}
+
+func writeRecord(w io.Writer, format string, record *api.Record) error {
+	var b []byte
+	var err error
+	if format == "proto" {
+		if b, err = proto.Marshal(record); err != nil {
+			return err
+		}
+		b = append(binary.AppendUvarint(nil, uint64(len(b))), b...)
+	} else {
+		if b, err = json.Marshal(exportedRecord{
+			Offset:     record.Offset,
+			Timestamp:  time.Unix(0, record.Timestamp).UTC(),
+			ProducerID: record.ProducerId,
+			Key:        record.Key,
+			Value:      record.Value,
+		}); err != nil {
+			return err
+		}
+		b = append(b, '\n')
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// reads the next record and how many bytes it took up. it returns io.EOF at the
+// end of the file and io.ErrUnexpectedEOF when the last record was cut short
+func readRecord(r *bufio.Reader, format string) (*api.Record, int64, error) {
+	if format == "proto" {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, 0, err
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(b, record); err != nil {
+			return nil, 0, err
+		}
+		return record, int64(len(binary.AppendUvarint(nil, n))) + int64(n), nil
+	}
+	line, err := r.ReadBytes('\n')
+	if errors.Is(err, io.EOF) && len(line) > 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var e exportedRecord
+	if err := json.Unmarshal(line, &e); err != nil {
+		return nil, 0, err
+	}
+	record := &api.Record{
+		Offset:     e.Offset,
+		Timestamp:  e.Timestamp.UnixNano(),
+		ProducerId: e.ProducerID,
+		Key:        e.Key,
+		Value:      e.Value,
+	}
+	return record, int64(len(line)), nil
+}
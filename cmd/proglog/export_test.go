@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []string{"jsonl", "proto"} {
+		t.Run(format, func(t *testing.T) {
+			source, sourceAddr := setupServer(t)
+			for _, value := range []string{"first", "second", "third"} {
+				_, err := source.Append(&api.Record{Key: []byte("key-" + value), Value: []byte(value)})
+				require.NoError(t, err)
+			}
+			path := filepath.Join(t.TempDir(), "records."+format)
+			export := func(to string) {
+				c := &exportConfig{From: "earliest", To: to, Format: format, Output: path}
+				c.Addr = sourceAddr
+				require.NoError(t, c.validate())
+				require.NoError(t, c.run(context.Background(), &bytes.Buffer{}))
+			}
+
+			export("2")
+			require.Equal(t, []string{"first", "second"}, readValues(t, path, format))
+			// a stopped export's partly written record is dropped, and the export
+			// resumes after the last whole one
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			require.NoError(t, err)
+			_, err = f.Write([]byte{0x10, '{'})
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			export("")
+			require.Equal(t, []string{"first", "second", "third"}, readValues(t, path, format))
+
+			target, targetAddr := setupServer(t)
+			c := &importConfig{Input: path, Format: format, Progress: path + ".progress"}
+			c.Addr = targetAddr
+			importAll := func() {
+				require.NoError(t, c.run(context.Background(), &bytes.Buffer{}))
+			}
+			importAll()
+			requireValues(t, target.Read, "first", "second", "third")
+			// the keys come along, so the target's key index finds the records
+			for off, value := range []string{"first", "second", "third"} {
+				record, err := target.Read(uint64(off))
+				require.NoError(t, err)
+				require.Equal(t, "key-"+value, string(record.Key))
+			}
+
+			// an import that's done doesn't append anything again, nor does one
+			// whose progress wasn't saved after its last records
+			importAll()
+			b, err := os.ReadFile(c.Progress)
+			require.NoError(t, err)
+			var progress importProgress
+			require.NoError(t, json.Unmarshal(b, &progress))
+			require.Equal(t, uint64(3), progress.Records)
+			progress.Records = 1
+			b, err = json.Marshal(progress)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(c.Progress, b, 0644))
+			importAll()
+			requireValues(t, target.Read, "first", "second", "third")
+			_, err = target.Read(3)
+			require.Error(t, err)
+		})
+	}
+}
+
+func readValues(t *testing.T, path, format string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var values []string
+	r := bufio.NewReader(f)
+	for {
+		record, _, err := readRecord(r, format)
+		if err != nil {
+			break
+		}
+		values = append(values, string(record.Value))
+	}
+	return values
+}
+
+func requireValues(t *testing.T, read func(uint64) (*api.Record, error), values ...string) {
+	t.Helper()
+	for off, want := range values {
+		record, err := read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+	"proglog/internal/migrate"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsck(t *testing.T) {
+	dataDir := t.TempDir()
+	require.NoError(t, migrate.Check(dataDir))
+	logDir := filepath.Join(dataDir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+	clog, err := log.NewLog(logDir, log.Config{})
+	require.NoError(t, err)
+	_, err = clog.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.NoError(t, clog.Close())
+	store := filepath.Join(logDir, "0.store")
+	fi, err := os.Stat(store)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(store, fi.Size()-1))
+
+	fsck := func(repair bool) (*log.FsckReport, error) {
+		c := &fsckConfig{Repair: repair}
+		var out bytes.Buffer
+		err := c.run(dataDir, &out)
+		report := &log.FsckReport{}
+		require.NoError(t, json.Unmarshal(out.Bytes(), report))
+		return report, err
+	}
+
+	report, err := fsck(false)
+	require.Error(t, err)
+	require.Equal(t, log.ProblemTornStore, report.Segments[0].Problems[0].Kind)
+	require.False(t, report.Segments[0].Problems[0].Fixed)
+
+	report, err = fsck(true)
+	require.NoError(t, err)
+	require.True(t, report.Segments[0].Problems[0].Fixed)
+
+	report, err = fsck(false)
+	require.NoError(t, err)
+	require.Empty(t, report.Segments[0].Problems)
+	require.Equal(t, uint64(0), report.Segments[0].Records)
+}
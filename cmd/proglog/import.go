@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	api "proglog/api/v1"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// how many records are sent ahead of their offsets coming back
+	importInFlight = 500
+	// how many records are appended between writes of the progress file
+	importCheckpointEvery = 100
+)
+
+type importConfig struct {
+	clientConfig
+	Input    string
+	Format   string
+	Progress string
+}
+
+func importCmd() *cobra.Command {
+	c := &importConfig{}
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Append the records of a file export wrote",
+		Long: `Append the records of a file export wrote, in the file's order. The records get
+new offsets and timestamps, only their keys and values are kept.
+
+The records appended so far are saved to the --progress file, and an import
+that's run again resumes after them. Records are appended as an idempotent
+producer whose ID's saved with the progress, so the ones appended after the
+progress was last saved aren't appended twice.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateFileFormat(c.Format); err != nil {
+				return err
+			}
+			if c.Input == "" {
+				return errors.New("input is required")
+			}
+			if c.Progress == "" {
+				c.Progress = c.Input + ".progress"
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.run(cmd.Context(), cmd.OutOrStdout())
+		},
+	}
+	c.addFlags(cmd.Flags())
+	flags := cmd.Flags()
+	flags.StringVar(&c.Input, "input", "", "The file records are read from, required.")
+	flags.StringVar(&c.Format, "format", "jsonl", "How the file's records are written: jsonl or proto.")
+	flags.StringVar(&c.Progress, "progress", "", "The file the import's progress is saved to, the input's path with .progress appended when empty.")
+	return cmd
+}
+
+// what's saved to the progress file
+type importProgress struct {
+	ProducerID string `json:"producer_id"`
+	// how many of the file's records were appended
+	Records uint64 `json:"records"`
+}
+
+func (c *importConfig) run(ctx context.Context, out io.Writer) error {
+	progress, err := c.readProgress()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(c.Input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for i := uint64(0); i < progress.Records; i++ {
+		if _, _, err := readRecord(r, c.Format); err != nil {
+			return fmt.Errorf("%s: skipping the %d records already imported: %w", c.Input, progress.Records, err)
+		}
+	}
+
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ProduceStream(ctx)
+	if err != nil {
+		return err
+	}
+	// the node answers each request in turn, so the sends run ahead, though not
+	// so far a resumed import's retries fall out of the producer's window
+	window := make(chan struct{}, importInFlight)
+	sent := make(chan error, 1)
+	go func() {
+		for seq := progress.Records; ; seq++ {
+			record, _, err := readRecord(r, c.Format)
+			if errors.Is(err, io.EOF) {
+				sent <- stream.CloseSend()
+				return
+			}
+			if err != nil {
+				sent <- fmt.Errorf("%s: record %d: %w", c.Input, seq, err)
+				return
+			}
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				sent <- ctx.Err()
+				return
+			}
+			if err := stream.Send(&api.ProduceRequest{Record: &api.Record{
+				Key:        record.Key,
+				Value:      record.Value,
+				ProducerId: progress.ProducerID,
+				Sequence:   seq,
+			}}); err != nil {
+				sent <- err
+				return
+			}
+		}
+	}()
+
+	var imported uint64
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// the records appended so far don't have to be sent again
+			c.writeProgress(progress)
+			return err
+		}
+		<-window
+		imported++
+		progress.Records++
+		if imported%importCheckpointEvery == 0 {
+			if err := c.writeProgress(progress); err != nil {
+				return err
+			}
+		}
+	}
+	if err := <-sent; err != nil {
+		c.writeProgress(progress)
+		return err
+	}
+	if err := c.writeProgress(progress); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "imported %d records, %d of %s so far\n", imported, progress.Records, c.Input)
+	return err
+}
+
+// a missing progress file means nothing was imported yet
+func (c *importConfig) readProgress() (importProgress, error) {
+	var progress importProgress
+	b, err := os.ReadFile(c.Progress)
+	if errors.Is(err, os.ErrNotExist) {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return progress, err
+		}
+		progress.ProducerID = "import-" + hex.EncodeToString(id)
+		return progress, nil
+	}
+	if err != nil {
+		return progress, err
+	}
+	if err := json.Unmarshal(b, &progress); err != nil {
+		return progress, fmt.Errorf("%s: %w", c.Progress, err)
+	}
+	return progress, nil
+}
+
+// writes the progress through a temporary file so a crash never leaves a torn one
+func (c *importConfig) writeProgress(progress importProgress) error {
+	b, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	tmp := c.Progress + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.Progress)
+}
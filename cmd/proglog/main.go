@@ -0,0 +1,46 @@
+// the proglog command runs nodes and talks to them
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+func main() {
+	cmd := &cobra.Command{
+		Use:          "proglog",
+		Short:        "A distributed commit log",
+		SilenceUsage: true,
+	}
+	cmd.AddCommand(
+		serveCmd(),
+		devCmd(),
+		migrateCmd(),
+		produceCmd(),
+		consumeCmd(),
+		replayCmd(),
+		mirrorCmd(),
+		exportCmd(),
+		importCmd(),
+		backupCmd(),
+		restoreCmd(),
+		clusterCmd(),
+		benchCmd(),
+		dumpSegmentCmd(),
+		fsckCmd(),
+		configCmd(),
+		apiKeyCmd(),
+	)
+
+	// commands that run until interrupted, e.g. consume --follow, stop through the context
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := cmd.ExecuteContext(ctx); err != nil {
+		stop()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"proglog/internal/migrate"
+
+	"github.com/spf13/cobra"
+)
+
+type migrateConfig struct {
+	DataDir   string
+	DryRun    bool
+	Backup    bool
+	BackupDir string
+}
+
+func migrateCmd() *cobra.Command {
+	c := &migrateConfig{}
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade a stopped node's data dir to the current on-disk format",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.run(cmd.OutOrStdout())
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&c.DataDir, "data-dir", "", "The node's data dir.")
+	flags.BoolVar(&c.DryRun, "dry-run", false, "Print the steps without applying them.")
+	flags.BoolVar(&c.Backup, "backup", true, "Copy the data dir before migrating it.")
+	flags.StringVar(&c.BackupDir, "backup-dir", "", "Where to copy the data dir, next to it when empty.")
+	cmd.MarkFlagRequired("data-dir")
+	return cmd
+}
+
+func (c *migrateConfig) run(out io.Writer) error {
+	plan, err := migrate.Plan(c.DataDir)
+	if err != nil {
+		return err
+	}
+	if len(plan) == 0 {
+		fmt.Fprintf(out, "%s is already at format version %d\n", c.DataDir, migrate.CurrentVersion)
+		return nil
+	}
+	for _, step := range plan {
+		fmt.Fprintf(out, "version %d -> %d: %s\n", step.From, step.From+1, step.Description)
+	}
+	if c.DryRun {
+		return nil
+	}
+
+	backupDir := ""
+	if c.Backup {
+		backupDir = c.BackupDir
+		if backupDir == "" {
+			backupDir = fmt.Sprintf("%s.backup-%d", c.DataDir, time.Now().Unix())
+		}
+		fmt.Fprintf(out, "backing up to %s\n", backupDir)
+	}
+	if _, err := migrate.Migrate(c.DataDir, backupDir); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "migrated %s to format version %d\n", c.DataDir, migrate.CurrentVersion)
+	return nil
+}
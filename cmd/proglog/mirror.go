@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"proglog/internal/mirror"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/cobra"
+)
+
+type mirrorConfig struct {
+	clientConfig
+	// the node the records are produced to, dialed with the same credentials
+	Destination        string
+	Checkpoint         string
+	CheckpointInterval time.Duration
+	// serves the mirror's lag and records metrics on /metrics when set
+	MetricsAddr string
+}
+
+func mirrorCmd() *cobra.Command {
+	c := &mirrorConfig{}
+	cmd := &cobra.Command{
+		Use:   "mirror",
+		Short: "Mirror a cluster's log into another cluster until interrupted",
+		Long: `Mirror a cluster's log into another cluster until interrupted, for disaster
+recovery and read replicas in other regions: the records are consumed from
+--addr and produced to --destination, which assigns its own offsets.
+
+The next offset to mirror is checkpointed to --checkpoint, so a restarted
+mirror resumes where it left off. The records since the last checkpoint are
+mirrored again, idempotent producers' ones are dropped by the destination as
+retries.
+
+Only committed transactions' records are mirrored, as plain records, so with
+transactions enabled --addr has to be the source cluster's leader. Redacted
+records aren't mirrored, but records redacted after they're mirrored have to
+be redacted in the destination cluster too.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.run(cmd.Context(), cmd.OutOrStdout())
+		},
+	}
+	c.addFlags(cmd.Flags())
+	flags := cmd.Flags()
+	flags.StringVar(&c.Destination, "destination", "", "RPC address of a node of the cluster the records are produced to.")
+	flags.StringVar(&c.Checkpoint, "checkpoint", "mirror.checkpoint", "The file the next offset to mirror is kept in.")
+	flags.DurationVar(&c.CheckpointInterval, "checkpoint-interval", time.Second, "How often the checkpoint's written, it's written on exit too.")
+	flags.StringVar(&c.MetricsAddr, "metrics-addr", "", "Address to serve the mirror's lag on /metrics, off when empty.")
+	return cmd
+}
+
+func (c *mirrorConfig) run(ctx context.Context, out io.Writer) error {
+	if c.Destination == "" {
+		return errors.New("destination is required")
+	}
+	source, err := c.config()
+	if err != nil {
+		return err
+	}
+	sourceOptions, err := source.ConnectOptions()
+	if err != nil {
+		return err
+	}
+	destination := source
+	destination.Addr = c.Destination
+	destinationOptions, err := destination.ConnectOptions()
+	if err != nil {
+		return err
+	}
+	registry := prometheus.NewRegistry()
+	m, err := mirror.New(mirror.Config{
+		SourceAddr:             source.Addr,
+		SourceDialOptions:      sourceOptions,
+		DestinationAddr:        destination.Addr,
+		DestinationDialOptions: destinationOptions,
+		CheckpointPath:         c.Checkpoint,
+		CheckpointInterval:     c.CheckpointInterval,
+		Registerer:             registry,
+	})
+	if err != nil {
+		return err
+	}
+	if c.MetricsAddr != "" {
+		l, err := net.Listen("tcp", c.MetricsAddr)
+		if err != nil {
+			m.Close()
+			return err
+		}
+		srv := &http.Server{Handler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{})}
+		go srv.Serve(l)
+		defer srv.Close()
+	}
+	fmt.Fprintf(out, "mirroring %s into %s from offset %d\n", source.Addr, destination.Addr, m.Offset())
+
+	<-ctx.Done()
+	if err := m.Close(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "mirrored up to offset %d\n", m.Offset())
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	source, sourceAddr := setupServer(t)
+	destination, destinationAddr := setupServer(t)
+	for _, value := range []string{"first", "second"} {
+		_, err := source.Append(&api.Record{Key: []byte("key"), Value: []byte(value)})
+		require.NoError(t, err)
+	}
+
+	c := &mirrorConfig{
+		Destination:        destinationAddr,
+		Checkpoint:         filepath.Join(t.TempDir(), "checkpoint"),
+		CheckpointInterval: 10 * time.Millisecond,
+	}
+	c.Addr = sourceAddr
+	ctx, cancel := context.WithCancel(context.Background())
+	var out bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- c.run(ctx, &out)
+	}()
+	// checkpointed once both are mirrored
+	require.Eventually(t, func() bool {
+		b, err := os.ReadFile(c.Checkpoint)
+		return err == nil && string(b) == "2"
+	}, 3*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	require.Contains(t, out.String(), "mirrored up to offset 2")
+
+	record, err := destination.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("key"), record.Key)
+	require.Equal(t, []byte("second"), record.Value)
+
+	require.Error(t, (&mirrorConfig{}).run(context.Background(), &out))
+}
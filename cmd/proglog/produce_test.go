@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"proglog/internal/log"
+	"proglog/internal/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProduce(t *testing.T) {
+	clog, addr := setupServer(t)
+
+	// in order, the records are checked by offset below
+	for _, tc := range []struct {
+		format, in string
+	}{
+		{"lines", "hello\nworld\n"},
+		{"json", "{\"hello\": \"world\"}\n[1, 2]"},
+	} {
+		c := &produceConfig{Format: tc.format}
+		c.Addr = addr
+		var out bytes.Buffer
+		require.NoError(t, c.run(context.Background(), strings.NewReader(tc.in), &out))
+		require.Len(t, strings.Fields(out.String()), 2)
+	}
+
+	for off, want := range []string{"hello", "world", `{"hello":"world"}`, "[1,2]"} {
+		record, err := clog.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+		require.Empty(t, record.Key)
+	}
+
+	c := &produceConfig{Format: "lines", Key: "greeting"}
+	c.Addr = addr
+	require.NoError(t, c.run(context.Background(), strings.NewReader("hi\n"), &bytes.Buffer{}))
+	record, err := clog.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, "greeting", string(record.Key))
+	require.Equal(t, "hi", string(record.Value))
+}
+
+// serves a log without TLS, returning the log and the server's address
+func setupServer(t *testing.T) (*log.Log, string) {
+	t.Helper()
+
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := server.NewGPRCServer(&server.Config{
+		CommitLog:    clog,
+		OffsetGetter: clog,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	t.Cleanup(func() {
+		srv.Stop()
+		clog.Close()
+	})
+	return clog, l.Addr().String()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type replayConfig struct {
+	clientConfig
+	From   uint64
+	To     uint64
+	Since  string
+	Until  string
+	Rate   float64
+	Output string
+	// a node the records are appended to rather than printed
+	Target string
+
+	since, until time.Time
+}
+
+func replayCmd() *cobra.Command {
+	c := &replayConfig{}
+	cmd := &cobra.Command{
+		Use:   "replay",
+		Short: "Re-send a past range of the log's records at a steady rate",
+		Long: `Re-send a past range of the log's records at a steady rate, paced by the node,
+for reprocessing them after a fix without flooding what consumes them.
+
+The range is the offsets [--from, --to), narrowed to the records appended in
+[--since, --until). The times take RFC 3339 or a duration before now (e.g. 2h).
+
+The records are printed like consume prints them, or with --target appended to
+that node's log, using the same credentials, printing the offsets they get.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return c.setup(time.Now())
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.run(cmd.Context(), cmd.OutOrStdout())
+		},
+	}
+	c.addFlags(cmd.Flags())
+	flags := cmd.Flags()
+	flags.Uint64Var(&c.From, "from", 0, "The first offset replayed.")
+	flags.Uint64Var(&c.To, "to", 0, "The offset the replay stops before, 0 replays up to the log's end.")
+	flags.StringVar(&c.Since, "since", "", "Only replay records appended at or after this time.")
+	flags.StringVar(&c.Until, "until", "", "Only replay records appended before this time.")
+	flags.Float64Var(&c.Rate, "rate", 100, "The most records replayed per second, 0 replays them as fast as they're taken.")
+	flags.StringVar(&c.Output, "output", "json", "How records are printed: json or raw (the values, one per line).")
+	flags.StringVar(&c.Target, "target", "", "RPC address of a node to append the records to, rather than print them.")
+	return cmd
+}
+
+func (c *replayConfig) setup(now time.Time) error {
+	if c.Output != "json" && c.Output != "raw" {
+		return fmt.Errorf("output %q isn't json or raw", c.Output)
+	}
+	if c.Rate < 0 {
+		return errors.New("rate can't be negative")
+	}
+	if c.To != 0 && c.To <= c.From {
+		return fmt.Errorf("to %d isn't after from %d", c.To, c.From)
+	}
+	var err error
+	if c.since, err = parseTime(c.Since, now); err != nil {
+		return fmt.Errorf("since: %w", err)
+	}
+	if c.until, err = parseTime(c.Until, now); err != nil {
+		return fmt.Errorf("until: %w", err)
+	}
+	return nil
+}
+
+func (c *replayConfig) run(ctx context.Context, out io.Writer) error {
+	client, conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	handle := func(record *api.Record) error {
+		return printRecord(out, c.Output, record)
+	}
+	if c.Target != "" {
+		target := c.clientConfig
+		target.Addr = c.Target
+		targetClient, targetConn, err := target.dial()
+		if err != nil {
+			return err
+		}
+		defer targetConn.Close()
+		handle = func(record *api.Record) error {
+			res, err := targetClient.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Key: record.Key, Value: record.Value},
+			})
+			if err != nil {
+				return fmt.Errorf("appending the record at %d: %w", record.Offset, err)
+			}
+			_, err = fmt.Fprintln(out, res.Offset)
+			return err
+		}
+	}
+
+	req := &api.ReplayRequest{
+		StartOffset:      c.From,
+		EndOffset:        c.To,
+		RecordsPerSecond: c.Rate,
+		Priority:         api.ConsumeRequest_BULK,
+	}
+	if !c.since.IsZero() {
+		req.StartTime = c.since.UnixNano()
+	}
+	if !c.until.IsZero() {
+		req.EndTime = c.until.UnixNano()
+	}
+	stream, err := client.Replay(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if status.Code(err) == codes.Canceled || err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := handle(res.Record); err != nil {
+			return err
+		}
+	}
+}
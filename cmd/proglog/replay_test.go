@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	clog, addr := setupServer(t)
+	for _, value := range []string{"first", "second", "third"} {
+		_, err := clog.Append(&api.Record{Key: []byte("key-" + value), Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	replay := func(c *replayConfig) string {
+		c.Addr = addr
+		require.NoError(t, c.setup(time.Now()))
+		var out bytes.Buffer
+		require.NoError(t, c.run(context.Background(), &out))
+		return out.String()
+	}
+
+	require.Equal(t, "second\nthird\n", replay(&replayConfig{From: 1, Output: "raw"}))
+	require.Equal(t, "first\n", replay(&replayConfig{To: 1, Output: "raw", Rate: 10}))
+	require.Empty(t, replay(&replayConfig{Until: "1h", Output: "raw"}))
+
+	// with a target the records are appended to its log
+	target, targetAddr := setupServer(t)
+	require.Equal(t, "0\n1\n", replay(&replayConfig{From: 1, Target: targetAddr, Output: "json"}))
+	record, err := target.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, "third", string(record.Value))
+	require.Equal(t, "key-third", string(record.Key))
+
+	require.Error(t, (&replayConfig{Output: "json", From: 2, To: 1}).setup(time.Now()))
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"proglog/internal/agent"
+	"proglog/internal/config"
+	"proglog/internal/logging"
+	"proglog/internal/netfilter"
+	"proglog/internal/systemd"
+	"proglog/internal/telemetry"
+	"proglog/internal/vault"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+type serveConfig struct {
+	agent.Config
+	ServerTLSConfig config.TLSConfig
+	PeerTLSConfig   config.TLSConfig
+	// the TLS policy, as spelled in the config, see the config package's parsers
+	TLSMinVersion   string
+	TLSCipherSuites []string
+	TLSClientAuth   string
+	// the networks each listener allows and denies, as spelled in the config,
+	// see netfilter.ParseRules
+	RPCAllow, RPCDeny       []string
+	HTTPAllow, HTTPDeny     []string
+	GossipAllow, GossipDeny []string
+	// the base64 key the gossip's encrypted with, as spelled in the config
+	GossipKey string
+	// when Vault's address is set, Vault issues the server and peer certificates
+	// instead of the TLS files, see setup
+	Vault vault.Config
+	vault *vault.Source
+	// reload the TLS files when they change, see config.CertWatcher
+	WatchTLSFiles bool
+	certWatchers  []*config.CertWatcher
+	// the log format and levels, as spelled in the config, see
+	// logging.ParseLevels. the levels take effect on a reload, the format
+	// doesn't
+	LogFormat string
+	LogLevel  string
+	LogLevels []string
+	logger    *logging.Logger
+}
+
+func serveCmd() *cobra.Command {
+	c := &serveConfig{}
+	v := viper.New()
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Run a node until it's interrupted",
+		Long: `Run a node until it's interrupted.
+
+Settings come from the flags, then PROGLOG_ environment variables (e.g.
+PROGLOG_DATA_DIR for --data-dir), then the config file, then the defaults.
+
+With --vault-addr, Vault's PKI secrets engine issues the node's certificates
+and the node renews them before they expire. The token comes from
+--vault-token, else VAULT_TOKEN.
+
+With --watch-tls-files, the node reloads its certificates as soon as their
+files change, without waiting for a SIGHUP.
+
+With --gossip-key, the nodes encrypt and authenticate their gossip with the key
+they share, without it anyone who reaches --bind-addr can join the cluster.
+
+The --*-allow and --*-deny flags restrict which networks the RPC, HTTP and
+gossip listeners accept connections from, as CIDRs or single addresses. Denied
+networks win over allowed ones and no allowed networks allows any.
+
+SIGHUP reloads the config file, rotates the TLS certificates and swaps the
+listeners' allowed and denied networks, SIGUSR1 logs
+runtime stats and the log's segment layout, SIGINT and SIGTERM drain the node
+and stop it.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := c.load(v); err != nil {
+				return err
+			}
+			printSettings(cmd.ErrOrStderr(), v)
+			if err := c.setupLogger(); err != nil {
+				return err
+			}
+			return c.setup()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.run(v)
+		},
+	}
+	if err := setupFlags(cmd, v); err != nil {
+		panic(err)
+	}
+	return cmd
+}
+
+func setupFlags(cmd *cobra.Command, v *viper.Viper) error {
+	dataDir := filepath.Join(os.TempDir(), "proglog")
+	hostname, _ := os.Hostname()
+	flags := cmd.Flags()
+	flags.String("config-file", "", "Path to a YAML config file.")
+	flags.String("data-dir", dataDir, "Directory to store log and membership data.")
+	flags.String("node-name", hostname, "Unique server ID.")
+	flags.String("bind-addr", "127.0.0.1:8401", "Address to bind Serf on.")
+	flags.Int("rpc-port", 8400, "Port for RPC clients (and followers) connections.")
+	flags.Int("http-port", 8402, "Port for the /healthz and /readyz probes and /metrics, 0 disables them.")
+	flags.Duration("drain-delay", 0, "How long the node reports it's unready before it stops on shutdown.")
+	flags.Duration("shutdown-timeout", 30*time.Second, "How long each component gets to stop on shutdown.")
+	flags.StringSlice("start-join-addrs", nil, "Serf addresses to join.")
+	flags.Bool("bootstrap", false, "Lead the log.")
+	flags.Uint64("leader-epoch", 0, "The leader's fencing token, higher than any previous leader's.")
+	flags.Int("min-in-sync-replicas", 1, "In-sync replicas (counting the leader) a write needs.")
+	flags.Int("catch-up-segments", 4, "Sealed segments a follower far behind the leader copies at once, 0 fetches every record.")
+	flags.Int("catch-up-bytes-per-second", 0, "Bytes per second the leader sends followers that aren't in sync, 0 doesn't throttle them.")
+	flags.Duration("max-lag-time", 10*time.Second, "How long a follower can go without catching up before it's dropped from the in-sync replicas.")
+	flags.Duration("ack-timeout", 5*time.Second, "How long a write waits for the in-sync replicas.")
+	flags.Duration("reap-after", 0, "How long the leader keeps tracking a follower that stopped fetching, 0 keeps it forever.")
+	flags.Duration("repair-interval", 0, "How often followers compare their records with the leader's, 0 turns repairs off.")
+	flags.Bool("direct-io", false, "Write the log with O_DIRECT, bypassing the page cache, where the filesystem supports it.")
+	flags.Bool("io-uring", false, "Experimental: read and write the log through io_uring, in Linux builds with -tags iouring.")
+	flags.Int("write-buffer-bytes", 0, "Size of the buffer the log's appends are written through, 4KiB when 0.")
+	flags.Bool("adaptive-write-buffer", false, "Size the log's write buffer to the records appended lately instead.")
+	flags.Bool("lazy-open", false, "Open the log's older segments when they're first read, so a node with a large log is ready sooner.")
+	flags.String("server-tls-cert-file", "", "Path to server tls cert.")
+	flags.String("server-tls-key-file", "", "Path to server tls key.")
+	flags.String("server-tls-ca-file", "", "Path to server certificate authority.")
+	flags.String("peer-tls-cert-file", "", "Path to peer tls cert, its common name or a DNS name must be the node name for the leader to serve its fetches.")
+	flags.String("peer-tls-key-file", "", "Path to peer tls key.")
+	flags.String("peer-tls-ca-file", "", "Path to peer certificate authority.")
+	flags.Bool("watch-tls-files", false, "Reload the TLS cert and key files when they change.")
+	flags.String("tls-min-version", "1.2", "Oldest TLS version the node speaks: 1.0, 1.1, 1.2 or 1.3.")
+	flags.StringSlice("tls-cipher-suites", nil, "TLS 1.2 cipher suites the node allows by IANA name, Go's secure defaults when empty.")
+	flags.String("tls-client-auth", "require-and-verify", "Whether the server needs client certificates: none, request or require-and-verify.")
+	for _, listener := range []string{"rpc", "http", "gossip"} {
+		flags.StringSlice(listener+"-allow", nil, "Networks the "+listener+" listener accepts connections from, any when empty.")
+		flags.StringSlice(listener+"-deny", nil, "Networks the "+listener+" listener rejects connections from.")
+	}
+	flags.String("gossip-key", "", "Base64 AES key, 16, 24 or 32 bytes every node shares, that encrypts the gossip. Without it the gossip's in the clear, so only run on trusted networks.")
+	flags.String("vault-addr", "", "Vault's address, to have its PKI secrets engine issue the node's certificates.")
+	flags.String("vault-token", "", "Token to authenticate to Vault with, VAULT_TOKEN when empty.")
+	flags.String("vault-pki-mount", "pki", "Path the PKI secrets engine is mounted at.")
+	flags.String("vault-pki-role", "", "PKI role to issue the node's certificates with.")
+	flags.Duration("vault-cert-ttl", 0, "Lifetime to request for the certificates, the role's default when 0.")
+	flags.String("log-format", "console", "How to format the logs: console or json.")
+	flags.String("log-level", "info", "Level to log at: debug, info, warn or error.")
+	flags.StringSlice("log-levels", nil, "Levels for single components, e.g. server=debug,discovery=warn.")
+	flags.Duration("slow-request-threshold", 0, "Log Produce and Consume calls that take longer, 0 logs none.")
+	flags.Int("slow-requests-per-second", 10, "Most slow requests logged per second, the rest are dropped.")
+	flags.Int("tail-records", 1024, "Newest records kept in memory for the consume streams following the log's head, 0 keeps none.")
+	flags.Int("consume-read-slots", 0, "Most consumers' reads from disk run at once, the rest wait in lanes by their priority, 0 doesn't limit them.")
+	flags.String("syslog-udp-addr", "", "Address to receive syslog messages on over UDP and append them to the log, off when empty.")
+	flags.String("syslog-tcp-addr", "", "Address to receive syslog messages on over TCP, off when empty.")
+	flags.String("syslog-tls-addr", "", "Address to receive syslog messages on over TLS with the server's certificate, off when empty.")
+	flags.String("fluent-addr", "", "Address Fluentd and Fluent Bit forward events to, appended to the log, off when empty.")
+	flags.String("telemetry-exporter", "none", "Where traces and metrics go: none, stdout or otlp.")
+	flags.String("otlp-endpoint", "localhost:4317", "The OTLP collector's gRPC endpoint.")
+	flags.Bool("otlp-insecure", false, "Talk to the OTLP collector without TLS.")
+	flags.Float64("trace-sample-ratio", 0.01, "Fraction of traces to sample, traces clients sampled are always kept.")
+	flags.Bool("trace-always-sample", false, "Sample every trace, for debugging.")
+	flags.Duration("metric-export-interval", time.Minute, "How often metrics are exported.")
+	flags.String("oidc-issuer", "", "OpenID Connect issuer whose ID tokens admin RPCs need, client certificates when empty.")
+	flags.String("oidc-client-id", "", "The client ID the ID tokens must be issued for.")
+	flags.Bool("insecure-admin", false, "Let clients without a certificate, ID token or API key call admin RPCs.")
+	flags.String("schema-registry-url", "", "Confluent-compatible schema registry produced records are validated against, none when empty.")
+	flags.String("schema-registry-username", "", "Username for the schema registry's basic auth.")
+	flags.String("schema-registry-password", "", "Password for the schema registry's basic auth, better set through $PROGLOG_SCHEMA_REGISTRY_PASSWORD.")
+	flags.Bool("require-schema-id", false, "Reject produced records whose values don't start with a schema ID.")
+	flags.String("produce-transform", "", "WASM module that rewrites or rejects records before they're appended, none when empty.")
+	flags.String("consume-transform", "", "WASM module that rewrites or drops records before they're sent to consumers, none when empty.")
+	flags.Bool("transactions", false, "Let producers append records in transactions that read committed consumers see all of, or none of.")
+	flags.Duration("transaction-timeout", time.Minute, "How long transactions that don't say may take before they're aborted.")
+	flags.Duration("max-transaction-timeout", 15*time.Minute, "The longest a transaction may take.")
+	flags.Bool("key-index", false, "Index each key's latest record, so GetByKey can serve it.")
+	flags.Bool("read-only", false, "Start the node rejecting produces, until the SetReadOnly RPC lets them through, see proglog cluster read-only.")
+	flags.Duration("dedup-window", 0, "How long message IDs are remembered, records with one appended within it are dropped, 0 turns deduplication off.")
+	flags.Uint64("disk-retention-free-bytes", 0, "Below this many bytes free on the data dir's disk, the oldest committed segments are removed until there's more, 0 turns it off.")
+	flags.Int("disk-retention-min-segments", 1, "How many of the newest segments, the active one included, are never removed to free space.")
+	flags.Uint64("disk-fence-free-bytes", 0, "Below this many bytes free on the data dir's disk, produces are refused with ResourceExhausted, 0 turns it off.")
+	flags.Duration("disk-check-interval", 5*time.Second, "How often the data dir's free disk space is checked.")
+	flags.Duration("backup-interval", 0, "How often the leader's sealed segments are backed up to the bucket, 0 turns backups off.")
+	flags.String("backup-s3-endpoint", "", "The S3-compatible store backups go to, e.g. https://s3.us-east-1.amazonaws.com or https://storage.googleapis.com.")
+	flags.String("backup-s3-region", "us-east-1", "The store's region.")
+	flags.String("backup-s3-bucket", "", "The bucket backups go to.")
+	flags.String("backup-s3-prefix", "proglog/", "What the names of the backup's objects start with.")
+	flags.Bool("backup-s3-path-style", false, "Address the bucket in the path, as most stores other than S3 need.")
+	flags.String("backup-s3-access-key-id", "", "The store's access key ID, AWS_ACCESS_KEY_ID when empty.")
+	flags.String("backup-s3-secret-access-key", "", "The store's secret access key, AWS_SECRET_ACCESS_KEY when empty.")
+	return v.BindPFlags(flags)
+}
+
+// merges the config file, the environment and the flags and validates the result
+func (c *serveConfig) load(v *viper.Viper) error {
+	v.SetEnvPrefix("proglog")
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+	if file := v.GetString("config-file"); file != "" {
+		v.SetConfigFile(file)
+		if err := v.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+
+	c.DataDir = v.GetString("data-dir")
+	c.NodeName = v.GetString("node-name")
+	c.BindAddr = v.GetString("bind-addr")
+	c.RPCPort = v.GetInt("rpc-port")
+	c.HTTPPort = v.GetInt("http-port")
+	c.DrainDelay = v.GetDuration("drain-delay")
+	c.ShutdownTimeout = v.GetDuration("shutdown-timeout")
+	c.StartJoinAddrs = v.GetStringSlice("start-join-addrs")
+	c.Bootstrap = v.GetBool("bootstrap")
+	c.LeaderEpoch = v.GetUint64("leader-epoch")
+	c.MinInSyncReplicas = v.GetInt("min-in-sync-replicas")
+	c.CatchUpSegments = v.GetInt("catch-up-segments")
+	c.CatchUpBytesPerSecond = v.GetInt("catch-up-bytes-per-second")
+	c.MaxLagTime = v.GetDuration("max-lag-time")
+	c.AckTimeout = v.GetDuration("ack-timeout")
+	c.ReapAfter = v.GetDuration("reap-after")
+	c.RepairInterval = v.GetDuration("repair-interval")
+	c.DirectIO = v.GetBool("direct-io")
+	c.IOUring = v.GetBool("io-uring")
+	c.LazyOpen = v.GetBool("lazy-open")
+	c.WriteBufferBytes = v.GetInt("write-buffer-bytes")
+	c.AdaptiveWriteBuffer = v.GetBool("adaptive-write-buffer")
+	c.ServerTLSConfig.CertFile = v.GetString("server-tls-cert-file")
+	c.ServerTLSConfig.KeyFile = v.GetString("server-tls-key-file")
+	c.ServerTLSConfig.CAFile = v.GetString("server-tls-ca-file")
+	c.PeerTLSConfig.CertFile = v.GetString("peer-tls-cert-file")
+	c.PeerTLSConfig.KeyFile = v.GetString("peer-tls-key-file")
+	c.PeerTLSConfig.CAFile = v.GetString("peer-tls-ca-file")
+	c.WatchTLSFiles = v.GetBool("watch-tls-files")
+	c.TLSMinVersion = v.GetString("tls-min-version")
+	c.TLSCipherSuites = v.GetStringSlice("tls-cipher-suites")
+	c.TLSClientAuth = v.GetString("tls-client-auth")
+	c.OIDCIssuer = v.GetString("oidc-issuer")
+	c.OIDCClientID = v.GetString("oidc-client-id")
+	c.InsecureAdmin = v.GetBool("insecure-admin")
+	c.SchemaRegistryURL = v.GetString("schema-registry-url")
+	c.SchemaRegistryUsername = v.GetString("schema-registry-username")
+	c.SchemaRegistryPassword = v.GetString("schema-registry-password")
+	c.RequireSchemaID = v.GetBool("require-schema-id")
+	c.ProduceTransformModule = v.GetString("produce-transform")
+	c.ConsumeTransformModule = v.GetString("consume-transform")
+	c.Transactions = v.GetBool("transactions")
+	c.TransactionTimeout = v.GetDuration("transaction-timeout")
+	c.MaxTransactionTimeout = v.GetDuration("max-transaction-timeout")
+	c.DedupWindow = v.GetDuration("dedup-window")
+	c.KeyIndex = v.GetBool("key-index")
+	c.ReadOnly = v.GetBool("read-only")
+	c.DiskGuard.RetentionFreeBytes = v.GetUint64("disk-retention-free-bytes")
+	c.DiskGuard.MinSegments = v.GetInt("disk-retention-min-segments")
+	c.DiskGuard.FenceFreeBytes = v.GetUint64("disk-fence-free-bytes")
+	c.DiskGuard.Interval = v.GetDuration("disk-check-interval")
+	c.Backup.Interval = v.GetDuration("backup-interval")
+	c.Backup.S3.Endpoint = v.GetString("backup-s3-endpoint")
+	c.Backup.S3.Region = v.GetString("backup-s3-region")
+	c.Backup.S3.Bucket = v.GetString("backup-s3-bucket")
+	c.Backup.S3.PathStyle = v.GetBool("backup-s3-path-style")
+	c.Backup.Prefix = v.GetString("backup-s3-prefix")
+	c.Backup.S3.AccessKeyID = v.GetString("backup-s3-access-key-id")
+	if c.Backup.S3.AccessKeyID == "" {
+		c.Backup.S3.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	c.Backup.S3.SecretAccessKey = v.GetString("backup-s3-secret-access-key")
+	if c.Backup.S3.SecretAccessKey == "" {
+		c.Backup.S3.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	c.Backup.S3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	c.SlowRequestThreshold = v.GetDuration("slow-request-threshold")
+	c.SlowRequestsPerSecond = v.GetInt("slow-requests-per-second")
+	c.TailRecords = v.GetInt("tail-records")
+	c.ConsumeReadSlots = v.GetInt("consume-read-slots")
+	c.SyslogUDPAddr = v.GetString("syslog-udp-addr")
+	c.SyslogTCPAddr = v.GetString("syslog-tcp-addr")
+	c.SyslogTLSAddr = v.GetString("syslog-tls-addr")
+	c.FluentAddr = v.GetString("fluent-addr")
+	c.Telemetry.Exporter = v.GetString("telemetry-exporter")
+	c.Telemetry.OTLPEndpoint = v.GetString("otlp-endpoint")
+	c.Telemetry.OTLPInsecure = v.GetBool("otlp-insecure")
+	c.Telemetry.SampleRatio = v.GetFloat64("trace-sample-ratio")
+	c.Telemetry.AlwaysSample = v.GetBool("trace-always-sample")
+	c.Telemetry.MetricInterval = v.GetDuration("metric-export-interval")
+	c.LogFormat = v.GetString("log-format")
+	c.LogLevel = v.GetString("log-level")
+	c.LogLevels = v.GetStringSlice("log-levels")
+	c.RPCAllow = v.GetStringSlice("rpc-allow")
+	c.RPCDeny = v.GetStringSlice("rpc-deny")
+	c.HTTPAllow = v.GetStringSlice("http-allow")
+	c.HTTPDeny = v.GetStringSlice("http-deny")
+	c.GossipAllow = v.GetStringSlice("gossip-allow")
+	c.GossipDeny = v.GetStringSlice("gossip-deny")
+	c.GossipKey = v.GetString("gossip-key")
+	c.Vault.Addr = v.GetString("vault-addr")
+	c.Vault.Token = v.GetString("vault-token")
+	if c.Vault.Token == "" {
+		c.Vault.Token = os.Getenv("VAULT_TOKEN")
+	}
+	c.Vault.Mount = v.GetString("vault-pki-mount")
+	c.Vault.Role = v.GetString("vault-pki-role")
+	c.Vault.TTL = v.GetDuration("vault-cert-ttl")
+	return c.validate()
+}
+
+// reports every problem with the config at once rather than the first one
+func (c *serveConfig) validate() error {
+	var errs []error
+	if c.DataDir == "" {
+		errs = append(errs, errors.New("data-dir is required"))
+	}
+	if c.NodeName == "" {
+		errs = append(errs, errors.New("node-name is required"))
+	}
+	if _, _, err := net.SplitHostPort(c.BindAddr); err != nil {
+		errs = append(errs, fmt.Errorf("bind-addr: %w", err))
+	}
+	if c.RPCPort <= 0 || c.RPCPort > 65535 {
+		errs = append(errs, fmt.Errorf("rpc-port %d isn't a valid port", c.RPCPort))
+	} else if rpcAddr, err := c.RPCAddr(); err == nil && rpcAddr == c.BindAddr {
+		errs = append(errs, fmt.Errorf("rpc-port %d is the bind-addr's port", c.RPCPort))
+	}
+	if c.HTTPPort < 0 || c.HTTPPort > 65535 {
+		errs = append(errs, fmt.Errorf("http-port %d isn't a valid port", c.HTTPPort))
+	} else if c.HTTPPort != 0 && c.HTTPPort == c.RPCPort {
+		errs = append(errs, fmt.Errorf("http-port %d is the rpc-port", c.HTTPPort))
+	} else if httpAddr, err := c.HTTPAddr(); err == nil && httpAddr == c.BindAddr {
+		errs = append(errs, fmt.Errorf("http-port %d is the bind-addr's port", c.HTTPPort))
+	}
+	if !c.Bootstrap && len(c.StartJoinAddrs) == 0 {
+		errs = append(errs, errors.New("start-join-addrs is required unless bootstrapping, followers find the leader through them"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown-timeout must be positive"))
+	}
+	if c.MinInSyncReplicas < 1 {
+		errs = append(errs, errors.New("min-in-sync-replicas must be at least 1"))
+	}
+	if c.WriteBufferBytes < 0 {
+		errs = append(errs, errors.New("write-buffer-bytes can't be negative"))
+	}
+	if c.CatchUpSegments < 0 {
+		errs = append(errs, errors.New("catch-up-segments can't be negative"))
+	}
+	if c.CatchUpBytesPerSecond < 0 {
+		errs = append(errs, errors.New("catch-up-bytes-per-second can't be negative"))
+	}
+	if c.MaxLagTime < 0 || c.AckTimeout < 0 || c.ReapAfter < 0 || c.RepairInterval < 0 {
+		errs = append(errs, errors.New("max-lag-time, ack-timeout, reap-after and repair-interval can't be negative"))
+	}
+	if _, err := config.ParseTLSVersion(c.TLSMinVersion); err != nil {
+		errs = append(errs, fmt.Errorf("tls-min-version: %w", err))
+	}
+	if _, err := config.ParseCipherSuites(c.TLSCipherSuites); err != nil {
+		errs = append(errs, fmt.Errorf("tls-cipher-suites: %w", err))
+	}
+	if _, err := config.ParseClientAuth(c.TLSClientAuth); err != nil {
+		errs = append(errs, fmt.Errorf("tls-client-auth: %w", err))
+	}
+	if c.LogFormat != "" && c.LogFormat != "console" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log-format %q isn't console or json", c.LogFormat))
+	}
+	if _, err := logging.ParseLevels(c.LogLevel, c.LogLevels); err != nil {
+		errs = append(errs, fmt.Errorf("log-level/log-levels: %w", err))
+	}
+	if c.SlowRequestThreshold < 0 {
+		errs = append(errs, errors.New("slow-request-threshold can't be negative"))
+	}
+	if c.SlowRequestsPerSecond < 0 {
+		errs = append(errs, errors.New("slow-requests-per-second can't be negative"))
+	}
+	if c.TailRecords < 0 {
+		errs = append(errs, errors.New("tail-records can't be negative"))
+	}
+	if c.ConsumeReadSlots < 0 {
+		errs = append(errs, errors.New("consume-read-slots can't be negative"))
+	}
+	if c.SyslogTLSAddr != "" && c.ServerTLSConfig.CertFile == "" && c.Vault.Addr == "" {
+		errs = append(errs, errors.New("syslog-tls-addr needs the server's certificate, from server-tls-cert-file or vault-addr"))
+	}
+	if _, err := telemetry.ParseExporter(c.Telemetry.Exporter); err != nil {
+		errs = append(errs, fmt.Errorf("telemetry-exporter: %w", err))
+	}
+	if c.Telemetry.SampleRatio < 0 || c.Telemetry.SampleRatio > 1 {
+		errs = append(errs, errors.New("trace-sample-ratio must be between 0 and 1"))
+	}
+	if c.Telemetry.Exporter == telemetry.ExporterOTLP && c.Telemetry.OTLPEndpoint == "" {
+		errs = append(errs, errors.New("otlp-endpoint is required with the otlp exporter"))
+	}
+	if c.Telemetry.MetricInterval < 0 {
+		errs = append(errs, errors.New("metric-export-interval must be positive"))
+	}
+	if (c.OIDCIssuer == "") != (c.OIDCClientID == "") {
+		errs = append(errs, errors.New("oidc-issuer and oidc-client-id go together"))
+	}
+	if c.RequireSchemaID && c.SchemaRegistryURL == "" {
+		errs = append(errs, errors.New("require-schema-id needs schema-registry-url"))
+	}
+	if c.SchemaRegistryUsername != "" && c.SchemaRegistryURL == "" {
+		errs = append(errs, errors.New("schema-registry-username needs schema-registry-url"))
+	}
+	if c.TransactionTimeout < 0 || c.MaxTransactionTimeout < 0 {
+		errs = append(errs, errors.New("transaction-timeout and max-transaction-timeout can't be negative"))
+	} else if c.MaxTransactionTimeout > 0 && c.TransactionTimeout > c.MaxTransactionTimeout {
+		errs = append(errs, errors.New("transaction-timeout can't be longer than max-transaction-timeout"))
+	}
+	if c.DedupWindow < 0 {
+		errs = append(errs, errors.New("dedup-window can't be negative"))
+	}
+	if c.DiskGuard.Interval < 0 {
+		errs = append(errs, errors.New("disk-check-interval can't be negative"))
+	}
+	if c.DiskGuard.MinSegments < 0 {
+		errs = append(errs, errors.New("disk-retention-min-segments can't be negative"))
+	}
+	// retention frees space before appends have to be fenced
+	if c.DiskGuard.RetentionFreeBytes > 0 && c.DiskGuard.FenceFreeBytes >= c.DiskGuard.RetentionFreeBytes {
+		errs = append(errs, errors.New("disk-fence-free-bytes has to be below disk-retention-free-bytes"))
+	}
+	if c.Backup.Interval < 0 {
+		errs = append(errs, errors.New("backup-interval can't be negative"))
+	} else if c.Backup.Interval > 0 && (c.Backup.S3.Endpoint == "" || c.Backup.S3.Bucket == "") {
+		errs = append(errs, errors.New("backup-interval needs backup-s3-endpoint and backup-s3-bucket"))
+	}
+	for listener, networks := range map[string][2][]string{
+		"rpc":    {c.RPCAllow, c.RPCDeny},
+		"http":   {c.HTTPAllow, c.HTTPDeny},
+		"gossip": {c.GossipAllow, c.GossipDeny},
+	} {
+		if _, err := netfilter.ParseRules(networks[0], networks[1]); err != nil {
+			errs = append(errs, fmt.Errorf("%s-allow/%s-deny: %w", listener, listener, err))
+		}
+	}
+	if c.GossipKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.GossipKey); err != nil {
+			errs = append(errs, fmt.Errorf("gossip-key: %w", err))
+		} else if n := len(key); n != 16 && n != 24 && n != 32 {
+			errs = append(errs, fmt.Errorf("gossip-key is %d bytes, it has to be 16, 24 or 32", n))
+		}
+	}
+	if c.Vault.Addr != "" {
+		if c.Vault.Role == "" {
+			errs = append(errs, errors.New("vault-pki-role is required with vault-addr"))
+		}
+		if c.Vault.Token == "" {
+			errs = append(errs, errors.New("vault-token or VAULT_TOKEN is required with vault-addr"))
+		}
+		if c.ServerTLSConfig.CertFile != "" || c.PeerTLSConfig.CertFile != "" {
+			errs = append(errs, errors.New("vault-addr and the tls cert files are mutually exclusive"))
+		}
+	}
+	for name, tls := range map[string]config.TLSConfig{
+		"server": c.ServerTLSConfig,
+		"peer":   c.PeerTLSConfig,
+	} {
+		if (tls.CertFile == "") != (tls.KeyFile == "") {
+			errs = append(errs, fmt.Errorf("%s-tls-cert-file and %s-tls-key-file go together", name, name))
+		}
+		for flag, file := range map[string]string{
+			"cert-file": tls.CertFile,
+			"key-file":  tls.KeyFile,
+			"ca-file":   tls.CAFile,
+		} {
+			if file == "" {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				errs = append(errs, fmt.Errorf("%s-tls-%s: %w", name, flag, err))
+			}
+		}
+	}
+	for flag, file := range map[string]string{
+		"produce-transform": c.ProduceTransformModule,
+		"consume-transform": c.ConsumeTransformModule,
+	} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", flag, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// prints the merged settings so it's clear what the node actually runs with
+func printSettings(w io.Writer, v *viper.Viper) {
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	fmt.Fprintln(w, "proglog: effective configuration:")
+	for _, key := range keys {
+		if (key == "vault-token" || key == "schema-registry-password" || key == "backup-s3-secret-access-key" || key == "gossip-key") && v.GetString(key) != "" {
+			fmt.Fprintf(w, "  %s: <redacted>\n", key)
+			continue
+		}
+		fmt.Fprintf(w, "  %s: %v\n", key, v.Get(key))
+	}
+}
+
+// builds the agent's TLS configs from the TLS files, if any were given, or from
+// Vault, with the TLS policy, and the listeners' filters, which validate has
+// checked parse
+func (c *serveConfig) setup() error {
+	levels, _ := logging.ParseLevels(c.LogLevel, c.LogLevels)
+	c.logger.SetLevels(levels)
+	c.Config.Logger = c.logger.Logger
+	c.Vault.Logger = c.logger.Named("vault")
+	c.RPCFilter, _ = netfilter.ParseRules(c.RPCAllow, c.RPCDeny)
+	c.HTTPFilter, _ = netfilter.ParseRules(c.HTTPAllow, c.HTTPDeny)
+	c.GossipFilter, _ = netfilter.ParseRules(c.GossipAllow, c.GossipDeny)
+	c.Config.GossipKey, _ = base64.StdEncoding.DecodeString(c.GossipKey)
+	minVersion, _ := config.ParseTLSVersion(c.TLSMinVersion)
+	cipherSuites, _ := config.ParseCipherSuites(c.TLSCipherSuites)
+	clientAuth, _ := config.ParseClientAuth(c.TLSClientAuth)
+	for _, tlsConfig := range []*config.TLSConfig{&c.ServerTLSConfig, &c.PeerTLSConfig} {
+		tlsConfig.MinVersion = minVersion
+		tlsConfig.CipherSuites = cipherSuites
+	}
+	c.ServerTLSConfig.ClientAuth = &clientAuth
+	if c.Vault.Addr != "" {
+		return c.setupVault(minVersion, cipherSuites, clientAuth)
+	}
+
+	var err error
+	if c.ServerTLSConfig.CertFile != "" && c.ServerTLSConfig.KeyFile != "" {
+		c.ServerTLSConfig.Server = true
+		if c.Config.ServerTLSConfig, err = config.SetupTLSConfig(c.ServerTLSConfig); err != nil {
+			return err
+		}
+	}
+	if c.PeerTLSConfig.CertFile != "" && c.PeerTLSConfig.KeyFile != "" {
+		if c.Config.PeerTLSConfig, err = config.SetupTLSConfig(c.PeerTLSConfig); err != nil {
+			return err
+		}
+	}
+	if c.WatchTLSFiles {
+		return c.watchTLSFiles()
+	}
+	return nil
+}
+
+// swaps the certificates the TLS files were loaded into for watchers serving
+// whatever the files hold
+func (c *serveConfig) watchTLSFiles() error {
+	if tlsConfig := c.Config.ServerTLSConfig; tlsConfig != nil {
+		w, err := config.NewCertWatcher(c.ServerTLSConfig.CertFile, c.ServerTLSConfig.KeyFile)
+		if err != nil {
+			return err
+		}
+		c.certWatchers = append(c.certWatchers, w)
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = w.GetCertificate
+	}
+	if tlsConfig := c.Config.PeerTLSConfig; tlsConfig != nil {
+		w, err := config.NewCertWatcher(c.PeerTLSConfig.CertFile, c.PeerTLSConfig.KeyFile)
+		if err != nil {
+			c.closeWatchers()
+			return err
+		}
+		c.certWatchers = append(c.certWatchers, w)
+		tlsConfig.Certificates = nil
+		tlsConfig.GetClientCertificate = w.GetClientCertificate
+	}
+	return nil
+}
+
+func (c *serveConfig) closeWatchers() {
+	for _, w := range c.certWatchers {
+		w.Close()
+	}
+	c.certWatchers = nil
+}
+
+// the server and the followers' replication both use the certificate Vault
+// issued for the node, and trust the CA that issued it. a reload keeps the
+// running Source, it renews the certificate on its own
+func (c *serveConfig) setupVault(minVersion uint16, cipherSuites []uint16, clientAuth tls.ClientAuthType) error {
+	if c.vault == nil {
+		c.Vault.CommonName = c.NodeName
+		if host, _, err := net.SplitHostPort(c.BindAddr); err == nil {
+			if net.ParseIP(host) != nil {
+				c.Vault.IPSANs = []string{host}
+			} else {
+				c.Vault.AltNames = []string{host}
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		var err error
+		if c.vault, err = vault.NewSource(ctx, c.Vault); err != nil {
+			return err
+		}
+	}
+	c.Config.ServerTLSConfig = &tls.Config{
+		GetCertificate: c.vault.GetCertificate,
+		ClientCAs:      c.vault.CAPool(),
+		ClientAuth:     clientAuth,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+	}
+	c.Config.PeerTLSConfig = &tls.Config{
+		GetClientCertificate: c.vault.GetClientCertificate,
+		RootCAs:              c.vault.CAPool(),
+		MinVersion:           minVersion,
+		CipherSuites:         cipherSuites,
+	}
+	return nil
+}
+
+// builds the logger the node logs through, which the packages logging through
+// zap's global logger and the standard logger also end up in
+func (c *serveConfig) setupLogger() error {
+	levels, _ := logging.ParseLevels(c.LogLevel, c.LogLevels)
+	var err error
+	if c.logger, err = logging.New(logging.Config{Format: c.LogFormat, Levels: levels}); err != nil {
+		return err
+	}
+	zap.ReplaceGlobals(c.logger.Logger)
+	zap.RedirectStdLog(c.logger.Named("stdlog"))
+	return nil
+}
+
+func (c *serveConfig) run(v *viper.Viper) error {
+	defer c.logger.Sync()
+	logger := c.logger.Named("proglog")
+	if c.vault != nil {
+		defer c.vault.Close()
+	}
+	// a reload replaces the config, and with it the TLS files' watchers
+	current := c
+	defer func() {
+		current.closeWatchers()
+	}()
+	agent, err := agent.New(c.Config)
+	if err != nil {
+		return err
+	}
+	// under systemd, the node is only up once it has recovered its log
+	if _, err := systemd.Notify(systemd.Ready); err != nil {
+		logger.Warn("notifying systemd", zap.Error(err))
+	}
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		logger.Warn("reading the systemd watchdog interval", zap.Error(err))
+	}
+	done := make(chan struct{})
+	if interval > 0 {
+		go systemd.RunWatchdog(interval, agent.Ready, done)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range sigc {
+		switch sig {
+		case syscall.SIGHUP:
+			next, err := reload(v, agent, current)
+			if err != nil {
+				logger.Error("reloading the config", zap.Error(err))
+				continue
+			}
+			current = next
+			logger.Info("reloaded the config")
+		case syscall.SIGUSR1:
+			if err := agent.WriteStats(zap.NewStdLog(logger).Writer()); err != nil {
+				logger.Error("writing stats", zap.Error(err))
+			}
+		default:
+			close(done)
+			_, _ = systemd.Notify(systemd.Stopping)
+			return agent.Shutdown()
+		}
+	}
+	return nil
+}
+
+// rereads the config file and hands the agent the result, a config that doesn't
+// load leaves the agent as it was. the node keeps the Vault source it started
+// with, while the current config's TLS file watchers give way to the new one's
+func reload(v *viper.Viper, a *agent.Agent, current *serveConfig) (*serveConfig, error) {
+	c := &serveConfig{vault: current.vault, logger: current.logger}
+	if err := c.load(v); err != nil {
+		return nil, err
+	}
+	if err := c.setup(); err != nil {
+		return nil, err
+	}
+	if err := a.Reload(c.Config); err != nil {
+		c.closeWatchers()
+		return nil, err
+	}
+	if c.LogFormat != current.LogFormat {
+		c.logger.Named("proglog").Warn("log-format changed, it takes effect after a restart")
+	}
+	current.closeWatchers()
+	return c, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+node-name: from-file
+rpc-port: 9400
+bootstrap: true
+min-in-sync-replicas: 2
+reap-after: 5m
+`), 0644))
+	t.Setenv("PROGLOG_RPC_PORT", "9500")
+
+	v := viper.New()
+	cmd := &cobra.Command{}
+	require.NoError(t, setupFlags(cmd, v))
+	require.NoError(t, cmd.Flags().Parse([]string{
+		"--config-file", file,
+		"--min-in-sync-replicas", "3",
+		"--catch-up-bytes-per-second", "1048576",
+	}))
+	c := &serveConfig{}
+	require.NoError(t, c.load(v))
+
+	// flags override the environment, which overrides the file
+	require.Equal(t, "from-file", c.NodeName)
+	require.Equal(t, 9500, c.RPCPort)
+	require.Equal(t, 3, c.MinInSyncReplicas)
+	require.Equal(t, 1048576, c.CatchUpBytesPerSecond)
+	require.Equal(t, 5*time.Minute, c.ReapAfter)
+	require.Equal(t, 10*time.Second, c.MaxLagTime)
+	require.True(t, c.Bootstrap)
+	require.Equal(t, "127.0.0.1:8401", c.BindAddr)
+}
+
+func TestServeConfigValidate(t *testing.T) {
+	c := &serveConfig{}
+	c.DataDir = "/tmp/proglog"
+	c.NodeName = "node-0"
+	c.BindAddr = "127.0.0.1:8401"
+	c.RPCPort = 8401
+	c.MinInSyncReplicas = 1
+	c.ShutdownTimeout = time.Second
+	c.TLSMinVersion = "1.2"
+	c.TLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	c.TLSClientAuth = "request"
+	c.GossipDeny = []string{"10.0.0.0/33"}
+	c.LogFormat = "text"
+	c.Telemetry.Exporter = "jaeger"
+	c.Telemetry.SampleRatio = 2
+	c.LogLevels = []string{"server=loud"}
+	c.RequireSchemaID = true
+	c.ConsumeTransformModule = "/nonexistent/mask.wasm"
+	c.Backup.Interval = time.Hour
+	c.DiskGuard.RetentionFreeBytes = 1 << 30
+	c.DiskGuard.FenceFreeBytes = 1 << 30
+	c.ConsumeReadSlots = -1
+	c.ReapAfter = -time.Second
+	c.GossipKey = "c2hvcnQ="
+	dir := t.TempDir()
+	c.ServerTLSConfig.CertFile = filepath.Join(dir, "server.pem")
+	require.NoError(t, os.WriteFile(c.ServerTLSConfig.CertFile, nil, 0644))
+	c.PeerTLSConfig.CAFile = filepath.Join(dir, "ca.pem")
+
+	err := c.validate()
+	require.ErrorContains(t, err, "rpc-port 8401 is the bind-addr's port")
+	require.ErrorContains(t, err, "start-join-addrs is required")
+	require.ErrorContains(t, err, "server-tls-cert-file and server-tls-key-file go together")
+	require.ErrorContains(t, err, "peer-tls-ca-file")
+	require.ErrorContains(t, err, "tls-cipher-suites")
+	require.ErrorContains(t, err, "gossip-allow/gossip-deny")
+	require.ErrorContains(t, err, "log-format")
+	require.ErrorContains(t, err, "telemetry-exporter")
+	require.ErrorContains(t, err, "trace-sample-ratio")
+	require.ErrorContains(t, err, "log-level/log-levels")
+	require.ErrorContains(t, err, "require-schema-id needs schema-registry-url")
+	require.ErrorContains(t, err, "consume-transform")
+	require.ErrorContains(t, err, "backup-interval needs backup-s3-endpoint and backup-s3-bucket")
+	require.ErrorContains(t, err, "disk-fence-free-bytes has to be below disk-retention-free-bytes")
+	require.ErrorContains(t, err, "consume-read-slots can't be negative")
+	require.ErrorContains(t, err, "reap-after and repair-interval can't be negative")
+	require.ErrorContains(t, err, "gossip-key is 5 bytes")
+
+	c.RPCPort = 8400
+	c.Bootstrap = true
+	c.ServerTLSConfig.KeyFile = filepath.Join(dir, "server-key.pem")
+	c.PeerTLSConfig.CAFile = ""
+	c.TLSCipherSuites = nil
+	c.GossipDeny = []string{"10.0.0.0/8"}
+	c.LogFormat = "json"
+	c.Telemetry.Exporter = "stdout"
+	c.Telemetry.SampleRatio = 1
+	c.LogLevels = []string{"server=debug"}
+	c.SchemaRegistryURL = "http://127.0.0.1:8081"
+	c.ConsumeTransformModule = ""
+	c.Backup.S3.Endpoint = "http://127.0.0.1:9000"
+	c.Backup.S3.Bucket = "backups"
+	c.DiskGuard.FenceFreeBytes = 1 << 28
+	c.ConsumeReadSlots = 8
+	c.ReapAfter = time.Minute
+	c.GossipKey = "MDEyMzQ1Njc4OWFiY2RlZg=="
+	require.ErrorContains(t, c.validate(), "server-tls-key-file")
+	require.NoError(t, os.WriteFile(c.ServerTLSConfig.KeyFile, nil, 0644))
+	require.NoError(t, c.validate())
+}
+
+func TestServeConfigValidateVault(t *testing.T) {
+	c := &serveConfig{}
+	c.DataDir = "/tmp/proglog"
+	c.NodeName = "node-0"
+	c.BindAddr = "127.0.0.1:8401"
+	c.RPCPort = 8400
+	c.Bootstrap = true
+	c.MinInSyncReplicas = 1
+	c.ShutdownTimeout = time.Second
+	c.TLSMinVersion = "1.2"
+	c.TLSClientAuth = "require-and-verify"
+	c.Vault.Addr = "https://vault:8200"
+	c.ServerTLSConfig.CertFile = "server.pem"
+
+	err := c.validate()
+	require.ErrorContains(t, err, "vault-pki-role is required")
+	require.ErrorContains(t, err, "vault-token or VAULT_TOKEN is required")
+	require.ErrorContains(t, err, "mutually exclusive")
+
+	c.Vault.Role = "proglog"
+	c.Vault.Token = "secret"
+	c.ServerTLSConfig.CertFile = ""
+	require.NoError(t, c.validate())
+}
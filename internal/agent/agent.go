@@ -0,0 +1,1130 @@
+// runs a node: it sets up and ties together the replicated log, the gRPC server
+// and the Serf membership, and shuts them down again
+
+// The agent serves liveness and readiness probes over HTTP from before it recovers
+// its log until it's shut down. It's only ready in between: once every component
+// is set up and until it starts shutting down, when it stays up but unready for
+// DrainDelay (lame duck) so load balancers stop routing to it before it stops.
+// /healthz?verbose=1 and the gRPC health service describe it in more detail, see
+// Health.
+
+// The node started with Bootstrap leads the log. The others find the leader through
+// Serf, which it tags itself in, and replicate from it. The leader stops waiting for
+// a replica as soon as Serf reports the replica left.
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/apikey"
+	"proglog/internal/audit"
+	"proglog/internal/backup"
+	"proglog/internal/dedup"
+	"proglog/internal/discovery"
+	"proglog/internal/diskguard"
+	"proglog/internal/fluent"
+	"proglog/internal/keyindex"
+	"proglog/internal/log"
+	"proglog/internal/migrate"
+	"proglog/internal/netfilter"
+	"proglog/internal/offsets"
+	"proglog/internal/oidc"
+	"proglog/internal/schema"
+	"proglog/internal/server"
+	"proglog/internal/syslog"
+	"proglog/internal/telemetry"
+	"proglog/internal/transform"
+	"proglog/internal/txn"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type Config struct {
+	// secures the RPC server
+	ServerTLSConfig *tls.Config
+	// secures the connections followers make to the leader
+	PeerTLSConfig *tls.Config
+	DataDir       string
+	// the address Serf gossips on, the RPC server listens on the same host
+	BindAddr string
+	RPCPort  int
+	// identifies the node in Serf and as a replica
+	NodeName string
+	// Serf addresses of nodes already in the cluster
+	StartJoinAddrs []string
+	// makes this node the leader
+	Bootstrap bool
+	// the leader's fencing token, see log.Config
+	LeaderEpoch uint64
+	// the number of in-sync replicas (counting the leader) a write needs
+	MinInSyncReplicas int
+	// how many of the leader's sealed segments a follower far behind copies at
+	// once, zero fetches every record, see log.Config
+	CatchUpSegments int
+	// caps the bytes per second the leader sends followers that aren't in
+	// sync, zero doesn't, see log.Config
+	CatchUpBytesPerSecond int
+	// how long a follower can go without catching up before it's dropped from
+	// the in-sync set, and how long an append waits for the in-sync replicas,
+	// the log's defaults when zero
+	MaxLagTime time.Duration
+	AckTimeout time.Duration
+	// how long the leader keeps tracking a follower that stopped fetching,
+	// zero keeps it forever
+	ReapAfter time.Duration
+	// how often followers compare their records with the leader's, zero
+	// disables repairs
+	RepairInterval time.Duration
+	// writes the log with O_DIRECT where it's supported, see log.Config
+	DirectIO bool
+	// experimental: reads and writes the log through io_uring, see log.Config
+	IOUring bool
+	// the size of the buffer the log's appends are written through, and
+	// whether it follows the records' sizes instead, see log.Config
+	WriteBufferBytes    int
+	AdaptiveWriteBuffer bool
+	// opens the log's older segments when they're first read, so a node with
+	// a large log is ready sooner, see log.Config
+	LazyOpen bool
+	// how long a follower waits to find the leader through Serf
+	LeaderTimeout time.Duration
+	// the port the health probes and the metrics are served on, on the same host
+	// as Serf, zero disables them
+	HTTPPort int
+	// how long the node reports it's unready before it stops serving on shutdown
+	DrainDelay time.Duration
+	// when set, admin RPCs need an ID token this OpenID Connect issuer issued
+	// for OIDCClientID
+	OIDCIssuer   string
+	OIDCClientID string
+	// lets clients without a certificate, token or API key call admin RPCs,
+	// see server.Config.InsecureAdmin
+	InsecureAdmin bool
+	// when set, produced records are checked against the schemas registered
+	// in this Confluent-compatible schema registry, see the schema package
+	SchemaRegistryURL      string
+	SchemaRegistryUsername string
+	SchemaRegistryPassword string
+	// rejects the produced records that don't name a schema
+	RequireSchemaID bool
+	// paths to WASM modules that rewrite records' values before they're
+	// appended, and before they're sent to consumers, each's off when empty,
+	// see the transform package
+	ProduceTransformModule string
+	ConsumeTransformModule string
+	// lets producers append records in transactions, see the txn package
+	Transactions bool
+	// how long transactions that don't say may take, and the longest they may,
+	// the txn package's defaults when zero
+	TransactionTimeout    time.Duration
+	MaxTransactionTimeout time.Duration
+	// how long the node remembers the message IDs producers set, dropping
+	// records with one it appended within it, off when zero, see the dedup
+	// package
+	DedupWindow time.Duration
+	// indexes the latest record of each key, serving GetByKey, see the
+	// keyindex package
+	KeyIndex bool
+	// starts the node in read-only mode, rejecting produces until the
+	// SetReadOnly RPC turns it off, see server.ReadOnly
+	ReadOnly bool
+	// backs the leader's sealed segments up to a bucket every Backup.Interval,
+	// off when it's zero, see the backup package
+	Backup backup.Config
+	// removes the oldest segments and refuses appends as the data dir's disk
+	// fills up, off when both its thresholds are zero, see the diskguard
+	// package. its Dir is the data dir
+	DiskGuard diskguard.Config
+	// how long each component gets to stop on shutdown before the agent gives up
+	// on it, 30s when zero
+	ShutdownTimeout time.Duration
+	// the components log through its named children: agent, log, server and
+	// discovery. nothing's logged when nil
+	Logger *zap.Logger
+	// Produce and Consume calls that take longer are logged, at most
+	// SlowRequestsPerSecond of them, see server.Config
+	SlowRequestThreshold  time.Duration
+	SlowRequestsPerSecond int
+	// how many of the newest records are kept in memory for the ConsumeStream
+	// calls following the log's head, zero keeps none, see server.Tail
+	TailRecords int
+	// how many consumers' reads from disk run at once, the rest wait their
+	// turn by their priority, zero doesn't limit them, see server.Lanes
+	ConsumeReadSlots int
+	// the addresses syslog messages are received on and appended to the log
+	// from, TLS with the server's TLS config. each's off when empty, see the
+	// syslog package
+	SyslogUDPAddr string
+	SyslogTCPAddr string
+	SyslogTLSAddr string
+	// the address Fluentd and Fluent Bit forward events to, secured like the
+	// RPC server, off when empty, see the fluent package
+	FluentAddr string
+	// exports traces and metrics of the RPCs the node serves and the fetches it
+	// makes as a follower, nothing's exported by default
+	Telemetry telemetry.Config
+	// called after the log's appends, truncations, segment rotations and
+	// leadership changes, for programs embedding the agent, see log.Hooks
+	LogHooks log.Hooks
+	// run in order after the RPC server authenticates a request, for programs
+	// embedding the agent, see server.Config.UnaryInterceptors
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StreamInterceptors []grpc.StreamServerInterceptor
+	// the networks each listener accepts connections from, Reload swaps them
+	RPCFilter    netfilter.Rules
+	HTTPFilter   netfilter.Rules
+	GossipFilter netfilter.Rules
+	// encrypts the gossip between the nodes, which all share it, see
+	// discovery.Config. nil gossips in the clear, only on trusted networks
+	GossipKey []byte
+}
+
+func (c Config) RPCAddr() (string, error) {
+	host, _, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, fmt.Sprint(c.RPCPort)), nil
+}
+
+func (c Config) HTTPAddr() (string, error) {
+	host, _, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, fmt.Sprint(c.HTTPPort)), nil
+}
+
+// fills in the settings left zero that have defaults
+func (c *Config) setDefaults() {
+	if c.LeaderTimeout == 0 {
+		c.LeaderTimeout = 10 * time.Second
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30 * time.Second
+	}
+}
+
+type Agent struct {
+	Config
+
+	logger    *zap.Logger
+	telemetry *telemetry.Telemetry
+	// the log's metrics, served on the HTTP port's /metrics
+	metrics *prometheus.Registry
+	log     *log.ReplicatedLog
+	// nil when TailRecords is zero
+	tail     *server.Tail
+	readOnly *server.ReadOnly
+	// started by the Drain RPC, the node's unready from then on
+	drain      *server.Drain
+	audit      *audit.Log
+	apiKeys    *apikey.Store
+	offsets    *offsets.Store
+	server     *grpc.Server
+	membership *discovery.Membership
+	http       *http.Server
+	ready      atomic.Bool
+	// the setup step New's on, "draining" once it shuts down, see Health
+	stage   atomic.Value
+	started time.Time
+	// how many of the log's segments are open, while it's recovered
+	segmentsOpened, segments atomic.Int64
+	// nil when no syslog address is set
+	syslog *syslog.Server
+	// nil when FluentAddr isn't set
+	fluent *fluent.Server
+	// nil when their modules aren't set
+	produceTransform, consumeTransform *transform.Transformer
+	// nil when Transactions is off
+	transactions *txn.Coordinator
+	// nil when DedupWindow is zero
+	dedup *dedup.Store
+	// nil when KeyIndex is off
+	keyIndex *keyindex.Index
+	// nil when Backup.Interval is zero
+	backup *backup.Backup
+	// nil when DiskGuard's thresholds are zero
+	diskGuard *diskguard.Guard
+
+	// the TLS configs in use, swapped by Reload
+	serverTLSConfig atomic.Pointer[tls.Config]
+	peerTLSConfig   atomic.Pointer[tls.Config]
+	// filter the listeners' connections, updated by Reload
+	rpcFilter    *netfilter.Filter
+	httpFilter   *netfilter.Filter
+	gossipFilter *netfilter.Filter
+	// the data dir's last writable check, see Health
+	writable writableCheck
+
+	shutdown     bool
+	shutdownLock sync.Mutex
+}
+
+func New(config Config) (*Agent, error) {
+	config.setDefaults()
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	a := &Agent{
+		Config:       config,
+		logger:       config.Logger.Named("agent"),
+		metrics:      prometheus.NewRegistry(),
+		started:      time.Now(),
+		rpcFilter:    netfilter.New("rpc", config.RPCFilter),
+		httpFilter:   netfilter.New("http", config.HTTPFilter),
+		gossipFilter: netfilter.New("gossip", config.GossipFilter),
+		writable:     writableCheck{interval: writableInterval},
+		readOnly:     &server.ReadOnly{},
+		drain:        server.NewDrain(),
+	}
+	a.readOnly.Set(config.ReadOnly, "it was started read-only")
+	a.serverTLSConfig.Store(config.ServerTLSConfig)
+	a.peerTLSConfig.Store(config.PeerTLSConfig)
+	// the leader is ready for followers before it joins the cluster, while
+	// followers have to join it first to find the leader
+	type step struct {
+		stage string
+		setup func() error
+	}
+	setup := []step{
+		{"telemetry", a.setupTelemetry},
+		{"http", a.setupHTTP},
+		{"log", a.setupLog},
+		{"audit", a.setupAudit},
+		{"apikeys", a.setupAPIKeys},
+		{"offsets", a.setupOffsets},
+		{"dedup", a.setupDedup},
+		{"backup", a.setupBackup},
+		{"diskguard", a.setupDiskGuard},
+		{"server", a.setupServer},
+		{"syslog", a.setupSyslog},
+		{"fluent", a.setupFluent},
+		{"membership", a.setupMembership},
+	}
+	if !a.Bootstrap {
+		setup = []step{
+			{"telemetry", a.setupTelemetry},
+			{"http", a.setupHTTP},
+			{"membership", a.setupMembership},
+			{"log", a.setupLog},
+			{"audit", a.setupAudit},
+			{"apikeys", a.setupAPIKeys},
+			{"offsets", a.setupOffsets},
+			{"dedup", a.setupDedup},
+			{"backup", a.setupBackup},
+			{"diskguard", a.setupDiskGuard},
+			{"server", a.setupServer},
+			{"syslog", a.setupSyslog},
+			{"fluent", a.setupFluent},
+		}
+	}
+	for _, s := range setup {
+		a.stage.Store(s.stage)
+		if err := s.setup(); err != nil {
+			a.Shutdown()
+			return nil, err
+		}
+	}
+	a.stage.Store("")
+	a.ready.Store(true)
+	a.logger.Info(
+		"started",
+		zap.String("node", a.NodeName),
+		zap.String("bind_addr", a.BindAddr),
+		zap.Int("rpc_port", a.RPCPort),
+		zap.Bool("bootstrap", a.Bootstrap),
+	)
+	return a, nil
+}
+
+// reports whether the node can take traffic
+func (a *Agent) Ready() bool {
+	return a.ready.Load() && !a.drain.Draining()
+}
+
+func (a *Agent) setupTelemetry() error {
+	c := a.Telemetry
+	c.NodeName = a.NodeName
+	var err error
+	a.telemetry, err = telemetry.New(context.Background(), c)
+	return err
+}
+
+func (a *Agent) setupHTTP() error {
+	if a.HTTPPort == 0 {
+		return nil
+	}
+	httpAddr, err := a.HTTPAddr()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(a.metrics, promhttp.HandlerOpts{}))
+	mux.Handle("/", server.NewProbeHandler(a.Ready, a.Health))
+	a.http = &http.Server{Handler: mux}
+	go a.http.Serve(netfilter.Listener(ln, a.httpFilter))
+	return nil
+}
+
+func (a *Agent) setupLog() error {
+	// before the key index's dir is made, which a fresh data dir would
+	// otherwise be taken to be an old format's for
+	if err := migrate.Check(a.DataDir); err != nil {
+		return err
+	}
+	c := a.logConfig()
+	if a.TailRecords > 0 {
+		a.tail = server.NewTail(a.TailRecords)
+		c.Hooks = tailHooks(a.tail, c.Hooks)
+	}
+	if a.KeyIndex {
+		dir := filepath.Join(a.DataDir, "keys")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		var err error
+		if a.keyIndex, err = keyindex.New(dir); err != nil {
+			return err
+		}
+		c.Hooks = keyIndexHooks(a.keyIndex, c.Hooks, a.Logger.Named("keyindex"))
+	}
+	onRecover := c.Hooks.OnRecover
+	c.Hooks.OnRecover = func(opened, total int) {
+		a.segmentsOpened.Store(int64(opened))
+		a.segments.Store(int64(total))
+		if onRecover != nil {
+			onRecover(opened, total)
+		}
+	}
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	c.Replication.LocalAddr = rpcAddr
+	if !a.Bootstrap {
+		if c.Replication.LeaderAddr, err = a.findLeader(); err != nil {
+			return err
+		}
+		creds := insecure.NewCredentials()
+		if a.PeerTLSConfig != nil {
+			creds = credentials.NewTLS(a.reloadablePeerTLSConfig())
+		}
+		c.Replication.DialOptions = []grpc.DialOption{
+			grpc.WithTransportCredentials(creds),
+			grpc.WithStatsHandler(otelgrpc.NewClientHandler(
+				otelgrpc.WithTracerProvider(a.telemetry.TracerProvider),
+				otelgrpc.WithMeterProvider(a.telemetry.MeterProvider),
+			)),
+		}
+	}
+	dir := filepath.Join(a.DataDir, "log")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if a.log, err = log.NewReplicatedLog(dir, c); err != nil {
+		return err
+	}
+	if a.keyIndex != nil {
+		return a.keyIndex.CatchUp(a.log)
+	}
+	return nil
+}
+
+// feeds the key index from the log, before the hooks it's given run
+func keyIndexHooks(index *keyindex.Index, hooks log.Hooks, logger *zap.Logger) log.Hooks {
+	onAppend, onCommit, onTruncate := hooks.OnAppend, hooks.OnCommit, hooks.OnTruncate
+	hooks.OnAppend = func(offset uint64, record *api.Record) {
+		index.Append(offset, record)
+		if onAppend != nil {
+			onAppend(offset, record)
+		}
+	}
+	hooks.OnCommit = func(highWatermark uint64) {
+		// the records that weren't indexed are retried on the next commit
+		if err := index.Commit(highWatermark); err != nil {
+			logger.Error("indexing keys", zap.Error(err))
+		}
+		if onCommit != nil {
+			onCommit(highWatermark)
+		}
+	}
+	hooks.OnTruncate = func(from, to uint64) {
+		index.Truncate(from, to)
+		if onTruncate != nil {
+			onTruncate(from, to)
+		}
+	}
+	onRedact := hooks.OnRedact
+	hooks.OnRedact = func(offset uint64, record *api.Record) {
+		index.Redact(offset)
+		if onRedact != nil {
+			onRedact(offset, record)
+		}
+	}
+	return hooks
+}
+
+// nil when ConsumeReadSlots is zero
+func (a *Agent) lanes() *server.Lanes {
+	if a.ConsumeReadSlots == 0 {
+		return nil
+	}
+	return server.NewLanes(a.ConsumeReadSlots)
+}
+
+// feeds the tail from the log, before the embedder's hooks run
+func tailHooks(tail *server.Tail, hooks log.Hooks) log.Hooks {
+	onAppend, onCommit, onTruncate := hooks.OnAppend, hooks.OnCommit, hooks.OnTruncate
+	hooks.OnAppend = func(offset uint64, record *api.Record) {
+		tail.Append(offset, record)
+		if onAppend != nil {
+			onAppend(offset, record)
+		}
+	}
+	hooks.OnCommit = func(highWatermark uint64) {
+		tail.Commit(highWatermark)
+		if onCommit != nil {
+			onCommit(highWatermark)
+		}
+	}
+	hooks.OnTruncate = func(from, to uint64) {
+		tail.Truncate(from, to)
+		if onTruncate != nil {
+			onTruncate(from, to)
+		}
+	}
+	onRedact := hooks.OnRedact
+	hooks.OnRedact = func(offset uint64, record *api.Record) {
+		tail.Replace(offset, record)
+		if onRedact != nil {
+			onRedact(offset, record)
+		}
+	}
+	return hooks
+}
+
+// the audit log lives next to the data log, see the audit package
+func (a *Agent) setupAudit() error {
+	dir := filepath.Join(a.DataDir, "audit")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var err error
+	a.audit, err = audit.New(dir)
+	return err
+}
+
+// each node keeps its own API keys, see the apikey package
+func (a *Agent) setupAPIKeys() error {
+	dir := filepath.Join(a.DataDir, "apikeys")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var err error
+	a.apiKeys, err = apikey.New(dir)
+	return err
+}
+
+// each node keeps the offsets committed to it, see the offsets package
+func (a *Agent) setupOffsets() error {
+	dir := filepath.Join(a.DataDir, "offsets")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var err error
+	a.offsets, err = offsets.New(dir)
+	return err
+}
+
+// each node keeps the message IDs it appended, see the dedup package
+func (a *Agent) setupDedup() error {
+	if a.DedupWindow == 0 {
+		return nil
+	}
+	dir := filepath.Join(a.DataDir, "dedup")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var err error
+	a.dedup, err = dedup.New(dir, a.DedupWindow)
+	return err
+}
+
+// every node schedules backups, the followers' are skipped, see the backup
+// package
+func (a *Agent) setupBackup() error {
+	if a.Backup.Interval == 0 {
+		return nil
+	}
+	c := a.Backup
+	c.Logger = a.Logger.Named("backup")
+	c.Registerer = a.metrics
+	var err error
+	a.backup, err = backup.New(a.log, c)
+	return err
+}
+
+func (a *Agent) setupDiskGuard() error {
+	if a.DiskGuard.RetentionFreeBytes == 0 && a.DiskGuard.FenceFreeBytes == 0 {
+		return nil
+	}
+	c := a.DiskGuard
+	c.Dir = a.DataDir
+	c.Logger = a.Logger.Named("diskguard")
+	c.Registerer = a.metrics
+	var err error
+	a.diskGuard, err = diskguard.New(a.log, c)
+	return err
+}
+
+// the log's config as the agent's settings have it, without the hooks and
+// addresses setupLog adds
+func (a *Agent) logConfig() log.Config {
+	c := log.Config{
+		Registerer: a.metrics,
+		Logger:     a.Logger.Named("log"),
+		Hooks:      a.LogHooks,
+	}
+	c.Replication.LocalID = a.NodeName
+	c.Replication.LeaderEpoch = a.LeaderEpoch
+	c.Replication.MinInSyncReplicas = a.MinInSyncReplicas
+	c.Replication.CatchUpSegments = a.CatchUpSegments
+	c.Replication.CatchUpBytesPerSecond = a.CatchUpBytesPerSecond
+	c.Replication.MaxLagTime = a.MaxLagTime
+	c.Replication.AckTimeout = a.AckTimeout
+	c.Replication.ReapAfter = a.ReapAfter
+	c.Replication.RepairInterval = a.RepairInterval
+	c.Segment.DirectIO = a.DirectIO
+	c.Segment.IOUring = a.IOUring
+	c.Segment.LazyOpen = a.LazyOpen
+	c.Segment.WriteBufferBytes = a.WriteBufferBytes
+	c.Segment.AdaptiveWriteBuffer = a.AdaptiveWriteBuffer
+	return c
+}
+
+// polls the members Serf knows about until one is tagged as the leader
+func (a *Agent) findLeader() (string, error) {
+	deadline := time.Now().Add(a.LeaderTimeout)
+	for time.Now().Before(deadline) {
+		for _, member := range a.membership.Members() {
+			if member.Tags["leader"] == "true" && member.Tags["rpc_addr"] != "" {
+				return member.Tags["rpc_addr"], nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return "", fmt.Errorf("agent: no leader found within %s", a.LeaderTimeout)
+}
+
+func (a *Agent) setupServer() error {
+	serverConfig := &server.Config{
+		MemberManager:         a,
+		CommitLog:             a.log,
+		ReplicaFetcher:        a.log,
+		SegmentFetcher:        a.log,
+		Checksummer:           a.log,
+		ReplicaMembers:        a,
+		ReplicationDescriber:  a.log,
+		LeaderVerifier:        a.log,
+		ClusterStatusGetter:   a.log,
+		SegmentDescriber:      a.log,
+		LogDescriber:          a.log,
+		OffsetGetter:          a.log,
+		AuditLog:              a.audit,
+		APIKeys:               a.apiKeys,
+		ConsumerOffsets:       a.offsets,
+		Logger:                a.Logger.Named("server"),
+		SlowRequestThreshold:  a.SlowRequestThreshold,
+		SlowRequestsPerSecond: a.SlowRequestsPerSecond,
+		HealthReporter:        a,
+		Tail:                  a.tail,
+		Lanes:                 a.lanes(),
+		ReadOnly:              a.readOnly,
+		Drain:                 a.drain,
+		ReplicationSettler:    a.log,
+		Redactor:              a.log,
+		InsecureAdmin:         a.InsecureAdmin,
+		UnaryInterceptors:     a.UnaryInterceptors,
+		StreamInterceptors:    a.StreamInterceptors,
+	}
+	if a.diskGuard != nil {
+		serverConfig.WriteFence = a.diskGuard
+	}
+	if a.OIDCIssuer != "" {
+		verifier, err := oidc.New(context.Background(), a.OIDCIssuer, a.OIDCClientID)
+		if err != nil {
+			return err
+		}
+		serverConfig.TokenVerifier = verifier
+	}
+	if a.SchemaRegistryURL != "" {
+		validator, err := schema.New(schema.Config{
+			URL:             a.SchemaRegistryURL,
+			Username:        a.SchemaRegistryUsername,
+			Password:        a.SchemaRegistryPassword,
+			RequireSchemaID: a.RequireSchemaID,
+			Registerer:      a.metrics,
+		})
+		if err != nil {
+			return err
+		}
+		serverConfig.SchemaValidator = validator
+	}
+	var err error
+	if a.ProduceTransformModule != "" {
+		if a.produceTransform, err = newTransformer(a.ProduceTransformModule); err != nil {
+			return err
+		}
+		serverConfig.ProduceTransformer = a.produceTransform
+	}
+	if a.ConsumeTransformModule != "" {
+		if a.consumeTransform, err = newTransformer(a.ConsumeTransformModule); err != nil {
+			return err
+		}
+		serverConfig.ConsumeTransformer = a.consumeTransform
+	}
+	if a.Transactions {
+		if a.transactions, err = txn.New(a.log, txn.Config{
+			DefaultTimeout: a.TransactionTimeout,
+			MaxTimeout:     a.MaxTransactionTimeout,
+			Registerer:     a.metrics,
+		}); err != nil {
+			return err
+		}
+		serverConfig.Transactions = a.transactions
+	}
+	if a.dedup != nil {
+		serverConfig.Deduplicator = a.dedup
+	}
+	if a.keyIndex != nil {
+		serverConfig.KeyIndex = a.keyIndex
+	}
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler(
+			otelgrpc.WithTracerProvider(a.telemetry.TracerProvider),
+			otelgrpc.WithMeterProvider(a.telemetry.MeterProvider),
+		)),
+	}
+	if a.ServerTLSConfig != nil {
+		creds := credentials.NewTLS(a.reloadableServerTLSConfig())
+		opts = append(opts, grpc.Creds(audit.Credentials(creds, a.audit)))
+	}
+	a.server, err = server.NewGPRCServer(serverConfig, opts...)
+	if err != nil {
+		return err
+	}
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := a.server.Serve(netfilter.Listener(ln, a.rpcFilter)); err != nil {
+			_ = a.Shutdown()
+		}
+	}()
+	return nil
+}
+
+func newTransformer(path string) (*transform.Transformer, error) {
+	module, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return transform.New(context.Background(), transform.Config{Module: module})
+}
+
+// appends the syslog messages sent to the node, only the leader takes them
+func (a *Agent) setupSyslog() error {
+	if a.SyslogUDPAddr == "" && a.SyslogTCPAddr == "" && a.SyslogTLSAddr == "" {
+		return nil
+	}
+	c := syslog.Config{
+		UDPAddr:    a.SyslogUDPAddr,
+		TCPAddr:    a.SyslogTCPAddr,
+		TLSAddr:    a.SyslogTLSAddr,
+		Appender:   fencedAppender{log: a.log, readOnly: a.readOnly, diskGuard: a.diskGuard},
+		Logger:     a.Logger.Named("syslog"),
+		Registerer: a.metrics,
+	}
+	if a.ServerTLSConfig != nil {
+		c.TLSConfig = a.ingestTLSConfig()
+	}
+	var err error
+	a.syslog, err = syslog.New(c)
+	return err
+}
+
+// appends the events Fluentd and Fluent Bit forward to the node, only the
+// leader takes them
+func (a *Agent) setupFluent() error {
+	if a.FluentAddr == "" {
+		return nil
+	}
+	c := fluent.Config{
+		Addr:       a.FluentAddr,
+		Appender:   fencedAppender{log: a.log, readOnly: a.readOnly, diskGuard: a.diskGuard},
+		Logger:     a.Logger.Named("fluent"),
+		Registerer: a.metrics,
+	}
+	if a.ServerTLSConfig != nil {
+		c.TLSConfig = a.ingestTLSConfig()
+	}
+	var err error
+	a.fluent, err = fluent.New(c)
+	return err
+}
+
+// rejects the records other systems send while the node's read-only or its
+// disk's almost full, like the server rejects produces
+type fencedAppender struct {
+	log      *log.ReplicatedLog
+	readOnly *server.ReadOnly
+	// nil when the disk isn't guarded
+	diskGuard *diskguard.Guard
+}
+
+func (a fencedAppender) Append(record *api.Record) (uint64, error) {
+	if err := a.readOnly.Err(); err != nil {
+		return 0, err
+	}
+	if a.diskGuard != nil {
+		if err := a.diskGuard.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return a.log.Append(record)
+}
+
+// the server's TLS config with the certificates Reload last set, for the
+// listeners that take logs from other systems
+func (a *Agent) ingestTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return a.serverTLSConfig.Load(), nil
+		},
+	}
+}
+
+func (a *Agent) setupMembership() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	tags := map[string]string{
+		"rpc_addr": rpcAddr,
+	}
+	if a.Bootstrap {
+		tags["leader"] = "true"
+	}
+	a.membership, err = discovery.New(a, discovery.Config{
+		NodeName:       a.NodeName,
+		BindAddr:       a.BindAddr,
+		Tags:           tags,
+		StartJoinAddrs: a.StartJoinAddrs,
+		Allowed:        a.gossipFilter.Allowed,
+		SecretKey:      a.GossipKey,
+		Logger:         a.Logger.Named("discovery"),
+		Registerer:     a.metrics,
+	})
+	return err
+}
+
+// followers pull from the leader, so a node joining needs nothing from the agent
+func (a *Agent) Join(name, addr string) error {
+	return nil
+}
+
+// stops the leader from waiting on a replica that left
+func (a *Agent) Leave(name string) error {
+	if a.Bootstrap {
+		a.log.RemoveReplica(name)
+	}
+	return nil
+}
+
+// lists the nodes Serf knows about, including this one
+func (a *Agent) Members() ([]*api.Member, error) {
+	var members []*api.Member
+	for _, m := range a.membership.Members() {
+		members = append(members, &api.Member{
+			Id:       m.Name,
+			Addr:     net.JoinHostPort(m.Addr.String(), fmt.Sprint(m.Port)),
+			RpcAddr:  m.Tags["rpc_addr"],
+			Status:   m.Status.String(),
+			IsLeader: m.Tags["leader"] == "true",
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Id < members[j].Id
+	})
+	return members, nil
+}
+
+// reports whether name's an alive member, the replication RPCs need a peer
+// certificate naming one
+func (a *Agent) IsMember(name string) bool {
+	if a.membership == nil {
+		return false
+	}
+	for _, m := range a.membership.Members() {
+		if m.Name == name && m.Status == serf.StatusAlive {
+			return true
+		}
+	}
+	return false
+}
+
+// forces a failed node out of the cluster, the leader stops tracking it right away
+func (a *Agent) RemoveMember(id string) error {
+	if err := a.membership.Remove(id); err != nil {
+		return err
+	}
+	return a.Leave(id)
+}
+
+// drains, then leaves the cluster, stops replicating, stops serving and closes
+// the log, in that order: the other nodes hear it's leaving first, and a
+// follower stops fetching right after so the leader doesn't track it again. it
+// carries on past a component that fails or doesn't stop within ShutdownTimeout
+// and returns every error, each prefixed with its component. the server cuts its
+// open streams once its time is up, so the log still closes after it
+func (a *Agent) Shutdown() error {
+	a.shutdownLock.Lock()
+	defer a.shutdownLock.Unlock()
+	if a.shutdown {
+		return nil
+	}
+	a.shutdown = true
+	a.stage.Store("draining")
+	// a node the Drain RPC settled has already been unready long enough
+	if a.ready.Swap(false) && a.DrainDelay > 0 && !a.drain.Drained() {
+		time.Sleep(a.DrainDelay)
+	}
+
+	shutdown := []struct {
+		component string
+		stop      func() error
+		// stops the component right away once stop has run out of time
+		abort func()
+	}{
+		{
+			component: "membership",
+			stop: func() error {
+				if a.membership == nil {
+					return nil
+				}
+				return a.membership.Leave()
+			},
+		},
+		{
+			component: "replicator",
+			stop: func() error {
+				if a.log != nil {
+					a.log.StopReplicating()
+				}
+				return nil
+			},
+		},
+		{
+			component: "syslog",
+			stop: func() error {
+				if a.syslog == nil {
+					return nil
+				}
+				return a.syslog.Close()
+			},
+		},
+		{
+			component: "fluent",
+			stop: func() error {
+				if a.fluent == nil {
+					return nil
+				}
+				return a.fluent.Close()
+			},
+		},
+		{
+			component: "server",
+			stop: func() error {
+				if a.server != nil {
+					a.server.GracefulStop()
+				}
+				return nil
+			},
+			abort: func() {
+				a.server.Stop()
+			},
+		},
+		{
+			component: "transforms",
+			stop: func() error {
+				for _, t := range []*transform.Transformer{a.produceTransform, a.consumeTransform} {
+					if t == nil {
+						continue
+					}
+					if err := t.Close(context.Background()); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			component: "transactions",
+			stop: func() error {
+				if a.transactions == nil {
+					return nil
+				}
+				return a.transactions.Close()
+			},
+		},
+		{
+			component: "diskguard",
+			stop: func() error {
+				if a.diskGuard == nil {
+					return nil
+				}
+				return a.diskGuard.Close()
+			},
+		},
+		{
+			component: "backup",
+			stop: func() error {
+				if a.backup == nil {
+					return nil
+				}
+				return a.backup.Close()
+			},
+		},
+		{
+			component: "log",
+			stop: func() error {
+				if a.log == nil {
+					return nil
+				}
+				return a.log.Close()
+			},
+		},
+		{
+			component: "keyindex",
+			stop: func() error {
+				if a.keyIndex == nil {
+					return nil
+				}
+				return a.keyIndex.Close()
+			},
+		},
+		{
+			component: "audit",
+			stop: func() error {
+				if a.audit == nil {
+					return nil
+				}
+				return a.audit.Close()
+			},
+		},
+		{
+			component: "apikeys",
+			stop: func() error {
+				if a.apiKeys == nil {
+					return nil
+				}
+				return a.apiKeys.Close()
+			},
+		},
+		{
+			component: "offsets",
+			stop: func() error {
+				if a.offsets == nil {
+					return nil
+				}
+				return a.offsets.Close()
+			},
+		},
+		{
+			component: "dedup",
+			stop: func() error {
+				if a.dedup == nil {
+					return nil
+				}
+				return a.dedup.Close()
+			},
+		},
+		{
+			component: "http",
+			stop: func() error {
+				if a.http == nil {
+					return nil
+				}
+				return a.http.Close()
+			},
+		},
+		{
+			component: "telemetry",
+			stop: func() error {
+				if a.telemetry == nil {
+					return nil
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), a.ShutdownTimeout)
+				defer cancel()
+				return a.telemetry.Shutdown(ctx)
+			},
+		},
+	}
+	var errs []error
+	for _, c := range shutdown {
+		errc := make(chan error, 1)
+		go func() {
+			errc <- c.stop()
+		}()
+		select {
+		case err := <-errc:
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", c.component, err))
+			}
+			continue
+		case <-time.After(a.ShutdownTimeout):
+		}
+		a.logger.Warn(
+			"component didn't stop in time",
+			zap.String("component", c.component),
+			zap.Duration("timeout", a.ShutdownTimeout),
+		)
+		if c.abort != nil {
+			c.abort()
+			<-errc
+			errs = append(errs, fmt.Errorf("%s: didn't stop within %s, stopped it forcefully", c.component, a.ShutdownTimeout))
+		} else {
+			errs = append(errs, fmt.Errorf("%s: didn't stop within %s", c.component, a.ShutdownTimeout))
+		}
+	}
+	return errors.Join(errs...)
+}
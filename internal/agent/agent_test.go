@@ -0,0 +1,527 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/backup"
+	"proglog/internal/config"
+	"proglog/internal/netfilter"
+	"proglog/internal/server"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestAgent(t *testing.T) {
+	// the leader only serves fetches to peers whose certificate names a member
+	tlsDir := t.TempDir()
+	require.NoError(t, config.GenerateCerts(tlsDir, []string{"127.0.0.1"}))
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      filepath.Join(tlsDir, "server.pem"),
+		KeyFile:       filepath.Join(tlsDir, "server-key.pem"),
+		CAFile:        filepath.Join(tlsDir, "ca.pem"),
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	clientTLSConfig := func(name string) *tls.Config {
+		if name != "client" {
+			require.NoError(t, config.GenerateClientCert(tlsDir, name))
+		}
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      filepath.Join(tlsDir, name+".pem"),
+			KeyFile:       filepath.Join(tlsDir, name+"-key.pem"),
+			CAFile:        filepath.Join(tlsDir, "ca.pem"),
+			Server:        false,
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		return tlsConfig
+	}
+	peerTLSConfig := clientTLSConfig("client")
+
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		addrs := freeAddrs(t, 2)
+		bindAddr := addrs[0]
+		rpcPort := port(t, addrs[1])
+
+		dataDir, err := os.MkdirTemp("", "agent-test-log")
+		require.NoError(t, err)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].BindAddr)
+		}
+		agent, err := New(Config{
+			NodeName:          fmt.Sprintf("%d", i),
+			Bootstrap:         i == 0,
+			StartJoinAddrs:    startJoinAddrs,
+			BindAddr:          bindAddr,
+			RPCPort:           rpcPort,
+			DataDir:           dataDir,
+			MinInSyncReplicas: 2,
+			ServerTLSConfig:   serverTLSConfig,
+			PeerTLSConfig:     clientTLSConfig(fmt.Sprintf("%d", i)),
+		})
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+			require.NoError(t, os.RemoveAll(agent.DataDir))
+		}
+	}()
+
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	// the followers join the in-sync set on their first fetch
+	var produceResponse *api.ProduceResponse
+	require.Eventually(t, func() bool {
+		produceResponse, err = leaderClient.Produce(
+			context.Background(),
+			&api.ProduceRequest{
+				Record: &api.Record{Value: []byte("foo")},
+			},
+		)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	consumeResponse, err := leaderClient.Consume(
+		context.Background(),
+		&api.ConsumeRequest{Offset: produceResponse.Offset},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), consumeResponse.Record.Value)
+
+	followerClient := client(t, agents[1], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		consumeResponse, err := followerClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{Offset: produceResponse.Offset},
+		)
+		return err == nil && string(consumeResponse.Record.Value) == "foo"
+	}, 3*time.Second, 50*time.Millisecond)
+
+	members, err := leaderClient.ListMembers(
+		context.Background(),
+		&api.ListMembersRequest{},
+	)
+	require.NoError(t, err)
+	require.Len(t, members.Members, 3)
+	for _, m := range members.Members {
+		require.Equal(t, m.Id == "0", m.IsLeader)
+		require.Equal(t, "alive", m.Status)
+	}
+
+	// a client whose certificate doesn't name the member can't fence the
+	// leader or pose as a follower
+	_, err = leaderClient.Fetch(
+		context.Background(),
+		&api.FetchRequest{ReplicaId: "1", Epoch: 100},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// once a follower leaves, the leader commits without it
+	require.NoError(t, agents[2].Shutdown())
+	_, err = leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{Value: []byte("bar")},
+		},
+	)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		res, err := leaderClient.GetClusterStatus(
+			context.Background(),
+			&api.GetClusterStatusRequest{},
+		)
+		return err == nil && len(res.Status.Nodes) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestAgentProbes(t *testing.T) {
+	addrs := freeAddrs(t, 3)
+	agent, err := New(Config{
+		NodeName:   "0",
+		Bootstrap:  true,
+		BindAddr:   addrs[0],
+		RPCPort:    port(t, addrs[1]),
+		HTTPPort:   port(t, addrs[2]),
+		DataDir:    t.TempDir(),
+		DrainDelay: 500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	httpAddr, err := agent.HTTPAddr()
+	require.NoError(t, err)
+	probe := func(path string) int {
+		res, err := http.Get("http://" + httpAddr + path)
+		if err != nil {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	require.Equal(t, http.StatusOK, probe("/healthz"))
+	require.Equal(t, http.StatusOK, probe("/readyz"))
+	res, err := http.Get("http://" + httpAddr + "/metrics")
+	require.NoError(t, err)
+	metrics, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.Contains(t, string(metrics), "proglog_segment_rotations_total 0")
+
+	res, err = http.Get("http://" + httpAddr + "/healthz?verbose=1")
+	require.NoError(t, err)
+	var health server.Health
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&health))
+	res.Body.Close()
+	require.True(t, health.Ready)
+	require.Empty(t, health.Stage)
+	require.True(t, health.DataDirWritable)
+	require.True(t, health.Leader)
+	require.Equal(t, "0", health.LeaderID)
+
+	// the node stays up but unready while it drains
+	done := make(chan error)
+	go func() {
+		done <- agent.Shutdown()
+	}()
+	require.Eventually(t, func() bool {
+		return probe("/readyz") == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusOK, probe("/healthz"))
+	require.NoError(t, <-done)
+	require.Equal(t, 0, probe("/healthz"))
+}
+
+func TestAgentDrain(t *testing.T) {
+	addrs := freeAddrs(t, 3)
+	agent, err := New(Config{
+		NodeName:   "0",
+		Bootstrap:  true,
+		BindAddr:   addrs[0],
+		RPCPort:    port(t, addrs[1]),
+		HTTPPort:   port(t, addrs[2]),
+		DataDir:    t.TempDir(),
+		DrainDelay: 10 * time.Second,
+		// the client below has no certificate
+		InsecureAdmin: true,
+	})
+	require.NoError(t, err)
+	rpcAddr, err := agent.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(rpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	client := api.NewLogClient(conn)
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+
+	res, err := client.Drain(context.Background(), &api.DrainRequest{})
+	require.NoError(t, err)
+	require.True(t, res.Settled)
+	require.False(t, agent.Ready())
+	health := agent.Health()
+	require.False(t, health.Ready)
+	require.Equal(t, "drained", health.Stage)
+
+	// it's been unready since it drained, so it doesn't wait DrainDelay
+	start := time.Now()
+	require.NoError(t, agent.Shutdown())
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestAgentRedact(t *testing.T) {
+	addrs := freeAddrs(t, 2)
+	agent, err := New(Config{
+		NodeName:  "0",
+		Bootstrap: true,
+		BindAddr:  addrs[0],
+		RPCPort:   port(t, addrs[1]),
+		DataDir:   t.TempDir(),
+		KeyIndex:  true,
+		// the client below has no certificate
+		InsecureAdmin: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		agent.Shutdown()
+	})
+	rpcAddr, err := agent.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(rpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	client := api.NewLogClient(conn)
+	ctx := context.Background()
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Key: []byte("alice"), Value: []byte("hello alice")},
+	})
+	require.NoError(t, err)
+	_, err = client.GetByKey(ctx, &api.GetByKeyRequest{Key: []byte("alice")})
+	require.NoError(t, err)
+
+	res, err := client.Redact(ctx, &api.RedactRequest{StartKey: []byte("alice")})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, res.Offsets)
+	// the key index dropped the erased key
+	_, err = client.GetByKey(ctx, &api.GetByKeyRequest{Key: []byte("alice")})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAgentShutdownTimeout(t *testing.T) {
+	addrs := freeAddrs(t, 2)
+	agent, err := New(Config{
+		NodeName:        "0",
+		Bootstrap:       true,
+		BindAddr:        addrs[0],
+		RPCPort:         port(t, addrs[1]),
+		DataDir:         t.TempDir(),
+		ShutdownTimeout: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	rpcAddr, err := agent.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(rpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	// a stream waiting for records keeps the server from stopping gracefully
+	stream, err := api.NewLogClient(conn).ConsumeStream(
+		context.Background(),
+		&api.ConsumeRequest{Offset: 0},
+	)
+	require.NoError(t, err)
+	go func() {
+		for {
+			if _, err := stream.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	err = agent.Shutdown()
+	require.ErrorContains(t, err, "server: didn't stop within 200ms")
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestAgentReload(t *testing.T) {
+	tlsConfigs := func(dir string) (server, client *tls.Config) {
+		require.NoError(t, config.GenerateCerts(dir, []string{"127.0.0.1"}))
+		server, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile: filepath.Join(dir, "server.pem"),
+			KeyFile:  filepath.Join(dir, "server-key.pem"),
+			CAFile:   filepath.Join(dir, "ca.pem"),
+			Server:   true,
+		})
+		require.NoError(t, err)
+		client, err = config.SetupTLSConfig(config.TLSConfig{
+			CertFile: filepath.Join(dir, "client.pem"),
+			KeyFile:  filepath.Join(dir, "client-key.pem"),
+			CAFile:   filepath.Join(dir, "ca.pem"),
+		})
+		require.NoError(t, err)
+		return server, client
+	}
+	oldServer, oldClient := tlsConfigs(t.TempDir())
+	newServer, newClient := tlsConfigs(t.TempDir())
+
+	addrs := freeAddrs(t, 2)
+	agent, err := New(Config{
+		NodeName:        "0",
+		Bootstrap:       true,
+		BindAddr:        addrs[0],
+		RPCPort:         port(t, addrs[1]),
+		DataDir:         t.TempDir(),
+		ServerTLSConfig: oldServer,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		agent.Shutdown()
+	})
+	getOffsets := func(tlsConfig *tls.Config) error {
+		_, err := client(t, agent, tlsConfig).GetOffsets(
+			context.Background(),
+			&api.GetOffsetsRequest{},
+		)
+		return err
+	}
+	require.NoError(t, getOffsets(oldClient))
+
+	// new connections use the rotated certificates
+	require.NoError(t, agent.Reload(Config{
+		NodeName:        "0",
+		Bootstrap:       true,
+		BindAddr:        addrs[0],
+		RPCPort:         agent.RPCPort,
+		DataDir:         agent.DataDir,
+		ServerTLSConfig: newServer,
+	}))
+	require.NoError(t, getOffsets(newClient))
+	require.Error(t, getOffsets(oldClient))
+
+	// and the RPC listener's new filter
+	deny, err := netfilter.ParseRules(nil, []string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	require.NoError(t, agent.Reload(Config{
+		NodeName:        "0",
+		Bootstrap:       true,
+		BindAddr:        addrs[0],
+		RPCPort:         agent.RPCPort,
+		DataDir:         agent.DataDir,
+		ServerTLSConfig: newServer,
+		RPCFilter:       deny,
+	}))
+	require.Error(t, getOffsets(newClient))
+
+	require.Error(t, agent.Reload(Config{}))
+
+	var stats bytes.Buffer
+	require.NoError(t, agent.WriteStats(&stats))
+	require.Contains(t, stats.String(), "node 0, up ")
+	require.Contains(t, stats.String(), "segment 0: offsets [0, 0)")
+}
+
+func TestWritableCheck(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	c := &writableCheck{interval: time.Hour}
+	require.NoError(t, c.check(dir))
+
+	// the result's reported until the interval's up
+	require.NoError(t, os.Remove(dir))
+	require.NoError(t, c.check(dir))
+	c.interval = 0
+	require.Error(t, c.check(dir))
+}
+
+func TestLogConfig(t *testing.T) {
+	a := &Agent{Config: Config{
+		NodeName:              "0",
+		MinInSyncReplicas:     2,
+		CatchUpSegments:       4,
+		CatchUpBytesPerSecond: 1 << 20,
+		MaxLagTime:            time.Second,
+		AckTimeout:            2 * time.Second,
+		ReapAfter:             time.Minute,
+		RepairInterval:        time.Hour,
+		Logger:                zap.NewNop(),
+	}}
+	c := a.logConfig()
+	require.Equal(t, "0", c.Replication.LocalID)
+	require.Equal(t, 2, c.Replication.MinInSyncReplicas)
+	require.Equal(t, 4, c.Replication.CatchUpSegments)
+	require.Equal(t, 1<<20, c.Replication.CatchUpBytesPerSecond)
+	require.Equal(t, time.Second, c.Replication.MaxLagTime)
+	require.Equal(t, 2*time.Second, c.Replication.AckTimeout)
+	require.Equal(t, time.Minute, c.Replication.ReapAfter)
+	require.Equal(t, time.Hour, c.Replication.RepairInterval)
+}
+
+func TestRestartSettings(t *testing.T) {
+	onAppend := func(uint64, *api.Record) {}
+	logger := zap.NewNop()
+	old := Config{
+		DataDir:        "data",
+		StartJoinAddrs: []string{"127.0.0.1:8401"},
+		Logger:         logger,
+		Backup:         backup.Config{Interval: time.Minute},
+	}
+	old.LogHooks.OnAppend = onAppend
+
+	// the same settings, and the same hooks and logger, haven't changed
+	same := old
+	same.StartJoinAddrs = []string{"127.0.0.1:8401"}
+	require.Empty(t, restartSettings(old, same))
+
+	// the reloadable ones aren't reported
+	reloaded := same
+	reloaded.ServerTLSConfig = &tls.Config{}
+	reloaded.RPCFilter = netfilter.Rules{Deny: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	require.Empty(t, restartSettings(old, reloaded))
+
+	changed := same
+	changed.KeyIndex = true
+	changed.Backup.Interval = time.Hour
+	changed.StartJoinAddrs = append(changed.StartJoinAddrs, "127.0.0.1:8402")
+	changed.Logger = zap.NewNop()
+	changed.LogHooks.OnAppend = func(uint64, *api.Record) {}
+	require.ElementsMatch(
+		t,
+		[]string{"StartJoinAddrs", "KeyIndex", "Backup", "Logger", "LogHooks"},
+		restartSettings(old, changed),
+	)
+}
+
+func client(
+	t *testing.T,
+	agent *Agent,
+	tlsConfig *tls.Config,
+) api.LogClient {
+	t.Helper()
+
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(
+		rpcAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return api.NewLogClient(conn)
+}
+
+// returns n distinct local addresses nothing is listening on
+func freeAddrs(t *testing.T, n int) []string {
+	t.Helper()
+
+	var addrs []string
+	for i := 0; i < n; i++ {
+		// held open until all are picked so the same port isn't picked twice
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs
+}
+
+func port(t *testing.T, addr string) int {
+	t.Helper()
+
+	_, p, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(p)
+	require.NoError(t, err)
+	return port
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"proglog/internal/server"
+)
+
+// describes the node for /healthz?verbose=1 and the gRPC health service. the
+// replication fields are only set once the log's been recovered
+func (a *Agent) Health() server.Health {
+	h := server.Health{
+		Node:   a.NodeName,
+		Ready:  a.Ready(),
+		Uptime: time.Since(a.started),
+	}
+	h.Stage, _ = a.stage.Load().(string)
+	if h.Stage == "" && a.drain.Draining() {
+		h.Stage = "draining"
+		if a.drain.Drained() {
+			h.Stage = "drained"
+		}
+	}
+	if err := a.writable.check(a.DataDir); err != nil {
+		h.DataDirError = err.Error()
+	} else {
+		h.DataDirWritable = true
+	}
+	// the log's set while it's being recovered, the stage has to be checked first
+	if h.Stage == "log" || a.log == nil {
+		if total := a.segments.Load(); h.Stage == "log" && total > 0 {
+			h.Recovery = &server.Recovery{
+				SegmentsOpened: int(a.segmentsOpened.Load()),
+				Segments:       int(total),
+			}
+		}
+		return h
+	}
+	if synced := a.log.LastSync(); !synced.IsZero() {
+		h.LastSync = &synced
+	}
+	status, err := a.log.GetClusterStatus()
+	if err != nil {
+		return h
+	}
+	h.Leader = status.IsLeader
+	h.LeaderID = status.LeaderId
+	h.Epoch = status.Epoch
+	for _, node := range status.Nodes {
+		if status.IsLeader && status.LogEndOffset > node.LogEndOffset {
+			h.ReplicationLag = max(h.ReplicationLag, status.LogEndOffset-node.LogEndOffset)
+		}
+		if !status.IsLeader && node.IsLeader && node.LogEndOffset > status.LogEndOffset {
+			h.ReplicationLag = node.LogEndOffset - status.LogEndOffset
+		}
+	}
+	return h
+}
+
+// how long a data dir check's result is reported, so probes polling the
+// node's health don't sync a file each time
+const writableInterval = 5 * time.Second
+
+// caches checkWritable's result for its interval. concurrent checks wait for
+// the one that's running rather than syncing files of their own
+type writableCheck struct {
+	interval time.Duration
+	mu       sync.Mutex
+	checked  time.Time
+	err      error
+}
+
+func (c *writableCheck) check(dir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checked.IsZero() && time.Since(c.checked) < c.interval {
+		return c.err
+	}
+	c.err = checkWritable(dir)
+	c.checked = time.Now()
+	return c.err
+}
+
+// creates and syncs a file in dir, then removes it
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
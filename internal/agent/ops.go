@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// applies what it can of a changed config without restarting the node: the
+// server's TLS config and the peer's client certificate, for rotating
+// certificates, and the listeners' network filters. new connections use them,
+// open ones keep the old ones. the other settings only take effect after a
+// restart, the ones that changed are logged
+func (a *Agent) Reload(config Config) error {
+	if (config.ServerTLSConfig == nil) != (a.ServerTLSConfig == nil) ||
+		(config.PeerTLSConfig == nil) != (a.PeerTLSConfig == nil) {
+		return errors.New("agent: turning TLS on or off needs a restart")
+	}
+	if config.ServerTLSConfig != nil {
+		a.serverTLSConfig.Store(config.ServerTLSConfig)
+	}
+	if config.PeerTLSConfig != nil {
+		if len(config.PeerTLSConfig.Certificates) == 0 && config.PeerTLSConfig.GetClientCertificate == nil {
+			return errors.New("agent: the peer TLS config has no certificate")
+		}
+		a.peerTLSConfig.Store(config.PeerTLSConfig)
+	}
+	a.rpcFilter.Update(config.RPCFilter)
+	a.httpFilter.Update(config.HTTPFilter)
+	a.gossipFilter.Update(config.GossipFilter)
+
+	config.setDefaults()
+	// no logger's the node's, which may be the default one
+	if config.Logger == nil {
+		config.Logger = a.Logger
+	}
+	if changed := restartSettings(a.Config, config); len(changed) > 0 {
+		a.logger.Warn("settings changed, they take effect after a restart", zap.Strings("settings", changed))
+	}
+	return nil
+}
+
+// the settings Reload applies
+var reloadable = map[string]bool{
+	"ServerTLSConfig": true,
+	"PeerTLSConfig":   true,
+	"RPCFilter":       true,
+	"HTTPFilter":      true,
+	"GossipFilter":    true,
+}
+
+// returns the names of the settings that differ between the configs, other
+// than the ones Reload applies, so new settings are covered without listing them
+func restartSettings(old, new Config) []string {
+	o, n := reflect.ValueOf(old), reflect.ValueOf(new)
+	var changed []string
+	for i := 0; i < o.NumField(); i++ {
+		name := o.Type().Field(i).Name
+		if !reloadable[name] && !sameSetting(o.Field(i), n.Field(i)) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// like reflect.DeepEqual, except funcs, e.g. the hooks and interceptors, and
+// pointers, e.g. the loggers and registerers, are the same setting when
+// they're the same ones, rather than never and when what they point to is
+func sameSetting(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Func, reflect.Pointer, reflect.Map, reflect.Chan, reflect.UnsafePointer:
+		return a.Pointer() == b.Pointer()
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return a.Elem().Type() == b.Elem().Type() && sameSetting(a.Elem(), b.Elem())
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !sameSetting(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !sameSetting(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a.Equal(b)
+	}
+}
+
+// picks the server's TLS config per connection so Reload can swap it
+func (a *Agent) reloadableServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := a.serverTLSConfig.Load().Clone()
+			// gRPC's credentials only set ALPN on the config they're given
+			c.NextProtos = []string{"h2"}
+			return c, nil
+		},
+	}
+}
+
+// verifies the leader with the CA the node started with but presents the client
+// certificate Reload last set, or asks its config for one, e.g. one Vault issued
+func (a *Agent) reloadablePeerTLSConfig() *tls.Config {
+	c := a.PeerTLSConfig.Clone()
+	c.Certificates = nil
+	c.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		peer := a.peerTLSConfig.Load()
+		if peer.GetClientCertificate != nil {
+			return peer.GetClientCertificate(info)
+		}
+		return &peer.Certificates[0], nil
+	}
+	return c
+}
+
+// writes runtime stats and the log's segment layout, for a look inside a running
+// node without attaching a debugger
+func (a *Agent) WriteStats(w io.Writer) error {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(w, "node %s, up %s, ready %t\n", a.NodeName, time.Since(a.started).Round(time.Second), a.Ready())
+	fmt.Fprintf(
+		w,
+		"goroutines %d, heap %d bytes in use, %d GCs\n",
+		runtime.NumGoroutine(),
+		m.HeapInuse,
+		m.NumGC,
+	)
+	if a.log == nil {
+		return nil
+	}
+	lowest, end, err := a.log.GetOffsets()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "log offsets [%d, %d), leader %t\n", lowest, end, a.log.IsLeader())
+	for _, s := range a.log.Segments() {
+		active := ""
+		if s.Active {
+			active = " (active)"
+		}
+		fmt.Fprintf(
+			w,
+			"segment %d: offsets [%d, %d), store %d bytes, index %d bytes%s\n",
+			s.BaseOffset,
+			s.BaseOffset,
+			s.NextOffset,
+			s.StoreBytes,
+			s.IndexBytes,
+			active,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// manages API keys, for clients that can't easily use client certificates or
+// ID tokens
+
+// Keys are stored as a commit log of their latest versions, replayed into memory
+// when the store opens, so revoking a key appends it again marked revoked. Only a
+// hash of each key's secret is stored. Each node has its own keys.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// what a key may do
+const (
+	ScopeProduce = "produce"
+	ScopeConsume = "consume"
+	ScopeAdmin   = "admin"
+)
+
+var (
+	ErrNotFound = errors.New("apikey: no such key")
+	// deliberately vague so callers can't tell a revoked key from a wrong secret
+	ErrInvalid = errors.New("apikey: invalid key")
+)
+
+type Store struct {
+	mu   sync.Mutex
+	log  *log.Log
+	keys map[string]*api.StoredAPIKey
+}
+
+func New(dir string) (*Store, error) {
+	l, err := log.NewLog(dir, log.Config{})
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		log:  l,
+		keys: make(map[string]*api.StoredAPIKey),
+	}
+	lowest, end, err := l.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	for off := lowest; off < end; off++ {
+		record, err := l.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		stored := &api.StoredAPIKey{}
+		if err := proto.Unmarshal(record.Value, stored); err != nil {
+			return nil, fmt.Errorf("apikey: corrupt record at offset %d: %w", off, err)
+		}
+		s.keys[stored.Key.Id] = stored
+	}
+	return s, nil
+}
+
+// creates a key with the given scopes and returns it with the token clients
+// authenticate with, which isn't stored and can't be retrieved again
+func (s *Store) Create(name string, scopes []string) (*api.APIKey, string, error) {
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeProduce, ScopeConsume, ScopeAdmin:
+		default:
+			return nil, "", fmt.Errorf("apikey: unknown scope %q", scope)
+		}
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256([]byte(secret))
+	stored := &api.StoredAPIKey{
+		Key: &api.APIKey{
+			Id:      id,
+			Name:    name,
+			Scopes:  scopes,
+			Created: time.Now().UnixNano(),
+		},
+		SecretHash: hash[:],
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.put(stored); err != nil {
+		return nil, "", err
+	}
+	return stored.Key, id + "." + secret, nil
+}
+
+func (s *Store) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.keys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Key.Revoked {
+		return nil
+	}
+	revoked := proto.Clone(stored).(*api.StoredAPIKey)
+	revoked.Key.Revoked = true
+	return s.put(revoked)
+}
+
+// lists the keys, revoked ones included, oldest first
+func (s *Store) List() []*api.APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []*api.APIKey
+	for _, stored := range s.keys {
+		keys = append(keys, stored.Key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created < keys[j].Created
+	})
+	return keys
+}
+
+// returns the key a token belongs to unless it's revoked
+func (s *Store) Authenticate(token string) (*api.APIKey, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalid
+	}
+	s.mu.Lock()
+	stored, ok := s.keys[id]
+	s.mu.Unlock()
+	if !ok || stored.Key.Revoked {
+		return nil, ErrInvalid
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], stored.SecretHash) != 1 {
+		return nil, ErrInvalid
+	}
+	return stored.Key, nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+func (s *Store) put(stored *api.StoredAPIKey) error {
+	b, err := proto.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Append(&api.Record{Value: b}); err != nil {
+		return err
+	}
+	s.keys[stored.Key.Id] = stored
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
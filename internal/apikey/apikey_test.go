@@ -0,0 +1,49 @@
+package apikey
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir)
+	require.NoError(t, err)
+
+	key, token, err := s.Create("ingest", []string{ScopeProduce})
+	require.NoError(t, err)
+	require.Equal(t, "ingest", key.Name)
+	_, _, err = s.Create("bad", []string{"everything"})
+	require.Error(t, err)
+
+	got, err := s.Authenticate(token)
+	require.NoError(t, err)
+	require.Equal(t, key.Id, got.Id)
+	_, err = s.Authenticate(key.Id + ".wrong")
+	require.ErrorIs(t, err, ErrInvalid)
+	_, err = s.Authenticate("garbage")
+	require.ErrorIs(t, err, ErrInvalid)
+
+	other, otherToken, err := s.Create("dashboard", []string{ScopeConsume})
+	require.NoError(t, err)
+	require.NoError(t, s.Revoke(key.Id))
+	require.ErrorIs(t, s.Revoke("unknown"), ErrNotFound)
+	_, err = s.Authenticate(token)
+	require.ErrorIs(t, err, ErrInvalid)
+
+	// the keys and revocations survive a restart
+	require.NoError(t, s.Close())
+	s, err = New(dir)
+	require.NoError(t, err)
+	keys := s.List()
+	require.Len(t, keys, 2)
+	require.Equal(t, key.Id, keys[0].Id)
+	require.True(t, keys[0].Revoked)
+	require.Equal(t, other.Id, keys[1].Id)
+	_, err = s.Authenticate(token)
+	require.ErrorIs(t, err, ErrInvalid)
+	_, err = s.Authenticate(otherToken)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,124 @@
+// records security-relevant events: authentication failures, authorization
+// denials and admin actions, each with who did what, when and from where
+
+// Events go to an append-only commit log of their own, next to the node's data
+// log, and to zap's global logger, which the node replaces with its own.
+package audit
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+	plog "proglog/internal/log"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/proto"
+)
+
+type Log struct {
+	mu  sync.Mutex
+	log *plog.Log
+}
+
+func New(dir string) (*Log, error) {
+	l, err := plog.NewLog(dir, plog.Config{})
+	if err != nil {
+		return nil, err
+	}
+	return &Log{log: l}, nil
+}
+
+// stamps the event with the current time unless it has one, logs it and
+// appends it
+func (l *Log) Record(e *api.AuditEvent) error {
+	if e.Time == 0 {
+		e.Time = time.Now().UnixNano()
+	}
+	zap.L().Named("audit").Info(
+		"audit event",
+		zap.String("principal", e.Principal),
+		zap.String("addr", e.Addr),
+		zap.String("action", e.Action),
+		zap.String("resource", e.Resource),
+		zap.Bool("allowed", e.Allowed),
+		zap.String("error", e.Error),
+	)
+	b, err := proto.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.log.Append(&api.Record{Value: b})
+	return err
+}
+
+// returns up to n of the most recent events, oldest first
+func (l *Log) Recent(n int) ([]*api.AuditEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lowest, end, err := l.log.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	from := lowest
+	if end-lowest > uint64(n) {
+		from = end - uint64(n)
+	}
+	var events []*api.AuditEvent
+	for off := from; off < end; off++ {
+		record, err := l.log.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		e := &api.AuditEvent{}
+		if err := proto.Unmarshal(record.Value, e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.log.Close()
+}
+
+// the part of a Log the server's credentials need
+type Recorder interface {
+	Record(*api.AuditEvent) error
+}
+
+// wraps server credentials so failed handshakes, e.g. with a certificate the CA
+// didn't sign, are recorded as authentication failures
+func Credentials(creds credentials.TransportCredentials, r Recorder) credentials.TransportCredentials {
+	return &auditedCredentials{TransportCredentials: creds, recorder: r}
+}
+
+type auditedCredentials struct {
+	credentials.TransportCredentials
+	recorder Recorder
+}
+
+func (c *auditedCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := c.TransportCredentials.ServerHandshake(rawConn)
+	if err != nil {
+		if rerr := c.recorder.Record(&api.AuditEvent{
+			Addr:   rawConn.RemoteAddr().String(),
+			Action: "authenticate",
+			Error:  err.Error(),
+		}); rerr != nil {
+			zap.L().Named("audit").Error("recording a failed handshake", zap.Error(rerr))
+		}
+	}
+	return conn, info, err
+}
+
+func (c *auditedCredentials) Clone() credentials.TransportCredentials {
+	return Credentials(c.TransportCredentials.Clone(), c.recorder)
+}
@@ -0,0 +1,95 @@
+package audit
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+	"proglog/internal/config"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := New(dir)
+	require.NoError(t, err)
+	for _, action := range []string{"first", "second", "third"} {
+		require.NoError(t, l.Record(&api.AuditEvent{Action: action, Allowed: true}))
+	}
+
+	events, err := l.Recent(2)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "second", events[0].Action)
+	require.Equal(t, "third", events[1].Action)
+	require.NotZero(t, events[1].Time)
+
+	// the events survive a restart
+	require.NoError(t, l.Close())
+	l, err = New(dir)
+	require.NoError(t, err)
+	events, err = l.Recent(10)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	require.NoError(t, l.Close())
+}
+
+func TestCredentials(t *testing.T) {
+	serverDir, otherDir := t.TempDir(), t.TempDir()
+	require.NoError(t, config.GenerateCerts(serverDir, []string{"127.0.0.1"}))
+	require.NoError(t, config.GenerateCerts(otherDir, []string{"127.0.0.1"}))
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: filepath.Join(serverDir, "server.pem"),
+		KeyFile:  filepath.Join(serverDir, "server-key.pem"),
+		CAFile:   filepath.Join(serverDir, "ca.pem"),
+		Server:   true,
+	})
+	require.NoError(t, err)
+	// trusts the server but has a certificate from another CA
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: filepath.Join(otherDir, "client.pem"),
+		KeyFile:  filepath.Join(otherDir, "client-key.pem"),
+		CAFile:   filepath.Join(serverDir, "ca.pem"),
+	})
+	require.NoError(t, err)
+
+	l, err := New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		l.Close()
+	})
+	creds := Credentials(credentials.NewTLS(serverTLSConfig), l)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		creds.ServerHandshake(conn)
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientTLSConfig)
+	if err == nil {
+		// TLS 1.3 clients only learn of the rejection on their first read
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	<-done
+
+	events, err := l.Recent(1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "authenticate", events[0].Action)
+	require.False(t, events[0].Allowed)
+	require.NotEmpty(t, events[0].Error)
+	require.NotEmpty(t, events[0].Addr)
+}
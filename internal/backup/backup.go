@@ -0,0 +1,454 @@
+// backs up the leader's sealed, committed segments to S3, or a store compatible
+// with it (GCS through its interoperability API...), and restores a node's log
+// from them, so recovering from a disaster doesn't depend on copying the files
+// of a node that's running
+//
+// A backup's objects are named under its prefix:
+//
+//	<prefix>segments/<base offset>-<next offset>.store
+//	<prefix>manifest.json
+//
+// with the offsets zero-padded so the names sort in the log's order. Each
+// segment object holds a store's records, the index is rebuilt from them when
+// they're restored. Sealed segments only change when records are redacted,
+// so a backup only uploads the ones after the manifest's last, then writes the
+// manifest listing them all again, with the offsets the REDACT records it
+// uploaded list. A restore erases those records again, as the objects uploaded
+// before the redaction still hold them. A full backup uploads every sealed
+// segment the leader holds and lists only those. The manifest's written once its segments are, so a backup that
+// fails leaves the last one whole. The records of the active segment are backed
+// up once it's sealed.
+//
+// A restore can stop at a point in time, an offset or the time a record was
+// appended, for recovering from bad data: the segment holding the point is cut
+// before its first record past it, and the segments after it are skipped.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+	"proglog/internal/s3"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+const manifestName = "manifest.json"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// the leader's sealed segments, see the ReplicatedLog's catch-up. Remote reads
+// them from a node over its RPCs
+type Source interface {
+	// the sealed segments whose records are all committed, holding offset or
+	// after it
+	SealedSegments(offset uint64) ([]*api.Segment, error)
+	// calls fn with the bytes of the sealed segment holding offset, from its
+	// record on, and returns their CRC-32 (Castagnoli)
+	ReadSegment(ctx context.Context, offset uint64, fn func(chunk []byte) error) (uint32, error)
+}
+
+type Config struct {
+	// the bucket the objects are written to, and what their names start with,
+	// e.g. "proglog/"
+	S3     s3.Config
+	Prefix string
+	// how often the leader's backed up, zero only backs up when Run's called
+	Interval time.Duration
+	// nothing's logged when nil
+	Logger *zap.Logger
+	// registers the backup's metrics when set
+	Registerer prometheus.Registerer
+}
+
+// what a backup holds, the segments in the log's order
+type Manifest struct {
+	// when the backup that wrote it finished
+	Time     time.Time `json:"time"`
+	Segments []Segment `json:"segments"`
+	// the offsets of the records the segments' REDACT records erase, a restore
+	// erases them even when it stops before the REDACT record
+	Redacted []uint64 `json:"redacted,omitempty"`
+}
+
+type Segment struct {
+	Key        string `json:"key"`
+	BaseOffset uint64 `json:"base_offset"`
+	// one past the segment's last record
+	NextOffset uint64 `json:"next_offset"`
+	Bytes      uint64 `json:"bytes"`
+	// the object's CRC-32 (Castagnoli)
+	Checksum uint32 `json:"checksum"`
+}
+
+// one past the last record the manifest's segments hold
+func (m *Manifest) End() uint64 {
+	if len(m.Segments) == 0 {
+		return 0
+	}
+	return m.Segments[len(m.Segments)-1].NextOffset
+}
+
+type Backup struct {
+	Config
+	source Source
+	bucket *s3.Client
+
+	// one backup runs at a time
+	mu sync.Mutex
+
+	segments    prometheus.Counter
+	bytes       prometheus.Counter
+	lastSuccess prometheus.Gauge
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// backs the source up every Interval, when it's set, until it's closed
+func New(source Source, config Config) (*Backup, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	b := &Backup{
+		Config: config,
+		source: source,
+		segments: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "backup",
+			Name:      "segments_total",
+			Help:      "Segments uploaded to the bucket.",
+		}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "backup",
+			Name:      "bytes_total",
+			Help:      "Bytes of segments uploaded to the bucket.",
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Subsystem: "backup",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "When the last backup finished, 0 before one has.",
+		}),
+	}
+	var err error
+	if b.bucket, err = s3.New(b.S3); err != nil {
+		return nil, err
+	}
+	if b.Registerer != nil {
+		for _, c := range []prometheus.Collector{b.segments, b.bytes, b.lastSuccess} {
+			if err := b.Registerer.Register(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	if b.Interval > 0 {
+		b.wg.Add(1)
+		go b.schedule(ctx)
+	}
+	return b, nil
+}
+
+// stops the scheduled backups, waiting for the one running to stop
+func (b *Backup) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	if b.Registerer != nil {
+		b.Registerer.Unregister(b.segments)
+		b.Registerer.Unregister(b.bytes)
+		b.Registerer.Unregister(b.lastSuccess)
+	}
+	return nil
+}
+
+// backs up every Interval. only the leader has segments to back up, so every
+// node runs the schedule and the followers' backups are skipped
+func (b *Backup) schedule(ctx context.Context) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m, err := b.Run(ctx, false)
+		if errors.As(err, &api.ErrNotLeader{}) || ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			b.Logger.Error("backing up", zap.Error(err))
+			continue
+		}
+		b.Logger.Debug("backed up", zap.Uint64("end", m.End()), zap.Int("segments", len(m.Segments)))
+	}
+}
+
+// uploads the sealed segments after the last backup's, or all of them when
+// full's set, and returns the manifest it wrote
+func (b *Backup) Run(ctx context.Context, full bool) (*Manifest, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := &Manifest{}
+	if !full {
+		var err error
+		if m, err = ReadManifest(ctx, b.bucket, b.Prefix); err != nil {
+			return nil, err
+		}
+	}
+	from := m.End()
+	segments, err := b.source.SealedSegments(from)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		// the first may start before the last backup's end when the segments
+		// were laid out by an earlier leader
+		base := max(from, seg.BaseOffset)
+		if base >= seg.NextOffset {
+			continue
+		}
+		uploaded, redacted, err := b.upload(ctx, base, seg.NextOffset)
+		if err != nil {
+			return nil, err
+		}
+		m.Segments = append(m.Segments, uploaded)
+		m.Redacted = append(m.Redacted, redacted...)
+	}
+	m.Time = time.Now().UTC()
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := b.bucket.Put(ctx, b.Prefix+manifestName, body); err != nil {
+		return nil, err
+	}
+	b.lastSuccess.Set(float64(m.Time.Unix()))
+	return m, nil
+}
+
+// uploads the records of the segment from base to next, and returns the
+// offsets its REDACT records list
+func (b *Backup) upload(ctx context.Context, base, next uint64) (Segment, []uint64, error) {
+	var buf bytes.Buffer
+	checksum, err := b.source.ReadSegment(ctx, base, func(chunk []byte) error {
+		_, err := buf.Write(chunk)
+		return err
+	})
+	if err != nil {
+		return Segment{}, nil, err
+	}
+	var redacted []uint64
+	err = log.ScanStoreReader(bytes.NewReader(buf.Bytes()), func(e log.StoreEntry) error {
+		if e.Err != nil {
+			return e.Err
+		}
+		offsets, err := redaction(e.Record)
+		redacted = append(redacted, offsets...)
+		return err
+	})
+	if err != nil {
+		return Segment{}, nil, fmt.Errorf("backup: segment %d: %w", base, err)
+	}
+	seg := Segment{
+		Key:        fmt.Sprintf("segments/%020d-%020d.store", base, next),
+		BaseOffset: base,
+		NextOffset: next,
+		Bytes:      uint64(buf.Len()),
+		Checksum:   checksum,
+	}
+	if err := b.bucket.Put(ctx, b.Prefix+seg.Key, buf.Bytes()); err != nil {
+		return Segment{}, nil, err
+	}
+	b.segments.Inc()
+	b.bytes.Add(float64(seg.Bytes))
+	return seg, redacted, nil
+}
+
+// the offsets the record lists when it's a REDACT record
+func redaction(record *api.Record) ([]uint64, error) {
+	if record.Control != api.Record_REDACT {
+		return nil, nil
+	}
+	redaction := &api.Redaction{}
+	if err := proto.Unmarshal(record.Value, redaction); err != nil {
+		return nil, err
+	}
+	return redaction.Offsets, nil
+}
+
+// reads the manifest of the backup under prefix, an empty one when there's none
+func ReadManifest(ctx context.Context, bucket *s3.Client, prefix string) (*Manifest, error) {
+	body, err := bucket.Get(ctx, prefix+manifestName)
+	if s3.IsNotFound(err) {
+		return &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(body, m); err != nil {
+		return nil, fmt.Errorf("backup: %s%s: %w", prefix, manifestName, err)
+	}
+	return m, nil
+}
+
+// where a point-in-time restore stops, the zero value restores every record
+type PointInTime struct {
+	// restores the records before the offset, when it's set
+	Offset uint64
+	// restores the records appended at or before the time, when it's set.
+	// records the log didn't stamp with a time are older than any
+	Time time.Time
+}
+
+// whether the record's past the point
+func (p PointInTime) after(record *api.Record) bool {
+	if p.Offset != 0 && record.Offset >= p.Offset {
+		return true
+	}
+	return !p.Time.IsZero() && record.Timestamp != 0 && time.Unix(0, record.Timestamp).After(p.Time)
+}
+
+// downloads the backup under prefix into the log in dir, which has to be empty,
+// checking each segment against its checksum. the records past the point
+// aren't restored, so a log can be recovered from bad data appended after it.
+// the records redacted since they were uploaded are erased again. it returns
+// the manifest of what was restored
+func Restore(ctx context.Context, bucket *s3.Client, prefix, dir string, c log.Config, at PointInTime) (*Manifest, error) {
+	m, err := ReadManifest(ctx, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Segments) == 0 {
+		return nil, fmt.Errorf("backup: there's no backup under %q", prefix)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("backup: %s isn't empty", dir)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	l, err := log.NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	// a failed restore leaves nothing behind, so it can be run again
+	restored, err := install(ctx, bucket, prefix, tmp, l, m, at)
+	if err == nil && len(restored.Segments) == 0 {
+		err = fmt.Errorf("backup: the backup under %q has no records before the point", prefix)
+	}
+	if err != nil {
+		l.Remove()
+		return nil, err
+	}
+	return restored, l.Close()
+}
+
+// stops scanning a store at the first record past the point
+var errPastPoint = errors.New("past the point")
+
+// installs the manifest's segments in the log, downloading each to tmp first,
+// up to the point
+func install(ctx context.Context, bucket *s3.Client, prefix, tmp string, l *log.Log, m *Manifest, at PointInTime) (*Manifest, error) {
+	restored := &Manifest{Time: m.Time}
+	// backups written before manifests listed them hold the REDACT records only
+	redacted := slices.Clone(m.Redacted)
+	for _, seg := range m.Segments {
+		if at.Offset != 0 && seg.BaseOffset >= at.Offset {
+			break
+		}
+		body, err := bucket.Get(ctx, prefix+seg.Key)
+		if err != nil {
+			return nil, err
+		}
+		if sum := crc32.Checksum(body, crcTable); sum != seg.Checksum || uint64(len(body)) != seg.Bytes {
+			return nil, fmt.Errorf("backup: %s doesn't match its checksum", seg.Key)
+		}
+		path := filepath.Join(tmp, fmt.Sprintf("%d.store", seg.BaseOffset))
+		if err := os.WriteFile(path, body, 0644); err != nil {
+			return nil, err
+		}
+		// the records are in the order they were appended, so the segment
+		// holding the point's the last restored
+		var pos uint64
+		next := seg.BaseOffset
+		err = log.ScanStore(path, func(e log.StoreEntry) error {
+			if e.Err != nil {
+				return e.Err
+			}
+			if at.after(e.Record) {
+				// the store's cut where the record starts
+				pos = e.Pos
+				return errPastPoint
+			}
+			next = e.Record.Offset + 1
+			offsets, err := redaction(e.Record)
+			redacted = append(redacted, offsets...)
+			return err
+		})
+		past := errors.Is(err, errPastPoint)
+		if err != nil && !past {
+			return nil, fmt.Errorf("backup: %s: %w", seg.Key, err)
+		}
+		if next == seg.BaseOffset {
+			break
+		}
+		if past {
+			if err := os.Truncate(path, int64(pos)); err != nil {
+				return nil, err
+			}
+			seg.NextOffset = next
+			seg.Bytes = pos
+			seg.Checksum = crc32.Checksum(body[:pos], crcTable)
+		}
+		if _, err := l.InstallSegment(seg.BaseOffset, path); err != nil {
+			return nil, fmt.Errorf("backup: %s: %w", seg.Key, err)
+		}
+		restored.Segments = append(restored.Segments, seg)
+		if past {
+			break
+		}
+	}
+	// the manifest lists the restored REDACT records' too
+	slices.Sort(redacted)
+	for _, off := range slices.Compact(redacted) {
+		// the restore may have stopped before it
+		if off >= restored.End() {
+			continue
+		}
+		if _, err := l.Redact(off); err != nil {
+			return nil, err
+		}
+		restored.Redacted = append(restored.Redacted, off)
+	}
+	return restored, nil
+}
@@ -0,0 +1,299 @@
+package backup
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+	"proglog/internal/s3"
+	"proglog/internal/s3/s3test"
+	"proglog/internal/server"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestBackup(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, leader *log.ReplicatedLog, config Config, bucket *s3test.Server){
+		"backups upload the new segments":   testIncremental,
+		"full backups upload every segment": testFull,
+		"backups restore the log":           testRestore,
+		"corrupt segments aren't restored":  testRestoreCorrupt,
+		"restores stop at a point in time":  testPointInTime,
+		"restores keep redactions":          testRestoreRedacted,
+		"failed backups keep the last one":  testFailedUpload,
+		"backups run on a schedule":         testSchedule,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			bucket := s3test.NewServer(t, "bucket")
+			config := Config{
+				S3: s3.Config{
+					Endpoint:        bucket.URL,
+					Bucket:          "bucket",
+					AccessKeyID:     "id",
+					SecretAccessKey: "secret",
+					PathStyle:       true,
+				},
+				Prefix:     "proglog/",
+				Registerer: prometheus.NewRegistry(),
+			}
+			fn(t, setupLeader(t), config, bucket)
+		})
+	}
+}
+
+func testIncremental(t *testing.T, leader *log.ReplicatedLog, config Config, bucket *s3test.Server) {
+	b := setupBackup(t, leader, config)
+	appendRecords(t, leader, 3)
+	m, err := b.Run(context.Background(), false)
+	require.NoError(t, err)
+	// the active segment's left for the next backup
+	require.Len(t, m.Segments, 1)
+	require.Equal(t, uint64(2), m.End())
+	require.Len(t, bucket.Objects(), 2)
+
+	appendRecords(t, leader, 2)
+	m, err = b.Run(context.Background(), false)
+	require.NoError(t, err)
+	require.Len(t, m.Segments, 2)
+	require.Equal(t, uint64(4), m.End())
+	require.Equal(t, "segments/00000000000000000002-00000000000000000004.store", m.Segments[1].Key)
+	require.Len(t, bucket.Objects(), 3)
+}
+
+func testFull(t *testing.T, leader *log.ReplicatedLog, config Config, bucket *s3test.Server) {
+	b := setupBackup(t, leader, config)
+	appendRecords(t, leader, 5)
+	require.NoError(t, b.bucket.Put(context.Background(), config.Prefix+manifestName, []byte("lost")))
+	_, err := b.Run(context.Background(), false)
+	require.Error(t, err)
+
+	// a full backup doesn't need the last one's manifest
+	m, err := b.Run(context.Background(), true)
+	require.NoError(t, err)
+	require.Len(t, m.Segments, 2)
+	require.Equal(t, uint64(4), m.End())
+}
+
+func testRestore(t *testing.T, leader *log.ReplicatedLog, config Config, bucket *s3test.Server) {
+	// backed up from outside the node, over its RPCs
+	b, err := New(Remote{Client: serve(t, leader)}, config)
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+	appendRecords(t, leader, 5)
+	_, err = b.Run(context.Background(), false)
+	require.NoError(t, err)
+
+	dir := filepath.Join(t.TempDir(), "log")
+	m, err := Restore(context.Background(), b.bucket, config.Prefix, dir, segmentConfig(), PointInTime{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), m.End())
+	l, err := log.NewLog(dir, segmentConfig())
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	for off := uint64(0); off < 4; off++ {
+		want, err := leader.Read(off)
+		require.NoError(t, err)
+		got, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+	require.Equal(t, uint64(4), l.NextOffset())
+
+	// the log restored into has to be empty
+	_, err = Restore(context.Background(), b.bucket, config.Prefix, dir, segmentConfig(), PointInTime{})
+	require.Error(t, err)
+}
+
+func testRestoreCorrupt(t *testing.T, leader *log.ReplicatedLog, config Config, bucket *s3test.Server) {
+	b := setupBackup(t, leader, config)
+	appendRecords(t, leader, 2)
+	m, err := b.Run(context.Background(), false)
+	require.NoError(t, err)
+	body := bucket.Objects()[config.Prefix+m.Segments[0].Key]
+	body[len(body)-1] ^= 0xff
+	require.NoError(t, b.bucket.Put(context.Background(), config.Prefix+m.Segments[0].Key, body))
+
+	_, err = Restore(context.Background(), b.bucket, config.Prefix, t.TempDir(), segmentConfig(), PointInTime{})
+	require.ErrorContains(t, err, "checksum")
+}
+
+func testPointInTime(t *testing.T, leader *log.ReplicatedLog, config Config, bucket *s3test.Server) {
+	b := setupBackup(t, leader, config)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		_, err := leader.Append(&api.Record{
+			Value:     []byte{byte(i)},
+			Timestamp: start.Add(time.Duration(i) * time.Minute).UnixNano(),
+		})
+		require.NoError(t, err)
+	}
+	_, err := b.Run(context.Background(), false)
+	require.NoError(t, err)
+
+	restore := func(at PointInTime) (*Manifest, *log.Log) {
+		dir := filepath.Join(t.TempDir(), "log")
+		m, err := Restore(context.Background(), b.bucket, config.Prefix, dir, segmentConfig(), at)
+		require.NoError(t, err)
+		l, err := log.NewLog(dir, segmentConfig())
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		return m, l
+	}
+
+	// the point's in the middle of the second segment
+	m, l := restore(PointInTime{Time: start.Add(2 * time.Minute)})
+	require.Equal(t, uint64(3), m.End())
+	require.Equal(t, uint64(3), l.NextOffset())
+	record, err := l.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, record.Value)
+
+	// the point's at a segment's start
+	m, l = restore(PointInTime{Offset: 4})
+	require.Len(t, m.Segments, 2)
+	require.Equal(t, uint64(4), l.NextOffset())
+
+	// the earlier of the two applies
+	_, l = restore(PointInTime{Offset: 5, Time: start})
+	require.Equal(t, uint64(1), l.NextOffset())
+
+	dir := filepath.Join(t.TempDir(), "log")
+	_, err = Restore(context.Background(), b.bucket, config.Prefix, dir, segmentConfig(), PointInTime{Time: start.Add(-time.Minute)})
+	require.Error(t, err)
+	// and it can be run again
+	_, err = Restore(context.Background(), b.bucket, config.Prefix, dir, segmentConfig(), PointInTime{})
+	require.NoError(t, err)
+}
+
+func testRestoreRedacted(t *testing.T, leader *log.ReplicatedLog, config Config, bucket *s3test.Server) {
+	b := setupBackup(t, leader, config)
+	appendRecords(t, leader, 3)
+	_, err := b.Run(context.Background(), false)
+	require.NoError(t, err)
+
+	// the uploaded segment still holds the record, its REDACT record's in the
+	// next one
+	res, err := leader.Redact(&api.RedactRequest{StartOffset: 0, EndOffset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Offset)
+	m, err := b.Run(context.Background(), false)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), m.End())
+	require.Equal(t, []uint64{0}, m.Redacted)
+
+	// even when the restore stops before the REDACT record
+	for _, at := range []PointInTime{{}, {Offset: 2}} {
+		dir := filepath.Join(t.TempDir(), "log")
+		m, err := Restore(context.Background(), b.bucket, config.Prefix, dir, segmentConfig(), at)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{0}, m.Redacted)
+		l, err := log.NewLog(dir, segmentConfig())
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		record, err := l.Read(0)
+		require.NoError(t, err)
+		require.Empty(t, record.Value)
+		require.NotZero(t, record.Redacted)
+		record, err = l.Read(1)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+}
+
+func testFailedUpload(t *testing.T, leader *log.ReplicatedLog, config Config, bucket *s3test.Server) {
+	b := setupBackup(t, leader, config)
+	appendRecords(t, leader, 2)
+	_, err := b.Run(context.Background(), false)
+	require.NoError(t, err)
+
+	appendRecords(t, leader, 2)
+	bucket.FailNext(http.StatusInternalServerError)
+	_, err = b.Run(context.Background(), false)
+	require.Error(t, err)
+	m, err := ReadManifest(context.Background(), b.bucket, config.Prefix)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), m.End())
+
+	m, err = b.Run(context.Background(), false)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), m.End())
+}
+
+func testSchedule(t *testing.T, leader *log.ReplicatedLog, config Config, bucket *s3test.Server) {
+	appendRecords(t, leader, 3)
+	config.Interval = 20 * time.Millisecond
+	setupBackup(t, leader, config)
+	require.Eventually(t, func() bool {
+		m, err := ReadManifest(context.Background(), s3Client(t, config), config.Prefix)
+		return err == nil && m.End() == 2
+	}, 3*time.Second, 20*time.Millisecond)
+}
+
+// two records per segment
+func segmentConfig() log.Config {
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 24
+	return c
+}
+
+func setupLeader(t *testing.T) *log.ReplicatedLog {
+	t.Helper()
+	leader, err := log.NewReplicatedLog(t.TempDir(), segmentConfig())
+	require.NoError(t, err)
+	t.Cleanup(func() { leader.Close() })
+	return leader
+}
+
+func setupBackup(t *testing.T, source Source, config Config) *Backup {
+	t.Helper()
+	b, err := New(source, config)
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func s3Client(t *testing.T, config Config) *s3.Client {
+	t.Helper()
+	c, err := s3.New(config.S3)
+	require.NoError(t, err)
+	return c
+}
+
+func appendRecords(t *testing.T, leader *log.ReplicatedLog, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+}
+
+func serve(t *testing.T, leader *log.ReplicatedLog) api.LogClient {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := server.NewGPRCServer(&server.Config{
+		CommitLog:      leader,
+		SegmentFetcher: leader,
+		InsecureAdmin:  true,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	cc, err := grpc.NewClient(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		cc.Close()
+		srv.Stop()
+	})
+	return api.NewLogClient(cc)
+}
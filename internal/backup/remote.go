@@ -0,0 +1,43 @@
+package backup
+
+import (
+	"context"
+	"io"
+
+	api "proglog/api/v1"
+)
+
+// reads the leader's sealed segments over its ListSealedSegments and
+// FetchSegment RPCs, for backing up a node from outside it
+type Remote struct {
+	Client api.LogClient
+}
+
+func (r Remote) SealedSegments(offset uint64) ([]*api.Segment, error) {
+	res, err := r.Client.ListSealedSegments(context.Background(), &api.ListSealedSegmentsRequest{Offset: offset})
+	if err != nil {
+		return nil, err
+	}
+	return res.Segments, nil
+}
+
+func (r Remote) ReadSegment(ctx context.Context, offset uint64, fn func(chunk []byte) error) (uint32, error) {
+	stream, err := r.Client.FetchSegment(ctx, &api.FetchSegmentRequest{Offset: offset})
+	if err != nil {
+		return 0, err
+	}
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		if res.Last {
+			return res.Checksum, nil
+		}
+		if err := fn(res.Chunk); err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// registers the gRPC compressors proglog's nodes and clients share: gzip,
+// snappy and zstd. importing the package is enough, a client compresses its
+// requests with grpc.UseCompressor and a node answers with the compressor the
+// request came with. gRPC advertises the registered names in the
+// grpc-accept-encoding header, so a node that doesn't know one fails the
+// call with Unimplemented
+package compression
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+const (
+	Gzip   = gzip.Name
+	Snappy = "snappy"
+	Zstd   = "zstd"
+)
+
+// the compressors that can be asked for by name
+var Names = []string{Gzip, Snappy, Zstd}
+
+// the most a zstd message can decompress to, so a small message can't make a
+// node allocate without bound
+const maxDecodedSize = 64 << 20
+
+func init() {
+	encoding.RegisterCompressor(snappyCompressor{})
+	encoding.RegisterCompressor(&zstdCompressor{})
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string {
+	return Snappy
+}
+
+func (snappyCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (snappyCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+// compresses and decompresses whole messages, with an encoder and decoder
+// that are safe to share and made the first time they're needed
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (z *zstdCompressor) Name() string {
+	return Zstd
+}
+
+func (z *zstdCompressor) init() error {
+	z.once.Do(func() {
+		z.encoder, z.err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if z.err != nil {
+			return
+		}
+		z.decoder, z.err = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(maxDecodedSize),
+		)
+	})
+	return z.err
+}
+
+func (z *zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return &zstdWriter{z: z, w: w}, nil
+}
+
+func (z *zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	compressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err := z.decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// buffers the message and writes it compressed when it's closed
+type zstdWriter struct {
+	z   *zstdCompressor
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (w *zstdWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *zstdWriter) Close() error {
+	_, err := w.w.Write(w.z.encoder.EncodeAll(w.buf.Bytes(), nil))
+	return err
+}
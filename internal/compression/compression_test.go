@@ -0,0 +1,34 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/encoding"
+)
+
+func TestCompressors(t *testing.T) {
+	message := bytes.Repeat([]byte("hello world "), 1000)
+	for _, name := range Names {
+		t.Run(name, func(t *testing.T) {
+			c := encoding.GetCompressor(name)
+			require.NotNil(t, c)
+
+			var compressed bytes.Buffer
+			w, err := c.Compress(&compressed)
+			require.NoError(t, err)
+			_, err = w.Write(message)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			require.Less(t, compressed.Len(), len(message))
+
+			r, err := c.Decompress(&compressed)
+			require.NoError(t, err)
+			b, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, message, b)
+		})
+	}
+}
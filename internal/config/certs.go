@@ -0,0 +1,180 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// generates a CA and a server and client certificate signed by it into dir, named
+// like the files `make gencert` creates. the server certificate is valid for hosts
+func GenerateCerts(dir string, hosts []string) error {
+	ca, caKey, err := generateCert(
+		pkix.Name{CommonName: "proglog CA"},
+		nil,
+		nil,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	if err := writeCert(dir, "ca", ca, caKey); err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		name  string
+		hosts []string
+		usage x509.ExtKeyUsage
+	}{
+		{"server", hosts, x509.ExtKeyUsageServerAuth},
+		{"client", nil, x509.ExtKeyUsageClientAuth},
+	} {
+		cert, key, err := generateCert(
+			pkix.Name{CommonName: c.name},
+			c.hosts,
+			&issuer{cert: ca, key: caKey},
+			[]x509.ExtKeyUsage{c.usage},
+		)
+		if err != nil {
+			return err
+		}
+		if err := writeCert(dir, c.name, cert, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generates another client certificate, name.pem and name-key.pem, signed by the
+// CA GenerateCerts put in dir, e.g. one per user the server tells apart
+func GenerateClientCert(dir, name string) error {
+	ca, err := readIssuer(dir, "ca")
+	if err != nil {
+		return err
+	}
+	cert, key, err := generateCert(
+		pkix.Name{CommonName: name},
+		nil,
+		ca,
+		[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	)
+	if err != nil {
+		return err
+	}
+	return writeCert(dir, name, cert, key)
+}
+
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// self-signs a CA certificate when there's no issuer
+func generateCert(
+	name pkix.Name,
+	hosts []string,
+	parent *issuer,
+	usage []x509.ExtKeyUsage,
+) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      name,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(8760 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  usage,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	signer := &issuer{cert: tmpl, key: key}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader,
+		tmpl,
+		signer.cert,
+		&key.PublicKey,
+		signer.key,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// reads name.pem and name-key.pem as writeCert wrote them
+func readIssuer(dir, name string) (*issuer, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, name+".pem"))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, name+"-key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("%s.pem or %s-key.pem in %s isn't PEM encoded", name, name, dir)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &issuer{cert: cert, key: key}, nil
+}
+
+// writes name.pem and name-key.pem
+func writeCert(dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(
+		filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		0644,
+	); err != nil {
+		return err
+	}
+	return os.WriteFile(
+		filepath.Join(dir, name+"-key.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+		0600,
+	)
+}
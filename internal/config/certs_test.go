@@ -0,0 +1,60 @@
+package config
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateCerts(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, GenerateCerts(dir, []string{"127.0.0.1", "localhost"}))
+
+	serverTLSConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, GenerateClientCert(dir, "root"))
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig)
+	require.NoError(t, err)
+	defer l.Close()
+	clients := make(chan string)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if tlsConn.Handshake() == nil {
+				clients <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			conn.Close()
+		}
+	}()
+
+	// both sides verify each other's certificate against the CA
+	for _, name := range []string{"client", "root"} {
+		clientTLSConfig, err := SetupTLSConfig(TLSConfig{
+			CertFile:      filepath.Join(dir, name+".pem"),
+			KeyFile:       filepath.Join(dir, name+"-key.pem"),
+			CAFile:        filepath.Join(dir, "ca.pem"),
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		conn, err := tls.Dial("tcp", l.Addr().String(), clientTLSConfig)
+		require.NoError(t, err)
+		require.NoError(t, conn.Handshake())
+		require.Equal(t, "server", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+		require.Equal(t, name, <-clients)
+		conn.Close()
+	}
+
+	require.Error(t, GenerateClientCert(t.TempDir(), "root"))
+}
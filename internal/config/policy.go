@@ -0,0 +1,55 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// parses a TLS version as configs spell it, e.g. 1.2
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, want 1.0, 1.1, 1.2 or 1.3", s)
+}
+
+// parses cipher suites by their IANA names, e.g.
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. suites Go considers insecure are
+// refused. TLS 1.3's suites aren't configurable
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	byName := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parses how a server treats client certificates: none doesn't ask for one,
+// request asks but accepts clients without one, e.g. to authenticate them with
+// API keys instead, and require-and-verify needs one the CA signed
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require-and-verify":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return 0, fmt.Errorf("unknown client auth mode %q, want none, request or require-and-verify", s)
+}
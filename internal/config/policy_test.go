@@ -0,0 +1,41 @@
+package config
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicy(t *testing.T) {
+	version, err := ParseTLSVersion("1.3")
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), version)
+	_, err = ParseTLSVersion("1.4")
+	require.Error(t, err)
+
+	suites, err := ParseCipherSuites([]string{
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}, suites)
+	// insecure suites are refused
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	require.Error(t, err)
+
+	for s, want := range map[string]tls.ClientAuthType{
+		"none":               tls.NoClientCert,
+		"request":            tls.VerifyClientCertIfGiven,
+		"require-and-verify": tls.RequireAndVerifyClientCert,
+	} {
+		got, err := ParseClientAuth(s)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	_, err = ParseClientAuth("maybe")
+	require.Error(t, err)
+}
@@ -7,6 +7,9 @@ import (
 	"os"
 )
 
+// builds the TLS config the server, the followers' replication and the CLI's
+// clients all use. with Server, the CA verifies clients' certificates, which
+// they must present, otherwise it verifies the server's as ServerAddress
 func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 	var err error
 	tlsConfig := &tls.Config{}
@@ -41,6 +44,11 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 		}
 		tlsConfig.ServerName = cfg.ServerAddress
 	}
+	if cfg.Server && cfg.ClientAuth != nil {
+		tlsConfig.ClientAuth = *cfg.ClientAuth
+	}
+	tlsConfig.MinVersion = cfg.MinVersion
+	tlsConfig.CipherSuites = cfg.CipherSuites
 	return tlsConfig, nil
 }
 
@@ -50,4 +58,10 @@ type TLSConfig struct {
 	CAFile        string // Certificate Authority
 	ServerAddress string
 	Server        bool
+	// the policy compliance regimes tend to dictate, Go's defaults when unset.
+	// servers with a CA require and verify client certificates unless ClientAuth
+	// says otherwise
+	MinVersion   uint16
+	CipherSuites []uint16
+	ClientAuth   *tls.ClientAuthType
 }
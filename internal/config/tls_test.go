@@ -0,0 +1,85 @@
+package config
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, GenerateCerts(dir, []string{"127.0.0.1"}))
+
+	for scenario, tc := range map[string]struct {
+		cfg   TLSConfig
+		check func(t *testing.T, c *tls.Config)
+	}{
+		"server verifies clients": {
+			cfg: TLSConfig{
+				CertFile: filepath.Join(dir, "server.pem"),
+				KeyFile:  filepath.Join(dir, "server-key.pem"),
+				CAFile:   filepath.Join(dir, "ca.pem"),
+				Server:   true,
+			},
+			check: func(t *testing.T, c *tls.Config) {
+				require.Len(t, c.Certificates, 1)
+				require.NotNil(t, c.ClientCAs)
+				require.Nil(t, c.RootCAs)
+				require.Equal(t, tls.RequireAndVerifyClientCert, c.ClientAuth)
+			},
+		},
+		"client verifies the server": {
+			cfg: TLSConfig{
+				CertFile:      filepath.Join(dir, "client.pem"),
+				KeyFile:       filepath.Join(dir, "client-key.pem"),
+				CAFile:        filepath.Join(dir, "ca.pem"),
+				ServerAddress: "127.0.0.1",
+			},
+			check: func(t *testing.T, c *tls.Config) {
+				require.Len(t, c.Certificates, 1)
+				require.NotNil(t, c.RootCAs)
+				require.Nil(t, c.ClientCAs)
+				require.Equal(t, "127.0.0.1", c.ServerName)
+			},
+		},
+		"server with a policy": {
+			cfg: TLSConfig{
+				CertFile:     filepath.Join(dir, "server.pem"),
+				KeyFile:      filepath.Join(dir, "server-key.pem"),
+				CAFile:       filepath.Join(dir, "ca.pem"),
+				Server:       true,
+				MinVersion:   tls.VersionTLS13,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+				ClientAuth:   func() *tls.ClientAuthType { a := tls.VerifyClientCertIfGiven; return &a }(),
+			},
+			check: func(t *testing.T, c *tls.Config) {
+				require.Equal(t, uint16(tls.VersionTLS13), c.MinVersion)
+				require.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, c.CipherSuites)
+				require.Equal(t, tls.VerifyClientCertIfGiven, c.ClientAuth)
+			},
+		},
+		"client without a certificate": {
+			cfg: TLSConfig{CAFile: filepath.Join(dir, "ca.pem")},
+			check: func(t *testing.T, c *tls.Config) {
+				require.Empty(t, c.Certificates)
+				require.NotNil(t, c.RootCAs)
+			},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			c, err := SetupTLSConfig(tc.cfg)
+			require.NoError(t, err)
+			tc.check(t, c)
+		})
+	}
+
+	_, err := SetupTLSConfig(TLSConfig{CAFile: filepath.Join(dir, "server-key.pem")})
+	require.ErrorContains(t, err, "failed to parse root certificate")
+	_, err = SetupTLSConfig(TLSConfig{
+		CertFile: filepath.Join(dir, "missing.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	require.Error(t, err)
+}
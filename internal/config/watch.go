@@ -0,0 +1,103 @@
+package config
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// serves the certificate in a cert and key file pair and reloads it when either
+// changes, so short-lived certificates rotate without a restart. it watches the
+// files' directories rather than the files, which survives the files being
+// replaced by a rename, e.g. when Kubernetes updates a mounted secret
+type CertWatcher struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+	watcher  *fsnotify.Watcher
+	logger   *zap.Logger
+	done     chan struct{}
+}
+
+// a write often shows up as several events, they're reloaded together once
+// they've stopped for this long
+const watchSettle = 100 * time.Millisecond
+
+func NewCertWatcher(certFile, keyFile string) (*CertWatcher, error) {
+	w := &CertWatcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   zap.L().Named("config").With(zap.String("cert_file", certFile)),
+		done:     make(chan struct{}),
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	var err error
+	if w.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := w.watcher.Add(dir); err != nil {
+			w.watcher.Close()
+			return nil, err
+		}
+	}
+	go w.watch()
+	return w, nil
+}
+
+func (w *CertWatcher) load() error {
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return err
+	}
+	w.cert.Store(&cert)
+	return nil
+}
+
+func (w *CertWatcher) watch() {
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-w.done:
+			return
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			settle = time.After(watchSettle)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Warn("watching the files", zap.Error(err))
+		case <-settle:
+			settle = nil
+			// a pair caught halfway through being rewritten doesn't load, the
+			// old certificate serves until the rest of the write shows up
+			if err := w.load(); err != nil {
+				w.logger.Warn("reloading the certificate", zap.Error(err))
+				continue
+			}
+			w.logger.Info("reloaded the certificate")
+		}
+	}
+}
+
+func (w *CertWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return w.cert.Load(), nil
+}
+
+func (w *CertWatcher) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return w.cert.Load(), nil
+}
+
+func (w *CertWatcher) Close() error {
+	close(w.done)
+	return w.watcher.Close()
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertWatcher(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, GenerateCerts(dir, []string{"127.0.0.1"}))
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server-key.pem")
+	w, err := NewCertWatcher(certFile, keyFile)
+	require.NoError(t, err)
+	defer w.Close()
+	first, err := w.GetCertificate(nil)
+	require.NoError(t, err)
+
+	// a broken pair keeps the certificate that's serving
+	require.NoError(t, os.WriteFile(certFile, []byte("not a certificate"), 0644))
+	time.Sleep(3 * watchSettle)
+	cert, err := w.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, first, cert)
+
+	require.NoError(t, GenerateCerts(dir, []string{"127.0.0.1"}))
+	require.Eventually(t, func() bool {
+		cert, err := w.GetClientCertificate(nil)
+		require.NoError(t, err)
+		return cert != first
+	}, 3*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,180 @@
+// remembers the message IDs producers set on their records, so a node drops a
+// record whose ID it appended within its window, for clients that can't keep
+// idempotent producers' sequences, e.g. ones that retry from a queue after
+// they restart
+//
+// The IDs are stored as a commit log like the offsets package's, replayed into
+// memory when the store opens. Every so often the IDs still within the window
+// are appended again and the segments before them are removed, so the index
+// only holds the window's IDs. Each node has its own index, a new leader starts
+// with what it appended while it led before.
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// how many IDs are appended between compactions, beyond the ones kept
+	compactAfter = 10000
+	// a few thousand IDs per segment, so compacting removes most of them
+	segmentBytes = 64 << 10
+)
+
+type Store struct {
+	// how long an ID's remembered after its record's appended
+	window time.Duration
+
+	mu   sync.Mutex
+	log  *log.Log
+	seen map[string]*api.DedupEntry
+	// closed once the record with the ID that's being appended is, so a
+	// duplicate sent meanwhile waits for its offset
+	pending map[string]chan struct{}
+	// the IDs in the log, and how many were kept by the last compaction
+	appended, kept int
+}
+
+func New(dir string, window time.Duration) (*Store, error) {
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = segmentBytes
+	c.Segment.MaxIndexBytes = segmentBytes
+	l, err := log.NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		window:  window,
+		log:     l,
+		seen:    make(map[string]*api.DedupEntry),
+		pending: make(map[string]chan struct{}),
+	}
+	lowest, end, err := l.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	oldest := time.Now().Add(-window).UnixNano()
+	for off := lowest; off < end; off++ {
+		record, err := l.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		entry := &api.DedupEntry{}
+		if err := proto.Unmarshal(record.Value, entry); err != nil {
+			return nil, fmt.Errorf("dedup: corrupt record at offset %d: %w", off, err)
+		}
+		if entry.Time >= oldest {
+			s.seen[entry.MessageId] = entry
+		}
+	}
+	s.appended = int(end - lowest)
+	return s, nil
+}
+
+// calls fn to append the record with the message ID, unless one was appended
+// within the window, then it returns that record's offset and duplicate's
+// true. records with the same ID are appended one at a time. a record that was
+// appended but not replicated in time is remembered too, fn returns its offset
+// with the error and it may still be committed, so the retry isn't appended
+// again
+func (s *Store) Append(id string, fn func() (uint64, error)) (offset uint64, duplicate bool, err error) {
+	s.mu.Lock()
+	for {
+		if entry, ok := s.seen[id]; ok && s.live(entry, time.Now()) {
+			s.mu.Unlock()
+			return entry.Offset, true, nil
+		}
+		done, ok := s.pending[id]
+		if !ok {
+			break
+		}
+		s.mu.Unlock()
+		<-done
+		s.mu.Lock()
+	}
+	done := make(chan struct{})
+	s.pending[id] = done
+	s.mu.Unlock()
+
+	offset, err = fn()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, id)
+	close(done)
+	if err != nil && !errors.As(err, &api.ErrReplicationTimeout{}) {
+		return 0, false, err
+	}
+	if err := s.put(&api.DedupEntry{
+		MessageId: id,
+		Offset:    offset,
+		Time:      time.Now().UnixNano(),
+	}); err != nil {
+		// the record's appended, only its retries aren't dropped
+		return offset, false, err
+	}
+	if err != nil {
+		return offset, false, err
+	}
+	if s.appended >= s.kept+compactAfter {
+		return offset, false, s.compact()
+	}
+	return offset, false, nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+func (s *Store) live(entry *api.DedupEntry, now time.Time) bool {
+	return now.Sub(time.Unix(0, entry.Time)) < s.window
+}
+
+func (s *Store) put(entry *api.DedupEntry) error {
+	b, err := proto.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Append(&api.Record{Value: b}); err != nil {
+		return err
+	}
+	s.seen[entry.MessageId] = entry
+	s.appended++
+	return nil
+}
+
+// forgets the IDs past the window, appends the rest again, then removes the
+// segments before them. a crash in between leaves the old IDs to be replayed
+// first
+func (s *Store) compact() error {
+	now := time.Now()
+	for id, entry := range s.seen {
+		if !s.live(entry, now) {
+			delete(s.seen, id)
+		}
+	}
+	start := s.log.NextOffset()
+	for _, entry := range s.seen {
+		if err := s.put(entry); err != nil {
+			return err
+		}
+	}
+	if start > 0 {
+		if err := s.log.Truncate(start - 1); err != nil {
+			return err
+		}
+	}
+	s.appended = len(s.seen)
+	s.kept = len(s.seen)
+	return nil
+}
@@ -0,0 +1,131 @@
+package dedup
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, time.Hour)
+	require.NoError(t, err)
+
+	var next uint64
+	appendRecord := func() (uint64, error) {
+		next++
+		return next - 1, nil
+	}
+	off, duplicate, err := s.Append("a", appendRecord)
+	require.NoError(t, err)
+	require.False(t, duplicate)
+	require.Equal(t, uint64(0), off)
+	off, duplicate, err = s.Append("a", appendRecord)
+	require.NoError(t, err)
+	require.True(t, duplicate)
+	require.Equal(t, uint64(0), off)
+	_, _, err = s.Append("failed", func() (uint64, error) {
+		return 0, fmt.Errorf("disk full")
+	})
+	require.Error(t, err)
+	off, duplicate, err = s.Append("failed", appendRecord)
+	require.NoError(t, err)
+	require.False(t, duplicate)
+	require.Equal(t, uint64(1), off)
+
+	// the IDs survive reopening the store
+	require.NoError(t, s.Close())
+	s, err = New(dir, time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	off, duplicate, err = s.Append("failed", appendRecord)
+	require.NoError(t, err)
+	require.True(t, duplicate)
+	require.Equal(t, uint64(1), off)
+}
+
+func TestStoreReplicationTimeout(t *testing.T) {
+	s, err := New(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	var calls atomic.Int32
+	// the record's appended at 7 but the replicas didn't ack it in time
+	off, duplicate, err := s.Append("a", func() (uint64, error) {
+		calls.Add(1)
+		return 7, api.ErrReplicationTimeout{Offset: 7}
+	})
+	require.ErrorAs(t, err, &api.ErrReplicationTimeout{})
+	require.False(t, duplicate)
+	require.Equal(t, uint64(7), off)
+
+	// so the client's retry isn't appended again
+	off, duplicate, err = s.Append("a", func() (uint64, error) {
+		calls.Add(1)
+		return 8, nil
+	})
+	require.NoError(t, err)
+	require.True(t, duplicate)
+	require.Equal(t, uint64(7), off)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestStoreWindow(t *testing.T) {
+	s, err := New(t.TempDir(), 50*time.Millisecond)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	var calls atomic.Int32
+	appendRecord := func() (uint64, error) {
+		return uint64(calls.Add(1)), nil
+	}
+	_, _, err = s.Append("a", appendRecord)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, duplicate, err := s.Append("a", appendRecord)
+	require.NoError(t, err)
+	require.False(t, duplicate)
+	require.Equal(t, int32(2), calls.Load())
+
+	// concurrent records with the same ID are appended once
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Append("b", func() (uint64, error) {
+				time.Sleep(10 * time.Millisecond)
+				return appendRecord()
+			})
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(3), calls.Load())
+}
+
+func TestStoreCompacts(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, time.Millisecond)
+	require.NoError(t, err)
+	for i := 0; i <= compactAfter+2; i++ {
+		_, _, err := s.Append(fmt.Sprintf("message-%d", i), func() (uint64, error) {
+			return uint64(i), nil
+		})
+		require.NoError(t, err)
+	}
+	lowest, end, err := s.log.GetOffsets()
+	require.NoError(t, err)
+	require.Less(t, end-lowest, uint64(compactAfter))
+	require.Less(t, len(s.seen), compactAfter)
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,186 @@
+// tracks the nodes in the cluster with Serf's gossip protocol and tells a handler
+// when nodes join and leave
+package discovery
+
+import (
+	"net"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	NodeName string
+	// the address Serf gossips on
+	BindAddr string
+	// shared with the other nodes, e.g. the node's RPC address
+	Tags map[string]string
+	// the addresses of nodes already in the cluster, empty when starting a new one
+	StartJoinAddrs []string
+	// when set, gossip from addresses it rejects is dropped, see filteredTransport
+	Allowed func(net.Addr) bool
+	// encrypts and authenticates the gossip with AES when set, 16, 24 or 32
+	// bytes every node shares. without it the gossip's in the clear, and anyone
+	// who reaches the bind address can join, so it only suits trusted networks
+	SecretKey []byte
+	// logs the failed membership changes, and Serf's own logs, nothing's logged
+	// when nil
+	Logger *zap.Logger
+	// registers the membership events and the members by status when set
+	Registerer prometheus.Registerer
+}
+
+// the component that acts on membership changes, e.g. the replication leader
+type Handler interface {
+	Join(name, addr string) error
+	Leave(name string) error
+}
+
+type Membership struct {
+	Config
+	handler Handler
+	serf    *serf.Serf
+	events  chan serf.Event
+	// counts the member events Serf reported, by event
+	eventCounts *prometheus.CounterVec
+}
+
+func New(handler Handler, config Config) (*Membership, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	c := &Membership{
+		Config:      config,
+		handler:     handler,
+		eventCounts: newMembershipEvents(),
+	}
+	if err := c.setupSerf(); err != nil {
+		return nil, err
+	}
+	if config.Registerer != nil {
+		if err := config.Registerer.Register(c); err != nil {
+			c.Leave()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (m *Membership) setupSerf() error {
+	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
+	if err != nil {
+		return err
+	}
+	config := serf.DefaultConfig()
+	config.Init()
+	config.MemberlistConfig.BindAddr = addr.IP.String()
+	config.MemberlistConfig.BindPort = addr.Port
+	config.MemberlistConfig.SecretKey = m.SecretKey
+	// Serf and memberlist prefix their lines with their levels, zap's standard
+	// logger logs them all at info
+	logger := zap.NewStdLog(m.Logger.Named("serf"))
+	config.Logger = logger
+	config.MemberlistConfig.Logger = logger
+	if m.Allowed != nil {
+		transport, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+			BindAddrs: []string{addr.IP.String()},
+			BindPort:  addr.Port,
+			Logger:    logger,
+		})
+		if err != nil {
+			return err
+		}
+		config.MemberlistConfig.Transport = newFilteredTransport(transport, m.Allowed)
+	}
+	m.events = make(chan serf.Event)
+	config.EventCh = m.events
+	config.Tags = m.Tags
+	config.NodeName = m.NodeName
+	if m.serf, err = serf.Create(config); err != nil {
+		return err
+	}
+	go m.eventHandler()
+	if m.StartJoinAddrs != nil {
+		if _, err = m.serf.Join(m.StartJoinAddrs, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Membership) eventHandler() {
+	for e := range m.events {
+		if me, ok := e.(serf.MemberEvent); ok {
+			m.eventCounts.WithLabelValues(me.Type.String()).Add(float64(len(me.Members)))
+		}
+		switch e.EventType() {
+		case serf.EventMemberJoin:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberLeave, serf.EventMemberFailed:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					// this node left, there's nothing more to handle
+					return
+				}
+				m.handleLeave(member)
+			}
+		}
+	}
+}
+
+func (m *Membership) handleJoin(member serf.Member) {
+	if err := m.handler.Join(
+		member.Name,
+		member.Tags["rpc_addr"],
+	); err != nil {
+		m.logError(err, "failed to join", member)
+	}
+}
+
+func (m *Membership) handleLeave(member serf.Member) {
+	if err := m.handler.Leave(member.Name); err != nil {
+		m.logError(err, "failed to leave", member)
+	}
+}
+
+func (m *Membership) isLocal(member serf.Member) bool {
+	return m.serf.LocalMember().Name == member.Name
+}
+
+// returns a snapshot of the cluster's members, including this node
+func (m *Membership) Members() []serf.Member {
+	return m.serf.Members()
+}
+
+// forces a failed node out of the cluster rather than waiting for Serf to reap
+// it, the other nodes handle it like a node that left
+func (m *Membership) Remove(name string) error {
+	return m.serf.RemoveFailedNodePrune(name)
+}
+
+// tells the other nodes this node is leaving and stops gossiping
+func (m *Membership) Leave() error {
+	if m.Registerer != nil {
+		m.Registerer.Unregister(m)
+	}
+	if err := m.serf.Leave(); err != nil {
+		return err
+	}
+	return m.serf.Shutdown()
+}
+
+func (m *Membership) logError(err error, msg string, member serf.Member) {
+	m.Logger.Error(
+		msg,
+		zap.Error(err),
+		zap.String("name", member.Name),
+		zap.String("rpc_addr", member.Tags["rpc_addr"]),
+	)
+}
@@ -0,0 +1,209 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMembership(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			len(handler.leaves) == 0
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.NoError(t, m[2].Leave())
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			m[0].Members()[2].Status == serf.StatusLeft &&
+			len(handler.leaves) == 1
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.Equal(t, "2", <-handler.leaves)
+}
+
+func TestMembershipAllowed(t *testing.T) {
+	var allowed atomic.Bool
+	addr := freeAddr(t)
+	m, err := New(&handler{}, Config{
+		NodeName: "0",
+		BindAddr: addr,
+		Allowed:  func(net.Addr) bool { return allowed.Load() },
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		m.Leave()
+	})
+
+	// the rejected node can't join
+	_, err = New(&handler{}, Config{
+		NodeName:       "1",
+		BindAddr:       freeAddr(t),
+		StartJoinAddrs: []string{addr},
+	})
+	require.Error(t, err)
+
+	allowed.Store(true)
+	members, _ := setupMember(t, []*Membership{m})
+	require.Eventually(t, func() bool {
+		return len(members[0].Members()) == 2
+	}, 3*time.Second, 250*time.Millisecond)
+}
+
+func TestMembershipSecretKey(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	addr := freeAddr(t)
+	m, err := New(&handler{}, Config{
+		NodeName:  "0",
+		BindAddr:  addr,
+		SecretKey: key,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		m.Leave()
+	})
+
+	// nodes without the key can't join
+	for i, secretKey := range [][]byte{nil, []byte("fedcba9876543210")} {
+		_, err = New(&handler{}, Config{
+			NodeName:       fmt.Sprintf("%d", i+1),
+			BindAddr:       freeAddr(t),
+			StartJoinAddrs: []string{addr},
+			SecretKey:      secretKey,
+		})
+		require.Error(t, err)
+	}
+
+	other, err := New(&handler{}, Config{
+		NodeName:       "3",
+		BindAddr:       freeAddr(t),
+		StartJoinAddrs: []string{addr},
+		SecretKey:      key,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		other.Leave()
+	})
+	require.Eventually(t, func() bool {
+		return len(m.Members()) == 2
+	}, 3*time.Second, 250*time.Millisecond)
+}
+
+func TestMembershipMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	addr := freeAddr(t)
+	m, err := New(&handler{}, Config{
+		NodeName:   "0",
+		BindAddr:   addr,
+		Registerer: registry,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		m.Leave()
+	})
+	members, _ := setupMember(t, []*Membership{m})
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.eventCounts.WithLabelValues("member-join")) == 2
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.NoError(t, members[1].Leave())
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.eventCounts.WithLabelValues("member-leave")) == 1
+	}, 3*time.Second, 250*time.Millisecond)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	statuses := map[string]float64{}
+	for _, f := range families {
+		if f.GetName() != "proglog_membership_members" {
+			continue
+		}
+		for _, metric := range f.Metric {
+			statuses[metric.Label[0].GetValue()] = metric.Gauge.GetValue()
+		}
+	}
+	require.Equal(t, 1.0, statuses["alive"])
+	require.Equal(t, 1.0, statuses["left"])
+
+	// leaving unregisters the metrics
+	require.NoError(t, m.Leave())
+	families, err = registry.Gather()
+	require.NoError(t, err)
+	require.Empty(t, families)
+}
+
+func setupMember(t *testing.T, members []*Membership) (
+	[]*Membership, *handler,
+) {
+	id := len(members)
+	addr := freeAddr(t)
+	tags := map[string]string{
+		"rpc_addr": addr,
+	}
+	c := Config{
+		NodeName: fmt.Sprintf("%d", id),
+		BindAddr: addr,
+		Tags:     tags,
+	}
+	h := &handler{}
+	if len(members) == 0 {
+		h.joins = make(chan map[string]string, 3)
+		h.leaves = make(chan string, 3)
+	} else {
+		c.StartJoinAddrs = []string{
+			members[0].BindAddr,
+		}
+	}
+	m, err := New(h, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		m.Leave()
+	})
+	members = append(members, m)
+	return members, h
+}
+
+// returns a local address nothing is listening on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+type handler struct {
+	joins  chan map[string]string
+	leaves chan string
+}
+
+func (h *handler) Join(id, addr string) error {
+	if h.joins != nil {
+		h.joins <- map[string]string{
+			"id":   id,
+			"addr": addr,
+		}
+	}
+	return nil
+}
+
+func (h *handler) Leave(id string) error {
+	if h.leaves != nil {
+		h.leaves <- id
+	}
+	return nil
+}
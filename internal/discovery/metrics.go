@@ -0,0 +1,50 @@
+package discovery
+
+import (
+	"github.com/hashicorp/serf/serf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var membersDesc = prometheus.NewDesc(
+	"proglog_membership_members",
+	"The nodes Serf knows about, by status.",
+	[]string{"status"}, nil,
+)
+
+func newMembershipEvents() *prometheus.CounterVec {
+	events := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_membership_events_total",
+		Help: "The members Serf reported joining, leaving, failing, updating or being reaped.",
+	}, []string{"event"})
+	for _, e := range []serf.EventType{
+		serf.EventMemberJoin,
+		serf.EventMemberLeave,
+		serf.EventMemberFailed,
+		serf.EventMemberUpdate,
+		serf.EventMemberReap,
+	} {
+		events.WithLabelValues(e.String())
+	}
+	return events
+}
+
+func (m *Membership) Describe(ch chan<- *prometheus.Desc) {
+	m.eventCounts.Describe(ch)
+	ch <- membersDesc
+}
+
+func (m *Membership) Collect(ch chan<- prometheus.Metric) {
+	m.eventCounts.Collect(ch)
+	statuses := map[serf.MemberStatus]int{
+		serf.StatusAlive:   0,
+		serf.StatusLeaving: 0,
+		serf.StatusLeft:    0,
+		serf.StatusFailed:  0,
+	}
+	for _, member := range m.serf.Members() {
+		statuses[member.Status]++
+	}
+	for status, n := range statuses {
+		ch <- prometheus.MustNewConstMetric(membersDesc, prometheus.GaugeValue, float64(n), status.String())
+	}
+}
@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"net"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// drops the gossip packets and closes the gossip streams from addresses allowed
+// rejects before memberlist handles them
+type filteredTransport struct {
+	*memberlist.NetTransport
+	allowed func(net.Addr) bool
+	packets chan *memberlist.Packet
+	streams chan net.Conn
+	done    chan struct{}
+}
+
+func newFilteredTransport(t *memberlist.NetTransport, allowed func(net.Addr) bool) *filteredTransport {
+	f := &filteredTransport{
+		NetTransport: t,
+		allowed:      allowed,
+		packets:      make(chan *memberlist.Packet),
+		streams:      make(chan net.Conn),
+		done:         make(chan struct{}),
+	}
+	go f.filter()
+	return f
+}
+
+func (f *filteredTransport) filter() {
+	for {
+		select {
+		case <-f.done:
+			return
+		case p := <-f.NetTransport.PacketCh():
+			if !f.allowed(p.From) {
+				continue
+			}
+			select {
+			case f.packets <- p:
+			case <-f.done:
+				return
+			}
+		case conn := <-f.NetTransport.StreamCh():
+			if !f.allowed(conn.RemoteAddr()) {
+				conn.Close()
+				continue
+			}
+			select {
+			case f.streams <- conn:
+			case <-f.done:
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (f *filteredTransport) PacketCh() <-chan *memberlist.Packet {
+	return f.packets
+}
+
+func (f *filteredTransport) StreamCh() <-chan net.Conn {
+	return f.streams
+}
+
+func (f *filteredTransport) Shutdown() error {
+	close(f.done)
+	return f.NetTransport.Shutdown()
+}
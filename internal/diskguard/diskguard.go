@@ -0,0 +1,241 @@
+// watches the free space on the file system holding the node's data dir, so a
+// filling disk doesn't end with an append failing with ENOSPC halfway through
+// a record. As the free space drops:
+//
+//   - below RetentionFreeBytes, the oldest sealed segments whose records are
+//     all committed are removed, one at a time, until it's back above it or
+//     only the newest MinSegments are left
+//   - below FenceFreeBytes, appends are refused with ResourceExhausted until
+//     it's back above it
+//
+// The free space is exported in metrics, for alerting before either happens.
+// Segments removed to free space are gone for good, so a node that needs them
+// should back them up, see the backup package. Followers that hadn't fetched
+// their records start their logs over from the leader's oldest record.
+package diskguard
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proglog/internal/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// read through a var so tests can fill the disk
+var statDisk = diskSpace
+
+// the node's log, the ReplicatedLog
+type Log interface {
+	// oldest first
+	Segments() []log.SegmentInfo
+	// the records below it are committed
+	HighWatermark() uint64
+	// removes the segments whose records are all below lowest
+	Truncate(lowest uint64) error
+}
+
+type Config struct {
+	// a directory on the file system that's watched, the node's data dir
+	Dir string
+	// below it, the oldest segments are removed, off when zero
+	RetentionFreeBytes uint64
+	// how many of the newest segments, the active one included, are never
+	// removed, so lagging followers and consumers have records to read, 1 when
+	// zero
+	MinSegments int
+	// below it, appends are refused, off when zero
+	FenceFreeBytes uint64
+	// how often the free space is checked, 5s when zero
+	Interval time.Duration
+	// nothing's logged when nil
+	Logger *zap.Logger
+	// registers the guard's metrics when set
+	Registerer prometheus.Registerer
+}
+
+type Guard struct {
+	Config
+	log Log
+
+	fenced atomic.Bool
+	// the free bytes the last check saw
+	free atomic.Uint64
+
+	freeBytes  prometheus.Gauge
+	totalBytes prometheus.Gauge
+	fencedDisk prometheus.Gauge
+	removed    prometheus.Counter
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// checks the free space once before it returns, so the node starts fenced when
+// its disk's already full, then every Interval until it's closed
+func New(l Log, config Config) (*Guard, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.Interval == 0 {
+		config.Interval = 5 * time.Second
+	}
+	if config.MinSegments == 0 {
+		config.MinSegments = 1
+	}
+	g := &Guard{
+		Config: config,
+		log:    l,
+		freeBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Subsystem: "disk",
+			Name:      "free_bytes",
+			Help:      "Bytes free on the data dir's file system.",
+		}),
+		totalBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Subsystem: "disk",
+			Name:      "total_bytes",
+			Help:      "Size of the data dir's file system.",
+		}),
+		fencedDisk: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Subsystem: "disk",
+			Name:      "writes_fenced",
+			Help:      "1 while appends are refused because the disk's almost full.",
+		}),
+		removed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "disk",
+			Name:      "retention_segments_removed_total",
+			Help:      "Segments removed to free space on the disk.",
+		}),
+	}
+	if err := g.check(); err != nil {
+		return nil, err
+	}
+	if g.Registerer != nil {
+		for _, c := range []prometheus.Collector{g.freeBytes, g.totalBytes, g.fencedDisk, g.removed} {
+			if err := g.Registerer.Register(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	g.wg.Add(1)
+	go g.watch(ctx)
+	return g, nil
+}
+
+// the status appends are refused with while the disk's almost full, nil
+// otherwise
+func (g *Guard) Err() error {
+	if !g.fenced.Load() {
+		return nil
+	}
+	return status.Errorf(
+		codes.ResourceExhausted,
+		"the node's disk is almost full, %d bytes free",
+		g.free.Load(),
+	)
+}
+
+func (g *Guard) Close() error {
+	g.cancel()
+	g.wg.Wait()
+	if g.Registerer != nil {
+		g.Registerer.Unregister(g.freeBytes)
+		g.Registerer.Unregister(g.totalBytes)
+		g.Registerer.Unregister(g.fencedDisk)
+		g.Registerer.Unregister(g.removed)
+	}
+	return nil
+}
+
+func (g *Guard) watch(ctx context.Context) {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := g.check(); err != nil {
+			g.Logger.Error("checking the free disk space", zap.Error(err))
+		}
+	}
+}
+
+// frees space when it's below RetentionFreeBytes, then fences or unfences
+// appends
+func (g *Guard) check() error {
+	free, total, err := statDisk(g.Dir)
+	if err != nil {
+		return err
+	}
+	for g.RetentionFreeBytes > 0 && free < g.RetentionFreeBytes {
+		removed, err := g.removeOldest()
+		if err != nil {
+			return err
+		}
+		if !removed {
+			g.Logger.Warn(
+				"the disk's almost full and there are no segments left to remove",
+				zap.Uint64("free_bytes", free),
+			)
+			break
+		}
+		if free, total, err = statDisk(g.Dir); err != nil {
+			return err
+		}
+	}
+	g.free.Store(free)
+	g.freeBytes.Set(float64(free))
+	g.totalBytes.Set(float64(total))
+	fenced := g.FenceFreeBytes > 0 && free < g.FenceFreeBytes
+	if g.fenced.Swap(fenced) != fenced {
+		if fenced {
+			g.Logger.Warn("the disk's almost full, refusing appends", zap.Uint64("free_bytes", free))
+		} else {
+			g.Logger.Info("the disk has space again, taking appends", zap.Uint64("free_bytes", free))
+		}
+	}
+	if fenced {
+		g.fencedDisk.Set(1)
+	} else {
+		g.fencedDisk.Set(0)
+	}
+	return nil
+}
+
+// removes the oldest segment unless it's one of the newest MinSegments, or
+// holds records that aren't committed, returning whether it did
+func (g *Guard) removeOldest() (bool, error) {
+	segments := g.log.Segments()
+	if len(segments) <= g.MinSegments {
+		return false, nil
+	}
+	oldest := segments[0]
+	if oldest.Active || oldest.NextOffset == oldest.BaseOffset || oldest.NextOffset > g.log.HighWatermark() {
+		return false, nil
+	}
+	if err := g.log.Truncate(oldest.NextOffset - 1); err != nil {
+		return false, err
+	}
+	g.removed.Inc()
+	g.Logger.Warn(
+		"removed the oldest segment to free disk space",
+		zap.Uint64("base_offset", oldest.BaseOffset),
+		zap.Uint64("next_offset", oldest.NextOffset),
+	)
+	return true, nil
+}
@@ -0,0 +1,105 @@
+package diskguard
+
+import (
+	"testing"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGuard(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, leader *log.ReplicatedLog, disk *disk){
+		"retention removes the oldest segments":   testRetention,
+		"retention keeps the active segment":      testRetentionActive,
+		"retention keeps the newest segments":     testRetentionMinSegments,
+		"appends are fenced while the disk fills": testFence,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			c := log.Config{}
+			// two records per segment
+			c.Segment.MaxIndexBytes = 24
+			leader, err := log.NewReplicatedLog(t.TempDir(), c)
+			require.NoError(t, err)
+			t.Cleanup(func() { leader.Close() })
+			// three segments: [0, 2), [2, 4) and the active [4, 5)
+			for i := 0; i < 5; i++ {
+				_, err := leader.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			fn(t, leader, fakeDisk(t, leader))
+		})
+	}
+}
+
+func testRetention(t *testing.T, leader *log.ReplicatedLog, disk *disk) {
+	// the disk frees 100 bytes for each segment removed
+	disk.segmentBytes = 100
+	g := setupGuard(t, leader, Config{RetentionFreeBytes: disk.free + 50})
+	lowest, _, err := leader.GetOffsets()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	require.Equal(t, 1.0, testutil.ToFloat64(g.removed))
+	require.NoError(t, g.Err())
+}
+
+func testRetentionActive(t *testing.T, leader *log.ReplicatedLog, disk *disk) {
+	g := setupGuard(t, leader, Config{RetentionFreeBytes: disk.free + 1})
+	segments := leader.Segments()
+	require.Len(t, segments, 1)
+	require.True(t, segments[0].Active)
+	require.Equal(t, 2.0, testutil.ToFloat64(g.removed))
+}
+
+func testRetentionMinSegments(t *testing.T, leader *log.ReplicatedLog, disk *disk) {
+	g := setupGuard(t, leader, Config{RetentionFreeBytes: disk.free + 1, MinSegments: 2})
+	segments := leader.Segments()
+	require.Len(t, segments, 2)
+	require.Equal(t, uint64(2), segments[0].BaseOffset)
+	require.Equal(t, 1.0, testutil.ToFloat64(g.removed))
+}
+
+func testFence(t *testing.T, leader *log.ReplicatedLog, disk *disk) {
+	g := setupGuard(t, leader, Config{FenceFreeBytes: disk.free + 1})
+	err := g.Err()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Equal(t, 1.0, testutil.ToFloat64(g.fencedDisk))
+	// fencing doesn't remove anything
+	require.Len(t, leader.Segments(), 3)
+
+	disk.free += 10
+	require.NoError(t, g.check())
+	require.NoError(t, g.Err())
+	require.Equal(t, 0.0, testutil.ToFloat64(g.fencedDisk))
+}
+
+// a disk whose free space grows with each segment removed
+type disk struct {
+	free, segmentBytes uint64
+}
+
+func fakeDisk(t *testing.T, leader *log.ReplicatedLog) *disk {
+	d := &disk{free: 1000}
+	segments := len(leader.Segments())
+	statDisk = func(string) (uint64, uint64, error) {
+		removed := segments - len(leader.Segments())
+		return d.free + uint64(removed)*d.segmentBytes, 10000, nil
+	}
+	t.Cleanup(func() { statDisk = diskSpace })
+	return d
+}
+
+func setupGuard(t *testing.T, leader *log.ReplicatedLog, config Config) *Guard {
+	t.Helper()
+	config.Dir = t.TempDir()
+	config.Registerer = prometheus.NewRegistry()
+	g, err := New(leader, config)
+	require.NoError(t, err)
+	t.Cleanup(func() { g.Close() })
+	return g
+}
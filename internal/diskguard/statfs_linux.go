@@ -0,0 +1,13 @@
+package diskguard
+
+import "syscall"
+
+// the bytes free for unprivileged users on the file system holding dir, and
+// its size
+func diskSpace(dir string) (free, total uint64, err error) {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(dir, &s); err != nil {
+		return 0, 0, err
+	}
+	return s.Bavail * uint64(s.Bsize), s.Blocks * uint64(s.Bsize), nil
+}
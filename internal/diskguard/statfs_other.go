@@ -0,0 +1,9 @@
+//go:build !linux
+
+package diskguard
+
+import "errors"
+
+func diskSpace(string) (free, total uint64, err error) {
+	return 0, 0, errors.New("diskguard: free space can't be read on this platform")
+}
@@ -0,0 +1,92 @@
+// compiles the CEL expressions consumers filter their streams with, so a
+// consumer that wants a few of the log's records isn't sent all of them. see
+// https://github.com/google/cel-spec for the language
+//
+// An expression sees the record as these variables:
+//
+//	offset       uint
+//	timestamp    timestamp, when the log appended the record
+//	producer_id  string, empty unless an idempotent producer appended it
+//	key          bytes, empty unless the record was appended with a key
+//	value        bytes
+//	json         the value parsed as JSON, null when it isn't JSON
+//
+// e.g. json.level == "error" && timestamp > timestamp("2024-01-01T00:00:00Z").
+// the value's only parsed when the expression uses json, and an expression that
+// fails on a record, e.g. reading a field a JSON object doesn't have, doesn't
+// match it.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/google/cel-go/cel"
+)
+
+// how much work evaluating an expression on a record may take, in CEL's cost
+// units, so an expression can't make the node spin
+const costLimit = 100_000
+
+type Filter struct {
+	program cel.Program
+}
+
+var env *cel.Env
+
+func init() {
+	var err error
+	env, err = cel.NewEnv(
+		cel.Variable("offset", cel.UintType),
+		cel.Variable("timestamp", cel.TimestampType),
+		cel.Variable("producer_id", cel.StringType),
+		cel.Variable("key", cel.BytesType),
+		cel.Variable("value", cel.BytesType),
+		cel.Variable("json", cel.DynType),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// compiles the expression, which has to be a bool
+func Compile(expr string) (*Filter, error) {
+	ast, issues := env.Compile(expr)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("filter: %w", issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("filter: %q is a %s, not a bool", expr, ast.OutputType())
+	}
+	program, err := env.Program(ast, cel.CostLimit(costLimit))
+	if err != nil {
+		return nil, fmt.Errorf("filter: %w", err)
+	}
+	return &Filter{program: program}, nil
+}
+
+// reports whether the expression's true for the record
+func (f *Filter) Match(record *api.Record) bool {
+	out, _, err := f.program.Eval(map[string]any{
+		"offset":      record.Offset,
+		"timestamp":   time.Unix(0, record.Timestamp).UTC(),
+		"producer_id": record.ProducerId,
+		"key":         record.Key,
+		"value":       record.Value,
+		"json": func() any {
+			var v any
+			if err := json.Unmarshal(record.Value, &v); err != nil {
+				return nil
+			}
+			return v
+		},
+	})
+	if err != nil {
+		return false
+	}
+	match, ok := out.Value().(bool)
+	return ok && match
+}
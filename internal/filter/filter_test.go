@@ -0,0 +1,54 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	appended := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	record := &api.Record{
+		Offset:     42,
+		Timestamp:  appended.UnixNano(),
+		ProducerId: "producer-1",
+		Key:        []byte("user-7"),
+		Value:      []byte(`{"level": "error", "user": {"id": 7}, "tags": ["a", "b"]}`),
+	}
+	for expr, want := range map[string]bool{
+		`json.level == "error"`:                               true,
+		`json.level == "info"`:                                false,
+		`json.user.id == 7.0 && "b" in json.tags`:             true,
+		`offset >= 40u && producer_id.startsWith("producer")`: true,
+		`key == b"user-7"`:                                    true,
+		`timestamp > timestamp("2024-01-01T00:00:00Z")`:       true,
+		`value.size() > 100`:                                  false,
+		// reading a field the record doesn't have doesn't match
+		`json.missing == 1`: false,
+		`has(json.missing)`: false,
+	} {
+		f, err := Compile(expr)
+		require.NoError(t, err, expr)
+		require.Equal(t, want, f.Match(record), expr)
+	}
+
+	// values that aren't JSON are null
+	plain := &api.Record{Value: []byte("plain text")}
+	f, err := Compile(`json == null && string(value).contains("text")`)
+	require.NoError(t, err)
+	require.True(t, f.Match(plain))
+	f, err = Compile(`key.size() == 0`)
+	require.NoError(t, err)
+	require.True(t, f.Match(plain))
+	f, err = Compile(`json.level == "error"`)
+	require.NoError(t, err)
+	require.False(t, f.Match(plain))
+
+	for _, expr := range []string{`offset +`, `offset`, `unknown == 1`} {
+		_, err := Compile(expr)
+		require.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,338 @@
+// receives events over the Fluent forward protocol and appends each to the log
+// as a record, so Fluentd and Fluent Bit can forward to proglog directly
+
+// The server speaks the protocol's Message, Forward, PackedForward and
+// CompressedPackedForward modes over TCP, or TLS, but not its handshake: it's
+// secured with TLS client certificates instead of shared keys. Each event's
+// appended as its tag, time and record encoded as JSON, see Event.
+//
+// It pushes back on senders: a connection's events are appended one at a time,
+// in order, before its next message is read, and a message whose events the log
+// won't take, e.g. as the node isn't the leader, isn't acknowledged and closes
+// the connection, so senders that ask for acks (require_ack_response) retry it.
+// Events appended before the one that failed are appended again then, delivery's
+// at-least-once.
+package fluent
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// the MessagePack extension type event times with nanoseconds are encoded as
+const eventTimeExt = 0
+
+// what the events are appended to
+type Appender interface {
+	Append(*api.Record) (uint64, error)
+}
+
+type Config struct {
+	// the address to listen on
+	Addr string
+	// secures the connections when set
+	TLSConfig *tls.Config
+	Appender  Appender
+	// nothing's logged when nil
+	Logger *zap.Logger
+	// registers the events' counts when set
+	Registerer prometheus.Registerer
+}
+
+type Server struct {
+	Config
+
+	ln     net.Listener
+	handle *codec.MsgpackHandle
+	events *prometheus.CounterVec
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// listens on the config's address and serves it until Close
+func New(config Config) (*Server, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	handle := &codec.MsgpackHandle{}
+	handle.RawToString = true
+	handle.WriteExt = true
+	handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	s := &Server{
+		Config: config,
+		handle: handle,
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "fluent",
+			Name:      "events_total",
+			Help:      "Fluent events received, by whether they were appended or failed to append.",
+		}, []string{"result"}),
+		conns: map[net.Conn]struct{}{},
+	}
+	if s.Registerer != nil {
+		if err := s.Registerer.Register(s.events); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if s.ln, err = net.Listen("tcp", s.Addr); err != nil {
+		return nil, err
+	}
+	if s.TLSConfig != nil {
+		s.ln = tls.NewListener(s.ln, s.TLSConfig)
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// the address listened on, e.g. to find the port picked for ":0"
+func (s *Server) ListenAddr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.Logger.Error("failed to accept a connection", zap.Error(err))
+			}
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	dec := codec.NewDecoder(bufio.NewReader(conn), s.handle)
+	enc := codec.NewEncoder(conn, s.handle)
+	for {
+		var msg []interface{}
+		if err := dec.Decode(&msg); err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.Logger.Warn(
+					"closing the connection",
+					zap.String("remote_addr", conn.RemoteAddr().String()),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+		chunk, err := s.handleMessage(msg)
+		if err != nil {
+			s.Logger.Warn(
+				"closing the connection, the message wasn't appended",
+				zap.String("remote_addr", conn.RemoteAddr().String()),
+				zap.Error(err),
+			)
+			return
+		}
+		if chunk != "" {
+			if err := enc.Encode(map[string]string{"ack": chunk}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// appends the message's events and returns the chunk to acknowledge, if the
+// sender asked for an ack
+func (s *Server) handleMessage(msg []interface{}) (string, error) {
+	if len(msg) < 2 {
+		return "", errors.New("fluent: malformed message")
+	}
+	tag, ok := msg[0].(string)
+	if !ok {
+		return "", errors.New("fluent: malformed tag")
+	}
+	var events []Event
+	var option map[string]interface{}
+	switch entries := msg[1].(type) {
+	case []interface{}:
+		// Forward mode, [tag, [[time, record], ...], option]
+		for _, entry := range entries {
+			event, err := s.event(tag, entry)
+			if err != nil {
+				return "", err
+			}
+			events = append(events, event)
+		}
+		option = optionAt(msg, 2)
+	case string, []byte:
+		// PackedForward mode, [tag, concatenated entries, option]
+		option = optionAt(msg, 2)
+		var err error
+		if events, err = s.unpack(tag, entries, option); err != nil {
+			return "", err
+		}
+	default:
+		// Message mode, [tag, time, record, option]
+		if len(msg) < 3 {
+			return "", errors.New("fluent: malformed message")
+		}
+		event, err := s.event(tag, []interface{}{msg[1], msg[2]})
+		if err != nil {
+			return "", err
+		}
+		events = append(events, event)
+		option = optionAt(msg, 3)
+	}
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return "", err
+		}
+		if _, err := s.Appender.Append(&api.Record{Value: value}); err != nil {
+			s.events.WithLabelValues("failed").Inc()
+			return "", err
+		}
+		s.events.WithLabelValues("appended").Inc()
+	}
+	chunk, _ := option["chunk"].(string)
+	return chunk, nil
+}
+
+func optionAt(msg []interface{}, i int) map[string]interface{} {
+	if i >= len(msg) {
+		return nil
+	}
+	option, _ := msg[i].(map[string]interface{})
+	return option
+}
+
+// decodes the entries packed into a PackedForward message, gzipped when it's
+// compressed
+func (s *Server) unpack(tag string, entries interface{}, option map[string]interface{}) ([]Event, error) {
+	var r io.Reader
+	switch entries := entries.(type) {
+	case string:
+		r = bytes.NewReader([]byte(entries))
+	case []byte:
+		r = bytes.NewReader(entries)
+	}
+	if option["compressed"] == "gzip" {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("fluent: %w", err)
+		}
+		r = gz
+	}
+	dec := codec.NewDecoder(r, s.handle)
+	var events []Event
+	for {
+		var entry interface{}
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fluent: %w", err)
+		}
+		event, err := s.event(tag, entry)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+}
+
+// an event as it's appended
+type Event struct {
+	Tag    string                 `json:"tag"`
+	Time   time.Time              `json:"time"`
+	Record map[string]interface{} `json:"record"`
+}
+
+// the event an entry, [time, record], stands for
+func (s *Server) event(tag string, entry interface{}) (Event, error) {
+	pair, ok := entry.([]interface{})
+	if !ok || len(pair) < 2 {
+		return Event{}, errors.New("fluent: malformed entry")
+	}
+	t, err := eventTime(pair[0])
+	if err != nil {
+		return Event{}, err
+	}
+	record, ok := pair[1].(map[string]interface{})
+	if !ok {
+		return Event{}, errors.New("fluent: malformed record")
+	}
+	return Event{Tag: tag, Time: t, Record: record}, nil
+}
+
+// an entry's time is either seconds since the Unix epoch or an EventTime: the
+// seconds and the nanoseconds as two big-endian 32-bit integers
+func eventTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case int64:
+		return time.Unix(v, 0).UTC(), nil
+	case uint64:
+		return time.Unix(int64(v), 0).UTC(), nil
+	case float64:
+		return time.Unix(0, int64(v*float64(time.Second))).UTC(), nil
+	case codec.RawExt:
+		if v.Tag != eventTimeExt || len(v.Data) != 8 {
+			break
+		}
+		sec := binary.BigEndian.Uint32(v.Data[:4])
+		nsec := binary.BigEndian.Uint32(v.Data[4:])
+		return time.Unix(int64(sec), int64(nsec)).UTC(), nil
+	}
+	return time.Time{}, errors.New("fluent: malformed time")
+}
+
+// stops listening, closes the open connections and waits for the events
+// they're appending
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.ln.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
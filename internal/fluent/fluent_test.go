@@ -0,0 +1,166 @@
+package fluent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, s *Server, appender *appender){
+		"appends every mode's events":       testModes,
+		"acks once the events are appended": testAck,
+		"pushes back when appends fail":     testPushBack,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			appender := &appender{}
+			s, err := New(Config{
+				Addr:       "127.0.0.1:0",
+				Appender:   appender,
+				Registerer: prometheus.NewRegistry(),
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				s.Close()
+			})
+			fn(t, s, appender)
+		})
+	}
+}
+
+func testModes(t *testing.T, s *Server, appender *appender) {
+	conn, enc := dial(t, s)
+	defer conn.Close()
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	entry := func(msg string) []interface{} {
+		return []interface{}{eventTimeOf(at), map[string]interface{}{"msg": msg}}
+	}
+	packed := func(msgs ...string) []byte {
+		var b bytes.Buffer
+		enc := codec.NewEncoder(&b, &codec.MsgpackHandle{})
+		for _, msg := range msgs {
+			require.NoError(t, enc.Encode(entry(msg)))
+		}
+		return b.Bytes()
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(packed("compressed"))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	for _, msg := range [][]interface{}{
+		{"app.message", at.Unix(), map[string]interface{}{"msg": "message"}},
+		{"app.forward", []interface{}{entry("forward-0"), entry("forward-1")}},
+		{"app.packed", packed("packed-0", "packed-1")},
+		{"app.compressed", compressed.Bytes(), map[string]interface{}{"compressed": "gzip"}},
+	} {
+		require.NoError(t, enc.Encode(msg))
+	}
+	events := appender.wait(t, 6)
+	require.Equal(t, Event{
+		Tag:    "app.message",
+		Time:   at.Truncate(time.Second),
+		Record: map[string]interface{}{"msg": "message"},
+	}, events[0])
+	var msgs []string
+	for _, event := range events[1:] {
+		require.Equal(t, at, event.Time)
+		msgs = append(msgs, event.Tag+" "+event.Record["msg"].(string))
+	}
+	require.Equal(t, []string{
+		"app.forward forward-0",
+		"app.forward forward-1",
+		"app.packed packed-0",
+		"app.packed packed-1",
+		"app.compressed compressed",
+	}, msgs)
+}
+
+func testAck(t *testing.T, s *Server, appender *appender) {
+	conn, enc := dial(t, s)
+	defer conn.Close()
+	require.NoError(t, enc.Encode([]interface{}{
+		"app", time.Now().Unix(), map[string]interface{}{"msg": "hello"},
+		map[string]interface{}{"chunk": "chunk-0"},
+	}))
+	var ack map[string]interface{}
+	require.NoError(t, codec.NewDecoder(conn, s.handle).Decode(&ack))
+	require.Equal(t, "chunk-0", ack["ack"])
+	appender.wait(t, 1)
+}
+
+func testPushBack(t *testing.T, s *Server, appender *appender) {
+	appender.err = errors.New("not the leader")
+	conn, enc := dial(t, s)
+	defer conn.Close()
+	require.NoError(t, enc.Encode([]interface{}{
+		"app", time.Now().Unix(), map[string]interface{}{"msg": "hello"},
+		map[string]interface{}{"chunk": "chunk-0"},
+	}))
+	// no ack, the connection's closed so the sender retries
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err := conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	var netErr net.Error
+	require.False(t, errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func dial(t *testing.T, s *Server) (net.Conn, *codec.Encoder) {
+	conn, err := net.Dial("tcp", s.ListenAddr())
+	require.NoError(t, err)
+	return conn, codec.NewEncoder(conn, &codec.MsgpackHandle{})
+}
+
+// the EventTime extension t's encoded as
+func eventTimeOf(t time.Time) codec.RawExt {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[:4], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(data[4:], uint32(t.Nanosecond()))
+	return codec.RawExt{Tag: eventTimeExt, Data: data}
+}
+
+type appender struct {
+	mu      sync.Mutex
+	records []*api.Record
+	err     error
+}
+
+func (a *appender) Append(record *api.Record) (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return 0, a.err
+	}
+	a.records = append(a.records, record)
+	return uint64(len(a.records) - 1), nil
+}
+
+func (a *appender) wait(t *testing.T, n int) []Event {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.records) == n
+	}, 3*time.Second, 10*time.Millisecond)
+	var events []Event
+	for _, record := range a.records {
+		var event Event
+		require.NoError(t, json.Unmarshal(record.Value, &event))
+		events = append(events, event)
+	}
+	return events
+}
@@ -0,0 +1,380 @@
+// tails a proglog cluster's log and produces every record into a Kafka topic,
+// so consumers can move between the two gradually
+
+// Records are produced in the log's order, which Kafka keeps for the records
+// that land in the same partition, e.g. as they have the same key. Each carries
+// its offset in the log in the proglog-offset header and its producer's ID, if
+// it had one, in the proglog-producer-id header. proglog's records have no keys,
+// Config.Key derives them.
+//
+// The sink checkpoints the next offset to produce to a file, only moving it past
+// records Kafka acknowledged, so it resumes where it left off after a restart.
+// Records produced after the last checkpoint are produced again on restart, and
+// so are those in flight when a produce fails, so delivery is at-least-once.
+package kafkasink
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"google.golang.org/grpc"
+)
+
+type Config struct {
+	// the cluster records are consumed from
+	SourceAddr        string
+	SourceDialOptions []grpc.DialOption
+	// the Kafka brokers to bootstrap from and the topic records are produced to
+	Brokers []string
+	Topic   string
+	// more options for the Kafka client, e.g. TLS, SASL or compression
+	KafkaOptions []kgo.Opt
+	// derives the Kafka record's key from the record, records have no key when nil
+	Key func(*api.Record) []byte
+	// the file the next offset to produce is persisted to
+	CheckpointPath string
+	// how often the checkpoint is written, it's also written on close
+	CheckpointInterval time.Duration
+	// how often the source's end offset is polled to compute the lag
+	LagInterval time.Duration
+	// registers the sink's metrics when set
+	Registerer prometheus.Registerer
+}
+
+// what the records are produced through, a *kgo.Client
+type producer interface {
+	Produce(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error))
+	Flush(ctx context.Context) error
+	Close()
+}
+
+type Sink struct {
+	Config
+
+	mu sync.Mutex
+	// the next offset to produce, every record before it was acknowledged
+	offset uint64
+	// the records produced but not acknowledged yet, in the log's order
+	pending []*pending
+	// the offset the checkpoint file holds
+	checkpointed uint64
+	// the source's end offset the last time it was polled
+	end uint64
+
+	source   api.LogClient
+	conn     *grpc.ClientConn
+	producer producer
+
+	lag     prometheus.Gauge
+	records prometheus.Counter
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	closed bool
+}
+
+type pending struct {
+	offset uint64
+	acked  bool
+}
+
+func New(config Config) (*Sink, error) {
+	opts := append([]kgo.Opt{
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.DefaultProduceTopic(config.Topic),
+	}, config.KafkaOptions...)
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSink(config, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func newSink(config Config, producer producer) (*Sink, error) {
+	if config.CheckpointInterval == 0 {
+		config.CheckpointInterval = time.Second
+	}
+	if config.LagInterval == 0 {
+		config.LagInterval = 5 * time.Second
+	}
+	s := &Sink{
+		Config:   config,
+		producer: producer,
+		lag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Subsystem: "kafka_sink",
+			Name:      "lag_records",
+			Help:      "Records in the source log that haven't been produced to Kafka yet.",
+		}),
+		records: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "kafka_sink",
+			Name:      "records_total",
+			Help:      "Records Kafka acknowledged.",
+		}),
+	}
+	if s.Registerer != nil {
+		for _, c := range []prometheus.Collector{s.lag, s.records} {
+			if err := s.Registerer.Register(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var err error
+	if s.offset, err = readCheckpoint(s.CheckpointPath); err != nil {
+		return nil, err
+	}
+	s.checkpointed = s.offset
+
+	if s.conn, err = grpc.NewClient(s.SourceAddr, s.SourceDialOptions...); err != nil {
+		return nil, err
+	}
+	s.source = api.NewLogClient(s.conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(2)
+	go s.run(ctx)
+	go s.track(ctx)
+	return s, nil
+}
+
+// returns the next offset to produce
+func (s *Sink) Offset() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.offset
+}
+
+// returns how many records the sink is behind the source, as of the last poll
+func (s *Sink) Lag() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lagLocked()
+}
+
+// stops producing, waits for the records in flight and writes the final
+// checkpoint
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	s.cancel()
+	s.wg.Wait()
+	s.producer.Close()
+	if err := s.checkpoint(); err != nil {
+		return err
+	}
+	if err := s.conn.Close(); err != nil {
+		return err
+	}
+	if s.Registerer != nil {
+		s.Registerer.Unregister(s.lag)
+		s.Registerer.Unregister(s.records)
+	}
+	return nil
+}
+
+// consumes the source from the last acknowledged record and produces each
+// record into Kafka, starting over with backoff on errors
+func (s *Sink) run(ctx context.Context) {
+	defer s.wg.Done()
+
+	backoff := 50 * time.Millisecond
+	for {
+		err := s.sink(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			backoff = 50 * time.Millisecond
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (s *Sink) sink(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the records in flight are done with before the next attempt starts
+	// over from the last one acknowledged
+	defer func() {
+		s.producer.Flush(context.Background())
+		s.mu.Lock()
+		s.pending = nil
+		s.mu.Unlock()
+	}()
+
+	stream, err := s.source.ConsumeStream(
+		ctx,
+		&api.ConsumeRequest{Offset: s.Offset()},
+	)
+	if err != nil {
+		return err
+	}
+	failed := make(chan error, 1)
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			select {
+			case err = <-failed:
+			default:
+			}
+			return err
+		}
+		p := &pending{offset: res.Record.Offset}
+		s.mu.Lock()
+		s.pending = append(s.pending, p)
+		s.mu.Unlock()
+		s.producer.Produce(ctx, s.kafkaRecord(res.Record), func(_ *kgo.Record, err error) {
+			if err != nil {
+				select {
+				case failed <- err:
+				default:
+				}
+				cancel()
+				return
+			}
+			s.ack(p)
+		})
+	}
+}
+
+func (s *Sink) kafkaRecord(record *api.Record) *kgo.Record {
+	r := &kgo.Record{
+		Value: record.Value,
+		Headers: []kgo.RecordHeader{{
+			Key:   "proglog-offset",
+			Value: []byte(strconv.FormatUint(record.Offset, 10)),
+		}},
+	}
+	if record.ProducerId != "" {
+		r.Headers = append(r.Headers, kgo.RecordHeader{
+			Key:   "proglog-producer-id",
+			Value: []byte(record.ProducerId),
+		})
+	}
+	if record.Timestamp != 0 {
+		r.Timestamp = time.Unix(0, record.Timestamp)
+	}
+	if s.Key != nil {
+		r.Key = s.Key(record)
+	}
+	return r
+}
+
+// moves the offset past the records acknowledged in a row
+func (s *Sink) ack(p *pending) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.acked = true
+	for len(s.pending) > 0 && s.pending[0].acked {
+		s.offset = s.pending[0].offset + 1
+		s.pending = s.pending[1:]
+		s.records.Inc()
+	}
+	s.lag.Set(float64(s.lagLocked()))
+}
+
+// periodically writes the checkpoint and polls the source's end offset
+func (s *Sink) track(ctx context.Context) {
+	defer s.wg.Done()
+
+	checkpoint := time.NewTicker(s.CheckpointInterval)
+	defer checkpoint.Stop()
+	lag := time.NewTicker(s.LagInterval)
+	defer lag.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-checkpoint.C:
+			// a failed write is retried on the next tick
+			_ = s.checkpoint()
+		case <-lag.C:
+			res, err := s.source.GetOffsets(ctx, &api.GetOffsetsRequest{})
+			if err != nil {
+				continue
+			}
+			s.mu.Lock()
+			s.end = res.EndOffset
+			s.lag.Set(float64(s.lagLocked()))
+			s.mu.Unlock()
+		}
+	}
+}
+
+// callers hold the lock
+func (s *Sink) lagLocked() uint64 {
+	if s.end <= s.offset {
+		return 0
+	}
+	return s.end - s.offset
+}
+
+// writes the next offset to produce to the checkpoint file if it moved,
+// through a temporary file so a crash never leaves a torn checkpoint
+func (s *Sink) checkpoint() error {
+	s.mu.Lock()
+	off := s.offset
+	s.mu.Unlock()
+	if off == s.checkpointed {
+		return nil
+	}
+	tmp := s.CheckpointPath + ".tmp"
+	if err := os.WriteFile(
+		tmp,
+		[]byte(strconv.FormatUint(off, 10)),
+		0644,
+	); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.CheckpointPath); err != nil {
+		return err
+	}
+	s.checkpointed = off
+	return nil
+}
+
+// a missing checkpoint means the sink starts from the beginning
+func readCheckpoint(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
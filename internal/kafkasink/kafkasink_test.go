@@ -0,0 +1,163 @@
+package kafkasink
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+	"proglog/internal/server"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestSink(t *testing.T) {
+	source, sourceAddr := setupServer(t)
+	dir := t.TempDir()
+	config := Config{
+		SourceAddr: sourceAddr,
+		SourceDialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		Key: func(record *api.Record) []byte {
+			return record.Value[:1]
+		},
+		CheckpointPath:     filepath.Join(dir, "checkpoint"),
+		CheckpointInterval: 10 * time.Millisecond,
+		LagInterval:        10 * time.Millisecond,
+		Registerer:         prometheus.NewRegistry(),
+	}
+	kafka := &fakeProducer{}
+	s, err := newSink(config, kafka)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	produce := func(value string) {
+		t.Helper()
+		_, err := source.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value), ProducerId: "producer-0", Sequence: uint64(len(value))},
+		})
+		require.NoError(t, err)
+	}
+	for _, value := range []string{"a", "bb", "ccc"} {
+		produce(value)
+	}
+	kafka.wait(t, 3)
+	require.Eventually(t, func() bool {
+		return s.Lag() == 0 && s.Offset() == 3
+	}, 3*time.Second, 10*time.Millisecond)
+
+	r := kafka.produced()[1]
+	require.Equal(t, []byte("bb"), r.Value)
+	require.Equal(t, []byte("b"), r.Key)
+	require.Equal(t, []kgo.RecordHeader{
+		{Key: "proglog-offset", Value: []byte("1")},
+		{Key: "proglog-producer-id", Value: []byte("producer-0")},
+	}, r.Headers)
+	require.False(t, r.Timestamp.IsZero())
+
+	// a failed produce starts over from the last record Kafka acknowledged
+	kafka.fail(errors.New("broker unavailable"))
+	produce("dddd")
+	require.Never(t, func() bool {
+		return s.Offset() > 3
+	}, 100*time.Millisecond, 10*time.Millisecond)
+	kafka.fail(nil)
+	require.Eventually(t, func() bool {
+		return s.Offset() == 4
+	}, 3*time.Second, 10*time.Millisecond)
+	require.NoError(t, s.Close())
+
+	// the sink resumes from its checkpoint rather than producing everything again
+	produce("eeeee")
+	kafka = &fakeProducer{}
+	s, err = newSink(config, kafka)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), s.Offset())
+	kafka.wait(t, 1)
+	require.Equal(t, []byte("eeeee"), kafka.produced()[0].Value)
+	require.NoError(t, s.Close())
+}
+
+// acknowledges every record it's given, or fails them while err's set
+type fakeProducer struct {
+	mu      sync.Mutex
+	records []*kgo.Record
+	err     error
+}
+
+func (p *fakeProducer) Produce(ctx context.Context, r *kgo.Record, promise func(*kgo.Record, error)) {
+	p.mu.Lock()
+	err := p.err
+	if err == nil {
+		p.records = append(p.records, r)
+	}
+	p.mu.Unlock()
+	go promise(r, err)
+}
+
+func (p *fakeProducer) Flush(context.Context) error {
+	return nil
+}
+
+func (p *fakeProducer) Close() {}
+
+func (p *fakeProducer) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+func (p *fakeProducer) produced() []*kgo.Record {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*kgo.Record(nil), p.records...)
+}
+
+func (p *fakeProducer) wait(t *testing.T, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return len(p.produced()) == n
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func setupServer(t *testing.T) (api.LogClient, string) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "kafkasink-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := server.NewGPRCServer(&server.Config{
+		CommitLog:    clog,
+		OffsetGetter: clog,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	cc, err := grpc.NewClient(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		cc.Close()
+		srv.Stop()
+		clog.Remove()
+	})
+	return api.NewLogClient(cc), l.Addr().String()
+}
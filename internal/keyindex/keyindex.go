@@ -0,0 +1,285 @@
+// indexes the offset of each key's latest record, so GetByKey serves a key's
+// record without the log being read through
+//
+// The index is fed by the log's hooks: a keyed record's noted when it's
+// appended, and indexed once it's committed, so a key never points at a record
+// a new leader may not have. Records produced in transactions aren't indexed,
+// their transactions may abort.
+//
+// The entries are stored as a commit log like the offsets package's, replayed
+// into memory when the index opens, and compacted to each key's latest entry
+// every so often. Closing the index notes how far it got, and opening it again
+// indexes the committed records since, see CatchUp. Keys whose latest records
+// retention removed stay in the index, reading them fails. Keys whose latest
+// records are redacted are dropped, and erased from the entries stored by the
+// compaction that follows, see Redact.
+package keyindex
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// how many entries are appended between compactions, beyond the ones kept
+	compactAfter = 10000
+	// a few thousand entries per segment, so compacting removes most of them
+	segmentBytes = 64 << 10
+)
+
+// the log the index catches up with
+type Log interface {
+	Read(uint64) (*api.Record, error)
+	GetOffsets() (lowest, end uint64, err error)
+}
+
+type Index struct {
+	mu     sync.Mutex
+	log    *log.Log
+	latest map[string]uint64
+	// the key each latest offset's record has, to find the keys to drop when
+	// records are redacted
+	keys map[uint64]string
+	// set once keys are dropped, so the next commit compacts them out
+	erased bool
+	// the keyed records appended but not committed yet, oldest first
+	pending []*api.KeyEntry
+	// the committed records below it are indexed
+	indexed uint64
+	// the entries in the log, and how many were kept by the last compaction
+	appended, kept int
+}
+
+func New(dir string) (*Index, error) {
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = segmentBytes
+	c.Segment.MaxIndexBytes = segmentBytes
+	l, err := log.NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	i := &Index{
+		log:    l,
+		latest: make(map[string]uint64),
+		keys:   make(map[uint64]string),
+	}
+	lowest, end, err := l.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	for off := lowest; off < end; off++ {
+		record, err := l.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		entry := &api.KeyEntry{}
+		if err := proto.Unmarshal(record.Value, entry); err != nil {
+			return nil, fmt.Errorf("keyindex: corrupt record at offset %d: %w", off, err)
+		}
+		if len(entry.Key) == 0 {
+			i.indexed = max(i.indexed, entry.Offset)
+			continue
+		}
+		i.note(entry)
+	}
+	i.appended = int(end - lowest)
+	return i, nil
+}
+
+// indexes the committed records the index hasn't, e.g. the ones committed
+// since it was last closed. call it once the log's opened
+func (i *Index) CatchUp(l Log) error {
+	lowest, end, err := l.GetOffsets()
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	start := max(i.indexed, lowest)
+	i.mu.Unlock()
+	for off := start; off < end; off++ {
+		record, err := l.Read(off)
+		if err != nil {
+			return err
+		}
+		if !indexed(record) {
+			continue
+		}
+		i.mu.Lock()
+		err = i.put(&api.KeyEntry{Key: record.Key, Offset: off})
+		i.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.indexed = max(i.indexed, end)
+	return nil
+}
+
+// notes the record appended at offset, for the OnAppend hook. concurrent
+// appends' hooks can run out of order, the entry's put in offset order so
+// Commit and Truncate can go by the oldest and newest ones
+func (i *Index) Append(offset uint64, record *api.Record) {
+	if !indexed(record) {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	n := len(i.pending)
+	for n > 0 && i.pending[n-1].Offset > offset {
+		n--
+	}
+	i.pending = slices.Insert(i.pending, n, &api.KeyEntry{Key: record.Key, Offset: offset})
+}
+
+// indexes the records below the high watermark, for the OnCommit hook
+func (i *Index) Commit(highWatermark uint64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	n := 0
+	for ; n < len(i.pending) && i.pending[n].Offset < highWatermark; n++ {
+		if err := i.put(i.pending[n]); err != nil {
+			i.pending = i.pending[n:]
+			return err
+		}
+	}
+	i.pending = i.pending[n:]
+	i.indexed = max(i.indexed, highWatermark)
+	if i.erased || i.appended >= i.kept+compactAfter {
+		return i.compact()
+	}
+	return nil
+}
+
+// forgets the records a replica removed because they diverged from its
+// leader's, for the OnTruncate hook. committed records never diverge
+func (i *Index) Truncate(from, to uint64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	n := len(i.pending)
+	for n > 0 && i.pending[n-1].Offset >= from {
+		n--
+	}
+	i.pending = i.pending[:n]
+}
+
+// drops the key of the record at offset when it's the key's latest, for the
+// OnRedact hook. the entries stored with the key are erased by the compaction
+// the next commit runs, the redaction's own record's commit
+func (i *Index) Redact(offset uint64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if key, ok := i.keys[offset]; ok {
+		delete(i.latest, key)
+		delete(i.keys, offset)
+		i.erased = true
+	}
+	for n, entry := range i.pending {
+		if entry.Offset == offset {
+			i.pending = append(i.pending[:n], i.pending[n+1:]...)
+			break
+		}
+	}
+}
+
+// the offset of the key's latest committed record
+func (i *Index) Lookup(key []byte) (uint64, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	off, ok := i.latest[string(key)]
+	return off, ok
+}
+
+// notes how far the index got, so opening it again catches up from there
+func (i *Index) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.write(&api.KeyEntry{Offset: i.indexed}); err != nil {
+		return err
+	}
+	return i.log.Close()
+}
+
+// keyed records outside transactions
+func indexed(record *api.Record) bool {
+	return len(record.Key) > 0 && record.TransactionId == "" && record.Control == api.Record_DATA
+}
+
+// keeps the entry in memory unless the key's latest is newer
+func (i *Index) note(entry *api.KeyEntry) bool {
+	off, ok := i.latest[string(entry.Key)]
+	if ok && off >= entry.Offset {
+		return false
+	}
+	if ok {
+		delete(i.keys, off)
+	}
+	i.latest[string(entry.Key)] = entry.Offset
+	i.keys[entry.Offset] = string(entry.Key)
+	return true
+}
+
+// indexes the entry unless the key's latest is newer, under the lock
+func (i *Index) put(entry *api.KeyEntry) error {
+	if !i.note(entry) {
+		return nil
+	}
+	return i.write(entry)
+}
+
+// appends every key's latest entry again, and how far the index got, then
+// removes the segments before them. a crash in between leaves the old entries
+// to be replayed first. once keys were dropped, the old entries left in the
+// segment the new ones start in are erased too, so the dropped keys aren't
+// kept on disk
+func (i *Index) compact() error {
+	start := i.log.NextOffset()
+	i.appended = 0
+	for key, off := range i.latest {
+		if err := i.write(&api.KeyEntry{Key: []byte(key), Offset: off}); err != nil {
+			return err
+		}
+	}
+	if err := i.write(&api.KeyEntry{Offset: i.indexed}); err != nil {
+		return err
+	}
+	if start > 0 {
+		if err := i.log.Truncate(start - 1); err != nil {
+			return err
+		}
+	}
+	if i.erased {
+		lowest, err := i.log.LowestOffset()
+		if err != nil {
+			return err
+		}
+		for off := lowest; off < start; off++ {
+			if _, err := i.log.Redact(off); err != nil {
+				return err
+			}
+		}
+		i.erased = false
+	}
+	i.kept = i.appended
+	return nil
+}
+
+// appends the entry as it is
+func (i *Index) write(entry *api.KeyEntry) error {
+	b, err := proto.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := i.log.Append(&api.Record{Value: b}); err != nil {
+		return err
+	}
+	i.appended++
+	return nil
+}
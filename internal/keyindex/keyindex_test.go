@@ -0,0 +1,193 @@
+package keyindex
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	i, err := New(dir)
+	require.NoError(t, err)
+
+	i.Append(0, &api.Record{Key: []byte("a")})
+	i.Append(1, &api.Record{Key: []byte("b")})
+	i.Append(2, &api.Record{Value: []byte("unkeyed")})
+	i.Append(3, &api.Record{Key: []byte("a")})
+	i.Append(4, &api.Record{Key: []byte("c"), TransactionId: "txn"})
+
+	// records are indexed once they're committed
+	_, ok := i.Lookup([]byte("a"))
+	require.False(t, ok)
+	require.NoError(t, i.Commit(2))
+	off, ok := i.Lookup([]byte("a"))
+	require.True(t, ok)
+	require.Equal(t, uint64(0), off)
+
+	// the diverged records are forgotten
+	i.Truncate(3, 5)
+	require.NoError(t, i.Commit(5))
+	off, _ = i.Lookup([]byte("a"))
+	require.Equal(t, uint64(0), off)
+	i.Append(3, &api.Record{Key: []byte("a")})
+	require.NoError(t, i.Commit(4))
+	off, _ = i.Lookup([]byte("a"))
+	require.Equal(t, uint64(3), off)
+	_, ok = i.Lookup([]byte("c"))
+	require.False(t, ok)
+
+	// the entries survive reopening the index
+	require.NoError(t, i.Close())
+	i, err = New(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		i.Close()
+	})
+	off, ok = i.Lookup([]byte("b"))
+	require.True(t, ok)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, uint64(5), i.indexed)
+}
+
+func TestIndexCatchesUp(t *testing.T) {
+	l, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	i, err := New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { i.Close() })
+
+	for _, key := range []string{"a", "b", "a"} {
+		_, err := l.Append(&api.Record{Key: []byte(key)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, i.CatchUp(l))
+	off, ok := i.Lookup([]byte("a"))
+	require.True(t, ok)
+	require.Equal(t, uint64(2), off)
+	require.Equal(t, uint64(3), i.indexed)
+}
+
+func TestIndexCompacts(t *testing.T) {
+	dir := t.TempDir()
+	i, err := New(dir)
+	require.NoError(t, err)
+	for off := uint64(0); off <= compactAfter+2; off++ {
+		i.Append(off, &api.Record{Key: []byte(fmt.Sprintf("key-%d", off%2))})
+		require.NoError(t, i.Commit(off+1))
+	}
+	lowest, end, err := i.log.GetOffsets()
+	require.NoError(t, err)
+	require.Less(t, end-lowest, uint64(compactAfter))
+
+	require.NoError(t, i.Close())
+	i, err = New(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		i.Close()
+	})
+	off, ok := i.Lookup([]byte("key-0"))
+	require.True(t, ok)
+	require.Equal(t, uint64(compactAfter+2), off)
+	require.Equal(t, uint64(compactAfter+3), i.indexed)
+}
+
+func TestIndexRedact(t *testing.T) {
+	dir := t.TempDir()
+	i, err := New(dir)
+	require.NoError(t, err)
+
+	i.Append(0, &api.Record{Key: []byte("alice")})
+	i.Append(1, &api.Record{Key: []byte("bob")})
+	require.NoError(t, i.Commit(2))
+	i.Redact(0)
+	_, ok := i.Lookup([]byte("alice"))
+	require.False(t, ok)
+
+	// the redaction's commit erases the entries stored with the key
+	require.NoError(t, i.Commit(3))
+	require.NoError(t, i.Close())
+	files, err := filepath.Glob(filepath.Join(dir, "*.store"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		require.NoError(t, err)
+		require.NotContains(t, string(b), "alice")
+	}
+
+	i, err = New(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		i.Close()
+	})
+	_, ok = i.Lookup([]byte("alice"))
+	require.False(t, ok)
+	off, ok := i.Lookup([]byte("bob"))
+	require.True(t, ok)
+	require.Equal(t, uint64(1), off)
+}
+
+func TestIndexConcurrentAppends(t *testing.T) {
+	const goroutines, appends, keys = 16, 200, 10
+	i, err := New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		i.Close()
+	})
+	c := log.Config{}
+	c.Hooks.OnAppend = i.Append
+	l, err := log.NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < appends; n++ {
+				_, err := l.Append(&api.Record{Key: []byte(fmt.Sprintf("key-%d", (g+n)%keys))})
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the records from the middle on diverged, and the ones before are
+	// committed: each key's latest below the middle is indexed
+	end := l.NextOffset()
+	from := end / 2
+	i.Truncate(from, end)
+	require.NoError(t, i.Commit(end))
+	want := make(map[string]uint64)
+	for off := uint64(0); off < from; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		want[string(record.Key)] = off
+	}
+	require.Len(t, want, keys)
+	for key, off := range want {
+		got, ok := i.Lookup([]byte(key))
+		require.True(t, ok, key)
+		require.Equal(t, off, got, key)
+	}
+
+	// a hook that ran late is still committed with the ones before it
+	i.Append(from+1, &api.Record{Key: []byte("late")})
+	i.Append(from, &api.Record{Key: []byte("late")})
+	require.NoError(t, i.Commit(from+1))
+	got, ok := i.Lookup([]byte("late"))
+	require.True(t, ok)
+	require.Equal(t, from, got)
+}
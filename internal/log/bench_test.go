@@ -0,0 +1,287 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// run with go test -bench . -benchmem ./internal/log, compare runs with benchstat
+
+var recordSizes = []int{64, 1 << 10, 16 << 10}
+
+// how often the benchmarks sync to stable storage: never, every 100
+// appends or after each one. the log itself only syncs when a segment's sealed
+var syncPolicies = []struct {
+	name  string
+	every int
+}{
+	{"never", 0},
+	{"every-100", 100},
+	{"every-append", 1},
+}
+
+func BenchmarkStoreAppend(b *testing.B) {
+	for _, size := range recordSizes {
+		for _, policy := range syncPolicies {
+			b.Run(fmt.Sprintf("size=%d/sync=%s", size, policy.name), func(b *testing.B) {
+				f, err := os.CreateTemp(b.TempDir(), "store_bench")
+				require.NoError(b, err)
+				s, err := newStore(f)
+				require.NoError(b, err)
+				b.Cleanup(func() {
+					s.Close()
+				})
+				p := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_, _, err := s.Append(p)
+					require.NoError(b, err)
+					if policy.every > 0 && (i+1)%policy.every == 0 {
+						require.NoError(b, s.Sync())
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkStoreRead(b *testing.B) {
+	for _, size := range recordSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			f, err := os.CreateTemp(b.TempDir(), "store_bench")
+			require.NoError(b, err)
+			s, err := newStore(f)
+			require.NoError(b, err)
+			b.Cleanup(func() {
+				s.Close()
+			})
+			p := make([]byte, size)
+			const records = 1000
+			positions := make([]uint64, records)
+			for i := range positions {
+				_, positions[i], err = s.Append(p)
+				require.NoError(b, err)
+			}
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := s.Read(positions[i%records])
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkIndexWrite(b *testing.B) {
+	idx := benchIndex(b, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, idx.Write(uint32(i), uint64(i)))
+	}
+}
+
+func BenchmarkIndexRead(b *testing.B) {
+	const entries = 1000
+	idx := benchIndex(b, entries)
+	for i := 0; i < entries; i++ {
+		require.NoError(b, idx.Write(uint32(i), uint64(i)))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := idx.Read(int64(i % entries))
+		require.NoError(b, err)
+	}
+}
+
+// an index with room for n entries
+func benchIndex(b *testing.B, n int) *index {
+	b.Helper()
+	f, err := os.CreateTemp(b.TempDir(), "index_bench")
+	require.NoError(b, err)
+	c := Config{}
+	c.Segment.MaxIndexBytes = uint64(n+1) * entWidth
+	idx, err := newIndex(f, c)
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		idx.Close()
+	})
+	return idx
+}
+
+func BenchmarkSegmentAppend(b *testing.B) {
+	for _, size := range recordSizes {
+		for _, policy := range syncPolicies {
+			b.Run(fmt.Sprintf("size=%d/sync=%s", size, policy.name), func(b *testing.B) {
+				c := Config{}
+				c.Segment.MaxStoreBytes = uint64(b.N) * uint64(size+64)
+				c.Segment.MaxIndexBytes = uint64(b.N+1) * entWidth
+				s, err := newSegment(b.TempDir(), 0, c)
+				require.NoError(b, err)
+				b.Cleanup(func() {
+					s.CLose()
+				})
+				value := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_, err := s.Append(&api.Record{Value: value})
+					require.NoError(b, err)
+					if policy.every > 0 && (i+1)%policy.every == 0 {
+						require.NoError(b, s.Sync())
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkSegmentRead(b *testing.B) {
+	for _, size := range recordSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			const records = 1000
+			c := Config{}
+			c.Segment.MaxStoreBytes = records * uint64(size+64)
+			c.Segment.MaxIndexBytes = (records + 1) * entWidth
+			s, err := newSegment(b.TempDir(), 0, c)
+			require.NoError(b, err)
+			b.Cleanup(func() {
+				s.CLose()
+			})
+			value := make([]byte, size)
+			for i := 0; i < records; i++ {
+				_, err := s.Append(&api.Record{Value: value})
+				require.NoError(b, err)
+			}
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := s.Read(uint64(i % records))
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// appends through the whole log, so segments rotate and are synced as they're
+// sealed, as they would on a node
+func BenchmarkLogAppend(b *testing.B) {
+	for _, size := range recordSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			log := benchLog(b)
+			value := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := log.Append(&api.Record{Value: value})
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkLogAppendParallel(b *testing.B) {
+	log := benchLog(b)
+	value := make([]byte, 1<<10)
+	b.SetBytes(int64(len(value)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := log.Append(&api.Record{Value: value})
+			require.NoError(b, err)
+		}
+	})
+}
+
+func BenchmarkLogRead(b *testing.B) {
+	for _, size := range recordSizes {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			log := benchLog(b)
+			const records = 10000
+			value := make([]byte, size)
+			for i := 0; i < records; i++ {
+				_, err := log.Append(&api.Record{Value: value})
+				require.NoError(b, err)
+			}
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := log.Read(uint64(i % records))
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// reads sealed segments from every core while a producer appends
+func BenchmarkLogReadParallel(b *testing.B) {
+	log := benchLog(b)
+	const records = 10000
+	value := make([]byte, 1<<10)
+	for i := 0; i < records; i++ {
+		_, err := log.Append(&api.Record{Value: value})
+		require.NoError(b, err)
+	}
+	done := make(chan struct{})
+	b.Cleanup(func() {
+		close(done)
+	})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				log.Append(&api.Record{Value: value})
+			}
+		}
+	}()
+	b.SetBytes(int64(len(value)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			_, err := log.Read(uint64(i % records))
+			require.NoError(b, err)
+		}
+	})
+}
+
+// reads reusing the record and buffer, as a high-rate consumer would
+func BenchmarkLogReadInto(b *testing.B) {
+	log := benchLog(b)
+	const records = 10000
+	value := make([]byte, 1<<10)
+	for i := 0; i < records; i++ {
+		_, err := log.Append(&api.Record{Value: value})
+		require.NoError(b, err)
+	}
+	record := &api.Record{}
+	var buf []byte
+	b.SetBytes(int64(len(value)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		buf, err = log.ReadInto(uint64(i%records), record, buf)
+		require.NoError(b, err)
+	}
+}
+
+// a log with the segment sizes a node would use
+func benchLog(b *testing.B) *Log {
+	b.Helper()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	log, err := NewLog(b.TempDir(), c)
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		log.Close()
+	})
+	return log
+}
@@ -0,0 +1,398 @@
+// a replica that's far behind its leader copies the leader's sealed, committed
+// segments whole rather than fetching their records one batch at a time: it
+// transfers several at once, each checked against the checksum the leader
+// sends with it, and installs them in order as they arrive. the records after
+// the last sealed segment are fetched as usual
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// the bytes of a segment sent in each FetchSegment response
+	segmentChunkBytes = 256 << 10
+	// how many times a replica transfers a segment whose checksum doesn't match
+	// before it falls back to fetching its records
+	segmentTransferAttempts = 3
+	// where a replica writes the segments it's transferring, in its log dir
+	catchUpDir = "catch-up"
+)
+
+var errChecksumMismatch = errors.New("the segment's checksum doesn't match the leader's")
+
+// calls fn with the bytes of the sealed segment holding off, from the record at
+// off to the segment's end, a chunk at a time, and returns a CRC-32
+// (Castagnoli) of them. fn may keep the chunk until it returns only
+func (l *Log) ReadSegment(off uint64, fn func(chunk []byte) error) (uint32, error) {
+	segments := l.snapshot()
+	// the active segment's the last, it isn't sealed
+	var s *segment
+	for _, seg := range segments[:len(segments)-1] {
+		if seg.baseOffset <= off && off < seg.readable.Load() {
+			s = seg
+			break
+		}
+	}
+	if s == nil {
+		return 0, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	if err := s.load(); err != nil {
+		return 0, err
+	}
+	pos, end, err := s.storeRange(off)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, segmentChunkBytes)
+	var sum uint32
+	for pos < end {
+		n, err := s.readStore(buf[:min(uint64(len(buf)), end-pos)], pos)
+		if err != nil {
+			return 0, err
+		}
+		sum = crc32.Update(sum, crcTable, buf[:n])
+		if err := fn(buf[:n]); err != nil {
+			return 0, err
+		}
+		pos += uint64(n)
+	}
+	return sum, nil
+}
+
+// where the record at off starts in the store and where the store ends
+func (s *segment) storeRange(off uint64) (pos, end uint64, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, 0, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	if _, pos, err = s.index.Read(int64(off - s.baseOffset)); err != nil {
+		return 0, 0, err
+	}
+	return pos, s.store.size, nil
+}
+
+// reads the store's bytes at pos, taking the lock for each read rather than
+// for the whole transfer so retention isn't held up by a slow replica
+func (s *segment) readStore(p []byte, pos uint64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, api.ErrOffsetOutOfRange{Offset: s.baseOffset}
+	}
+	start := time.Now()
+	n, err := s.store.ReadAt(p, int64(pos))
+	s.metrics.observe(opStoreRead, start, err)
+	return n, err
+}
+
+// moves the store file at path, records another log stored from offset base
+// on, into the log as a sealed segment, followed by an empty active segment,
+// and returns the log's next offset. base has to be the log's next offset,
+// unless the log's empty, and the records' offsets have to follow on from it
+func (l *Log) InstallSegment(base uint64, path string) (uint64, error) {
+	var positions []uint64
+	err := ScanStore(path, func(e StoreEntry) error {
+		if e.Err != nil {
+			return e.Err
+		}
+		if want := base + uint64(len(positions)); e.Record.Offset != want {
+			return fmt.Errorf("record at position %d has offset %d, want %d", e.Pos, e.Record.Offset, want)
+		}
+		positions = append(positions, e.Pos)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(positions) == 0 {
+		return 0, fmt.Errorf("segment at offset %d has no records", base)
+	}
+	if uint64(len(positions))*entWidth > l.Config.Segment.MaxIndexBytes {
+		return 0, fmt.Errorf("segment at offset %d has more records than an index fits", base)
+	}
+	next := base + uint64(len(positions))
+
+	l.mu.Lock()
+	err = l.installSegment(base, next, path, positions)
+	l.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if l.Config.Hooks.OnAppend != nil {
+		err = ScanStore(filepath.Join(l.Dir, fmt.Sprintf("%d%s", base, ".store")), func(e StoreEntry) error {
+			l.Config.Hooks.appended(e.Record.Offset, e.Record)
+			return nil
+		})
+	}
+	return next, err
+}
+
+// the writer holds the lock
+func (l *Log) installSegment(base, next uint64, path string, positions []uint64) error {
+	active := l.activeSegment
+	empty := active.nextOffset == active.baseOffset
+	if base != active.nextOffset && !(empty && len(l.segments) == 1) {
+		return fmt.Errorf("segment at offset %d doesn't follow the log's end %d", base, active.nextOffset)
+	}
+	if empty {
+		// the installed segment takes the empty one's place
+		if err := active.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+	} else if err := active.flushIndex(); err != nil {
+		return err
+	}
+	storePath := filepath.Join(l.Dir, fmt.Sprintf("%d%s", base, ".store"))
+	if err := os.Rename(path, storePath); err != nil {
+		return err
+	}
+	if err := rebuildIndex(filepath.Join(l.Dir, fmt.Sprintf("%d%s", base, ".index")), positions); err != nil {
+		return err
+	}
+	if err := l.newSegment(base); err != nil {
+		return err
+	}
+	record := api.GetRecord()
+	defer record.Release()
+	var buf []byte
+	for i, pos := range positions {
+		var err error
+		if buf, err = l.activeSegment.store.ReadInto(pos, buf); err != nil {
+			return err
+		}
+		if err := proto.Unmarshal(buf, record); err != nil {
+			return err
+		}
+		l.producers.appended(record, base+uint64(i))
+	}
+	return l.newSegment(next)
+}
+
+// on the leader, the sealed segments holding records at or after offset whose
+// records are all committed, oldest first
+func (r *ReplicatedLog) SealedSegments(offset uint64) ([]*api.Segment, error) {
+	if !r.IsLeader() {
+		return nil, api.ErrNotLeader{LeaderAddr: r.config.Replication.LeaderAddr}
+	}
+	hw := r.HighWatermark()
+	var segments []*api.Segment
+	for _, info := range r.log.Segments() {
+		if info.Active || info.NextOffset > hw {
+			break
+		}
+		if info.NextOffset <= offset {
+			continue
+		}
+		segments = append(segments, &api.Segment{
+			BaseOffset: info.BaseOffset,
+			NextOffset: info.NextOffset,
+			StoreBytes: info.StoreBytes,
+			IndexBytes: info.IndexBytes,
+		})
+	}
+	return segments, nil
+}
+
+// on the leader, serves a replica's FetchSegment, see Log.ReadSegment. the
+// replica isn't in sync, so it's throttled like its fetches
+func (r *ReplicatedLog) ReadSegment(ctx context.Context, offset uint64, fn func(chunk []byte) error) (uint32, error) {
+	if !r.IsLeader() {
+		return 0, api.ErrNotLeader{LeaderAddr: r.config.Replication.LeaderAddr}
+	}
+	// every record in the segment has to be committed
+	if offset >= r.sealedEnd() {
+		return 0, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	return r.log.ReadSegment(offset, func(chunk []byte) error {
+		if r.throttle != nil {
+			for n := len(chunk); n > 0; n -= r.throttle.Burst() {
+				if err := r.throttle.WaitN(ctx, min(n, r.throttle.Burst())); err != nil {
+					return err
+				}
+			}
+		}
+		return fn(chunk)
+	})
+}
+
+// one past the last record of the sealed segments whose records are all
+// committed, the leader tells replicas with its fetch responses
+func (r *ReplicatedLog) sealedEnd() uint64 {
+	hw := r.HighWatermark()
+	segments := r.log.snapshot()
+	var end uint64
+	for _, s := range segments[:len(segments)-1] {
+		next := s.readable.Load()
+		if next > hw {
+			break
+		}
+		end = next
+	}
+	return end
+}
+
+// on a follower, copies the leader's sealed segments from the log's end on,
+// CatchUpSegments at a time, installing each once it and the ones before it
+// have arrived. what's installed stays when a transfer fails, the records
+// after it are fetched as usual
+func (r *ReplicatedLog) catchUp(ctx context.Context) error {
+	from := r.log.NextOffset()
+	res, err := r.client.ListSealedSegments(ctx, &api.ListSealedSegmentsRequest{Offset: from})
+	if err != nil {
+		return err
+	}
+	if len(res.Segments) == 0 {
+		return nil
+	}
+	dir := filepath.Join(r.log.Dir, catchUpDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	type transfer struct {
+		// the first segment's sent from the log's end, the others whole
+		from uint64
+		path string
+		err  error
+		done chan struct{}
+	}
+	transfers := make([]*transfer, len(res.Segments))
+	for i, seg := range res.Segments {
+		transfers[i] = &transfer{
+			from: max(from, seg.BaseOffset),
+			path: filepath.Join(dir, fmt.Sprintf("%d%s", seg.BaseOffset, ".store")),
+			done: make(chan struct{}),
+		}
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// transfers start oldest first, so the next one to install never waits
+	// for a slot
+	slots := make(chan struct{}, r.config.Replication.CatchUpSegments)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, t := range transfers {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.err = r.transferSegment(ctx, t.from, t.path)
+				close(t.done)
+				<-slots
+			}()
+		}
+	}()
+
+	for _, t := range transfers {
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if t.err != nil {
+			return t.err
+		}
+		if err := r.installSegment(t.from, t.path); err != nil {
+			return err
+		}
+		r.events.WithLabelValues(eventSegmentCopy).Inc()
+	}
+	r.logger.Info(
+		"caught up by copying the leader's segments",
+		zap.Int("segments", len(transfers)),
+		zap.Uint64("from", from),
+		zap.Uint64("to", r.log.NextOffset()),
+	)
+	return nil
+}
+
+// copies the leader's segment holding from, from the record at from on, to
+// path, transferring it again while its checksum doesn't match
+func (r *ReplicatedLog) transferSegment(ctx context.Context, from uint64, path string) error {
+	var err error
+	for attempt := 0; attempt < segmentTransferAttempts; attempt++ {
+		if err = r.copySegment(ctx, from, path); !errors.Is(err, errChecksumMismatch) {
+			return err
+		}
+		r.logger.Warn("transferring a segment again", zap.Uint64("offset", from), zap.Error(err))
+	}
+	return err
+}
+
+func (r *ReplicatedLog) copySegment(ctx context.Context, from uint64, path string) error {
+	stream, err := r.client.FetchSegment(ctx, &api.FetchSegmentRequest{
+		ReplicaId: r.config.Replication.LocalID,
+		Offset:    from,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var sum uint32
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		if _, err := f.Write(res.Chunk); err != nil {
+			return err
+		}
+		sum = crc32.Update(sum, crcTable, res.Chunk)
+		if res.Last {
+			if sum != res.Checksum {
+				return errChecksumMismatch
+			}
+			return f.Close()
+		}
+	}
+}
+
+// installs a transferred segment, serialized with the appends and repairs
+func (r *ReplicatedLog) installSegment(from uint64, path string) error {
+	r.appendMu.Lock()
+	defer r.appendMu.Unlock()
+	if _, err := r.log.InstallSegment(from, path); err != nil {
+		return err
+	}
+	lastEpoch, err := r.readLastEpoch()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.lastEpoch = lastEpoch
+	r.mu.Unlock()
+	return nil
+}
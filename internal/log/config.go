@@ -1,6 +1,23 @@
 package log
 
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
 type Config struct {
+	// registers the log's metrics when set: the storage layer's latencies, and
+	// the ReplicatedLog's replication metrics on the leader
+	Registerer prometheus.Registerer
+	// the ReplicatedLog logs replication's ISR changes, fencing, failed fetches
+	// and repairs through it, and the log that it fell back from direct I/O or io_uring.
+	// nothing's logged when nil
+	Logger *zap.Logger
+	// called after the log's operations, see Hooks
+	Hooks   Hooks
 	Segment struct {
 		// store the maximum number of bytes that can be held in the store segment
 		MaxStoreBytes uint64
@@ -8,5 +25,61 @@ type Config struct {
 		MaxIndexBytes uint64
 		// stores the initial offset value, indicate a starting point within a file or data stream
 		InitialOffset uint64
+		// the size of the buffer each store's appends are written through, 4KiB
+		// when zero
+		WriteBufferBytes int
+		// sizes each store's buffer to hold about 16 of the records appended
+		// lately instead, between 512B and 1MiB, starting at WriteBufferBytes
+		AdaptiveWriteBuffer bool
+		// writes the stores with O_DIRECT, so records aren't cached in the page
+		// cache as well as by whoever reads them. where the platform or the
+		// filesystem doesn't support it the stores are written as usual
+		DirectIO bool
+		// experimental: reads and writes the stores through an io_uring, batching
+		// concurrent operations into one syscall. only builds with -tags iouring
+		// on Linux support it, the stores are read and written as usual otherwise
+		IOUring bool
+		// opens the sealed segments older than the newest two when they're
+		// first read rather than when the log's opened, so a log with many
+		// segments opens sooner
+		LazyOpen bool
+	}
+	// only used by the ReplicatedLog
+	Replication struct {
+		// identifies this node to the leader when it fetches records
+		LocalID string
+		// the address other nodes reach this node's RPC server at, only reported in the cluster status
+		LocalAddr string
+		// the address of the leader's RPC server, empty when this node is the leader
+		LeaderAddr string
+		// the leader's fencing token, whoever promotes a leader gives it a higher
+		// epoch than any previous leader had
+		LeaderEpoch uint64
+		// options used to dial the leader, e.g. the transport credentials
+		DialOptions []grpc.DialOption
+		// the number of in-sync replicas (counting the leader) a write needs to be accepted
+		MinInSyncReplicas int
+		// how long a replica can go without catching up before it's dropped from the in-sync set
+		MaxLagTime time.Duration
+		// how long the leader keeps tracking a replica that stopped fetching, zero keeps it forever
+		ReapAfter time.Duration
+		// how long an append waits for the in-sync replicas to replicate it
+		AckTimeout time.Duration
+		// how long a fetch waits for new records before returning an empty response
+		FetchMaxWait time.Duration
+		// the maximum number of records returned by a fetch
+		FetchMaxRecords int
+		// caps the bytes per second the leader sends to replicas that aren't in sync,
+		// shared between them, so seeding a new replica doesn't saturate the leader's
+		// disk or network. in-sync replicas are never throttled, zero disables throttling
+		CatchUpBytesPerSecond int
+		// how many of the leader's sealed segments a replica far behind copies at
+		// once, rather than fetching their records, see catchUp. zero fetches
+		// every record
+		CatchUpSegments int
+		// how often followers compare their records with the leader's, zero disables repairs
+		RepairInterval time.Duration
+		// the number of records per checksummed range when comparing with the leader
+		RepairRangeRecords uint64
 	}
 }
@@ -0,0 +1,140 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+)
+
+const (
+	// the alignment O_DIRECT needs of the buffers written, their lengths and the
+	// offsets they're written at. 4KiB covers the logical block sizes of the
+	// disks and filesystems we run on
+	directAlign = 4096
+	// how much the writer buffers before it writes, a multiple of directAlign
+	directBufferSize = 256 << 10
+)
+
+var errDirectIOUnsupported = errors.New("direct I/O isn't supported on this platform")
+
+// writes a store's records with O_DIRECT, so they skip the page cache rather
+// than being cached twice, by the kernel and by whoever reads them.
+//
+// O_DIRECT can only write whole aligned blocks, so the writer keeps the
+// store's last, partial block in its buffer and only writes the blocks it's
+// filled. when the store's flushed before a read or a sync, the partial block's
+// appended to the file through the store's own file, with the page cache; the
+// writer rewrites it with O_DIRECT once it's full. the file never holds more
+// than the records written, so a crash leaves the same store a buffered write
+// would have
+type directWriter struct {
+	// opened with O_DIRECT
+	direct *os.File
+	// the store's file, opened with O_APPEND
+	tail *os.File
+	// the store's size when the writer was last reset, buf's loaded from it
+	size uint64
+	// aligned, nil until the writer's first written to, so sealed segments'
+	// stores don't hold one
+	buf []byte
+	// the file offset buf starts at, aligned
+	off int64
+	// the bytes in buf, and how many of them are already in the file
+	n, flushed int
+}
+
+func newDirectWriter(tail *os.File, size uint64) (*directWriter, error) {
+	direct, err := openDirect(tail.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &directWriter{direct: direct, tail: tail, size: size}, nil
+}
+
+// drops the buffer, e.g. after the store's truncated to size
+func (w *directWriter) reset(size uint64) {
+	w.size = size
+	w.buf = nil
+}
+
+// reads the store's partial last block into a new buffer
+func (w *directWriter) load() error {
+	w.buf = alignedBuffer(directBufferSize)
+	w.off = int64(w.size &^ (directAlign - 1))
+	w.n = int(int64(w.size) - w.off)
+	w.flushed = w.n
+	if w.n == 0 {
+		return nil
+	}
+	_, err := w.tail.ReadAt(w.buf[:w.n], w.off)
+	return err
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	if w.buf == nil {
+		if err := w.load(); err != nil {
+			return 0, err
+		}
+	}
+	var written int
+	for len(p) > 0 {
+		c := copy(w.buf[w.n:], p)
+		w.n += c
+		written += c
+		p = p[c:]
+		if w.n == len(w.buf) {
+			if err := w.writeBlocks(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// writes the full blocks in buf with O_DIRECT and moves the partial one to
+// the front
+func (w *directWriter) writeBlocks() error {
+	full := w.n &^ (directAlign - 1)
+	if full == 0 {
+		return nil
+	}
+	if _, err := w.direct.WriteAt(w.buf[:full], w.off); err != nil {
+		return err
+	}
+	w.n = copy(w.buf, w.buf[full:w.n])
+	w.off += int64(full)
+	w.flushed = max(w.flushed-full, 0)
+	return nil
+}
+
+// gets everything written into the file, so it can be read or synced
+func (w *directWriter) Flush() error {
+	if w.buf == nil {
+		return nil
+	}
+	if err := w.writeBlocks(); err != nil {
+		return err
+	}
+	if w.flushed == w.n {
+		return nil
+	}
+	if _, err := w.tail.Write(w.buf[w.flushed:w.n]); err != nil {
+		return err
+	}
+	w.flushed = w.n
+	return nil
+}
+
+func (w *directWriter) Close() error {
+	return w.direct.Close()
+}
+
+// a buffer of n bytes whose first byte's address is aligned
+func alignedBuffer(n int) []byte {
+	b := make([]byte, n+directAlign)
+	shift := int(uintptr(unsafe.Pointer(&b[0])) & (directAlign - 1))
+	if shift != 0 {
+		shift = directAlign - shift
+	}
+	return b[shift : shift+n : shift+n]
+}
@@ -0,0 +1,11 @@
+package log
+
+import (
+	"os"
+	"syscall"
+)
+
+// fails with EINVAL on filesystems that don't support O_DIRECT, e.g. tmpfs
+func openDirect(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|syscall.O_DIRECT, 0)
+}
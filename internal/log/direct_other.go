@@ -0,0 +1,9 @@
+//go:build !linux
+
+package log
+
+import "os"
+
+func openDirect(string) (*os.File, error) {
+	return nil, errDirectIOUnsupported
+}
@@ -0,0 +1,197 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// kinds of problems Fsck finds
+const (
+	// the store ends partway through a record, e.g. after a crash during an append
+	ProblemTornStore = "torn_store"
+	// a record's bytes don't decode
+	ProblemUndecodableRecord = "undecodable_record"
+	// a record's offset isn't the one its position in the segment gives it
+	ProblemOffsetMismatch = "offset_mismatch"
+	// the index doesn't point at the store's records, e.g. after an unclean close
+	ProblemIndexMismatch = "index_mismatch"
+	// the segment doesn't start where the previous one ends
+	ProblemOffsetGap = "offset_gap"
+)
+
+type FsckReport struct {
+	Dir      string        `json:"dir"`
+	Segments []FsckSegment `json:"segments"`
+}
+
+// whether any problem is left unfixed
+func (r *FsckReport) Unhealthy() bool {
+	for _, s := range r.Segments {
+		for _, p := range s.Problems {
+			if !p.Fixed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type FsckSegment struct {
+	BaseOffset uint64        `json:"base_offset"`
+	Records    uint64        `json:"records"`
+	Problems   []FsckProblem `json:"problems,omitempty"`
+}
+
+type FsckProblem struct {
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	Fixed  bool   `json:"fixed"`
+}
+
+// checks every segment in the log dir, which mustn't be open meanwhile. with
+// repair, truncates torn stores to their last whole record and rebuilds indexes
+// that don't match their store, the other problems need a person to look at them
+func Fsck(dir string, repair bool) (*FsckReport, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[uint64]bool{}
+	var baseOffsets []uint64
+	for _, file := range files {
+		ext := path.Ext(file.Name())
+		if ext != ".store" && ext != ".index" {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ext), 10, 64)
+		if err != nil || seen[off] {
+			continue
+		}
+		seen[off] = true
+		baseOffsets = append(baseOffsets, off)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+
+	report := &FsckReport{Dir: dir}
+	for i, baseOffset := range baseOffsets {
+		s, err := fsckSegment(dir, baseOffset, repair)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			prev := report.Segments[i-1]
+			if end := prev.BaseOffset + prev.Records; end != baseOffset {
+				s.Problems = append(s.Problems, FsckProblem{
+					Kind:   ProblemOffsetGap,
+					Detail: fmt.Sprintf("previous segment ends at offset %d", end),
+				})
+			}
+		}
+		report.Segments = append(report.Segments, s)
+	}
+	return report, nil
+}
+
+func fsckSegment(dir string, baseOffset uint64, repair bool) (FsckSegment, error) {
+	s := FsckSegment{BaseOffset: baseOffset}
+	storePath := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store"))
+	indexPath := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index"))
+
+	var positions []uint64
+	err := ScanStore(storePath, func(e StoreEntry) error {
+		want := baseOffset + uint64(len(positions))
+		positions = append(positions, e.Pos)
+		switch {
+		case e.Err != nil:
+			s.Problems = append(s.Problems, FsckProblem{
+				Kind:   ProblemUndecodableRecord,
+				Detail: fmt.Sprintf("record at position %d: %v", e.Pos, e.Err),
+			})
+		case e.Record.Offset != want:
+			s.Problems = append(s.Problems, FsckProblem{
+				Kind:   ProblemOffsetMismatch,
+				Detail: fmt.Sprintf("record at position %d has offset %d, want %d", e.Pos, e.Record.Offset, want),
+			})
+		}
+		return nil
+	})
+	var torn ErrTornStore
+	if errors.As(err, &torn) {
+		p := FsckProblem{
+			Kind:   ProblemTornStore,
+			Detail: fmt.Sprintf("store ends partway through the record at position %d", torn.Pos),
+		}
+		if repair {
+			if err := os.Truncate(storePath, int64(torn.Pos)); err != nil {
+				return s, err
+			}
+			p.Fixed = true
+		}
+		s.Problems = append(s.Problems, p)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return s, err
+	}
+	s.Records = uint64(len(positions))
+
+	var entries []IndexEntry
+	err = ScanIndex(indexPath, func(e IndexEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return s, err
+	}
+	detail := indexMismatch(entries, positions)
+	if fi, err := os.Stat(indexPath); err == nil && detail == "" &&
+		uint64(fi.Size()) != uint64(len(entries))*entWidth {
+		// the segment takes the index's size for where its entries end
+		detail = fmt.Sprintf("index is padded to %d bytes after its %d entries", fi.Size(), len(entries))
+	}
+	if detail != "" {
+		p := FsckProblem{Kind: ProblemIndexMismatch, Detail: detail}
+		if repair {
+			if err := rebuildIndex(indexPath, positions); err != nil {
+				return s, err
+			}
+			p.Fixed = true
+		}
+		s.Problems = append(s.Problems, p)
+	}
+	return s, nil
+}
+
+// describes how the index's entries differ from the store's record positions,
+// empty when they match
+func indexMismatch(entries []IndexEntry, positions []uint64) string {
+	if len(entries) != len(positions) {
+		return fmt.Sprintf("index has %d entries, store has %d records", len(entries), len(positions))
+	}
+	for i, e := range entries {
+		if uint64(e.RelOffset) != uint64(i) || e.Pos != positions[i] {
+			return fmt.Sprintf(
+				"entry %d points at offset %d position %d, want offset %d position %d",
+				i, e.RelOffset, e.Pos, i, positions[i],
+			)
+		}
+	}
+	return ""
+}
+
+// writes an index as the segment leaves it on a clean close: one entry per record
+// with no padding after them
+func rebuildIndex(indexPath string, positions []uint64) error {
+	b := make([]byte, uint64(len(positions))*entWidth)
+	for i, pos := range positions {
+		at := uint64(i) * entWidth
+		enc.PutUint32(b[at:at+offWidth], uint32(i))
+		enc.PutUint64(b[at+offWidth:at+entWidth], pos)
+	}
+	return os.WriteFile(indexPath, b, 0644)
+}
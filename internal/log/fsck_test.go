@@ -0,0 +1,67 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	report, err := Fsck(dir, false)
+	require.NoError(t, err)
+	require.False(t, report.Unhealthy())
+	require.Len(t, report.Segments, 2)
+	require.Equal(t, uint64(3), report.Segments[0].Records)
+	require.Equal(t, uint64(3), report.Segments[1].BaseOffset)
+	require.Equal(t, uint64(2), report.Segments[1].Records)
+
+	// tear the last record and pad the index like an unclean close does
+	store := path.Join(dir, "3.store")
+	fi, err := os.Stat(store)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(store, fi.Size()-3))
+	require.NoError(t, os.Truncate(path.Join(dir, "0.index"), int64(c.Segment.MaxIndexBytes)*2))
+
+	report, err = Fsck(dir, false)
+	require.NoError(t, err)
+	require.True(t, report.Unhealthy())
+	require.Equal(t, ProblemIndexMismatch, report.Segments[1].Problems[1].Kind)
+	require.Equal(t, ProblemTornStore, report.Segments[1].Problems[0].Kind)
+	require.Equal(t, ProblemIndexMismatch, report.Segments[0].Problems[0].Kind)
+
+	report, err = Fsck(dir, true)
+	require.NoError(t, err)
+	require.False(t, report.Unhealthy())
+	require.Len(t, report.Segments[0].Problems, 1)
+	require.Len(t, report.Segments[1].Problems, 2)
+
+	report, err = Fsck(dir, false)
+	require.NoError(t, err)
+	require.False(t, report.Unhealthy())
+	for _, s := range report.Segments {
+		require.Empty(t, s.Problems)
+	}
+
+	// the repaired log opens and appends after its last whole record
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	require.NoError(t, log.Close())
+}
@@ -0,0 +1,77 @@
+package log
+
+import (
+	api "proglog/api/v1"
+)
+
+// lets embedders keep their own metrics, caches or notifications in step with
+// the log. each hook's optional and runs synchronously once the operation has
+// succeeded, after the log's locks are released, so a hook may read the log but
+// holds up the caller (e.g. a Produce) while it runs
+type Hooks struct {
+	// after a record's appended, whether by a Produce or a follower's fetch
+	OnAppend func(offset uint64, record *api.Record)
+	// after the records in [from, to) are removed: the oldest ones when the log
+	// is truncated for retention, or a replica's newest ones that diverged from
+	// its leader
+	OnTruncate func(from, to uint64)
+	// after the active segment fills up and a new one starting at baseOffset
+	// takes its place
+	OnSegmentRotate func(baseOffset uint64)
+	// only called by the ReplicatedLog: after the high watermark moves up, the
+	// records below it are committed and consumers can read them. calls made
+	// concurrently may arrive out of order, so keep the highest
+	OnCommit func(highWatermark uint64)
+	// only called by the ReplicatedLog: when a leader opens its log, when a
+	// follower starts following a leader, and when a newer leader fences this
+	// one, where the new leader's ID isn't known and leaderID is empty
+	OnLeadershipChange func(leaderID string, epoch uint64)
+	// while the log's opened, after each of its segments is, out of how many
+	// it has. lazily opened segments count as opened, see Config
+	OnRecover func(opened, total int)
+	// after the key and value of the record at offset are erased, record is
+	// how it's now stored, see Log.Redact
+	OnRedact func(offset uint64, record *api.Record)
+}
+
+func (h Hooks) appended(offset uint64, record *api.Record) {
+	if h.OnAppend != nil {
+		h.OnAppend(offset, record)
+	}
+}
+
+func (h Hooks) truncated(from, to uint64) {
+	if h.OnTruncate != nil && from < to {
+		h.OnTruncate(from, to)
+	}
+}
+
+func (h Hooks) rotated(baseOffset uint64) {
+	if h.OnSegmentRotate != nil {
+		h.OnSegmentRotate(baseOffset)
+	}
+}
+
+func (h Hooks) committed(highWatermark uint64) {
+	if h.OnCommit != nil {
+		h.OnCommit(highWatermark)
+	}
+}
+
+func (h Hooks) leadershipChanged(leaderID string, epoch uint64) {
+	if h.OnLeadershipChange != nil {
+		h.OnLeadershipChange(leaderID, epoch)
+	}
+}
+
+func (h Hooks) recovered(opened, total int) {
+	if h.OnRecover != nil {
+		h.OnRecover(opened, total)
+	}
+}
+
+func (h Hooks) redacted(offset uint64, record *api.Record) {
+	if h.OnRedact != nil {
+		h.OnRedact(offset, record)
+	}
+}
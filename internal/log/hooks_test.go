@@ -0,0 +1,47 @@
+package log
+
+import (
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooks(t *testing.T) {
+	var appended, rotated []uint64
+	var truncated [][2]uint64
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Hooks = Hooks{
+		OnAppend: func(offset uint64, record *api.Record) {
+			require.Equal(t, []byte("a record that fills a segment"), record.Value)
+			appended = append(appended, offset)
+		},
+		OnTruncate: func(from, to uint64) {
+			truncated = append(truncated, [2]uint64{from, to})
+		},
+		OnSegmentRotate: func(baseOffset uint64) {
+			rotated = append(rotated, baseOffset)
+		},
+	}
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		log.Close()
+	})
+
+	// each record fills a segment
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("a record that fills a segment")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []uint64{0, 1, 2}, appended)
+	require.Equal(t, []uint64{1, 2, 3}, rotated)
+
+	require.NoError(t, log.Truncate(0))
+	require.NoError(t, log.TruncateFrom(2))
+	// nothing's removed, so the hook isn't called
+	require.NoError(t, log.TruncateFrom(5))
+	require.Equal(t, [][2]uint64{{0, 1}, {2, 3}}, truncated)
+}
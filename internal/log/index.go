@@ -96,6 +96,15 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	return idx, nil
 }
 
+// writes the memory-mapped entries to the file and the file to stable storage,
+// without resizing or closing it
+func (i *index) Sync() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	return i.file.Sync()
+}
+
 // make sure the memory-mapped file has synced its data to the persisted file
 // and that the persisted file has flushed its contents to stable storage.
 // truncate the persisted file to the amount of data that's actually in it
@@ -176,6 +185,26 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// appends the entries in one pass, updating the size once
+func (i *index) WriteBatch(entries []IndexEntry) error {
+	if uint64(len(i.mmap)) < i.size+uint64(len(entries))*entWidth {
+		return io.EOF
+	}
+	pos := i.size
+	for _, e := range entries {
+		enc.PutUint32(i.mmap[pos:pos+offWidth], e.RelOffset)
+		enc.PutUint64(i.mmap[pos+offWidth:pos+entWidth], e.Pos)
+		pos += entWidth
+	}
+	i.size = pos
+	return nil
+}
+
+// whether the index has room for n more entries
+func (i *index) fits(n int) bool {
+	return uint64(len(i.mmap)) >= i.size+uint64(n)*entWidth
+}
+
 //	func (binary.BigEndian) PutUint32(b []byte, v uint32) {
 //		_ = b[3] // early bounds check to guarantee safety of writes below
 //		b[0] = byte(v)
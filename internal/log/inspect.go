@@ -0,0 +1,115 @@
+// reads store and index files on their own, without opening them as part of a log,
+// for tools that inspect or check a data dir offline
+package log
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// a record as it's laid out in a store file
+type StoreEntry struct {
+	// where the record's length prefix starts
+	Pos uint64
+	// the length of the record's bytes, without the prefix
+	Len uint64
+	// the CRC-32 (Castagnoli) of the record's bytes
+	CRC    uint32
+	Record *api.Record
+	// why the record's bytes don't decode, Record is nil when set
+	Err error
+}
+
+// returned by ScanStore when the store ends partway through a record, e.g. after
+// a crash during an append
+type ErrTornStore struct {
+	// where the torn record starts, the store is sound up to here
+	Pos uint64
+}
+
+func (e ErrTornStore) Error() string {
+	return fmt.Sprintf("store is torn at position %d", e.Pos)
+}
+
+// calls fn with every record in the store file in order
+func ScanStore(path string, fn func(StoreEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ScanStoreReader(f, fn)
+}
+
+// calls fn with every record in the store's bytes read from rd in order
+func ScanStoreReader(rd io.Reader, fn func(StoreEntry) error) error {
+	r := bufio.NewReader(rd)
+	var pos uint64
+	size := make([]byte, lenWidth)
+	for {
+		if _, err := io.ReadFull(r, size); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return ErrTornStore{Pos: pos}
+		}
+		n := enc.Uint64(size)
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return ErrTornStore{Pos: pos}
+		}
+		entry := StoreEntry{
+			Pos: pos,
+			Len: n,
+			CRC: crc32.Checksum(b, crcTable),
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(b, record); err != nil {
+			entry.Err = err
+		} else {
+			entry.Record = record
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+		pos += lenWidth + n
+	}
+}
+
+// an entry as it's laid out in an index file
+type IndexEntry struct {
+	// the record's offset relative to the segment's base offset
+	RelOffset uint32
+	// the record's position in the store
+	Pos uint64
+}
+
+// calls fn with every entry in the index file in order. an index that wasn't
+// closed cleanly is still padded with zeros to its maximum size, its entries
+// end at the first zeroed entry after the first one
+func ScanIndex(path string, fn func(IndexEntry) error) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i+entWidth <= uint64(len(b)); i += entWidth {
+		entry := IndexEntry{
+			RelOffset: enc.Uint32(b[i : i+offWidth]),
+			Pos:       enc.Uint64(b[i+offWidth : i+entWidth]),
+		}
+		if i > 0 && entry.RelOffset == 0 && entry.Pos == 0 {
+			return nil
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,28 +2,69 @@
 package log
 
 import (
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	api "proglog/api/v1"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 )
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type Log struct {
+	// held by the writer while it appends, and to truncate, rotate or close the
+	// log. readers don't take it, they read a snapshot of the segments and
+	// take the segment they read's lock, see view
 	mu sync.RWMutex
 
 	Dir    string
 	Config Config
+	// nil when the config has no Registerer
+	metrics *storageMetrics
 
 	activeSegment *segment
 	segments      []*segment
+	// what readers see of segments, published whenever it changes. the active
+	// segment's always the last
+	view atomic.Pointer[[]*segment]
+	// when a segment was last synced to stable storage
+	synced time.Time
+	// the idempotent producers' latest sequences
+	producers *producers
+	// appends the records, replaced when the log's reset
+	writer atomic.Pointer[writer]
+	// the stores read and write through it, nil unless the config asks for it
+	// and it's supported
+	ring *uring
+	// set by the ReplicatedLog, which erases the records REDACT records list
+	// once they're committed rather than once they're appended
+	replicated bool
+	// on a log that isn't replicated, every REDACT record before redactedFrom
+	// has been applied, see replayRedactions. the checkpoint's held back while
+	// redacting records are being applied, and at one that failed
+	redactMu     sync.Mutex
+	redactedFrom uint64
+	redacting    int
+	redactFailed bool
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
+	return newLog(dir, c, false)
+}
+
+func newLog(dir string, c Config, replicated bool) (*Log, error) {
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = 1024
 	}
@@ -32,10 +73,55 @@ func NewLog(dir string, c Config) (*Log, error) {
 	}
 
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:        dir,
+		Config:     c,
+		replicated: replicated,
+	}
+	if c.Registerer != nil {
+		l.metrics = newStorageMetrics(l)
+		if err := c.Registerer.Register(l.metrics); err != nil {
+			return nil, err
+		}
+	}
+	l.openRing()
+	if err := l.setup(); err != nil {
+		l.closeRing()
+		l.unregister()
+		return nil, err
+	}
+	l.startWriter()
+	return l, nil
+}
+
+// opens the io_uring the stores share when the config asks for it, falling
+// back to plain syscalls when it can't
+func (l *Log) openRing() {
+	if !l.Config.Segment.IOUring {
+		return
+	}
+	r, err := newURing()
+	if err != nil {
+		if l.Config.Logger != nil {
+			l.Config.Logger.Warn("reading and writing the log with syscalls, io_uring failed", zap.Error(err))
+		}
+		return
+	}
+	l.ring = r
+}
+
+func (l *Log) closeRing() error {
+	if l.ring == nil {
+		return nil
+	}
+	err := l.ring.close()
+	l.ring = nil
+	return err
+}
+
+func (l *Log) unregister() {
+	if l.metrics != nil {
+		l.Config.Registerer.Unregister(l.metrics)
 	}
-	return l, l.setup()
 }
 
 func (l *Log) setup() error {
@@ -45,22 +131,49 @@ func (l *Log) setup() error {
 	}
 	var baseOffsets []uint64
 	for _, file := range files {
-		offStr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
-		)
+		// e.g. where a replica catching up writes the segments it transfers,
+		// or the replicated log's high watermark checkpoint
+		ext := path.Ext(file.Name())
+		if file.IsDir() || (ext != ".store" && ext != ".index") {
+			continue
+		}
+		offStr := strings.TrimSuffix(file.Name(), ext)
 		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
+		// baseOffset contains dup for index and store, so skip the dup
+		if !slices.Contains(baseOffsets, off) {
+			baseOffsets = append(baseOffsets, off)
+		}
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	start := time.Now()
+	logged := start
+	for i, off := range baseOffsets {
+		// the newest two are opened either way, the producers are rebuilt
+		// from them
+		if l.Config.Segment.LazyOpen && i < len(baseOffsets)-2 {
+			s := newLazySegment(l.Dir, off, baseOffsets[i+1], l.Config)
+			s.metrics = l.metrics
+			s.ring = l.ring
+			l.segments = append(l.segments, s)
+		} else if err = l.newSegment(off); err != nil {
 			return err
 		}
-		// baseOffset contains dup for index and store, so skip the dup
-		i++
+		l.Config.Hooks.recovered(i+1, len(baseOffsets))
+		if l.Config.Logger != nil && time.Since(logged) >= time.Second {
+			logged = time.Now()
+			l.Config.Logger.Info("recovering the log",
+				zap.Int("segments_opened", i+1),
+				zap.Int("segments", len(baseOffsets)),
+			)
+		}
+	}
+	if l.Config.Logger != nil && logged != start {
+		l.Config.Logger.Info("recovered the log",
+			zap.Int("segments", len(baseOffsets)),
+			zap.Duration("took", time.Since(start)),
+		)
 	}
 	if l.segments == nil {
 		if err = l.newSegment(
@@ -69,44 +182,140 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
-	return nil
+	if err := l.loadNewest(); err != nil {
+		return err
+	}
+	// the ReplicatedLog replays them once it knows what's committed
+	if l.replicated {
+		return nil
+	}
+	return l.replayRedactions()
 }
 
+// appends through the log's writer, see writer, and runs the hooks once the
+// record's appended. a log that isn't replicated commits what it appends, so a
+// REDACT record's applied then
 func (l *Log) Append(record *api.Record) (uint64, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	redact := record.Control == api.Record_REDACT && !l.replicated
+	if redact {
+		l.startRedaction()
+	}
+	res := l.submit(record)
+	if res.err != nil || res.duplicate {
+		if redact {
+			l.finishRedaction(res.off, nil)
+		}
+		return res.off, res.err
+	}
+	l.Config.Hooks.appended(res.off, record)
+	if res.rotated {
+		l.Config.Hooks.rotated(res.off + 1)
+		if !l.replicated {
+			if err := l.checkpointRedactions(); err != nil {
+				return res.off, err
+			}
+		}
+	}
+	if redact {
+		return res.off, l.finishRedaction(res.off, l.applyRedaction(record))
+	}
+	return res.off, nil
+}
+
+// appends the record, the writer holds the lock. a record an idempotent
+// producer retried isn't appended again, its offset's returned
+func (l *Log) append(record *api.Record) (off uint64, rotated, duplicate bool, err error) {
+	if off, duplicate, err = l.producers.check(record); err != nil || duplicate {
+		return off, false, duplicate, err
+	}
 
-	off, err := l.activeSegment.Append(record)
+	// records keep the time they were first appended, e.g. when followers copy them
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+	off, err = l.activeSegment.appendDeferred(record)
 	if err != nil {
-		return 0, err
+		return 0, false, false, err
 	}
+	l.producers.appended(record, off)
 	if l.activeSegment.IsMaxed() {
+		// a sealed segment's synced once, rather than on every append
+		if err := l.activeSegment.Sync(); err != nil {
+			return off, false, false, err
+		}
+		l.synced = time.Now()
+		start := time.Now()
 		err = l.newSegment(off + 1)
+		l.metrics.observe(opSegmentRotate, start, err)
+		if l.metrics != nil && err == nil {
+			l.metrics.rotations.Inc()
+		}
+		return off, err == nil, false, err
 	}
 
-	return off, err
+	return off, false, false, nil
 }
 
-func (l *Log) Read(off uint64) (*api.Record, error) {
+// when the last sealed segment was synced to stable storage, zero if none has
+// been since the log was opened
+func (l *Log) LastSync() time.Time {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
-		}
+	return l.synced
+}
+
+// records' bytes, the buffers Read reads into and appends marshal into are
+// reused, since unmarshaling copies what it keeps and the store copies what
+// it's appending
+var recordBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 4<<10)
+		return &b
+	},
+}
+
+// bigger buffers aren't pooled, so one big record doesn't pin its memory
+const maxPooledRecordBuffer = 1 << 20
+
+func putRecordBuffer(buf *[]byte) {
+	if cap(*buf) <= maxPooledRecordBuffer {
+		recordBuffers.Put(buf)
 	}
-	if s == nil || s.nextOffset <= off {
+}
+
+func (l *Log) Read(off uint64) (*api.Record, error) {
+	buf := recordBuffers.Get().(*[]byte)
+	defer putRecordBuffer(buf)
+	record := &api.Record{}
+	var err error
+	*buf, err = l.ReadInto(off, record, *buf)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// decodes the record at off into record, reading its bytes into buf, and
+// returns buf, grown when it was too small. a consumer reading at a high rate
+// reuses both, so a read only allocates what the record keeps
+func (l *Log) ReadInto(off uint64, record *api.Record, buf []byte) ([]byte, error) {
+	s := l.segment(off)
+	if s == nil {
 		// return nil, fmt.Errorf("offset out of range: %d", off)
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+		return buf, api.ErrOffsetOutOfRange{Offset: off}
 	}
-	return s.Read(off)
+	return s.ReadInto(off, record, buf)
 }
 
 // iterates over the segments
 // closes them
 func (l *Log) Close() error {
+	l.stopWriter()
+	if !l.replicated {
+		if err := l.checkpointRedactions(); err != nil {
+			return err
+		}
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	for _, segment := range l.segments {
@@ -114,7 +323,8 @@ func (l *Log) Close() error {
 			return err
 		}
 	}
-	return nil
+	l.unregister()
+	return l.closeRing()
 }
 
 // closes the log
@@ -132,74 +342,357 @@ func (l *Log) Reset() error {
 	if err = l.Remove(); err != nil {
 		return err
 	}
-
-	return l.setup()
+	l.segments, l.activeSegment = nil, nil
+	l.redactedFrom, l.redactFailed = 0, false
+	if l.metrics != nil {
+		if err := l.Config.Registerer.Register(l.metrics); err != nil {
+			return err
+		}
+	}
+	l.openRing()
+	if err := l.setup(); err != nil {
+		return err
+	}
+	l.startWriter()
+	return nil
 }
 
 func (l *Log) LowestOffset() (uint64, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-
-	return l.segments[0].baseOffset, nil
+	return l.snapshot()[0].baseOffset, nil
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	off := l.segments[len(l.segments)-1].nextOffset
+	off := l.NextOffset()
 	if off == 0 {
 		return 0, nil
 	}
 	return off - 1, nil
 }
 
+// returns the offset the next appended record will get, unlike HighestOffset
+// it tells an empty log apart from a log holding a single record
+func (l *Log) NextOffset() uint64 {
+	segments := l.snapshot()
+	return segments[len(segments)-1].readable.Load()
+}
+
+// returns the oldest offset in the log and the offset the next record will get
+func (l *Log) GetOffsets() (lowest, end uint64, err error) {
+	if lowest, err = l.LowestOffset(); err != nil {
+		return 0, 0, err
+	}
+	return lowest, l.NextOffset(), nil
+}
+
+// returns when the oldest record was appended, zero when the log is empty. it
+// reads around the segment's metrics so scrapes don't show up in them
+func (l *Log) oldestTimestamp() int64 {
+	s := l.snapshot()[0]
+	if err := s.load(); err != nil {
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed || s.readable.Load() == s.baseOffset {
+		return 0
+	}
+	_, pos, err := s.index.Read(0)
+	if err != nil {
+		return 0
+	}
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return 0
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return 0
+	}
+	return record.Timestamp
+}
+
+// where a segment's records are and how big its files are
+type SegmentInfo struct {
+	BaseOffset, NextOffset uint64
+	StoreBytes, IndexBytes uint64
+	Active                 bool
+}
+
+// describes the log's segments, oldest first
+func (l *Log) Segments() []SegmentInfo {
+	segments := l.snapshot()
+	var infos []SegmentInfo
+	for i, s := range segments {
+		s.mu.RLock()
+		storeBytes, indexBytes := s.sizes()
+		infos = append(infos, SegmentInfo{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.readable.Load(),
+			StoreBytes: storeBytes,
+			IndexBytes: indexBytes,
+			Active:     i == len(segments)-1,
+		})
+		s.mu.RUnlock()
+	}
+	return infos
+}
+
+// serves the DescribeSegments RPC: the segments, oldest first, and the index
+// entries of the one the request asks for
+func (l *Log) DescribeSegments(req *api.DescribeSegmentsRequest) (*api.DescribeSegmentsResponse, error) {
+	res := &api.DescribeSegmentsResponse{}
+	for _, info := range l.Segments() {
+		res.Segments = append(res.Segments, &api.Segment{
+			BaseOffset: info.BaseOffset,
+			NextOffset: info.NextOffset,
+			StoreBytes: info.StoreBytes,
+			IndexBytes: info.IndexBytes,
+			Active:     info.Active,
+		})
+	}
+	if !req.IndexEntries {
+		return res, nil
+	}
+
+	for _, s := range l.snapshot() {
+		if s.baseOffset != req.BaseOffset {
+			continue
+		}
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		for i := int64(0); uint64(i) < s.index.size/entWidth; i++ {
+			off, pos, err := s.index.Read(i)
+			if err != nil {
+				return nil, err
+			}
+			res.IndexEntries = append(res.IndexEntries, &api.IndexEntry{
+				RelativeOffset: off,
+				Position:       pos,
+			})
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("no segment starts at offset %d", req.BaseOffset)
+}
+
+// serves the DescribeLog RPC: the log's offsets, segments and when its oldest
+// and newest records were appended
+func (l *Log) DescribeLog() (*api.LogDescription, error) {
+	lowest, end, err := l.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	d := &api.LogDescription{
+		LowestOffset:    lowest,
+		HighWatermark:   end,
+		LogEndOffset:    end,
+		OldestTimestamp: l.oldestTimestamp(),
+	}
+	for _, info := range l.Segments() {
+		d.Segments++
+		d.SizeBytes += info.StoreBytes + info.IndexBytes
+	}
+	if end > lowest {
+		// retention may have removed the record since, then the log's empty
+		if record, err := l.Read(end - 1); err == nil {
+			d.NewestTimestamp = record.Timestamp
+		}
+	}
+	return d, nil
+}
+
 // removes all segments whose highest offset is lower than lowest
 func (l *Log) Truncate(lowest uint64) error {
+	from, to, err := l.truncate(lowest)
+	if err != nil {
+		return err
+	}
+	l.Config.Hooks.truncated(from, to)
+	return nil
+}
+
+// returns the range of offsets removed
+func (l *Log) truncate(lowest uint64) (from, to uint64, err error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	from = l.segments[0].baseOffset
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		// the active segment is kept so the log always has one to append to
+		if s.nextOffset <= lowest+1 && s != l.activeSegment {
 			if err = s.Remove(); err != nil {
-				return err
+				return 0, 0, err
 			}
 			continue
 		}
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	l.publish()
+	return from, l.segments[0].baseOffset, nil
+}
+
+// removes every record at and after off, it's how a replica drops
+// the records that diverged from its leader
+func (l *Log) TruncateFrom(off uint64) error {
+	to, err := l.truncateFrom(off)
+	if err != nil {
+		return err
+	}
+	l.Config.Hooks.truncated(off, to)
 	return nil
 }
 
-func (l *Log) Reader() io.Reader {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+// returns the log's end before the truncation
+func (l *Log) truncateFrom(off uint64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	end := l.activeSegment.nextOffset
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset >= off {
+			if err := s.Remove(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if off < s.nextOffset {
+			if err := s.TruncateFrom(off); err != nil {
+				return 0, err
+			}
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	l.producers.truncated(off)
+	// a full segment can't take the records appended after the truncation
+	if len(l.segments) == 0 || l.segments[len(l.segments)-1].IsMaxed() {
+		return end, l.newSegment(off)
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	l.publish()
+	return end, nil
+}
 
-	readers := make([]io.Reader, len(l.segments))
-	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+// removes every record and starts the log over at next, it's how a replica
+// that fell behind its leader's oldest record catches up
+func (l *Log) TruncateAll(next uint64) error {
+	l.mu.Lock()
+	from := l.segments[0].baseOffset
+	end := l.activeSegment.nextOffset
+	for _, s := range l.segments {
+		if err := s.Remove(); err != nil {
+			l.mu.Unlock()
+			return err
+		}
+	}
+	l.segments = nil
+	l.producers.truncated(from)
+	err := l.newSegment(next)
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	l.Config.Hooks.truncated(from, end)
+	return nil
+}
+
+// returns a CRC-32 (Castagnoli) of the stored records in [from, to)
+// replicas compare checksums to find the ranges they need to repair
+func (l *Log) Checksum(from, to uint64) (uint32, error) {
+	return l.checksum(from, to, nil)
+}
+
+// calls redacted, when it isn't nil, with the offset of each redacted record
+// the checksum covers
+func (l *Log) checksum(from, to uint64, redacted func(off uint64)) (uint32, error) {
+	var sum uint32
+	record := &api.Record{}
+	for off := from; off < to; off++ {
+		s := l.segment(off)
+		if s == nil {
+			return 0, api.ErrOffsetOutOfRange{Offset: off}
+		}
+		p, err := s.ReadBytes(off)
+		if err != nil {
+			return 0, err
+		}
+		sum = crc32.Update(sum, crcTable, p)
+		if redacted == nil {
+			continue
+		}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return 0, err
+		}
+		if record.Redacted != 0 {
+			redacted(off)
+		}
+	}
+	return sum, nil
+}
+
+func (l *Log) Reader() io.Reader {
+	segments := l.snapshot()
+	readers := make([]io.Reader, len(segments))
+	for i, segment := range segments {
+		readers[i] = &originReader{segment, 0}
 	}
 	return io.MultiReader(readers...)
 }
 
 type originReader struct {
-	*store
+	*segment
 	off int64
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
+	if err := o.load(); err != nil {
+		return 0, err
+	}
+	n, err := o.store.ReadAt(p, o.off)
 	o.off += int64(n)
 
 	return n, err
 }
 
+// returns the segment holding the readable record at off, nil if no segment
+// does
+func (l *Log) segment(off uint64) *segment {
+	for _, segment := range l.snapshot() {
+		if segment.baseOffset <= off && off < segment.readable.Load() {
+			return segment
+		}
+	}
+	return nil
+}
+
+// the segments as they were last published, oldest first
+func (l *Log) snapshot() []*segment {
+	return *l.view.Load()
+}
+
+// publishes the segments to readers, the writer holds the lock
+func (l *Log) publish() {
+	segments := l.segments
+	l.view.Store(&segments)
+}
+
 func (l *Log) newSegment(off uint64) error {
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
 	}
+	s.metrics = l.metrics
+	if l.ring != nil {
+		if err := s.store.useRing(l.ring); err != nil {
+			return err
+		}
+	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
+	l.publish()
 	return nil
 }
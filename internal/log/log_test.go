@@ -1,9 +1,12 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	api "proglog/api/v1"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -19,6 +22,14 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"truncate from":                     testTruncateFrom,
+		"sealed segments are synced":        testLastSync,
+		"concurrent appends":                testConcurrentAppends,
+		"appends fail once closed":          testAppendClosed,
+		"read into reused buffers":          testReadInto,
+		"reads don't wait on appends":       testReadsDontWait,
+		"lazily opened segments":            testLazyOpen,
+		"redactions are replayed on open":   testReplayRedactions,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "store-test")
@@ -115,3 +126,192 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testTruncateFrom(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record-%d", i)),
+		})
+		require.NoError(t, err)
+	}
+	err = log.TruncateFrom(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), log.NextOffset())
+
+	_, err = log.Read(1)
+	require.Error(t, err)
+
+	off, err := log.Append(&api.Record{Value: []byte("replaced")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("replaced"), read.Value)
+}
+
+func testLastSync(t *testing.T, log *Log) {
+	require.True(t, log.LastSync().IsZero())
+	// a record fills the 32 byte store, sealing its segment
+	_, err := log.Append(&api.Record{Value: []byte("Hello, World!")})
+	require.NoError(t, err)
+	require.Len(t, log.segments, 2)
+	require.False(t, log.LastSync().IsZero())
+}
+
+func testConcurrentAppends(t *testing.T, log *Log) {
+	const producers, records = 8, 50
+	offsets := make(chan uint64, producers*records)
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("%d-%d", p, i))})
+				require.NoError(t, err)
+				offsets <- off
+			}
+		}()
+	}
+	wg.Wait()
+	close(offsets)
+	seen := map[uint64]bool{}
+	for off := range offsets {
+		require.False(t, seen[off], "offset %d appended twice", off)
+		seen[off] = true
+	}
+	require.Len(t, seen, producers*records)
+	require.Equal(t, uint64(producers*records), log.NextOffset())
+}
+
+func testAppendClosed(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.ErrorIs(t, err, os.ErrClosed)
+}
+
+func testReadInto(t *testing.T, log *Log) {
+	for _, value := range []string{"a", "a much longer value"} {
+		_, err := log.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	record := &api.Record{}
+	buf := make([]byte, 0, 4)
+	buf, err := log.ReadInto(0, record, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), record.Value)
+	buf, err = log.ReadInto(1, record, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a much longer value"), record.Value)
+	require.Equal(t, uint64(1), record.Offset)
+	// grown to fit the longer record
+	require.Greater(t, cap(buf), 4)
+
+	// the record doesn't alias the buffer
+	value := record.Value
+	_, err = log.ReadInto(0, record, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a much longer value"), value)
+
+	_, err = log.ReadInto(2, record, buf)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+}
+
+func testReadsDontWait(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.Segments()), 1)
+
+	// as the writer holds it while it appends a batch
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for off := uint64(0); off < 5; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	require.Equal(t, uint64(5), log.NextOffset())
+}
+
+func testLazyOpen(t *testing.T, log *Log) {
+	const records = 10
+	for i := 0; i < records; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	eager := log.Segments()
+	require.Greater(t, len(eager), 4)
+	require.NoError(t, log.Close())
+
+	c := log.Config
+	c.Segment.LazyOpen = true
+	var progress [][2]int
+	c.Hooks.OnRecover = func(opened, total int) {
+		progress = append(progress, [2]int{opened, total})
+	}
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		log.Close()
+	})
+	require.Len(t, progress, len(eager))
+	require.Equal(t, [2]int{len(eager), len(eager)}, progress[len(progress)-1])
+
+	// only the newest two are open, the others report their files' sizes
+	for i, s := range log.segments {
+		require.Equal(t, i >= len(log.segments)-2, s.opened.Load())
+	}
+	require.Equal(t, eager, log.Segments())
+
+	record, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, "record 3", string(record.Value))
+	require.True(t, log.segment(3).opened.Load())
+
+	// segments that were never opened are removed all the same
+	require.False(t, log.segments[0].opened.Load())
+	require.NoError(t, log.Truncate(1))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, eager[1].BaseOffset, lowest)
+
+	b, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.NotEmpty(t, b)
+}
+
+func testReplayRedactions(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte("secret")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// like a log that stopped before it applied its REDACT record, which is
+	// older than the newest two segments by the time it's reopened
+	unapplied, err := newLog(log.Dir, log.Config, true)
+	require.NoError(t, err)
+	value, err := proto.Marshal(&api.Redaction{Offsets: []uint64{0}})
+	require.NoError(t, err)
+	_, err = unapplied.Append(&api.Record{Control: api.Record_REDACT, Value: value})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = unapplied.Append(&api.Record{Value: make([]byte, 32)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, unapplied.Close())
+
+	reopened, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Greater(t, len(reopened.segments), 3)
+	got, err := reopened.Read(0)
+	require.NoError(t, err)
+	require.NotZero(t, got.Redacted)
+	// it's checkpointed past them, so they aren't replayed again
+	b, err := os.ReadFile(filepath.Join(log.Dir, redactedFile))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(reopened.NextOffset()), string(b))
+}
@@ -0,0 +1,128 @@
+package log
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// times the storage layer's operations, so a slow disk shows up apart from the
+// RPCs' latency, and reports the log's size on disk, for capacity alerts. there's
+// one log per node, so there are no per-topic labels
+type storageMetrics struct {
+	log       *Log
+	latency   *prometheus.HistogramVec
+	errors    *prometheus.CounterVec
+	rotations prometheus.Counter
+}
+
+var (
+	segmentsDesc = prometheus.NewDesc(
+		"proglog_segments",
+		"The segments the log has, the active one included.",
+		nil, nil,
+	)
+	storeBytesDesc = prometheus.NewDesc(
+		"proglog_store_bytes",
+		"The bytes the segments' stores hold.",
+		nil, nil,
+	)
+	indexBytesDesc = prometheus.NewDesc(
+		"proglog_index_bytes",
+		"The bytes of the segments' index entries.",
+		nil, nil,
+	)
+	oldestRecordAgeDesc = prometheus.NewDesc(
+		"proglog_oldest_record_age_seconds",
+		"How long ago the oldest record still in the log was appended, absent when the log is empty.",
+		nil, nil,
+	)
+	activeSegmentFillDesc = prometheus.NewDesc(
+		"proglog_active_segment_fill_ratio",
+		"How full the active segment is, from 0 to 1, it rolls over at 1. the fuller of its store and its index.",
+		nil, nil,
+	)
+)
+
+// the operations the metrics are labeled with
+const (
+	opStoreAppend   = "store_append"
+	opStoreRead     = "store_read"
+	opIndexWrite    = "index_write"
+	opIndexRead     = "index_read"
+	opSegmentRotate = "segment_rotate"
+)
+
+func newStorageMetrics(l *Log) *storageMetrics {
+	return &storageMetrics{
+		log: l,
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "proglog_storage_operation_seconds",
+			Help: "How long the storage layer's operations take, by operation.",
+			// the operations take from microseconds (buffered writes, mmapped
+			// index reads) to tens of milliseconds (a segment's files created)
+			Buckets: prometheus.ExponentialBuckets(1e-6, 4, 12),
+		}, []string{"op"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proglog_storage_operation_errors_total",
+			Help: "The storage layer's failed operations, by operation.",
+		}, []string{"op"}),
+		rotations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proglog_segment_rotations_total",
+			Help: "The segments the log rolled over to once the active one was full.",
+		}),
+	}
+}
+
+func (m *storageMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.latency.Describe(ch)
+	m.errors.Describe(ch)
+	m.rotations.Describe(ch)
+	ch <- segmentsDesc
+	ch <- storeBytesDesc
+	ch <- indexBytesDesc
+	ch <- oldestRecordAgeDesc
+	ch <- activeSegmentFillDesc
+}
+
+func (m *storageMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.latency.Collect(ch)
+	m.errors.Collect(ch)
+	m.rotations.Collect(ch)
+
+	var storeBytes, indexBytes uint64
+	var fill float64
+	segments := m.log.Segments()
+	for _, s := range segments {
+		storeBytes += s.StoreBytes
+		indexBytes += s.IndexBytes
+		if s.Active {
+			segment := m.log.Config.Segment
+			fill = max(
+				float64(s.StoreBytes)/float64(segment.MaxStoreBytes),
+				float64(s.IndexBytes)/float64(segment.MaxIndexBytes),
+			)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(segmentsDesc, prometheus.GaugeValue, float64(len(segments)))
+	ch <- prometheus.MustNewConstMetric(storeBytesDesc, prometheus.GaugeValue, float64(storeBytes))
+	ch <- prometheus.MustNewConstMetric(indexBytesDesc, prometheus.GaugeValue, float64(indexBytes))
+	ch <- prometheus.MustNewConstMetric(activeSegmentFillDesc, prometheus.GaugeValue, min(fill, 1))
+
+	// records appended before they had timestamps don't have an age
+	if ts := m.log.oldestTimestamp(); ts != 0 {
+		age := time.Since(time.Unix(0, ts)).Seconds()
+		ch <- prometheus.MustNewConstMetric(oldestRecordAgeDesc, prometheus.GaugeValue, age)
+	}
+}
+
+// records an operation that started at start, a nil storageMetrics records nothing
+func (m *storageMetrics) observe(op string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.latency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(op).Inc()
+	}
+}
@@ -0,0 +1,78 @@
+package log
+
+import (
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := Config{Registerer: reg}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	_, err = log.Read(10)
+	require.Error(t, err)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(log.metrics.rotations))
+	count := func(op string) uint64 {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		for _, f := range families {
+			if f.GetName() != "proglog_storage_operation_seconds" {
+				continue
+			}
+			for _, m := range f.Metric {
+				if m.Label[0].GetValue() == op {
+					return m.Histogram.GetSampleCount()
+				}
+			}
+		}
+		return 0
+	}
+	require.Equal(t, uint64(3), count(opStoreAppend))
+	require.Equal(t, uint64(3), count(opIndexWrite))
+	require.Equal(t, uint64(1), count(opStoreRead))
+	require.Equal(t, uint64(1), count(opIndexRead))
+	require.Equal(t, uint64(1), count(opSegmentRotate))
+
+	gauge := func(name string) (float64, bool) {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		for _, f := range families {
+			if f.GetName() == name {
+				return f.Metric[0].Gauge.GetValue(), true
+			}
+		}
+		return 0, false
+	}
+	segments, _ := gauge("proglog_segments")
+	require.Equal(t, 2.0, segments)
+	indexBytes, _ := gauge("proglog_index_bytes")
+	require.Equal(t, float64(3*entWidth), indexBytes)
+	storeBytes, _ := gauge("proglog_store_bytes")
+	require.Greater(t, storeBytes, 3*float64(lenWidth))
+	fill, _ := gauge("proglog_active_segment_fill_ratio")
+	require.Equal(t, 0.5, fill)
+	age, ok := gauge("proglog_oldest_record_age_seconds")
+	require.True(t, ok)
+	require.GreaterOrEqual(t, age, 0.0)
+
+	// closing the log frees its metrics' names for the next one
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
@@ -0,0 +1,131 @@
+package log
+
+import (
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// how many of a producer's latest offsets are kept, a retried record older
+	// than that can't be told apart from one sent out of order
+	producerWindow = 1000
+	// how many producers are tracked, the one that appended longest ago is
+	// forgotten to make room for a new one
+	maxProducers = 10000
+)
+
+// the sequences idempotent producers' records were appended with, so retried
+// records get the offset they were first appended at rather than a new one.
+// it's kept in memory and rebuilt from the newest segments when the log's
+// opened, retries come seconds apart so they don't reach further back
+type producers struct {
+	byID map[string]*producer
+	// counts appends, to find the producer that appended longest ago
+	clock uint64
+}
+
+type producer struct {
+	// the latest sequence appended and the offsets of the sequences up to it,
+	// oldest first
+	sequence uint64
+	offsets  []uint64
+	appended uint64
+}
+
+func newProducers() *producers {
+	return &producers{byID: make(map[string]*producer)}
+}
+
+// returns the offset the record was already appended at, if it was
+func (p *producers) check(record *api.Record) (offset uint64, duplicate bool, err error) {
+	if record.ProducerId == "" {
+		return 0, false, nil
+	}
+	prod, ok := p.byID[record.ProducerId]
+	if !ok || record.Sequence == prod.sequence+1 {
+		return 0, false, nil
+	}
+	if record.Sequence <= prod.sequence {
+		if back := prod.sequence - record.Sequence; back < uint64(len(prod.offsets)) {
+			return prod.offsets[uint64(len(prod.offsets))-1-back], true, nil
+		}
+	}
+	return 0, false, api.ErrOutOfOrderSequence{
+		ProducerId: record.ProducerId,
+		Sequence:   record.Sequence,
+		Expected:   prod.sequence + 1,
+	}
+}
+
+// notes the record was appended at offset
+func (p *producers) appended(record *api.Record, offset uint64) {
+	if record.ProducerId == "" {
+		return
+	}
+	p.clock++
+	prod, ok := p.byID[record.ProducerId]
+	if !ok {
+		if len(p.byID) >= maxProducers {
+			p.evict()
+		}
+		prod = &producer{}
+		p.byID[record.ProducerId] = prod
+	} else if record.Sequence != prod.sequence+1 {
+		// a producer that restarted its sequences
+		prod.offsets = prod.offsets[:0]
+	}
+	prod.sequence = record.Sequence
+	prod.offsets = append(prod.offsets, offset)
+	if len(prod.offsets) > producerWindow {
+		prod.offsets = prod.offsets[len(prod.offsets)-producerWindow:]
+	}
+	prod.appended = p.clock
+}
+
+// forgets the records at and after off, once the log's truncated from it
+func (p *producers) truncated(off uint64) {
+	for id, prod := range p.byID {
+		if prod.offsets[len(prod.offsets)-1] >= off {
+			delete(p.byID, id)
+		}
+	}
+}
+
+func (p *producers) evict() {
+	var oldest string
+	for id, prod := range p.byID {
+		if oldest == "" || prod.appended < p.byID[oldest].appended {
+			oldest = id
+		}
+	}
+	delete(p.byID, oldest)
+}
+
+// rebuilds the producers from the newest two segments' records, reading around
+// the metrics like oldestTimestamp
+func (l *Log) loadNewest() error {
+	l.producers = newProducers()
+	segments := l.segments[max(len(l.segments)-2, 0):]
+	// the producers keep none of the record, so one's reused for them all
+	record := api.GetRecord()
+	defer record.Release()
+	var buf []byte
+	for _, s := range segments {
+		for i := int64(0); uint64(i) < s.nextOffset-s.baseOffset; i++ {
+			_, pos, err := s.index.Read(i)
+			if err != nil {
+				return err
+			}
+			buf, err = s.store.ReadInto(pos, buf)
+			if err != nil {
+				return err
+			}
+			if err := proto.Unmarshal(buf, record); err != nil {
+				return err
+			}
+			l.producers.appended(record, s.baseOffset+uint64(i))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotentProducers(t *testing.T) {
+	dir := t.TempDir()
+	var appends int
+	c := Config{}
+	c.Hooks.OnAppend = func(uint64, *api.Record) {
+		appends++
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	record := func(seq uint64) *api.Record {
+		return &api.Record{Value: []byte("hello world"), ProducerId: "p1", Sequence: seq}
+	}
+
+	for seq := uint64(0); seq < 3; seq++ {
+		off, err := log.Append(record(seq))
+		require.NoError(t, err)
+		require.Equal(t, seq, off)
+	}
+	// a retry gets the offset the record was first appended at
+	off, err := log.Append(record(1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, uint64(3), log.NextOffset())
+	require.Equal(t, 3, appends)
+
+	_, err = log.Append(record(5))
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerId: "p1", Sequence: 5, Expected: 3}, err)
+
+	// records without a producer aren't checked
+	off, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// the sequences are rebuilt when the log's opened again
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		log.Close()
+	})
+	off, err = log.Append(record(2))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	// and forgotten once the records are truncated
+	require.NoError(t, log.TruncateFrom(2))
+	off, err = log.Append(record(7))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func TestLoadProducers(t *testing.T) {
+	dir := t.TempDir()
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	// the records are read into one record when the log's opened, so the plain
+	// ones mustn't keep the producer of the one read before them
+	for _, record := range []*api.Record{
+		{Value: []byte("first"), ProducerId: "p1", Sequence: 0},
+		{Value: []byte("plain")},
+		{Value: []byte("second"), ProducerId: "p2", Sequence: 0},
+		{Value: []byte("third"), ProducerId: "p1", Sequence: 1},
+		{Value: []byte("plain")},
+	} {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		log.Close()
+	})
+
+	off, err := log.Append(&api.Record{Value: []byte("third"), ProducerId: "p1", Sequence: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	off, err = log.Append(&api.Record{Value: []byte("second"), ProducerId: "p2", Sequence: 0})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	_, err = log.Append(&api.Record{ProducerId: "p2", Sequence: 2})
+	require.Equal(t, api.ErrOutOfOrderSequence{ProducerId: "p2", Sequence: 2, Expected: 1}, err)
+	require.Equal(t, uint64(5), log.NextOffset())
+}
@@ -0,0 +1,186 @@
+package log
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	api "proglog/api/v1"
+
+	"github.com/hashicorp/raft"
+)
+
+// raft checks for this message when a key hasn't been set yet
+var ErrKeyNotFound = errors.New("not found")
+
+var (
+	_ raft.LogStore    = (*LogStore)(nil)
+	_ raft.StableStore = (*StableStore)(nil)
+)
+
+// stores Raft's log entries in a segmented log, each entry's index is its offset
+type LogStore struct {
+	*Log
+}
+
+func NewLogStore(dir string, c Config) (*LogStore, error) {
+	// raft's indexes start at one
+	c.Segment.InitialOffset = 1
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &LogStore{log}, nil
+}
+
+// returns zero when the store holds no entries
+func (l *LogStore) FirstIndex() (uint64, error) {
+	lowest, end, err := l.GetOffsets()
+	if err != nil || lowest == end {
+		return 0, err
+	}
+	return lowest, nil
+}
+
+func (l *LogStore) LastIndex() (uint64, error) {
+	return l.HighestOffset()
+}
+
+func (l *LogStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(index)
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	out.Index = in.Offset
+	out.Term = in.Term
+	out.Type = raft.LogType(in.Type)
+	out.Data = in.Value
+	return nil
+}
+
+func (l *LogStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+func (l *LogStore) StoreLogs(records []*raft.Log) error {
+	for _, record := range records {
+		// raft hands over entries in order, a gap means the store and raft disagree
+		if next := l.NextOffset(); record.Index != next {
+			return fmt.Errorf("log store: storing index %d, expected %d", record.Index, next)
+		}
+		if _, err := l.Append(&api.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// raft deletes either a prefix of the log, after a snapshot, or a suffix, when
+// a new leader overwrites conflicting entries. a prefix is removed a segment at a
+// time, so entries sharing a segment with ones still needed are kept
+func (l *LogStore) DeleteRange(min, max uint64) error {
+	first, err := l.FirstIndex()
+	if err != nil {
+		return err
+	}
+	if min <= first {
+		return l.Truncate(max)
+	}
+	last, err := l.LastIndex()
+	if err != nil {
+		return err
+	}
+	if max < last {
+		return fmt.Errorf("log store: can't delete [%d, %d] from the middle of the log", min, max)
+	}
+	return l.TruncateFrom(min)
+}
+
+// stores Raft's term and vote in a segmented log: every Set appends the key and
+// value and opening the store replays the log into memory. raft only sets a handful
+// of keys, once per election, so the log stays small
+type StableStore struct {
+	mu     sync.RWMutex
+	log    *Log
+	values map[string][]byte
+}
+
+func NewStableStore(dir string, c Config) (*StableStore, error) {
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	s := &StableStore{
+		log:    log,
+		values: make(map[string][]byte),
+	}
+	lowest, end, err := log.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	for off := lowest; off < end; off++ {
+		record, err := log.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		n, w := binary.Uvarint(record.Value)
+		if w <= 0 || uint64(len(record.Value)-w) < n {
+			return nil, fmt.Errorf("stable store: corrupt record at offset %d", off)
+		}
+		key := string(record.Value[w : w+int(n)])
+		s.values[key] = record.Value[w+int(n):]
+	}
+	return s, nil
+}
+
+func (s *StableStore) Set(key, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value := binary.AppendUvarint(nil, uint64(len(key)))
+	value = append(value, key...)
+	value = append(value, val...)
+	if _, err := s.log.Append(&api.Record{Value: value}); err != nil {
+		return err
+	}
+	s.values[string(key)] = append([]byte(nil), val...)
+	return nil
+}
+
+func (s *StableStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	val, ok := s.values[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return val, nil
+}
+
+func (s *StableStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, binary.BigEndian.AppendUint64(nil, val))
+}
+
+func (s *StableStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("stable store: %q doesn't hold a uint64", key)
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+func (s *StableStore) Close() error {
+	return s.log.Close()
+}
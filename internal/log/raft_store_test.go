@@ -0,0 +1,169 @@
+package log
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	store, err := NewLogStore(dir, c)
+	require.NoError(t, err)
+
+	first, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+	last, err := store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), last)
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 6; i++ {
+		logs = append(logs, &raft.Log{
+			Index: i,
+			Term:  1,
+			Type:  raft.LogCommand,
+			Data:  []byte("hello world"),
+		})
+	}
+	require.NoError(t, store.StoreLogs(logs))
+	require.Error(t, store.StoreLog(&raft.Log{Index: 8, Term: 1}))
+
+	var out raft.Log
+	require.NoError(t, store.GetLog(3, &out))
+	require.Equal(t, *logs[2], out)
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(7, &out))
+
+	// a new leader overwrites the conflicting suffix
+	require.NoError(t, store.DeleteRange(5, 6))
+	require.NoError(t, store.StoreLog(&raft.Log{Index: 5, Term: 2, Data: []byte("replaced")}))
+	require.NoError(t, store.GetLog(5, &out))
+	require.Equal(t, uint64(2), out.Term)
+	last, err = store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), last)
+
+	// a snapshot compacts the prefix a segment at a time
+	require.NoError(t, store.DeleteRange(1, 3))
+	first, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), first)
+	require.Equal(t, raft.ErrLogNotFound, store.GetLog(2, &out))
+	require.NoError(t, store.GetLog(3, &out))
+
+	require.NoError(t, store.Close())
+	store, err = NewLogStore(dir, c)
+	require.NoError(t, err)
+	defer store.Close()
+	first, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), first)
+	last, err = store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), last)
+}
+
+func TestStableStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stable-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewStableStore(dir, Config{})
+	require.NoError(t, err)
+
+	_, err = store.Get([]byte("LastVoteCand"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, store.Set([]byte("LastVoteCand"), []byte("node-0")))
+	require.NoError(t, store.SetUint64([]byte("CurrentTerm"), 1))
+	require.NoError(t, store.SetUint64([]byte("CurrentTerm"), 2))
+	require.NoError(t, store.Close())
+
+	store, err = NewStableStore(dir, Config{})
+	require.NoError(t, err)
+	defer store.Close()
+	val, err := store.Get([]byte("LastVoteCand"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("node-0"), val)
+	term, err := store.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), term)
+}
+
+// runs a single node raft on the stores to check they hold up to raft's use of them
+func TestRaftOnStores(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raft-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "log"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "stable"), 0755))
+	logStore, err := NewLogStore(filepath.Join(dir, "log"), Config{})
+	require.NoError(t, err)
+	defer logStore.Close()
+	stableStore, err := NewStableStore(filepath.Join(dir, "stable"), Config{})
+	require.NoError(t, err)
+	defer stableStore.Close()
+
+	config := raft.DefaultConfig()
+	config.LocalID = "node-0"
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	config.LogOutput = io.Discard
+	addr, transport := raft.NewInmemTransport("")
+	r, err := raft.NewRaft(
+		config,
+		&countFSM{},
+		logStore,
+		stableStore,
+		raft.NewInmemSnapshotStore(),
+		transport,
+	)
+	require.NoError(t, err)
+	defer r.Shutdown()
+	require.NoError(t, r.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{ID: config.LocalID, Address: addr}},
+	}).Error())
+	require.Eventually(t, func() bool {
+		return r.State() == raft.Leader
+	}, 3*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, r.Apply([]byte("hello world"), time.Second).Error())
+	}
+	last, err := logStore.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, r.LastIndex(), last)
+	term, err := stableStore.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.NotZero(t, term)
+}
+
+type countFSM struct {
+	applied int
+}
+
+func (f *countFSM) Apply(*raft.Log) interface{} {
+	f.applied++
+	return nil
+}
+
+func (f *countFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return nil, raft.ErrNothingNewToSnapshot
+}
+
+func (f *countFSM) Restore(snapshot io.ReadCloser) error {
+	return snapshot.Close()
+}
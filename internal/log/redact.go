@@ -0,0 +1,265 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// erases the key and value of the record at off in place, for legal deletion
+// requests. the record keeps its size, so the store's positions and the index
+// stay as they are, see api.Record's redacted, and the erased bytes are synced
+// before it returns. it reports whether it erased anything: transactions'
+// markers, records already redacted and those without a key or a value are
+// left as they are
+func (l *Log) Redact(off uint64) (bool, error) {
+	s := l.segment(off)
+	if s == nil {
+		return false, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	record, err := s.redact(off)
+	if err != nil || record == nil {
+		return false, err
+	}
+	l.Config.Hooks.redacted(off, record)
+	return true, nil
+}
+
+// erases the records a REDACT control record lists, once it's committed: when
+// it's appended to a log that isn't replicated, and when the high watermark
+// passes it on each replica, see ReplicatedLog.applyRedactions. a node that
+// stops in between erases them when it's restarted, see replayRedactions and
+// ReplicatedLog.replayRedactions. records the log doesn't hold anymore are
+// skipped
+func (l *Log) applyRedaction(record *api.Record) error {
+	redaction := &api.Redaction{}
+	if err := proto.Unmarshal(record.Value, redaction); err != nil {
+		return err
+	}
+	for _, off := range redaction.Offsets {
+		if _, err := l.Redact(off); err != nil && !errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return err
+		}
+	}
+	return nil
+}
+
+// where a log that isn't replicated checkpoints the offset its REDACT records
+// are replayed from, in the log dir
+const redactedFile = "redacted"
+
+// applies the REDACT records from the checkpoint on again, a log that stopped
+// between appending one and applying it, or failed to apply it, would otherwise
+// never erase the records it lists. logs from before the checkpoint are
+// replayed whole, once
+func (l *Log) replayRedactions() error {
+	from, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(filepath.Join(l.Dir, redactedFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		off, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %w", redactedFile, err)
+		}
+		l.redactedFrom = off
+		from = max(from, off)
+	}
+	record := api.GetRecord()
+	defer record.Release()
+	var buf []byte
+	for off := from; off < l.NextOffset(); off++ {
+		if buf, err = l.ReadInto(off, record, buf); err != nil {
+			return err
+		}
+		if record.Control != api.Record_REDACT {
+			continue
+		}
+		if err := l.applyRedaction(record); err != nil {
+			return err
+		}
+	}
+	return l.checkpointRedactions()
+}
+
+// notes a REDACT record's being appended, the checkpoint's held back until
+// it's applied
+func (l *Log) startRedaction() {
+	l.redactMu.Lock()
+	defer l.redactMu.Unlock()
+	l.redacting++
+}
+
+// notes the REDACT record appended at off was applied, or wasn't when err isn't
+// nil, in which case it's replayed from there when the log's next opened
+func (l *Log) finishRedaction(off uint64, err error) error {
+	l.redactMu.Lock()
+	l.redacting--
+	if err == nil {
+		l.redactMu.Unlock()
+		return l.checkpointRedactions()
+	}
+	defer l.redactMu.Unlock()
+	l.redactFailed = true
+	if off < l.redactedFrom {
+		if err := l.writeRedacted(off); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// checkpoints the log's end as where the REDACT records are replayed from,
+// unless one's being applied or failed to be
+func (l *Log) checkpointRedactions() error {
+	l.redactMu.Lock()
+	defer l.redactMu.Unlock()
+	if l.redacting > 0 || l.redactFailed {
+		return nil
+	}
+	if next := l.NextOffset(); next != l.redactedFrom {
+		return l.writeRedacted(next)
+	}
+	return nil
+}
+
+// writes the checkpoint through a temporary file, so a crash never leaves a
+// torn one. callers hold redactMu
+func (l *Log) writeRedacted(off uint64) error {
+	path := filepath.Join(l.Dir, redactedFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(off, 10)), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	l.redactedFrom = off
+	return nil
+}
+
+// rewrites the record at off with its key and value erased, returning the
+// record as it's now stored, or nil when there was nothing to erase
+func (s *segment) redact(off uint64) (*api.Record, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || off < s.baseOffset || off >= s.readable.Load() {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return nil, err
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	if record.Redacted != 0 || record.Control != api.Record_DATA || len(record.Key)+len(record.Value) == 0 {
+		return nil, nil
+	}
+	record.Key, record.Value = nil, nil
+	if err := pad(record, len(p)); err != nil {
+		return nil, fmt.Errorf("redacting the record at %d: %w", off, err)
+	}
+	b, err := proto.MarshalOptions{}.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.overwrite(b, pos+lenWidth); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// sets the erased record's redacted and padding so it marshals to size bytes:
+// redacted's varint takes one to five bytes, padding the rest
+func pad(record *api.Record, size int) error {
+	for n := 0; n < 5; n++ {
+		record.Redacted = 1 << (7 * n)
+		record.Padding = nil
+		rest := size - proto.Size(record)
+		if rest == 0 {
+			return nil
+		}
+		// padding takes a byte for its tag and its length's varint
+		for p := max(rest-11, 1); p <= rest-2; p++ {
+			if 1+protowire.SizeVarint(uint64(p))+p == rest {
+				record.Padding = make([]byte, p)
+				return nil
+			}
+		}
+	}
+	return errors.New("the record's too small to keep its size")
+}
+
+// the most records one Redact erases, so its REDACT control record stays small
+const maxRedaction = 10000
+
+// erases the committed records req picks on every replica: the leader appends
+// a REDACT control record listing them, which each replica applies once it's
+// committed, see applyRedactions, and returns once the leader has. records
+// already erased and transactions' markers are skipped, and when there's
+// nothing left to erase nothing's appended
+func (r *ReplicatedLog) Redact(req *api.RedactRequest) (*api.RedactResponse, error) {
+	if !r.IsLeader() {
+		return nil, api.ErrNotLeader{LeaderAddr: r.config.Replication.LeaderAddr}
+	}
+	lowest, end, err := r.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	from, to := lowest, end
+	if len(req.StartKey) == 0 {
+		from, to = max(from, req.StartOffset), min(to, req.EndOffset)
+	}
+	res := &api.RedactResponse{}
+	record := &api.Record{}
+	var buf []byte
+	for off := from; off < to; off++ {
+		if buf, err = r.log.ReadInto(off, record, buf); err != nil {
+			return nil, err
+		}
+		if record.Redacted != 0 || record.Control != api.Record_DATA || len(record.Key)+len(record.Value) == 0 {
+			continue
+		}
+		if len(req.StartKey) > 0 && (bytes.Compare(record.Key, req.StartKey) < 0 ||
+			len(req.EndKey) > 0 && bytes.Compare(record.Key, req.EndKey) >= 0) {
+			continue
+		}
+		if len(res.Offsets) == maxRedaction {
+			return nil, api.ErrRedactionTooLarge{Max: maxRedaction}
+		}
+		res.Offsets = append(res.Offsets, off)
+	}
+	if len(res.Offsets) == 0 {
+		return res, nil
+	}
+	value, err := proto.Marshal(&api.Redaction{Offsets: res.Offsets})
+	if err != nil {
+		return nil, err
+	}
+	if res.Offset, err = r.Append(&api.Record{Control: api.Record_REDACT, Value: value}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,1491 @@
+// a Kafka-like alternative to consensus: one leader takes the writes
+// and the followers pull them, the leader tracks which replicas are in sync (the ISR)
+// and commits a record once every in-sync replica has it
+
+// The high watermark (HW) is the offset of the first uncommitted record:
+// - the leader only acknowledges an append once the HW has moved past it
+// - consumers only see records below the HW, on the leader and the followers
+// - a follower learns the HW from the leader's fetch responses
+// - each replica checkpoints it to its log dir, so after a restart the records
+//   that weren't committed stay hidden until the in-sync replicas have them
+
+// Each leader has an epoch, a fencing token handed out by whoever promotes it,
+// that it stamps on the records it appends so epochs never decrease along the log:
+// - followers send the highest epoch they've seen with every fetch, a leader
+//   that sees a newer epoch than its own is stale and fences itself, it takes
+//   no more writes and fails the appends waiting to be committed
+// - followers ignore leaders older than the highest epoch they've seen
+// - a follower's last record must match the leader's record at the same offset,
+//   otherwise the follower truncates the records the leader doesn't have
+//   (e.g. a stale leader's) instead of interleaving them with the leader's
+// - a leader cut off from its replicas isn't fenced, nothing fetches from it,
+//   so before a linearizable read it waits for a majority of them to fetch
+//   again, see VerifyLeader
+
+// Followers also run an anti-entropy repair: they compare checksums of their
+// committed records with the leader's range by range and, from the first range
+// that differs (e.g. after a disk fault), drop their records and fetch them again.
+// Redactions rewrite records in place once their REDACT record's committed on
+// each replica, so the leader may have erased records a follower hasn't yet: it
+// sends their offsets with the checksums and the follower erases them first.
+
+// A replica catching up (e.g. a new one) fetches from its own last offset, so it
+// resumes where it left off after a blip, and the leader can throttle those fetches.
+// One that's further behind than a fetch copies the leader's sealed segments
+// whole, several at once, see catchUp.
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// where the high watermark's checkpointed, in the log dir
+const highWatermarkFile = "high-watermark"
+
+type ReplicatedLog struct {
+	config Config
+	log    *Log
+	logger *zap.Logger
+
+	mu sync.Mutex
+	// the offset of the first record that isn't committed yet
+	highWatermark uint64
+	// the log's next offset the last time the waiters were woken up
+	logEnd uint64
+	// the leader's epoch, on a follower the highest epoch it has seen
+	epoch uint64
+	// the epoch of the log's last record
+	lastEpoch uint64
+	// on a leader, the newer epoch that superseded it, it takes no more writes once set
+	fencedBy uint64
+	// on a leader, bumped by each linearizable read, see VerifyLeader
+	readRound uint64
+	// the followers that have fetched from this leader, by replica id
+	replicas map[string]*replica
+	// on a leader that restarted with records past its checkpoint, until enough
+	// followers have them, see advance
+	restarted bool
+	// closed and replaced whenever the log or the high watermark moves
+	// so waiting fetches and appends wake up
+	changed chan struct{}
+	// limits the fetches of replicas catching up, nil when they aren't throttled
+	throttle *rate.Limiter
+
+	conn   *grpc.ClientConn
+	client api.LogClient
+	// on a follower, what it learned about the leader from its last successful fetch
+	leaderID  string
+	leaderEnd uint64
+	fetched   time.Time
+	// serializes the follower's appends and repairs
+	appendMu sync.Mutex
+	// the offsets of the REDACT records that aren't applied yet, ascending,
+	// they are once they're committed
+	redactions []uint64
+	// serializes applying them
+	redactMu sync.Mutex
+	// counts the replication events, by event, see the event constants
+	events *prometheus.CounterVec
+	// signaled when the high watermark moves, so it's checkpointed
+	checkpoints chan struct{}
+
+	shutdown chan struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	// on a follower, closed to stop its fetches and repairs, see StopReplicating
+	stopping    chan struct{}
+	stopOnce    sync.Once
+	replicators sync.WaitGroup
+}
+
+// the leader's view of a follower
+type replica struct {
+	// the offset the replica fetched from last, it has every record before it
+	offset uint64
+	// the last time the replica had every record the leader had
+	caughtUp time.Time
+	// the last time the replica fetched, dead replicas are reaped after ReapAfter
+	fetched time.Time
+	inSync  bool
+	// the leader's readRound when the replica last fetched
+	readRound uint64
+}
+
+func NewReplicatedLog(dir string, c Config) (*ReplicatedLog, error) {
+	if c.Replication.MinInSyncReplicas == 0 {
+		c.Replication.MinInSyncReplicas = 1
+	}
+	if c.Replication.MaxLagTime == 0 {
+		c.Replication.MaxLagTime = 10 * time.Second
+	}
+	if c.Replication.AckTimeout == 0 {
+		c.Replication.AckTimeout = 5 * time.Second
+	}
+	if c.Replication.FetchMaxWait == 0 {
+		c.Replication.FetchMaxWait = 500 * time.Millisecond
+	}
+	if c.Replication.FetchMaxRecords == 0 {
+		c.Replication.FetchMaxRecords = 100
+	}
+	if c.Replication.RepairRangeRecords == 0 {
+		c.Replication.RepairRangeRecords = 1000
+	}
+	if c.Logger == nil {
+		c.Logger = zap.NewNop()
+	}
+
+	log, err := newLog(dir, c, true)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReplicatedLog{
+		config:      c,
+		log:         log,
+		logger:      c.Logger.Named("replicator"),
+		events:      newReplicationEvents(),
+		replicas:    make(map[string]*replica),
+		changed:     make(chan struct{}),
+		shutdown:    make(chan struct{}),
+		stopping:    make(chan struct{}),
+		checkpoints: make(chan struct{}, 1),
+		logEnd:      log.NextOffset(),
+	}
+	// the records past the checkpoint may not have been committed before we
+	// restarted, they're committed again once the in-sync replicas have them
+	if r.highWatermark, err = r.readHighWatermark(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	if err := r.writeHighWatermark(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	if err := r.replayRedactions(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	if r.lastEpoch, err = r.readLastEpoch(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	r.epoch = r.lastEpoch
+	if r.IsLeader() {
+		if c.Replication.LeaderEpoch < r.lastEpoch {
+			log.Close()
+			return nil, api.ErrStaleEpoch{
+				Epoch:       c.Replication.LeaderEpoch,
+				LatestEpoch: r.lastEpoch,
+			}
+		}
+		r.epoch = c.Replication.LeaderEpoch
+		r.restarted = r.logEnd > r.highWatermark
+		if n := c.Replication.CatchUpBytesPerSecond; n > 0 {
+			r.throttle = rate.NewLimiter(rate.Limit(n), n)
+		}
+		if c.Registerer != nil {
+			if err := c.Registerer.Register(r); err != nil {
+				log.Close()
+				return nil, err
+			}
+		}
+		r.wg.Add(2)
+		go r.expireReplicas()
+		go r.checkpointHighWatermark()
+		c.Hooks.leadershipChanged(c.Replication.LocalID, r.epoch)
+		return r, nil
+	}
+	r.conn, err = grpc.NewClient(
+		c.Replication.LeaderAddr,
+		c.Replication.DialOptions...,
+	)
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	if c.Registerer != nil {
+		if err := c.Registerer.Register(r); err != nil {
+			r.conn.Close()
+			log.Close()
+			return nil, err
+		}
+	}
+	r.client = api.NewLogClient(r.conn)
+	r.wg.Add(1)
+	go r.checkpointHighWatermark()
+	r.replicators.Add(1)
+	go r.replicate()
+	if c.Replication.RepairInterval > 0 {
+		r.replicators.Add(1)
+		go r.repairs()
+	}
+	return r, nil
+}
+
+func (r *ReplicatedLog) IsLeader() bool {
+	return r.config.Replication.LeaderAddr == ""
+}
+
+// appends the record on the leader and waits until the in-sync replicas have it
+func (r *ReplicatedLog) Append(record *api.Record) (uint64, error) {
+	if !r.IsLeader() {
+		return 0, api.ErrNotLeader{LeaderAddr: r.config.Replication.LeaderAddr}
+	}
+	min := r.config.Replication.MinInSyncReplicas
+	r.mu.Lock()
+	if err := r.fenced(); err != nil {
+		r.mu.Unlock()
+		return 0, err
+	}
+	inSync := r.inSync()
+	r.mu.Unlock()
+	if inSync < min {
+		return 0, api.ErrNotEnoughReplicas{InSync: inSync, MinInSync: min}
+	}
+
+	record.Epoch = r.epoch
+	off, err := r.log.Append(record)
+	if err != nil {
+		return 0, err
+	}
+	r.appended(off, record)
+	r.mu.Lock()
+	moved := r.advance()
+	r.mu.Unlock()
+	if moved {
+		r.committed()
+	}
+
+	timeout := time.NewTimer(r.config.Replication.AckTimeout)
+	defer timeout.Stop()
+	for {
+		r.mu.Lock()
+		committed := r.highWatermark > off
+		fenced := r.fenced()
+		changed := r.changed
+		r.mu.Unlock()
+		if committed {
+			// whoever moved the high watermark may still be applying it
+			if record.Control == api.Record_REDACT {
+				return off, r.applyRedactions()
+			}
+			return off, nil
+		}
+		// a newer leader may never have this record
+		if fenced != nil {
+			return off, fenced
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return off, api.ErrReplicationTimeout{Offset: off}
+		case <-r.shutdown:
+			return off, api.ErrReplicationTimeout{Offset: off}
+		}
+	}
+}
+
+// returns an error unless this node is the leader, only the leader is guaranteed
+// to have every acknowledged record below its high watermark so linearizable
+// reads have to go through it.
+//
+// a leader that's been cut off and replaced isn't fenced until a replica that
+// follows the newer one fetches from it, which may be never, so it waits up to
+// AckTimeout for a majority of the replicas it knows, itself included, to
+// fetch from it after the read arrived. it counts the replicas that aren't in
+// sync too, otherwise once they'd dropped out it'd be a majority on its own.
+// the fetches waiting for records are woken so the replicas come back at once
+func (r *ReplicatedLog) VerifyLeader() error {
+	if err := r.CheckLeader(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	quorum := (len(r.replicas)+1)/2 + 1
+	if quorum == 1 {
+		r.mu.Unlock()
+		return nil
+	}
+	r.readRound++
+	round := r.readRound
+	r.notify()
+	r.mu.Unlock()
+
+	timeout := time.NewTimer(r.config.Replication.AckTimeout)
+	defer timeout.Stop()
+	for {
+		r.mu.Lock()
+		if err := r.fenced(); err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		confirmed := 1
+		for _, rep := range r.replicas {
+			if rep.readRound >= round {
+				confirmed++
+			}
+		}
+		changed := r.changed
+		r.mu.Unlock()
+		if confirmed >= quorum {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return api.ErrNotEnoughReplicas{InSync: confirmed, MinInSync: quorum}
+		case <-r.shutdown:
+			return api.ErrNotEnoughReplicas{InSync: confirmed, MinInSync: quorum}
+		}
+	}
+}
+
+// returns an error on followers, and on a leader once it's fenced
+func (r *ReplicatedLog) CheckLeader() error {
+	if !r.IsLeader() {
+		return api.ErrNotLeader{LeaderAddr: r.config.Replication.LeaderAddr}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.fenced()
+}
+
+// reads committed records, consumers never see records the in-sync replicas might not have
+func (r *ReplicatedLog) Read(off uint64) (*api.Record, error) {
+	if off >= r.HighWatermark() {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return r.log.Read(off)
+}
+
+// reads a committed record as Read does, into record and buf, see Log.ReadInto
+func (r *ReplicatedLog) ReadInto(off uint64, record *api.Record, buf []byte) ([]byte, error) {
+	if off >= r.HighWatermark() {
+		return buf, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return r.log.ReadInto(off, record, buf)
+}
+
+func (r *ReplicatedLog) HighWatermark() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.highWatermark
+}
+
+// the offset the node's next record goes at, past the high watermark while the
+// records in between aren't committed
+func (r *ReplicatedLog) LogEndOffset() uint64 {
+	return r.log.NextOffset()
+}
+
+// how many records the slowest in-sync follower doesn't have yet, zero on a
+// follower
+func (r *ReplicatedLog) Unreplicated() uint64 {
+	if !r.IsLeader() {
+		return 0
+	}
+	end, hw := r.LogEndOffset(), r.HighWatermark()
+	if end <= hw {
+		return 0
+	}
+	return end - hw
+}
+
+// the end is the high watermark since consumers can't read past it
+func (r *ReplicatedLog) GetOffsets() (lowest, end uint64, err error) {
+	if lowest, err = r.log.LowestOffset(); err != nil {
+		return 0, 0, err
+	}
+	return lowest, r.HighWatermark(), nil
+}
+
+func (r *ReplicatedLog) Segments() []SegmentInfo {
+	return r.log.Segments()
+}
+
+func (r *ReplicatedLog) DescribeSegments(req *api.DescribeSegmentsRequest) (*api.DescribeSegmentsResponse, error) {
+	return r.log.DescribeSegments(req)
+}
+
+func (r *ReplicatedLog) LastSync() time.Time {
+	return r.log.LastSync()
+}
+
+// serves a follower's fetch on the leader
+// the fetch offset acknowledges every record before it, so it's also how
+// followers move the high watermark
+// waits up to FetchMaxWait for new records when the follower is caught up
+func (r *ReplicatedLog) Fetch(
+	ctx context.Context,
+	req *api.FetchRequest,
+) (*api.FetchResponse, error) {
+	if !r.IsLeader() {
+		return nil, api.ErrNotLeader{LeaderAddr: r.config.Replication.LeaderAddr}
+	}
+	r.mu.Lock()
+	fenced := req.Epoch > r.epoch && req.Epoch > r.fencedBy
+	if fenced {
+		// the replica has followed a newer leader
+		r.fencedBy = req.Epoch
+		r.notify()
+		r.events.WithLabelValues(eventFenced).Inc()
+		r.logger.Warn(
+			"fenced by a newer leader, taking no more writes",
+			zap.String("replica", req.ReplicaId),
+			zap.Uint64("epoch", r.epoch),
+			zap.Uint64("newer_epoch", req.Epoch),
+		)
+	}
+	err := r.fenced()
+	r.mu.Unlock()
+	if fenced {
+		r.config.Hooks.leadershipChanged("", req.Epoch)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	offset := req.Offset
+	// the records were removed, e.g. to free disk space, so the replica starts
+	// over from the oldest one there is
+	if lowest, err := r.log.LowestOffset(); err != nil {
+		return nil, err
+	} else if offset < lowest {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	if truncate, diverged, err := r.divergence(offset, req.LastEpoch); err != nil {
+		return nil, err
+	} else if diverged {
+		return &api.FetchResponse{
+			Epoch:          r.epoch,
+			LeaderId:       r.config.Replication.LocalID,
+			Diverged:       true,
+			TruncateOffset: truncate,
+		}, nil
+	}
+
+	next := r.log.NextOffset()
+	r.mu.Lock()
+	rep, ok := r.replicas[req.ReplicaId]
+	if !ok {
+		rep = &replica{}
+		r.replicas[req.ReplicaId] = rep
+	}
+	rep.offset = offset
+	rep.fetched = time.Now()
+	if rep.readRound < r.readRound {
+		// confirms this node still leads to the reads waiting on it
+		rep.readRound = r.readRound
+		r.notify()
+	}
+	if offset == next {
+		rep.caughtUp = time.Now()
+	}
+	// a replica (re)joins the in-sync set once it has every committed record
+	if !rep.inSync && offset >= r.highWatermark {
+		rep.inSync = true
+		rep.caughtUp = time.Now()
+		r.events.WithLabelValues(eventISRExpand).Inc()
+		r.logger.Info(
+			"replica joined the in-sync set",
+			zap.String("replica", req.ReplicaId),
+			zap.Uint64("offset", offset),
+		)
+	}
+	moved := r.advance()
+	changed := r.changed
+	throttled := r.throttle != nil && !rep.inSync
+	r.mu.Unlock()
+	if moved {
+		r.committed()
+	}
+
+	if offset == next {
+		wait := time.NewTimer(r.config.Replication.FetchMaxWait)
+		defer wait.Stop()
+		select {
+		case <-changed:
+		case <-wait.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-r.shutdown:
+		}
+	}
+
+	res := &api.FetchResponse{
+		Epoch:    r.epoch,
+		LeaderId: r.config.Replication.LocalID,
+	}
+	next = r.log.NextOffset()
+	var size int
+	for off := offset; off < next && len(res.Records) < r.config.Replication.FetchMaxRecords; off++ {
+		record, err := r.log.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		// a throttled fetch returns at most a second's worth of records, though
+		// always at least one so a record larger than that still gets through
+		n := proto.Size(record)
+		if throttled && len(res.Records) > 0 && size+n > r.throttle.Burst() {
+			break
+		}
+		size += n
+		res.Records = append(res.Records, record)
+	}
+	if throttled && size > 0 {
+		if err := r.throttle.WaitN(ctx, min(size, r.throttle.Burst())); err != nil {
+			return nil, err
+		}
+	}
+	res.HighWatermark = r.HighWatermark()
+	res.LogEndOffset = next
+	res.SealedEndOffset = r.sealedEnd()
+	return res, nil
+}
+
+// checks the replica's last record, the one before offset, was appended in
+// the same epoch as the leader's record at that offset
+// when they differ it returns the offset the replica has to truncate its log
+// to: the end of the replica's last epoch in the leader's log, always before
+// offset so the replica makes progress even if it has to go back a few times
+func (r *ReplicatedLog) divergence(offset, lastEpoch uint64) (uint64, bool, error) {
+	lowest, err := r.log.LowestOffset()
+	if err != nil {
+		return 0, false, err
+	}
+	next := r.log.NextOffset()
+	if offset > next {
+		// the replica has records the leader doesn't
+		offset = next + 1
+	} else if offset <= lowest {
+		return 0, false, nil
+	} else {
+		record, err := r.log.Read(offset - 1)
+		if err != nil {
+			return 0, false, err
+		}
+		if record.Epoch == lastEpoch {
+			return 0, false, nil
+		}
+	}
+	// epochs never decrease along the log so the first record
+	// appended after lastEpoch can be binary searched, reading into one record
+	record := api.GetRecord()
+	defer record.Release()
+	var buf []byte
+	var searchErr error
+	end := lowest + uint64(sort.Search(int(offset-1-lowest), func(i int) bool {
+		var err error
+		buf, err = r.log.ReadInto(lowest+uint64(i), record, buf)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return record.Epoch > lastEpoch
+	}))
+	if searchErr != nil {
+		return 0, false, searchErr
+	}
+	return end, true, nil
+}
+
+// returns the checksums of consecutive ranges of rangeRecords records starting
+// at offset, stopping at the last complete range the log has
+func (r *ReplicatedLog) Checksums(offset, rangeRecords, ranges uint64) (checksums []uint32, redacted []uint64, err error) {
+	if rangeRecords == 0 {
+		return nil, nil, nil
+	}
+	next := r.log.NextOffset()
+	for i := uint64(0); i < ranges; i++ {
+		from := offset + i*rangeRecords
+		if from+rangeRecords > next {
+			break
+		}
+		sum, err := r.log.checksum(from, from+rangeRecords, func(off uint64) {
+			redacted = append(redacted, off)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		checksums = append(checksums, sum)
+	}
+	return checksums, redacted, nil
+}
+
+// describes the in-sync set and how far behind each follower is, only the leader knows
+func (r *ReplicatedLog) DescribeReplication() (*api.Replication, error) {
+	if !r.IsLeader() {
+		return nil, api.ErrNotLeader{LeaderAddr: r.config.Replication.LeaderAddr}
+	}
+	next := r.log.NextOffset()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replication := &api.Replication{
+		LeaderEpoch:       r.epoch,
+		LeaderId:          r.config.Replication.LocalID,
+		HighWatermark:     r.highWatermark,
+		LogEndOffset:      next,
+		MinInSyncReplicas: uint32(r.config.Replication.MinInSyncReplicas),
+	}
+	for id, rep := range r.replicas {
+		var lag uint64
+		if rep.offset < next {
+			lag = next - rep.offset
+		}
+		replication.Replicas = append(replication.Replicas, &api.Replica{
+			Id:     id,
+			Offset: rep.offset,
+			Lag:    lag,
+			LagMs:  uint64(time.Since(rep.caughtUp).Milliseconds()),
+			InSync: rep.inSync,
+		})
+	}
+	sort.Slice(replication.Replicas, func(i, j int) bool {
+		return replication.Replicas[i].Id < replication.Replicas[j].Id
+	})
+	return replication, nil
+}
+
+// describes the log like Log.DescribeLog, with the high watermark and the
+// nodes holding it as this node knows them
+func (r *ReplicatedLog) DescribeLog() (*api.LogDescription, error) {
+	d, err := r.log.DescribeLog()
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d.HighWatermark = r.highWatermark
+	d.ReplicaIds = []string{r.config.Replication.LocalID}
+	if r.IsLeader() {
+		d.LeaderId = r.config.Replication.LocalID
+		for id := range r.replicas {
+			d.ReplicaIds = append(d.ReplicaIds, id)
+		}
+	} else {
+		d.LeaderId = r.leaderID
+		if r.leaderID != "" {
+			d.ReplicaIds = append(d.ReplicaIds, r.leaderID)
+		}
+	}
+	sort.Strings(d.ReplicaIds)
+	return d, nil
+}
+
+// describes the cluster from this node's point of view: the leader knows every
+// follower that fetches from it while a follower only knows itself and the leader
+func (r *ReplicatedLog) GetClusterStatus() (*api.ClusterStatus, error) {
+	next := r.log.NextOffset()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := &api.ClusterStatus{
+		NodeId:        r.config.Replication.LocalID,
+		IsLeader:      r.IsLeader(),
+		Epoch:         r.epoch,
+		HighWatermark: r.highWatermark,
+		LogEndOffset:  next,
+	}
+	self := &api.NodeStatus{
+		Id:           r.config.Replication.LocalID,
+		IsLeader:     r.IsLeader(),
+		Healthy:      r.fencedBy == 0,
+		InSync:       true,
+		LogEndOffset: next,
+	}
+	if r.IsLeader() {
+		status.LeaderId = r.config.Replication.LocalID
+		status.LeaderAddr = r.config.Replication.LocalAddr
+		status.Nodes = append(status.Nodes, self)
+		for id, rep := range r.replicas {
+			status.Nodes = append(status.Nodes, &api.NodeStatus{
+				Id:            id,
+				Healthy:       time.Since(rep.fetched) <= r.config.Replication.MaxLagTime,
+				InSync:        rep.inSync,
+				LogEndOffset:  rep.offset,
+				LastContactMs: uint64(time.Since(rep.fetched).Milliseconds()),
+			})
+		}
+	} else {
+		status.LeaderId = r.leaderID
+		status.LeaderAddr = r.config.Replication.LeaderAddr
+		self.InSync = next >= r.leaderEnd
+		leader := &api.NodeStatus{
+			Id:           r.leaderID,
+			IsLeader:     true,
+			InSync:       true,
+			LogEndOffset: r.leaderEnd,
+		}
+		if !r.fetched.IsZero() {
+			leader.Healthy = time.Since(r.fetched) <= r.config.Replication.MaxLagTime
+			leader.LastContactMs = uint64(time.Since(r.fetched).Milliseconds())
+		}
+		status.Nodes = append(status.Nodes, leader, self)
+	}
+	sort.SliceStable(status.Nodes[1:], func(i, j int) bool {
+		return status.Nodes[i+1].Id < status.Nodes[j+1].Id
+	})
+	return status, nil
+}
+
+// the replication events counted, a leader change is a follower fetching from
+// a leader with a newer epoch than the one it followed
+const (
+	eventISRExpand    = "isr_expand"
+	eventISRShrink    = "isr_shrink"
+	eventFenced       = "fenced"
+	eventLeaderChange = "leader_change"
+	eventFetchError   = "fetch_error"
+	eventTruncation   = "truncation"
+	eventRepairError  = "repair_error"
+	eventSegmentCopy  = "segment_copy"
+	eventCatchUpError = "catch_up_error"
+)
+
+func newReplicationEvents() *prometheus.CounterVec {
+	events := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_replication_events_total",
+		Help: "Replication events: in-sync set changes, fencing, leader changes, failed fetches and repairs, truncations, segments copied by replicas catching up and failed catch-ups.",
+	}, []string{"event"})
+	// the events that haven't happened yet still show up, at zero
+	for _, e := range []string{
+		eventISRExpand,
+		eventISRShrink,
+		eventFenced,
+		eventLeaderChange,
+		eventFetchError,
+		eventTruncation,
+		eventRepairError,
+		eventSegmentCopy,
+		eventCatchUpError,
+	} {
+		events.WithLabelValues(e)
+	}
+	return events
+}
+
+var (
+	highWatermarkDesc = prometheus.NewDesc(
+		"proglog_replication_high_watermark",
+		"The offset of the first record that isn't committed yet.",
+		nil, nil,
+	)
+	logEndOffsetDesc = prometheus.NewDesc(
+		"proglog_replication_log_end_offset",
+		"The offset the node's next record goes at.",
+		nil, nil,
+	)
+	epochDesc = prometheus.NewDesc(
+		"proglog_replication_epoch",
+		"The leader's epoch, on a follower the newest epoch it has seen.",
+		nil, nil,
+	)
+	leaderDesc = prometheus.NewDesc(
+		"proglog_replication_leader",
+		"1 when the node leads and no newer leader has fenced it, 0 otherwise.",
+		nil, nil,
+	)
+	leaderLagDesc = prometheus.NewDesc(
+		"proglog_replication_leader_lag_records",
+		"On a follower, the records it's behind the leader's log end as of its last fetch.",
+		nil, nil,
+	)
+	inSyncReplicasDesc = prometheus.NewDesc(
+		"proglog_replication_in_sync_replicas",
+		"The number of in-sync replicas, the leader included.",
+		nil, nil,
+	)
+	replicaLagDesc = prometheus.NewDesc(
+		"proglog_replication_replica_lag_records",
+		"The number of records a follower is behind the leader's log end.",
+		[]string{"replica"}, nil,
+	)
+	replicaLagSecondsDesc = prometheus.NewDesc(
+		"proglog_replication_replica_lag_seconds",
+		"How long since a follower last had every record the leader had.",
+		[]string{"replica"}, nil,
+	)
+)
+
+func (r *ReplicatedLog) Describe(ch chan<- *prometheus.Desc) {
+	r.events.Describe(ch)
+	ch <- highWatermarkDesc
+	ch <- logEndOffsetDesc
+	ch <- epochDesc
+	ch <- leaderDesc
+	ch <- leaderLagDesc
+	ch <- inSyncReplicasDesc
+	ch <- replicaLagDesc
+	ch <- replicaLagSecondsDesc
+}
+
+// every node reports its own view, only the leader reports the followers'
+func (r *ReplicatedLog) Collect(ch chan<- prometheus.Metric) {
+	r.events.Collect(ch)
+	next := r.log.NextOffset()
+	r.mu.Lock()
+	hw, epoch, leaderEnd := r.highWatermark, r.epoch, r.leaderEnd
+	leading := r.IsLeader() && r.fencedBy == 0
+	r.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(highWatermarkDesc, prometheus.GaugeValue, float64(hw))
+	ch <- prometheus.MustNewConstMetric(logEndOffsetDesc, prometheus.GaugeValue, float64(next))
+	ch <- prometheus.MustNewConstMetric(epochDesc, prometheus.GaugeValue, float64(epoch))
+	var leader float64
+	if leading {
+		leader = 1
+	}
+	ch <- prometheus.MustNewConstMetric(leaderDesc, prometheus.GaugeValue, leader)
+	if !r.IsLeader() {
+		var lag uint64
+		if next < leaderEnd {
+			lag = leaderEnd - next
+		}
+		ch <- prometheus.MustNewConstMetric(leaderLagDesc, prometheus.GaugeValue, float64(lag))
+		return
+	}
+
+	replication, err := r.DescribeReplication()
+	if err != nil {
+		return
+	}
+	inSync := 1
+	for _, rep := range replication.Replicas {
+		if rep.InSync {
+			inSync++
+		}
+		ch <- prometheus.MustNewConstMetric(
+			replicaLagDesc,
+			prometheus.GaugeValue,
+			float64(rep.Lag),
+			rep.Id,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			replicaLagSecondsDesc,
+			prometheus.GaugeValue,
+			float64(rep.LagMs)/1000,
+			rep.Id,
+		)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		inSyncReplicasDesc,
+		prometheus.GaugeValue,
+		float64(inSync),
+	)
+}
+
+// stops a follower fetching from the leader and repairing its log, it serves
+// what it has until it's closed. a node that left the cluster stops it before
+// it stops serving, so the leader doesn't track it again. leaders carry on
+func (r *ReplicatedLog) StopReplicating() {
+	r.stopOnce.Do(func() {
+		close(r.stopping)
+	})
+	r.replicators.Wait()
+}
+
+func (r *ReplicatedLog) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.shutdown)
+	r.mu.Unlock()
+
+	if r.config.Registerer != nil {
+		r.config.Registerer.Unregister(r)
+	}
+
+	r.StopReplicating()
+	r.wg.Wait()
+	if r.conn != nil {
+		if err := r.conn.Close(); err != nil {
+			return err
+		}
+	}
+	return r.log.Close()
+}
+
+// stops tracking a replica that left the cluster, so the leader commits without it
+// right away instead of waiting for it to fall out of the in-sync set
+func (r *ReplicatedLog) RemoveReplica(id string) {
+	r.mu.Lock()
+	delete(r.replicas, id)
+	moved := r.advance()
+	r.mu.Unlock()
+	if moved {
+		r.committed()
+	}
+}
+
+// removes the oldest segments, whose records are all below lowest, e.g. to free
+// disk space. the active segment's kept
+func (r *ReplicatedLog) Truncate(lowest uint64) error {
+	return r.log.Truncate(lowest)
+}
+
+func (r *ReplicatedLog) Remove() error {
+	if err := r.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(r.log.Dir)
+}
+
+// counts the in-sync replicas, the leader included
+// callers hold the lock
+func (r *ReplicatedLog) inSync() int {
+	n := 1
+	for _, rep := range r.replicas {
+		if rep.inSync {
+			n++
+		}
+	}
+	return n
+}
+
+// drops the replicas that fell behind for too long from the in-sync set and
+// moves the high watermark up to the lowest offset the in-sync replicas have,
+// returning whether it moved. callers hold the lock, and run the OnCommit hook
+// once they've released it when it moved.
+//
+// a restarted leader doesn't know which followers were in sync before, so it
+// holds the high watermark at its checkpoint until MinInSyncReplicas-1 of them
+// have fetched past it, otherwise it'd commit the tail on its own
+func (r *ReplicatedLog) advance() bool {
+	next := r.log.NextOffset()
+	hw := next
+	past := 0
+	for id, rep := range r.replicas {
+		if !rep.inSync {
+			continue
+		}
+		if time.Since(rep.caughtUp) > r.config.Replication.MaxLagTime {
+			rep.inSync = false
+			r.events.WithLabelValues(eventISRShrink).Inc()
+			r.logger.Warn(
+				"replica fell out of the in-sync set",
+				zap.String("replica", id),
+				zap.Uint64("offset", rep.offset),
+				zap.Duration("lag", time.Since(rep.caughtUp)),
+			)
+			continue
+		}
+		if rep.offset > r.highWatermark {
+			past++
+		}
+		if rep.offset < hw {
+			hw = rep.offset
+		}
+	}
+	if r.restarted {
+		if past < r.config.Replication.MinInSyncReplicas-1 {
+			hw = r.highWatermark
+		} else {
+			r.restarted = false
+		}
+	}
+	if hw <= r.highWatermark && next == r.logEnd {
+		return false
+	}
+	moved := hw > r.highWatermark
+	if moved {
+		r.highWatermark = hw
+	}
+	r.logEnd = next
+	r.notify()
+	return moved
+}
+
+// applies the REDACT records committed before the high watermark's
+// checkpointed, and runs the OnCommit hook with it, callers don't hold the lock
+func (r *ReplicatedLog) committed() {
+	if err := r.applyRedactions(); err != nil {
+		r.logger.Error("erasing redacted records", zap.Error(err))
+	}
+	r.checkpoint()
+	r.config.Hooks.committed(r.HighWatermark())
+}
+
+// notes the REDACT records from the checkpointed high watermark on, which is
+// never past one that wasn't applied, see writeHighWatermark. they're applied
+// once they're committed again
+func (r *ReplicatedLog) replayRedactions() error {
+	record := api.GetRecord()
+	defer record.Release()
+	var buf []byte
+	var err error
+	for off := r.highWatermark; off < r.logEnd; off++ {
+		if buf, err = r.log.ReadInto(off, record, buf); err != nil {
+			return err
+		}
+		if record.Control == api.Record_REDACT {
+			r.redactions = append(r.redactions, off)
+		}
+	}
+	return nil
+}
+
+// notes the REDACT record appended at off, it's applied once it's committed
+func (r *ReplicatedLog) appended(off uint64, record *api.Record) {
+	if record.Control != api.Record_REDACT {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, _ := slices.BinarySearch(r.redactions, off)
+	r.redactions = slices.Insert(r.redactions, i, off)
+}
+
+// erases the records the committed REDACT records list, oldest first. one that
+// fails is retried on the next commit
+func (r *ReplicatedLog) applyRedactions() error {
+	r.redactMu.Lock()
+	defer r.redactMu.Unlock()
+	for {
+		r.mu.Lock()
+		if len(r.redactions) == 0 || r.redactions[0] >= r.highWatermark {
+			r.mu.Unlock()
+			return nil
+		}
+		off := r.redactions[0]
+		r.mu.Unlock()
+		record, err := r.log.Read(off)
+		if err == nil {
+			err = r.log.applyRedaction(record)
+		}
+		// retention may have removed it
+		if err != nil && !errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return err
+		}
+		r.mu.Lock()
+		// a truncation may have dropped it meanwhile
+		if len(r.redactions) > 0 && r.redactions[0] == off {
+			r.redactions = r.redactions[1:]
+		}
+		r.mu.Unlock()
+	}
+}
+
+// wakes up the waiters, appends wait on the high watermark and
+// fetches wait on the end of the log
+// callers hold the lock
+func (r *ReplicatedLog) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// returns an error once a newer leader superseded this one
+// callers hold the lock
+func (r *ReplicatedLog) fenced() error {
+	if r.fencedBy == 0 {
+		return nil
+	}
+	return api.ErrStaleEpoch{Epoch: r.epoch, LatestEpoch: r.fencedBy}
+}
+
+// reads the checkpointed high watermark, capped at the log's end. logs from
+// before it was checkpointed, and restored ones, only hold committed records
+func (r *ReplicatedLog) readHighWatermark() (uint64, error) {
+	next := r.log.NextOffset()
+	b, err := os.ReadFile(filepath.Join(r.log.Dir, highWatermarkFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return next, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	hw, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", highWatermarkFile, err)
+	}
+	return min(hw, next), nil
+}
+
+// checkpoints the high watermark through a temporary file, so a crash never
+// leaves a torn one. it's held at the first REDACT record that isn't applied
+// yet, the ones before it aren't replayed when the log's reopened
+func (r *ReplicatedLog) writeHighWatermark() error {
+	path := filepath.Join(r.log.Dir, highWatermarkFile)
+	tmp := path + ".tmp"
+	r.mu.Lock()
+	off := r.highWatermark
+	if len(r.redactions) > 0 {
+		off = min(off, r.redactions[0])
+	}
+	r.mu.Unlock()
+	hw := strconv.FormatUint(off, 10)
+	if err := os.WriteFile(tmp, []byte(hw), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// asks for the high watermark to be checkpointed, the checkpoints of moves
+// made while one's written are coalesced into the next
+func (r *ReplicatedLog) checkpoint() {
+	select {
+	case r.checkpoints <- struct{}{}:
+	default:
+	}
+}
+
+// writes the checkpoints asked for, and a last one on shutdown
+func (r *ReplicatedLog) checkpointHighWatermark() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.checkpoints:
+		case <-r.shutdown:
+			if err := r.writeHighWatermark(); err != nil {
+				r.logger.Error("checkpointing the high watermark", zap.Error(err))
+			}
+			return
+		}
+		// a failed checkpoint is retried when the high watermark next moves
+		if err := r.writeHighWatermark(); err != nil {
+			r.logger.Warn("checkpointing the high watermark", zap.Error(err))
+		}
+	}
+}
+
+// returns the epoch of the log's last record, zero when the log is empty
+func (r *ReplicatedLog) readLastEpoch() (uint64, error) {
+	lowest, end, err := r.log.GetOffsets()
+	if err != nil || end <= lowest {
+		return 0, err
+	}
+	record, err := r.log.Read(end - 1)
+	if err != nil {
+		return 0, err
+	}
+	return record.Epoch, nil
+}
+
+// on the leader, shrinks the in-sync set when a replica stops fetching
+// altogether, otherwise a dead replica would hold the high watermark back forever
+// and forgets the replicas that have been gone for longer than ReapAfter
+func (r *ReplicatedLog) expireReplicas() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.config.Replication.MaxLagTime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.shutdown:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			moved := r.advance()
+			r.reap()
+			r.mu.Unlock()
+			if moved {
+				r.committed()
+			}
+		}
+	}
+}
+
+// removes the out-of-sync replicas that haven't fetched for ReapAfter
+// callers hold the lock
+func (r *ReplicatedLog) reap() {
+	if r.config.Replication.ReapAfter == 0 {
+		return
+	}
+	for id, rep := range r.replicas {
+		if !rep.inSync && time.Since(rep.fetched) > r.config.Replication.ReapAfter {
+			delete(r.replicas, id)
+			r.logger.Info("forgot a replica that stopped fetching", zap.String("replica", id))
+		}
+	}
+}
+
+// on a follower, pulls records from the leader starting at the end of
+// the local log and appends them under the same offsets
+func (r *ReplicatedLog) replicate() {
+	defer r.replicators.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-r.stopping
+		cancel()
+	}()
+
+	backoff := 50 * time.Millisecond
+	for {
+		select {
+		case <-r.stopping:
+			return
+		default:
+		}
+		if err := r.fetch(ctx); err != nil {
+			r.events.WithLabelValues(eventFetchError).Inc()
+			r.logger.Warn(
+				"fetching from the leader",
+				zap.String("leader", r.config.Replication.LeaderAddr),
+				zap.Duration("backoff", backoff),
+				zap.Error(err),
+			)
+			select {
+			case <-r.stopping:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < r.config.Replication.MaxLagTime {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = 50 * time.Millisecond
+	}
+}
+
+func (r *ReplicatedLog) fetch(ctx context.Context) error {
+	r.mu.Lock()
+	req := &api.FetchRequest{
+		ReplicaId: r.config.Replication.LocalID,
+		Offset:    r.log.NextOffset(),
+		Epoch:     r.epoch,
+		LastEpoch: r.lastEpoch,
+	}
+	r.mu.Unlock()
+	res, err := r.client.Fetch(ctx, req)
+	if status.Code(err) == status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()) {
+		return r.startOver(ctx, req.Offset)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if res.Epoch < r.epoch {
+		r.mu.Unlock()
+		return api.ErrStaleEpoch{Epoch: res.Epoch, LatestEpoch: r.epoch}
+	}
+	changed := res.Epoch > r.epoch || res.LeaderId != r.leaderID
+	if changed {
+		r.events.WithLabelValues(eventLeaderChange).Inc()
+		r.logger.Info(
+			"following a new leader",
+			zap.String("leader", res.LeaderId),
+			zap.Uint64("epoch", res.Epoch),
+		)
+	}
+	r.epoch = res.Epoch
+	r.leaderID = res.LeaderId
+	r.leaderEnd = res.LogEndOffset
+	r.fetched = time.Now()
+	r.mu.Unlock()
+	if changed {
+		r.config.Hooks.leadershipChanged(res.LeaderId, res.Epoch)
+	}
+	if res.Diverged {
+		return r.truncate(res.TruncateOffset)
+	}
+
+	if err := r.appendFetched(res.Records); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	hw := res.HighWatermark
+	if next := r.log.NextOffset(); next < hw {
+		hw = next
+	}
+	moved := hw > r.highWatermark
+	if moved {
+		r.highWatermark = hw
+	}
+	r.mu.Unlock()
+	if moved {
+		r.committed()
+	}
+
+	// more than a fetch's worth of records sit in sealed segments, they're
+	// copied whole. the fetch checked the log hasn't diverged from the leader's
+	if r.config.Replication.CatchUpSegments > 0 &&
+		res.SealedEndOffset > r.log.NextOffset()+uint64(r.config.Replication.FetchMaxRecords) {
+		if err := r.catchUp(ctx); err != nil && ctx.Err() == nil {
+			// the records are fetched instead
+			r.events.WithLabelValues(eventCatchUpError).Inc()
+			r.logger.Warn("copying the leader's segments", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// appends the records a fetch returned under the offsets the leader gave them
+func (r *ReplicatedLog) appendFetched(records []*api.Record) error {
+	r.appendMu.Lock()
+	defer r.appendMu.Unlock()
+	for _, record := range records {
+		// a repair may have truncated the log while the fetch was in flight
+		if next := r.log.NextOffset(); record.Offset != next {
+			return fmt.Errorf(
+				"fetched offset %d doesn't follow the log's end %d",
+				record.Offset,
+				next,
+			)
+		}
+		r.mu.Lock()
+		lastEpoch := r.lastEpoch
+		r.mu.Unlock()
+		if record.Epoch < lastEpoch {
+			return api.ErrStaleEpoch{Epoch: record.Epoch, LatestEpoch: lastEpoch}
+		}
+		off, err := r.log.Append(record)
+		if err != nil {
+			return err
+		}
+		r.appended(off, record)
+		r.mu.Lock()
+		r.lastEpoch = record.Epoch
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// on a follower, periodically compares the committed records with the leader's
+func (r *ReplicatedLog) repairs() {
+	defer r.replicators.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-r.stopping
+		cancel()
+	}()
+
+	ticker := time.NewTicker(r.config.Replication.RepairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopping:
+			return
+		case <-ticker.C:
+			// a failed pass is retried on the next tick
+			if err := r.repair(ctx); err != nil {
+				r.events.WithLabelValues(eventRepairError).Inc()
+				r.logger.Warn("repairing the log", zap.Error(err))
+			}
+		}
+	}
+}
+
+// compares the checksums of the committed ranges with the leader's and drops
+// everything from the first range that differs, the replicate loop then
+// fetches the dropped records again
+func (r *ReplicatedLog) repair(ctx context.Context) error {
+	const batch = 100
+	size := r.config.Replication.RepairRangeRecords
+	lowest, err := r.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	// ranges line up with the leader's, the first one is skipped when
+	// the oldest records were truncated away
+	start := (lowest + size - 1) / size * size
+	end := r.HighWatermark()
+	for from := start; from+size <= end; from += batch * size {
+		ranges := (end - from) / size
+		if ranges > batch {
+			ranges = batch
+		}
+		res, err := r.client.GetChecksums(ctx, &api.GetChecksumsRequest{
+			Offset:       from,
+			RangeRecords: size,
+			Ranges:       ranges,
+		})
+		if err != nil {
+			return err
+		}
+		// the leader erased them once their REDACT records were committed, this
+		// replica may not have fetched those yet
+		for _, off := range res.Redacted {
+			if _, err := r.log.Redact(off); err != nil && !errors.As(err, &api.ErrOffsetOutOfRange{}) {
+				return err
+			}
+		}
+		for i, want := range res.Checksums {
+			off := from + uint64(i)*size
+			got, err := r.log.Checksum(off, off+size)
+			if err == nil && got == want {
+				continue
+			}
+			return r.truncate(off)
+		}
+	}
+	return nil
+}
+
+// on a follower whose log ends before the leader's oldest record, drops its
+// records and starts its log over at the leader's oldest record, the next
+// fetches copy the leader's sealed segments or fetch the records from there
+func (r *ReplicatedLog) startOver(ctx context.Context, offset uint64) error {
+	res, err := r.client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if err != nil {
+		return err
+	}
+	if offset >= res.LowestOffset {
+		return api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	r.appendMu.Lock()
+	defer r.appendMu.Unlock()
+	if err := r.log.TruncateAll(res.LowestOffset); err != nil {
+		return err
+	}
+	r.logger.Warn(
+		"fell behind the leader's oldest record, starting the log over",
+		zap.Uint64("offset", offset),
+		zap.Uint64("leader_lowest_offset", res.LowestOffset),
+	)
+	r.events.WithLabelValues(eventTruncation).Inc()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.highWatermark = res.LowestOffset
+	r.checkpoint()
+	r.lastEpoch = 0
+	r.redactions = nil
+	return nil
+}
+
+// drops the records at and after off and lowers the high watermark to match
+func (r *ReplicatedLog) truncate(off uint64) error {
+	r.appendMu.Lock()
+	defer r.appendMu.Unlock()
+	if err := r.log.TruncateFrom(off); err != nil {
+		return err
+	}
+	r.logger.Info("truncated the log", zap.Uint64("offset", off))
+	r.events.WithLabelValues(eventTruncation).Inc()
+	lastEpoch, err := r.readLastEpoch()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.highWatermark > off {
+		r.highWatermark = off
+		r.checkpoint()
+	}
+	r.lastEpoch = lastEpoch
+	i, _ := slices.BinarySearch(r.redactions, off)
+	r.redactions = r.redactions[:i]
+	return nil
+}
@@ -0,0 +1,1031 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestReplicatedLog(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"followers replicate committed records":      testReplicate,
+		"followers reject appends":                   testFollowerAppend,
+		"appends need enough in-sync replicas":       testNotEnoughReplicas,
+		"lagging replicas leave the in-sync set":     testShrinkInSync,
+		"followers repair diverged records":          testRepair,
+		"leader describes replication lag":           testDescribeReplication,
+		"leader reaps dead replicas":                 testReap,
+		"records carry the leader epoch":             testEpoch,
+		"stale leaders are fenced":                   testFenceStaleLeader,
+		"cut off leaders don't read linearizably":    testPartitionedLeader,
+		"leaders can't go back in epochs":            testLeaderEpochBehindLog,
+		"followers truncate diverged records":        testTruncateDiverged,
+		"divergence is found reading one record":     testDivergence,
+		"nodes report the cluster status":            testClusterStatus,
+		"nodes describe the log":                     testDescribeLog,
+		"catching up replicas are throttled":         testThrottleCatchUp,
+		"leadership changes call the hook":           testLeadershipHook,
+		"commits call the hook":                      testCommitHook,
+		"replicas far behind copy segments":          testCatchUpSegments,
+		"redactions erase records on each replica":   testRedact,
+		"repairs don't undo the leader's redactions": testRepairRedacted,
+		"restarts keep uncommitted records hidden":   testRestartUncommitted,
+		"restarts apply redactions once committed":   testRestartRedact,
+		"followers stop replicating before closing":  testStopReplicating,
+		"replicas behind the oldest record restart":  testStartOver,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testReplicate(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.MinInSyncReplicas = 2
+	})
+	follower := setupFollower(t, "follower-0", addr, nil)
+
+	record := &api.Record{Value: []byte("hello world")}
+	// the follower joins the in-sync set on its first fetch
+	require.Eventually(t, func() bool {
+		_, err := leader.Append(record)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		off, err := leader.Append(record)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i+1), off)
+		// the record is committed once the append returns
+		require.Less(t, off, leader.HighWatermark())
+	}
+
+	for off := uint64(0); off < 4; off++ {
+		require.Eventually(t, func() bool {
+			got, err := follower.Read(off)
+			return err == nil && got.Offset == off
+		}, 3*time.Second, 50*time.Millisecond)
+	}
+}
+
+func testFollowerAppend(t *testing.T) {
+	_, addr := setupLeader(t, nil)
+	follower := setupFollower(t, "follower-0", addr, nil)
+
+	_, err := follower.Append(&api.Record{Value: []byte("hello world")})
+	apiErr := err.(api.ErrNotLeader)
+	require.Equal(t, addr, apiErr.LeaderAddr)
+
+	// nor can they serve linearizable reads
+	err = follower.VerifyLeader()
+	require.Equal(t, api.ErrNotLeader{LeaderAddr: addr}, err)
+}
+
+func testNotEnoughReplicas(t *testing.T) {
+	leader, _ := setupLeader(t, func(c *Config) {
+		c.Replication.MinInSyncReplicas = 2
+	})
+
+	_, err := leader.Append(&api.Record{Value: []byte("hello world")})
+	apiErr := err.(api.ErrNotEnoughReplicas)
+	require.Equal(t, 1, apiErr.InSync)
+	require.Equal(t, 2, apiErr.MinInSync)
+}
+
+func testShrinkInSync(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.AckTimeout = 100 * time.Millisecond
+		c.Replication.MaxLagTime = time.Second
+	})
+	follower := setupFollower(t, "follower-0", addr, nil)
+	require.Eventually(t, func() bool {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		return leader.inSync() == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, follower.Close())
+	_, err := leader.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, api.ErrReplicationTimeout{Offset: 0}, err)
+	// uncommitted records aren't visible to consumers
+	_, err = leader.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	_, end, err := leader.GetOffsets()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), end)
+	require.Equal(t, uint64(1), leader.LogEndOffset())
+
+	// the high watermark moves once the follower leaves the in-sync set
+	require.Eventually(t, func() bool {
+		_, err := leader.Read(0)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func testRestartUncommitted(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.AckTimeout = 100 * time.Millisecond
+		c.Replication.MaxLagTime = time.Minute
+		c.Replication.MinInSyncReplicas = 2
+	})
+	follower := setupFollower(t, "follower-0", addr, nil)
+	require.Eventually(t, func() bool {
+		_, err := leader.Append(&api.Record{Value: []byte("committed")})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	committed := leader.HighWatermark()
+
+	require.NoError(t, follower.Close())
+	_, err := leader.Append(&api.Record{Value: []byte("uncommitted")})
+	require.Equal(t, api.ErrReplicationTimeout{Offset: committed}, err)
+	require.NoError(t, leader.Close())
+
+	c := leader.config
+	c.Replication.MaxLagTime = 200 * time.Millisecond
+	restarted, err := NewReplicatedLog(leader.log.Dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		restarted.Close()
+	})
+	// the record the follower never had isn't served, though it's kept for the
+	// in-sync replicas to commit
+	require.Equal(t, committed, restarted.HighWatermark())
+	require.Equal(t, committed+1, restarted.LogEndOffset())
+	_, err = restarted.Read(committed - 1)
+	require.NoError(t, err)
+	_, err = restarted.Read(committed)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: committed}, err)
+
+	// nor is it committed by appends or expiry ticks before a follower has it
+	_, err = restarted.Append(&api.Record{Value: []byte("no followers")})
+	require.Equal(t, api.ErrNotEnoughReplicas{InSync: 1, MinInSync: 2}, err)
+	time.Sleep(2 * c.Replication.MaxLagTime)
+	require.Equal(t, committed, restarted.HighWatermark())
+
+	setupFollower(t, "follower-1", serveFetches(t, restarted), nil)
+	require.Eventually(t, func() bool {
+		return restarted.HighWatermark() == committed+1
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func testRestartRedact(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.AckTimeout = 100 * time.Millisecond
+		c.Replication.MaxLagTime = time.Minute
+		c.Replication.MinInSyncReplicas = 2
+	})
+	follower := setupFollower(t, "follower-0", addr, nil)
+	require.Eventually(t, func() bool {
+		_, err := leader.Append(&api.Record{Key: []byte("a"), Value: []byte("secret")})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, follower.Close())
+	_, err := leader.Redact(&api.RedactRequest{StartOffset: 0, EndOffset: 1})
+	require.Equal(t, api.ErrReplicationTimeout{Offset: 1}, err)
+	require.NoError(t, leader.Close())
+
+	restarted, err := NewReplicatedLog(leader.log.Dir, leader.config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		restarted.Close()
+	})
+	// the REDACT record isn't committed, so neither is the erasure
+	require.Equal(t, uint64(1), restarted.HighWatermark())
+	got, err := restarted.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), got.Value)
+
+	setupFollower(t, "follower-1", serveFetches(t, restarted), nil)
+	require.Eventually(t, func() bool {
+		got, err := restarted.Read(0)
+		return err == nil && got.Redacted != 0
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func testStopReplicating(t *testing.T) {
+	leader, addr := setupLeader(t, nil)
+	follower := setupFollower(t, "follower-0", addr, nil)
+	_, err := leader.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return follower.LogEndOffset() == 1
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// once the node's left, the leader forgets it and it doesn't fetch again
+	follower.StopReplicating()
+	leader.RemoveReplica("follower-0")
+	_, err = leader.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, uint64(1), follower.LogEndOffset())
+	replication, err := leader.DescribeReplication()
+	require.NoError(t, err)
+	require.Empty(t, replication.Replicas)
+
+	// it serves what it has until it's closed
+	got, err := follower.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), got.Value)
+}
+
+func testStartOver(t *testing.T) {
+	segments := func(c *Config) {
+		c.Segment.MaxStoreBytes = 1024
+		c.Segment.MaxIndexBytes = 1 << 10
+		c.Replication.FetchMaxRecords = 10
+		c.Replication.CatchUpSegments = 2
+	}
+	leader, addr := setupLeader(t, segments)
+	appendRecords := func(from, to int) {
+		for i := from; i < to; i++ {
+			_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			require.NoError(t, err)
+		}
+	}
+	appendRecords(0, 20)
+	follower := setupFollower(t, "follower-0", addr, segments)
+	require.Eventually(t, func() bool {
+		return follower.HighWatermark() == 20
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NoError(t, follower.Close())
+	leader.RemoveReplica("follower-0")
+
+	// the records the follower would fetch next are removed while it's away
+	appendRecords(20, 300)
+	require.NoError(t, leader.Truncate(200))
+	lowest, _, err := leader.GetOffsets()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(20))
+	_, err = leader.Fetch(context.Background(), &api.FetchRequest{ReplicaId: "follower-0", Offset: 20})
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 20}, err)
+
+	follower, err = NewReplicatedLog(follower.log.Dir, follower.config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		follower.Close()
+	})
+	require.Eventually(t, func() bool {
+		return follower.HighWatermark() == 300
+	}, 5*time.Second, 50*time.Millisecond)
+	got, _, err := follower.GetOffsets()
+	require.NoError(t, err)
+	require.Equal(t, lowest, got)
+	for off := lowest; off < 300; off++ {
+		record, err := follower.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+	}
+}
+
+func testRepair(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.MinInSyncReplicas = 2
+	})
+	follower := setupFollower(t, "follower-0", addr, func(c *Config) {
+		c.Replication.RepairInterval = 50 * time.Millisecond
+		c.Replication.RepairRangeRecords = 2
+	})
+	require.Eventually(t, func() bool {
+		_, err := leader.Append(&api.Record{Value: []byte("record-0")})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	for i := 1; i < 4; i++ {
+		_, err := leader.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record-%d", i)),
+		})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		_, err := follower.Read(3)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// flip a record on the follower's disk behind its back, once it's there
+	for _, s := range follower.log.snapshot() {
+		require.NoError(t, s.Sync())
+	}
+	name := filepath.Join(follower.log.Dir, "0.store")
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	i := bytes.Index(b, []byte("record-1"))
+	require.NotEqual(t, -1, i)
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("RECORD-1"), int64(i))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.Eventually(t, func() bool {
+		got, err := follower.Read(1)
+		return err == nil && string(got.Value) == "record-1"
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func testDescribeReplication(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Registerer = reg
+		c.Replication.MinInSyncReplicas = 2
+	})
+	followerReg := prometheus.NewRegistry()
+	follower := setupFollower(t, "follower-0", addr, func(c *Config) {
+		c.Registerer = followerReg
+	})
+	require.Eventually(t, func() bool {
+		_, err := leader.Append(&api.Record{Value: []byte("hello world")})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	replication, err := leader.DescribeReplication()
+	require.NoError(t, err)
+	require.Equal(t, "leader", replication.LeaderId)
+	require.Equal(t, uint64(1), replication.HighWatermark)
+	require.Equal(t, uint64(1), replication.LogEndOffset)
+	require.Len(t, replication.Replicas, 1)
+	require.Equal(t, "follower-0", replication.Replicas[0].Id)
+	require.True(t, replication.Replicas[0].InSync)
+	require.Equal(t, uint64(0), replication.Replicas[0].Lag)
+
+	// only the leader tracks the followers
+	_, err = follower.DescribeReplication()
+	require.Error(t, err)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	metrics := make(map[string]float64)
+	for _, f := range families {
+		metrics[f.GetName()] = f.GetMetric()[0].GetGauge().GetValue()
+	}
+	require.Equal(t, float64(2), metrics["proglog_replication_in_sync_replicas"])
+	require.Equal(t, float64(1), metrics["proglog_replication_high_watermark"])
+	require.Equal(t, float64(0), metrics["proglog_replication_replica_lag_records"])
+	require.Equal(t, float64(1), metrics["proglog_replication_leader"])
+	require.Equal(t, float64(1), gatherEvents(t, reg)["isr_expand"])
+
+	// followers report their own view
+	require.Eventually(t, func() bool {
+		families, err := followerReg.Gather()
+		require.NoError(t, err)
+		metrics := make(map[string]float64)
+		for _, f := range families {
+			metrics[f.GetName()] = f.GetMetric()[0].GetGauge().GetValue()
+		}
+		return metrics["proglog_replication_high_watermark"] == 1 &&
+			metrics["proglog_replication_leader_lag_records"] == 0 &&
+			metrics["proglog_replication_leader"] == 0
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, float64(1), gatherEvents(t, followerReg)["leader_change"])
+}
+
+func gatherEvents(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	events := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != "proglog_replication_events_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			events[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	return events
+}
+
+func testReap(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.MaxLagTime = 100 * time.Millisecond
+		c.Replication.ReapAfter = 200 * time.Millisecond
+	})
+	follower := setupFollower(t, "follower-0", addr, nil)
+	require.Eventually(t, func() bool {
+		replication, err := leader.DescribeReplication()
+		return err == nil && len(replication.Replicas) == 1
+	}, 3*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, follower.Close())
+	require.Eventually(t, func() bool {
+		replication, err := leader.DescribeReplication()
+		return err == nil && len(replication.Replicas) == 0
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func testEpoch(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.LeaderEpoch = 3
+	})
+	follower := setupFollower(t, "follower-0", addr, nil)
+
+	_, err := leader.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := follower.Read(0)
+		return err == nil && got.Epoch == 3
+	}, 3*time.Second, 50*time.Millisecond)
+
+	replication, err := leader.DescribeReplication()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), replication.LeaderEpoch)
+}
+
+func testFenceStaleLeader(t *testing.T) {
+	leader, _ := setupLeader(t, func(c *Config) {
+		c.Replication.LeaderEpoch = 1
+	})
+	want := api.ErrStaleEpoch{Epoch: 1, LatestEpoch: 2}
+
+	// a replica that has followed a newer leader fetches from this one
+	_, err := leader.Fetch(context.Background(), &api.FetchRequest{
+		ReplicaId: "follower-0",
+		Epoch:     2,
+	})
+	require.Equal(t, want, err)
+
+	_, err = leader.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, want, err)
+	require.Equal(t, want, leader.VerifyLeader())
+}
+
+func testPartitionedLeader(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.AckTimeout = 200 * time.Millisecond
+		c.Replication.MaxLagTime = 200 * time.Millisecond
+	})
+	follower := setupFollower(t, "follower-0", addr, nil)
+	require.Eventually(t, func() bool {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		return leader.inSync() == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	require.NoError(t, leader.VerifyLeader())
+
+	// the follower's cut off, e.g. it follows a newer leader now, so nothing
+	// fences this one
+	require.NoError(t, follower.Close())
+	require.Eventually(t, func() bool {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		return leader.inSync() == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, api.ErrNotEnoughReplicas{InSync: 1, MinInSync: 2}, leader.VerifyLeader())
+	require.NoError(t, leader.CheckLeader())
+}
+
+func testLeadershipHook(t *testing.T) {
+	type change struct {
+		leaderID string
+		epoch    uint64
+	}
+	leaderChanges := make(chan change, 2)
+	followerChanges := make(chan change, 1)
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.LeaderEpoch = 1
+		c.Hooks.OnLeadershipChange = func(leaderID string, epoch uint64) {
+			leaderChanges <- change{leaderID, epoch}
+		}
+	})
+	require.Equal(t, change{"leader", 1}, <-leaderChanges)
+
+	setupFollower(t, "follower-0", addr, func(c *Config) {
+		c.Hooks.OnLeadershipChange = func(leaderID string, epoch uint64) {
+			followerChanges <- change{leaderID, epoch}
+		}
+	})
+	require.Equal(t, change{"leader", 1}, <-followerChanges)
+
+	// fenced by a replica that has followed a newer leader
+	_, err := leader.Fetch(context.Background(), &api.FetchRequest{
+		ReplicaId: "follower-1",
+		Epoch:     2,
+	})
+	require.Error(t, err)
+	require.Equal(t, change{"", 2}, <-leaderChanges)
+}
+
+func testCommitHook(t *testing.T) {
+	var leaderHW, followerHW atomic.Uint64
+	keepHighest := func(hw *atomic.Uint64) func(uint64) {
+		return func(highWatermark uint64) {
+			for {
+				old := hw.Load()
+				if highWatermark <= old || hw.CompareAndSwap(old, highWatermark) {
+					return
+				}
+			}
+		}
+	}
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.MinInSyncReplicas = 2
+		c.Hooks.OnCommit = keepHighest(&leaderHW)
+	})
+	setupFollower(t, "follower-0", addr, func(c *Config) {
+		c.Hooks.OnCommit = keepHighest(&followerHW)
+	})
+
+	record := &api.Record{Value: []byte("hello world")}
+	require.Eventually(t, func() bool {
+		_, err := leader.Append(record)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	off, err := leader.Append(record)
+	require.NoError(t, err)
+
+	// the record's committed by the time the append returns
+	require.Greater(t, leaderHW.Load(), off)
+	require.Eventually(t, func() bool {
+		return followerHW.Load() > off
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func testCatchUpSegments(t *testing.T) {
+	segments := func(c *Config) {
+		c.Segment.MaxStoreBytes = 1024
+		c.Segment.MaxIndexBytes = 1 << 10
+		c.Replication.FetchMaxRecords = 10
+	}
+	dir, err := os.MkdirTemp("", "replicated-test")
+	require.NoError(t, err)
+	c := Config{}
+	c.Replication.LocalID = "leader"
+	c.Replication.FetchMaxWait = 50 * time.Millisecond
+	segments(&c)
+	leader, err := NewReplicatedLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		leader.Remove()
+	})
+	addr, fs := serveFetchServer(t, leader)
+
+	const records = 500
+	for i := 0; i < records; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(leader.Segments()), 10)
+	// a transfer that arrives corrupted is sent again
+	fs.corrupt.Store(1)
+
+	reg := prometheus.NewRegistry()
+	var appended atomic.Int64
+	follower := setupFollower(t, "follower-0", addr, func(c *Config) {
+		segments(c)
+		c.Registerer = reg
+		c.Replication.CatchUpSegments = 4
+		c.Hooks.OnAppend = func(uint64, *api.Record) {
+			appended.Add(1)
+		}
+	})
+	require.Eventually(t, func() bool {
+		return follower.HighWatermark() == records
+	}, 5*time.Second, 50*time.Millisecond)
+
+	for off := uint64(0); off < records; off++ {
+		record, err := follower.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+	}
+	// the copied records run the hooks as the fetched ones do
+	require.Equal(t, int64(records), appended.Load())
+	events := gatherEvents(t, reg)
+	require.Greater(t, events["segment_copy"], float64(0))
+	require.Zero(t, events["catch_up_error"])
+	_, err = os.Stat(filepath.Join(follower.log.Dir, catchUpDir))
+	require.True(t, os.IsNotExist(err))
+}
+
+func testRedact(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.MinInSyncReplicas = 2
+	})
+	redacted := make(chan uint64, 10)
+	follower := setupFollower(t, "follower-0", addr, func(c *Config) {
+		c.Hooks.OnRedact = func(offset uint64, record *api.Record) {
+			redacted <- offset
+		}
+	})
+
+	// values of all sizes, so the erased records need each size of padding
+	keys := []string{"a", "b", "b", "b", "b", "b", "b", "c"}
+	require.Eventually(t, func() bool {
+		_, err := leader.Append(&api.Record{Key: []byte(keys[0]), Value: []byte("a")})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	for i, key := range keys[1:] {
+		value := bytes.Repeat([]byte("x"), i*i*i*25)
+		_, err := leader.Append(&api.Record{Key: []byte(key), Value: value})
+		require.NoError(t, err)
+	}
+
+	res, err := leader.Redact(&api.RedactRequest{StartKey: []byte("b"), EndKey: []byte("c")})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3, 4, 5, 6}, res.Offsets)
+	require.Equal(t, uint64(8), res.Offset)
+
+	control, err := leader.Read(res.Offset)
+	require.NoError(t, err)
+	require.Equal(t, api.Record_REDACT, control.Control)
+
+	for _, l := range []*ReplicatedLog{leader, follower} {
+		require.Eventually(t, func() bool {
+			return l.LogEndOffset() == res.Offset+1
+		}, 3*time.Second, 50*time.Millisecond)
+		for off := uint64(0); off < res.Offset; off++ {
+			got, err := l.Read(off)
+			// the erased records kept their size, so the ones after them
+			// still read
+			require.NoError(t, err)
+			require.Equal(t, off, got.Offset)
+			if off == 0 || off == 7 {
+				require.NotEmpty(t, got.Value)
+				require.Zero(t, got.Redacted)
+				continue
+			}
+			require.Empty(t, got.Key)
+			require.Empty(t, got.Value)
+			require.NotZero(t, got.Redacted)
+		}
+	}
+	for _, off := range res.Offsets {
+		require.Equal(t, off, <-redacted)
+	}
+
+	// the records already erased are skipped
+	res, err = leader.Redact(&api.RedactRequest{StartOffset: 0, EndOffset: 8})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 7}, res.Offsets)
+
+	_, err = follower.Redact(&api.RedactRequest{StartOffset: 0, EndOffset: 1})
+	require.ErrorAs(t, err, &api.ErrNotLeader{})
+}
+
+func testRepairRedacted(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.MinInSyncReplicas = 2
+	})
+	follower := setupFollower(t, "follower-0", addr, func(c *Config) {
+		c.Replication.RepairRangeRecords = 2
+	})
+	require.Eventually(t, func() bool {
+		_, err := leader.Append(&api.Record{Value: []byte("record-0")})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	for i := 1; i < 4; i++ {
+		_, err := leader.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record-%d", i)),
+		})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return follower.HighWatermark() == 4
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the leader erased it on commit, the follower hasn't fetched the REDACT
+	// record yet
+	erased, err := leader.log.Redact(1)
+	require.NoError(t, err)
+	require.True(t, erased)
+
+	require.NoError(t, follower.repair(context.Background()))
+	require.Equal(t, uint64(4), follower.LogEndOffset())
+	got, err := follower.Read(1)
+	require.NoError(t, err)
+	require.Empty(t, got.Value)
+	require.NotZero(t, got.Redacted)
+	got, err = follower.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, "record-2", string(got.Value))
+}
+
+func testLeaderEpochBehindLog(t *testing.T) {
+	dir := setupDir(t, &api.Record{Value: []byte("hello world"), Epoch: 2})
+
+	c := Config{}
+	c.Replication.LeaderEpoch = 1
+	_, err := NewReplicatedLog(dir, c)
+	require.Equal(t, api.ErrStaleEpoch{Epoch: 1, LatestEpoch: 2}, err)
+}
+
+func testTruncateDiverged(t *testing.T) {
+	// both took the first two records from the old leader in epoch 1,
+	// the follower also took a third that never got committed
+	old := func(value string) *api.Record {
+		return &api.Record{Value: []byte(value), Epoch: 1}
+	}
+	leaderDir := setupDir(t, old("record-0"), old("record-1"))
+	followerDir := setupDir(t, old("record-0"), old("record-1"), old("stale"))
+
+	c := Config{}
+	c.Replication.LeaderEpoch = 2
+	c.Replication.FetchMaxWait = 50 * time.Millisecond
+	leader, err := NewReplicatedLog(leaderDir, c)
+	require.NoError(t, err)
+	defer leader.Close()
+	addr := serveFetches(t, leader)
+	_, err = leader.Append(&api.Record{Value: []byte("record-2")})
+	require.NoError(t, err)
+
+	c = Config{}
+	c.Replication.LocalID = "follower-0"
+	c.Replication.LeaderAddr = addr
+	c.Replication.DialOptions = []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	follower, err := NewReplicatedLog(followerDir, c)
+	require.NoError(t, err)
+	defer follower.Close()
+
+	require.Eventually(t, func() bool {
+		got, err := follower.Read(2)
+		return err == nil && string(got.Value) == "record-2" && got.Epoch == 2
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func testDivergence(t *testing.T) {
+	// the search reads the records into one record, the shorter ones mustn't
+	// keep the longer ones' bytes or epochs
+	var records []*api.Record
+	for i, epoch := range []uint64{1, 1, 1, 2, 2, 3, 3} {
+		value := bytes.Repeat([]byte("v"), (i%3)*64+1)
+		records = append(records, &api.Record{Value: value, Epoch: epoch})
+	}
+	c := Config{}
+	c.Replication.LeaderEpoch = 3
+	leader, err := NewReplicatedLog(setupDir(t, records...), c)
+	require.NoError(t, err)
+	defer leader.Close()
+
+	for _, tc := range []struct {
+		offset, lastEpoch uint64
+		truncate          uint64
+		diverged          bool
+	}{
+		// the replica's last record's in the leader's epoch
+		{offset: 5, lastEpoch: 2},
+		{offset: 7, lastEpoch: 3},
+		// the replica truncates to the end of its last epoch in the leader's log
+		{offset: 7, lastEpoch: 1, truncate: 3, diverged: true},
+		{offset: 6, lastEpoch: 2, truncate: 5, diverged: true},
+		{offset: 3, lastEpoch: 0, truncate: 0, diverged: true},
+	} {
+		truncate, diverged, err := leader.divergence(tc.offset, tc.lastEpoch)
+		require.NoError(t, err)
+		require.Equal(t, tc.diverged, diverged, "offset %d, epoch %d", tc.offset, tc.lastEpoch)
+		require.Equal(t, tc.truncate, truncate, "offset %d, epoch %d", tc.offset, tc.lastEpoch)
+	}
+}
+
+func testClusterStatus(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.LocalAddr = "127.0.0.1:8400"
+		c.Replication.LeaderEpoch = 2
+		c.Replication.MinInSyncReplicas = 2
+	})
+	follower := setupFollower(t, "follower-0", addr, nil)
+	require.Eventually(t, func() bool {
+		_, err := leader.Append(&api.Record{Value: []byte("hello world")})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	status, err := leader.GetClusterStatus()
+	require.NoError(t, err)
+	require.True(t, status.IsLeader)
+	require.Equal(t, "leader", status.LeaderId)
+	require.Equal(t, "127.0.0.1:8400", status.LeaderAddr)
+	require.Equal(t, uint64(2), status.Epoch)
+	require.Equal(t, uint64(1), status.HighWatermark)
+	require.Len(t, status.Nodes, 2)
+	require.Equal(t, "leader", status.Nodes[0].Id)
+	require.Equal(t, "follower-0", status.Nodes[1].Id)
+	require.True(t, status.Nodes[1].Healthy)
+	require.True(t, status.Nodes[1].InSync)
+
+	require.Eventually(t, func() bool {
+		status, err := follower.GetClusterStatus()
+		return err == nil && status.HighWatermark == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	status, err = follower.GetClusterStatus()
+	require.NoError(t, err)
+	require.False(t, status.IsLeader)
+	require.Equal(t, "leader", status.LeaderId)
+	require.Equal(t, addr, status.LeaderAddr)
+	require.Equal(t, uint64(1), status.LogEndOffset)
+	require.Len(t, status.Nodes, 2)
+	require.True(t, status.Nodes[0].IsLeader)
+	require.True(t, status.Nodes[0].Healthy)
+	require.Equal(t, "follower-0", status.Nodes[1].Id)
+}
+
+func testDescribeLog(t *testing.T) {
+	leader, addr := setupLeader(t, func(c *Config) {
+		c.Replication.MinInSyncReplicas = 2
+	})
+	follower := setupFollower(t, "follower-0", addr, nil)
+	require.Eventually(t, func() bool {
+		_, err := leader.Append(&api.Record{Value: []byte("hello world")})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	d, err := leader.DescribeLog()
+	require.NoError(t, err)
+	require.Equal(t, "leader", d.LeaderId)
+	require.Equal(t, []string{"follower-0", "leader"}, d.ReplicaIds)
+	require.Equal(t, uint64(1), d.HighWatermark)
+	require.Equal(t, uint64(1), d.LogEndOffset)
+	require.NotZero(t, d.NewestTimestamp)
+	require.Equal(t, d.OldestTimestamp, d.NewestTimestamp)
+	require.Greater(t, d.SizeBytes, uint64(0))
+
+	require.Eventually(t, func() bool {
+		d, err := follower.DescribeLog()
+		return err == nil && d.HighWatermark == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	d, err = follower.DescribeLog()
+	require.NoError(t, err)
+	require.Equal(t, "leader", d.LeaderId)
+	require.Equal(t, []string{"follower-0", "leader"}, d.ReplicaIds)
+}
+
+func testThrottleCatchUp(t *testing.T) {
+	var records []*api.Record
+	for i := 0; i < 10; i++ {
+		records = append(records, &api.Record{Value: bytes.Repeat([]byte("a"), 100)})
+	}
+	c := Config{}
+	c.Replication.FetchMaxWait = 50 * time.Millisecond
+	c.Replication.CatchUpBytesPerSecond = 500
+	leader, err := NewReplicatedLog(setupDir(t, records...), c)
+	require.NoError(t, err)
+	defer leader.Close()
+	follower := setupFollower(t, "follower-0", serveFetches(t, leader), nil)
+
+	// ~1KB of records at 500B/s takes the follower about a second to fetch
+	time.Sleep(300 * time.Millisecond)
+	require.Less(t, follower.log.NextOffset(), uint64(10))
+	require.Eventually(t, func() bool {
+		return follower.log.NextOffset() == 10
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// returns a log directory holding the records, as if an earlier leader appended them
+func setupDir(t *testing.T, records ...*api.Record) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "replicated-test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+	return dir
+}
+
+func setupLeader(t *testing.T, fn func(*Config)) (*ReplicatedLog, string) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "replicated-test")
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Replication.LocalID = "leader"
+	c.Replication.FetchMaxWait = 50 * time.Millisecond
+	if fn != nil {
+		fn(&c)
+	}
+	leader, err := NewReplicatedLog(dir, c)
+	require.NoError(t, err)
+	addr := serveFetches(t, leader)
+
+	t.Cleanup(func() {
+		leader.Remove()
+	})
+	return leader, addr
+}
+
+// serves the leader's replication RPCs and returns their address
+func serveFetches(t *testing.T, leader *ReplicatedLog) string {
+	t.Helper()
+
+	addr, _ := serveFetchServer(t, leader)
+	return addr
+}
+
+func serveFetchServer(t *testing.T, leader *ReplicatedLog) (string, *fetchServer) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	fs := &fetchServer{log: leader}
+	api.RegisterLogServer(srv, fs)
+	go srv.Serve(l)
+
+	t.Cleanup(func() {
+		srv.Stop()
+	})
+	return l.Addr().String(), fs
+}
+
+func setupFollower(
+	t *testing.T,
+	id, leaderAddr string,
+	fn func(*Config),
+) *ReplicatedLog {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "replicated-test")
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Replication.LocalID = id
+	c.Replication.LeaderAddr = leaderAddr
+	c.Replication.DialOptions = []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	if fn != nil {
+		fn(&c)
+	}
+	follower, err := NewReplicatedLog(dir, c)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		follower.Remove()
+	})
+	return follower
+}
+
+// serves the leader's replication RPCs without pulling in the server package
+type fetchServer struct {
+	api.UnimplementedLogServer
+	log *ReplicatedLog
+	// flips a byte of that many of the next segment chunks sent
+	corrupt atomic.Int32
+}
+
+func (s *fetchServer) ListSealedSegments(
+	ctx context.Context,
+	req *api.ListSealedSegmentsRequest,
+) (*api.ListSealedSegmentsResponse, error) {
+	segments, err := s.log.SealedSegments(req.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListSealedSegmentsResponse{Segments: segments}, nil
+}
+
+func (s *fetchServer) FetchSegment(req *api.FetchSegmentRequest, stream api.Log_FetchSegmentServer) error {
+	checksum, err := s.log.ReadSegment(stream.Context(), req.Offset, func(chunk []byte) error {
+		if s.corrupt.Add(-1) >= 0 {
+			chunk = append([]byte(nil), chunk...)
+			chunk[len(chunk)-1] ^= 0xff
+		}
+		return stream.Send(&api.FetchSegmentResponse{Chunk: chunk})
+	})
+	if err != nil {
+		return err
+	}
+	return stream.Send(&api.FetchSegmentResponse{Last: true, Checksum: checksum})
+}
+
+func (s *fetchServer) GetChecksums(
+	ctx context.Context,
+	req *api.GetChecksumsRequest,
+) (*api.GetChecksumsResponse, error) {
+	checksums, redacted, err := s.log.Checksums(req.Offset, req.RangeRecords, req.Ranges)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetChecksumsResponse{Checksums: checksums, Redacted: redacted}, nil
+}
+
+func (s *fetchServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	lowest, end, err := s.log.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetsResponse{LowestOffset: lowest, EndOffset: end}, nil
+}
+
+func (s *fetchServer) Fetch(ctx context.Context, req *api.FetchRequest) (*api.FetchResponse, error) {
+	return s.log.Fetch(ctx, req)
+}
@@ -8,15 +8,23 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	api "proglog/api/v1"
 
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
 
 type segment struct {
+	// readers hold it to read the segment and the log's writer to append to
+	// it, so reads of sealed segments never wait on appends
+	mu sync.RWMutex
 	// needs to call its store and index files
 	store *store
 	index *index
@@ -26,6 +34,23 @@ type segment struct {
 	// The offset for the next log entry to be appended to this segment
 	baseOffset, nextOffset uint64
 	config                 Config
+	// times the store's and the index's operations, nil when the log has no
+	// Registerer
+	metrics *storageMetrics
+	// the index entries of the records appended since the index was last
+	// flushed, see appendDeferred
+	pending []IndexEntry
+	// the offset after the last record readers can see, nextOffset once the
+	// pending index entries are flushed
+	readable atomic.Uint64
+	// set once the segment's closed or removed, there's nothing to read then
+	closed bool
+	// where the segment's files are, and whether they're open yet, a sealed
+	// segment the log opens lazily isn't until it's first used, see load
+	dir    string
+	opened atomic.Bool
+	// the stores read and write through it when set
+	ring *uring
 }
 
 // The log calls newSegment when it needs to add a new segment,
@@ -37,94 +62,280 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
+		dir:        dir,
 	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if off, _, err := s.index.Read(-1); err != nil {
+		s.nextOffset = baseOffset
+	} else {
+		s.nextOffset = baseOffset + uint64(off) + 1
+	}
+	s.readable.Store(s.nextOffset)
+	return s, nil
+}
+
+// a sealed segment holding the records in [baseOffset, nextOffset) whose files
+// aren't opened until it's first used
+func newLazySegment(dir string, baseOffset, nextOffset uint64, c Config) *segment {
+	s := &segment{
+		baseOffset: baseOffset,
+		nextOffset: nextOffset,
+		config:     c,
+		dir:        dir,
+	}
+	s.readable.Store(nextOffset)
+	return s
+}
+
+// opens a lazily opened segment's files, the first caller does and the others
+// wait for it. the segment keeps the offsets the log gave it
+func (s *segment) load() error {
+	if s.opened.Load() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opened.Load() || s.closed {
+		return nil
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	if s.ring != nil {
+		return s.store.useRing(s.ring)
+	}
+	return nil
+}
 
+func (s *segment) open() error {
 	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		path.Join(s.dir, fmt.Sprintf("%d%s", s.baseOffset, ".store")),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0644,
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if s.store, err = newStore(storeFile); err != nil {
-		return nil, err
+		return err
+	}
+	if c := s.config.Segment; c.WriteBufferBytes > 0 || c.AdaptiveWriteBuffer {
+		if err := s.store.setWriteBuffer(c.WriteBufferBytes, c.AdaptiveWriteBuffer); err != nil {
+			return err
+		}
+	}
+	if s.config.Segment.DirectIO {
+		if err := s.store.enableDirectIO(); err != nil && s.config.Logger != nil {
+			s.config.Logger.Debug("writing the store through the page cache, direct I/O failed",
+				zap.String("store", storeFile.Name()),
+				zap.Error(err),
+			)
+		}
 	}
 	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		path.Join(s.dir, fmt.Sprintf("%d%s", s.baseOffset, ".index")),
 		os.O_RDWR|os.O_CREATE,
 		0644,
 	)
 
 	if err != nil {
-		return nil, err
-	}
-	if s.index, err = newIndex(indexFile, c); err != nil {
-		return nil, err
+		return err
 	}
-	if off, _, err := s.index.Read(-1); err != nil {
-		s.nextOffset = baseOffset
-	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
+	if s.index, err = newIndex(indexFile, s.config); err != nil {
+		return err
 	}
+	s.opened.Store(true)
+	return nil
+}
 
-	return s, nil
+// the store's and the index's sizes, a segment that isn't open yet reports
+// its files'
+func (s *segment) sizes() (store, index uint64) {
+	if s.opened.Load() {
+		return s.store.size, s.index.size
+	}
+	for _, f := range []struct {
+		ext  string
+		size *uint64
+	}{{".store", &store}, {".index", &index}} {
+		if fi, err := os.Stat(path.Join(s.dir, fmt.Sprintf("%d%s", s.baseOffset, f.ext))); err == nil {
+			*f.size = uint64(fi.Size())
+		}
+	}
+	return store, index
 }
 
 // writes the record to the segment
 // returns the newly appended record's offset
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	if offset, err = s.appendDeferred(record); err != nil {
+		return 0, err
+	}
+	return offset, s.flushIndex()
+}
+
+// writes the record to the store but holds its index entry back until
+// flushIndex, so a batch's entries are written together. the record can't be
+// read until then
+func (s *segment) appendDeferred(record *api.Record) (offset uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.index.fits(len(s.pending) + 1) {
+		return 0, io.EOF
+	}
 	cur := s.nextOffset
 	record.Offset = cur
-	p, err := proto.Marshal(record)
+	buf := recordBuffers.Get().(*[]byte)
+	defer putRecordBuffer(buf)
+	p, err := proto.MarshalOptions{}.MarshalAppend((*buf)[:0], record)
 	if err != nil {
 		return 0, err
 	}
+	*buf = p
+	start := time.Now()
 	_, pos, err := s.store.Append(p)
+	s.metrics.observe(opStoreAppend, start, err)
 	if err != nil {
 		return 0, err
 	}
-	if err = s.index.Write(
+	s.pending = append(s.pending, IndexEntry{
 		// index offsets are relative to base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
-		pos,
-	); err != nil {
-		return 0, err
-	}
+		RelOffset: uint32(cur - s.baseOffset),
+		Pos:       pos,
+	})
 	s.nextOffset++
 	return cur, nil
 }
 
+// writes the index entries appendDeferred held back, making their records
+// readable
+func (s *segment) flushIndex() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushIndexLocked()
+}
+
+func (s *segment) flushIndexLocked() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := s.index.WriteBatch(s.pending)
+	s.metrics.observe(opIndexWrite, start, err)
+	s.pending = s.pending[:0]
+	if err != nil {
+		return err
+	}
+	s.readable.Store(s.nextOffset)
+	return nil
+}
+
 // returns the record for the given offset
 // to read a record the segment must first translate the absolute index
 // into a relative offset
 // gett he ssociated index entry
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	record := &api.Record{}
+	_, err := s.ReadInto(off, record, nil)
+	return record, err
+}
+
+// decodes the record at off into record, reading its bytes into buf, and
+// returns buf, grown when it was too small, so it can be reused
+func (s *segment) ReadInto(off uint64, record *api.Record, buf []byte) ([]byte, error) {
+	p, err := s.readBytes(off, buf)
 	if err != nil {
+		return buf, err
+	}
+	return p, proto.Unmarshal(p, record)
+}
+
+// returns the record's bytes as they're stored, without decoding them
+func (s *segment) ReadBytes(off uint64) ([]byte, error) {
+	return s.readBytes(off, nil)
+}
+
+func (s *segment) readBytes(off uint64, buf []byte) ([]byte, error) {
+	if err := s.load(); err != nil {
 		return nil, err
 	}
-	p, err := s.store.Read(pos)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// the segment may have been truncated or removed since the reader found it
+	if s.closed || off < s.baseOffset || off >= s.readable.Load() {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	start := time.Now()
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	s.metrics.observe(opIndexRead, start, err)
 	if err != nil {
 		return nil, err
 	}
-	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
+	start = time.Now()
+	p, err := s.store.ReadInto(pos, buf)
+	s.metrics.observe(opStoreRead, start, err)
+	return p, err
+}
 
-	return record, err
+// removes the records at and after off from the segment
+// the store is cut where the record at off starts and the index
+// forgets the entries from off onwards
+func (s *segment) TruncateFrom(off uint64) error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rel := off - s.baseOffset
+	_, pos, err := s.index.Read(int64(rel))
+	if err != nil {
+		return err
+	}
+	if err := s.store.Truncate(pos); err != nil {
+		return err
+	}
+	s.index.size = rel * entWidth
+	s.nextOffset = off
+	s.readable.Store(off)
+	return nil
 }
 
 // returns whether the segment has reached its max
 // either by writing too much to the store
-// or the index
+// or the index. the index is full once it can't fit another entry, counting the pending
+// ones, even when MaxIndexBytes isn't a multiple of an entry's width
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxStoreBytes
+	return s.store.size >= s.config.Segment.MaxStoreBytes || !s.index.fits(len(s.pending)+1)
+}
+
+// syncs the store and the index to stable storage
+func (s *segment) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushIndexLocked(); err != nil {
+		return err
+	}
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
 }
 
 // closes the segment
 // removes the index and store files
 func (s *segment) Remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if !s.opened.Load() {
+		if err = os.Remove(path.Join(s.dir, fmt.Sprintf("%d%s", s.baseOffset, ".index"))); err != nil {
+			return err
+		}
+		return os.Remove(path.Join(s.dir, fmt.Sprintf("%d%s", s.baseOffset, ".store")))
+	}
 	if err = s.index.Close(); err != nil {
 		return err
 	}
@@ -138,6 +349,16 @@ func (s *segment) Remove() error {
 }
 
 func (s *segment) CLose() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.opened.Load() {
+		s.closed = true
+		return nil
+	}
+	if err = s.flushIndexLocked(); err != nil {
+		return err
+	}
+	s.closed = true
 	if err = s.index.Close(); err != nil {
 		return err
 	}
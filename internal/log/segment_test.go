@@ -43,6 +43,7 @@ func TestSegment(t *testing.T) {
 	c.Segment.MaxIndexBytes = 1024
 
 	// maxed store
+	require.NoError(t, s.Sync())
 	s, err = newSegment(dir, 16, c)
 	require.NoError(t, err)
 	require.True(t, s.IsMaxed())
@@ -53,3 +54,55 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentDeferredIndex(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entWidth * 3
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.CLose()
+	})
+
+	record := &api.Record{Value: []byte("hello world!")}
+	for i := uint64(0); i < 3; i++ {
+		off, err := s.appendDeferred(record)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	// the pending entries count towards the index's size
+	require.True(t, s.IsMaxed())
+	_, err = s.appendDeferred(record)
+	require.Equal(t, io.EOF, err)
+	// and aren't readable until they're flushed
+	_, err = s.Read(0)
+	require.Error(t, err)
+
+	require.NoError(t, s.flushIndex())
+	require.Equal(t, 3*entWidth, s.index.size)
+	for off := uint64(0); off < 3; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+}
+
+func TestSegmentMaxedByPartialIndex(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	// room for three entries and part of a fourth
+	c.Segment.MaxIndexBytes = entWidth*3 + entWidth/2
+	s, err := newSegment(t.TempDir(), 0, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.CLose()
+	})
+	for i := 0; i < 3; i++ {
+		require.False(t, s.IsMaxed())
+		_, err := s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, s.IsMaxed())
+}
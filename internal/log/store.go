@@ -2,8 +2,8 @@
 package log
 
 import (
-	"bufio"
 	"encoding/binary"
+	"io"
 	"os"
 	"sync"
 )
@@ -22,11 +22,83 @@ const (
 	lenWidth = 8
 )
 
+// an adaptive write buffer holds about adaptiveRecords records, within
+// [minWriteBuffer, maxWriteBuffer]
+const (
+	adaptiveRecords = 16
+	minWriteBuffer  = 512
+	maxWriteBuffer  = 1 << 20
+)
+
+// buffers a store's appends until they're flushed
+type storeWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// the store's write buffer, unlike a bufio.Writer it lets the store read the
+// appends it holds, so reading the newest records doesn't flush them
+type appendBuffer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// a buffer of size bytes, 4KiB when size isn't positive
+func newAppendBuffer(w io.Writer, size int) *appendBuffer {
+	if size <= 0 {
+		size = 4096
+	}
+	return &appendBuffer{w: w, buf: make([]byte, 0, size)}
+}
+
+// buffers p, flushing what's buffered first when p doesn't fit. p's written
+// straight through when it's larger than the buffer, a store's bytes are
+// either in the file or in the buffer, never split between them out of order
+func (b *appendBuffer) Write(p []byte) (int, error) {
+	if len(p) > cap(b.buf)-len(b.buf) {
+		if err := b.Flush(); err != nil {
+			return 0, err
+		}
+		if len(p) >= cap(b.buf) {
+			return b.w.Write(p)
+		}
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+func (b *appendBuffer) Flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	n, err := b.w.Write(b.buf)
+	// keeps what wasn't written, for the next flush
+	b.buf = b.buf[:copy(b.buf, b.buf[n:])]
+	return err
+}
+
+func (b *appendBuffer) Size() int {
+	return cap(b.buf)
+}
+
 type store struct {
 	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
+	mu  sync.Mutex
+	buf storeWriter
+	// where buf writes to, the file or the ring, unless it writes with O_DIRECT
+	dst io.Writer
+	// sizes buf to the records appended, see adapt, and the average of their
+	// sizes so far
+	adaptive  bool
+	avgRecord float64
+	// set when the store writes with O_DIRECT, it's buf then
+	direct *directWriter
+	// set when the store reads and writes through the log's io_uring
+	ring *uring
+	fd   int32
 	size uint64 // in bytes
+	// scratch for reading records' lengths, guarded by mu
+	lenBuf [lenWidth]byte
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -38,14 +110,60 @@ func newStore(f *os.File) (*store, error) {
 	return &store{
 		File: f,
 		size: size,
-		buf:  bufio.NewWriter(f),
+		buf:  newAppendBuffer(f, 0),
+		dst:  f,
 	}, nil
 }
 
+// sizes the buffer the appends are written through, the default 4KiB when
+// size is zero. an adaptive buffer starts at size and then follows the
+// records' sizes
+func (s *store) setWriteBuffer(size int, adaptive bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	s.buf = newAppendBuffer(s.dst, size)
+	s.adaptive = adaptive
+	return nil
+}
+
+// resizes the buffer to hold about adaptiveRecords of the records appended
+// lately, a few large ones otherwise flush on every append and tiny ones
+// leave most of it unused. it's only replaced once it's off by twice, so it
+// doesn't churn while the sizes wobble. callers hold the lock
+func (s *store) adapt(n int) error {
+	b, ok := s.buf.(*appendBuffer)
+	if !ok {
+		// O_DIRECT writes go through their own aligned buffer
+		return nil
+	}
+	if s.avgRecord == 0 {
+		s.avgRecord = float64(n)
+	} else {
+		s.avgRecord += (float64(n) - s.avgRecord) / adaptiveRecords
+	}
+	want := min(max(int(s.avgRecord)*adaptiveRecords, minWriteBuffer), maxWriteBuffer)
+	if size := b.Size(); want < size*2 && want > size/2 {
+		return nil
+	}
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	s.buf = newAppendBuffer(s.dst, want)
+	return nil
+}
+
 func (s *store) Append(p []byte) (n, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size
+	if s.adaptive {
+		if err := s.adapt(lenWidth + len(p)); err != nil {
+			return 0, 0, err
+		}
+	}
 	// Writes the length of the data (len(p)) as a uint64 value into the buffe
 	if err = binary.Write(s.buf, enc, uint64(len(p))); err != nil {
 		return 0, 0, err
@@ -62,21 +180,26 @@ func (s *store) Append(p []byte) (n, pos uint64, err error) {
 }
 
 func (s *store) Read(pos uint64) ([]byte, error) {
+	return s.ReadInto(pos, nil)
+}
+
+// reads the record at pos into buf, growing it when it's too small, and
+// returns the record's bytes
+func (s *store) ReadInto(pos uint64, buf []byte) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	// The buffer (s.buf) is flushed to ensure all buffered data
-	// is written to the file before reading
-	if err = s.buf.Flush(); err != nil {
-		return nil, err
-	}
-	size := make([]byte, lenWidth)
 	// Reading the Length of the Data
-	if _, err = s.File.ReadAt(size, int64(pos)); err != nil {
+	// err is local so concurrent reads of different stores don't race
+	if _, err := s.read(s.lenBuf[:], int64(pos)); err != nil {
 		return nil, err
 	}
-	b := make([]byte, enc.Uint64(size))
+	n := enc.Uint64(s.lenBuf[:])
+	if uint64(cap(buf)) < n {
+		buf = make([]byte, n)
+	}
+	b := buf[:n]
 	// Reading the Data
-	if _, err = s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	if _, err := s.read(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
 	return b, nil
@@ -85,18 +208,144 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.read(p, off)
+}
 
-	if err = s.buf.Flush(); err != nil {
-		return 0, err
+// reads the store's bytes at off, those still buffered from the buffer, so
+// consumers following the log's head don't flush it on every read. an
+// O_DIRECT store's flushed first, its buffer's laid out by block. callers
+// hold the lock
+func (s *store) read(p []byte, off int64) (int, error) {
+	b, ok := s.buf.(*appendBuffer)
+	if !ok {
+		if err := s.buf.Flush(); err != nil {
+			return 0, err
+		}
+		return s.readAt(p, off)
+	}
+	flushed := int64(s.size) - int64(len(b.buf))
+	var n int
+	if off < flushed {
+		var err error
+		if n, err = s.readAt(p[:min(int64(len(p)), flushed-off)], off); err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		if start := off + int64(n) - flushed; start < int64(len(b.buf)) {
+			n += copy(p[n:], b.buf[start:])
+		}
+		if n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (s *store) readAt(p []byte, off int64) (int, error) {
+	if s.ring != nil {
+		return s.ring.readAt(s.fd, p, off)
 	}
 	return s.File.ReadAt(p, off)
 }
 
+// has the store read, and write unless it writes with O_DIRECT, through the
+// ring from now on
+func (s *store) useRing(r *uring) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	s.ring = r
+	s.fd = int32(s.File.Fd())
+	if s.direct == nil {
+		s.dst = ringWriter{u: r, fd: s.fd}
+		s.buf = newAppendBuffer(s.dst, s.buf.(*appendBuffer).Size())
+	}
+	return nil
+}
+
+// has the store write its records with O_DIRECT from now on, it fails, and
+// the store keeps writing through the page cache, when the platform or the
+// file's filesystem doesn't support it
+func (s *store) enableDirectIO() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	w, err := newDirectWriter(s.File, s.size)
+	if err != nil {
+		return err
+	}
+	s.buf = w
+	s.direct = w
+	return nil
+}
+
+// writes p over the store's bytes at off and syncs them, e.g. to erase a
+// record. the file's opened for appends, so it's written through another
+// handle
+func (s *store) overwrite(p []byte, off uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.File.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(p, int64(off)); err != nil {
+		return err
+	}
+	if s.direct != nil {
+		// it reloads the last block, which may hold the bytes written
+		s.direct.reset(s.size)
+	}
+	return f.Sync()
+}
+
+// cuts the file down to size bytes, dropping everything written after it
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	if s.direct != nil {
+		s.direct.reset(size)
+	}
+	s.size = size
+	return nil
+}
+
+// flushes the buffer and the file's contents to stable storage
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err = s.buf.Flush(); err != nil {
 		return err
 	}
+	if s.direct != nil {
+		if err = s.direct.Close(); err != nil {
+			return err
+		}
+	}
 	return s.File.Close()
 }
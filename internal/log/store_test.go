@@ -1,7 +1,10 @@
 package log
 
 import (
+	"bytes"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -23,6 +26,8 @@ func TestStoreAppendRead(t *testing.T) {
 	testStoreAppend(t, s)
 	testStoreRead(t, s)
 	testStoreReadAt(t, s)
+	// reads don't flush the appends they're served from
+	require.NoError(t, s.Sync())
 
 	s, err = newStore(f)
 	require.NoError(t, err)
@@ -90,6 +95,65 @@ func TestStoreClose(t *testing.T) {
 
 }
 
+func TestStoreDirectIO(t *testing.T) {
+	f, _, err := openFile(filepath.Join(t.TempDir(), "0.store"))
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	if err := s.enableDirectIO(); err != nil {
+		t.Skipf("direct I/O isn't supported here: %v", err)
+	}
+
+	// records that straddle blocks and fill the buffer a few times, read
+	// back while the last block's still partial
+	record := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 1000+i*7)
+	}
+	var positions []uint64
+	for i := 0; i < 300; i++ {
+		_, pos, err := s.Append(record(i))
+		require.NoError(t, err)
+		positions = append(positions, pos)
+		if i%50 == 0 {
+			read, err := s.Read(pos)
+			require.NoError(t, err)
+			require.Equal(t, record(i), read)
+			// the file only ever holds what's been written
+			fi, err := f.Stat()
+			require.NoError(t, err)
+			require.Equal(t, int64(s.size), fi.Size())
+		}
+	}
+	for i, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, record(i), read)
+	}
+
+	// appends after a truncation overwrite what was cut
+	require.NoError(t, s.Truncate(positions[200]))
+	_, pos, err := s.Append([]byte("after truncation"))
+	require.NoError(t, err)
+	require.Equal(t, positions[200], pos)
+	require.NoError(t, s.Close())
+
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	for i, pos := range positions[:200] {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, record(i), read)
+	}
+	read, err := s.Read(positions[200])
+	require.NoError(t, err)
+	require.Equal(t, []byte("after truncation"), read)
+}
+
 func openFile(name string) (file *os.File, size int64, err error) {
 	f, err := os.OpenFile(
 		name,
@@ -105,3 +169,96 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+func TestStoreWriteBuffer(t *testing.T) {
+	f, err := os.CreateTemp("", "store_write_buffer_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.NoError(t, s.setWriteBuffer(64<<10, false))
+	require.Equal(t, 64<<10, s.buf.(*appendBuffer).Size())
+
+	require.NoError(t, s.setWriteBuffer(0, true))
+	size := func() int {
+		return s.buf.(*appendBuffer).Size()
+	}
+	var positions []uint64
+	var records [][]byte
+	appendRecords := func(n, recordBytes int) {
+		for i := 0; i < n; i++ {
+			p := bytes.Repeat([]byte{byte(len(records))}, recordBytes)
+			_, pos, err := s.Append(p)
+			require.NoError(t, err)
+			positions = append(positions, pos)
+			records = append(records, p)
+		}
+	}
+	// large records grow the buffer so it holds several of them
+	appendRecords(50, 128<<10)
+	require.Equal(t, maxWriteBuffer, size())
+	// tiny ones shrink it again
+	appendRecords(200, 8)
+	require.Less(t, size(), 1<<10)
+
+	for i, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, records[i], read)
+	}
+}
+
+func TestStoreReadBuffered(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_buffered_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.NoError(t, s.setWriteBuffer(64, false))
+	// the third record's too big for the buffer, it's written straight through
+	// after what's buffered, and the fourth's left in the buffer
+	records := [][]byte{
+		bytes.Repeat([]byte("a"), 40),
+		bytes.Repeat([]byte("b"), 20),
+		bytes.Repeat([]byte("c"), 100),
+		[]byte("d"),
+	}
+	var positions []uint64
+	for _, record := range records {
+		_, pos, err := s.Append(record)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	flushed := fi.Size()
+	require.Less(t, uint64(flushed), s.size)
+
+	for i, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, records[i], read)
+	}
+	// reading the buffered records didn't flush them
+	fi, err = f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, flushed, fi.Size())
+
+	// a read spanning the file and the buffer
+	b := make([]byte, s.size)
+	n, err := s.ReadAt(b, 0)
+	require.NoError(t, err)
+	require.Equal(t, int(s.size), n)
+	_, err = s.ReadAt(make([]byte, 1), int64(s.size))
+	require.Equal(t, io.EOF, err)
+
+	require.NoError(t, s.Close())
+	fi, err = os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(len(b)), fi.Size())
+	disk, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, disk, b)
+}
@@ -0,0 +1,153 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// how many operations the ring submits to the kernel at once
+const ringEntries = 256
+
+var errIOUringUnsupported = errors.New("io_uring isn't supported by this build, build with -tags iouring on Linux")
+
+// experimental: the log's stores read and write their files through an
+// io_uring, shared by the log's segments. like the log's writer, a goroutine
+// takes the operations handed over to it and submits those handed over
+// meanwhile together, so concurrent reads cost one io_uring_enter call rather
+// than a pread each
+type uring struct {
+	ring *ring
+	// unbuffered, as the writer's
+	requests chan *ringOp
+	stop     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+// a read or a write, res is what the syscall would have returned, or the
+// negated errno
+type ringOp struct {
+	write bool
+	fd    int32
+	buf   []byte
+	off   uint64
+	res   int32
+	done  chan struct{}
+}
+
+func newURing() (*uring, error) {
+	r, err := newRing(ringEntries)
+	if err != nil {
+		return nil, err
+	}
+	u := &uring{
+		ring:     r,
+		requests: make(chan *ringOp),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go u.submit()
+	return u, nil
+}
+
+func (u *uring) submit() {
+	defer close(u.stopped)
+	batch := make([]*ringOp, 0, ringEntries)
+	for {
+		batch = batch[:0]
+		select {
+		case op := <-u.requests:
+			batch = append(batch, op)
+		case <-u.stop:
+			return
+		}
+	drain:
+		for len(batch) < ringEntries {
+			select {
+			case op := <-u.requests:
+				batch = append(batch, op)
+			default:
+				break drain
+			}
+		}
+		u.ring.submit(batch)
+		for _, op := range batch {
+			close(op.done)
+		}
+	}
+}
+
+// hands op to the submitter and waits for it to complete
+func (u *uring) do(op *ringOp) error {
+	op.done = make(chan struct{})
+	select {
+	case u.requests <- op:
+	case <-u.stop:
+		return os.ErrClosed
+	}
+	<-op.done
+	return nil
+}
+
+// reads as os.File.ReadAt would
+func (u *uring) readAt(fd int32, p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		op := &ringOp{fd: fd, buf: p[n:], off: uint64(off) + uint64(n)}
+		if err := u.do(op); err != nil {
+			return n, err
+		}
+		if op.res < 0 {
+			if err := errno(op.res); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if op.res == 0 {
+			return n, io.EOF
+		}
+		n += int(op.res)
+	}
+	return n, nil
+}
+
+// appends p to the file fd, which is opened with O_APPEND
+func (u *uring) write(fd int32, p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		// an offset of -1 writes at the file's position, its end here
+		op := &ringOp{write: true, fd: fd, buf: p[n:], off: ^uint64(0)}
+		if err := u.do(op); err != nil {
+			return n, err
+		}
+		if op.res < 0 {
+			if err := errno(op.res); err != nil {
+				return n, err
+			}
+			continue
+		}
+		n += int(op.res)
+	}
+	return n, nil
+}
+
+// stops the submitter, later operations fail with os.ErrClosed
+func (u *uring) close() error {
+	u.once.Do(func() {
+		close(u.stop)
+	})
+	<-u.stopped
+	return u.ring.close()
+}
+
+// writes a store's flushed appends through the ring
+type ringWriter struct {
+	u  *uring
+	fd int32
+}
+
+func (w ringWriter) Write(p []byte) (int, error) {
+	return w.u.write(w.fd, p)
+}
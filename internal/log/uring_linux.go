@@ -0,0 +1,193 @@
+//go:build linux && iouring
+
+package log
+
+import (
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// from linux/io_uring.h
+const (
+	ioringOpRead         = 22
+	ioringOpWrite        = 23
+	ioringEnterGetEvents = 1 << 0
+	ioringOffSQRing      = 0
+	ioringOffCQRing      = 0x8000000
+	ioringOffSQEs        = 0x10000000
+)
+
+type ioSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type ioURingParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  ioSQRingOffsets
+	cqOff                                                                  ioCQRingOffsets
+}
+
+type ioURingSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type ioURingCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// an io_uring's submission and completion queues, mapped from the kernel.
+// only the submitter goroutine uses it
+type ring struct {
+	fd int
+	// the mappings, to unmap them
+	sqRing, cqRing, sqeMem []byte
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []uint32
+	sqes                   []ioURingSQE
+
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []ioURingCQE
+}
+
+func newRing(entries uint32) (*ring, error) {
+	var p ioURingParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	r := &ring{fd: int(fd)}
+	var err error
+	r.sqRing, err = unix.Mmap(r.fd, ioringOffSQRing,
+		int(p.sqOff.array+p.sqEntries*4),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.cqRing, err = unix.Mmap(r.fd, ioringOffCQRing,
+		int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(ioURingCQE{}))),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.sqeMem, err = unix.Mmap(r.fd, ioringOffSQEs,
+		int(p.sqEntries*uint32(unsafe.Sizeof(ioURingSQE{}))),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*ioURingSQE)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*ioURingCQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return r, nil
+}
+
+// submits the operations with one io_uring_enter call and waits for them all
+// to complete, setting their results. there are never more than the ring's
+// entries, and the completion queue's twice as big, so neither overflows
+func (r *ring) submit(ops []*ringOp) {
+	tail := atomic.LoadUint32(r.sqTail)
+	mask := *r.sqMask
+	for i, op := range ops {
+		idx := (tail + uint32(i)) & mask
+		sqe := &r.sqes[idx]
+		*sqe = ioURingSQE{
+			opcode:   ioringOpRead,
+			fd:       op.fd,
+			off:      op.off,
+			len:      uint32(len(op.buf)),
+			userData: uint64(i),
+		}
+		if op.write {
+			sqe.opcode = ioringOpWrite
+		}
+		// until it completes
+		op.res = -int32(syscall.ECANCELED)
+		if len(op.buf) > 0 {
+			sqe.addr = uint64(uintptr(unsafe.Pointer(&op.buf[0])))
+		}
+		r.sqArray[idx] = idx
+	}
+	atomic.StoreUint32(r.sqTail, tail+uint32(len(ops)))
+
+	toSubmit, completed := len(ops), 0
+	for completed < len(ops) {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd),
+			uintptr(toSubmit), uintptr(len(ops)-completed), ioringEnterGetEvents, 0, 0)
+		if errno != 0 && errno != syscall.EINTR && errno != syscall.EAGAIN && errno != syscall.EBUSY {
+			// the ring's unusable, fail whatever hasn't completed
+			for _, op := range ops {
+				if op.res == -int32(syscall.ECANCELED) {
+					op.res = -int32(errno)
+				}
+			}
+			break
+		}
+		if errno == 0 {
+			toSubmit -= int(n)
+		}
+		head := atomic.LoadUint32(r.cqHead)
+		for ; head != atomic.LoadUint32(r.cqTail); head++ {
+			cqe := r.cqes[head&*r.cqMask]
+			ops[cqe.userData].res = cqe.res
+			completed++
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+	// the kernel's done with the buffers
+	runtime.KeepAlive(ops)
+}
+
+func (r *ring) close() error {
+	for _, m := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	return unix.Close(r.fd)
+}
+
+// the error a negated errno result stands for, nil when the operation should
+// be retried
+func errno(res int32) error {
+	err := syscall.Errno(-res)
+	if err == syscall.EINTR || err == syscall.EAGAIN {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+//go:build !linux || !iouring
+
+package log
+
+import "syscall"
+
+type ring struct{}
+
+func newRing(uint32) (*ring, error) {
+	return nil, errIOUringUnsupported
+}
+
+func (*ring) submit([]*ringOp) {}
+
+func (*ring) close() error {
+	return nil
+}
+
+func errno(res int32) error {
+	return syscall.Errno(-res)
+}
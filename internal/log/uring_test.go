@@ -0,0 +1,69 @@
+package log
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the ring's only used in builds with -tags iouring, other builds check the
+// log falls back to syscalls
+func TestLogIOUring(t *testing.T) {
+	for scenario, directIO := range map[string]bool{
+		"through the page cache": false,
+		"with direct I/O":        true,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir := t.TempDir()
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32 << 10
+			c.Segment.MaxIndexBytes = 1 << 20
+			c.Segment.IOUring = true
+			c.Segment.DirectIO = directIO
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			if r, err := newRing(1); err == nil {
+				require.NoError(t, r.close())
+				require.NotNil(t, log.ring)
+			}
+
+			const writers, records = 8, 100
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < records; i++ {
+						off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+						require.NoError(t, err)
+						// concurrent reads are submitted together
+						_, err = log.Read(off)
+						require.NoError(t, err)
+					}
+				}()
+			}
+			wg.Wait()
+			require.NoError(t, log.Close())
+
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				log.Close()
+			})
+			counts := map[string]int{}
+			for off := uint64(0); off < writers*records; off++ {
+				record, err := log.Read(off)
+				require.NoError(t, err)
+				counts[string(record.Value)]++
+			}
+			require.Len(t, counts, records)
+			for _, n := range counts {
+				require.Equal(t, writers, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package log
+
+import (
+	"os"
+	"sync"
+
+	api "proglog/api/v1"
+)
+
+// the most records the writer appends under one hold of the lock
+const maxAppendBatch = 128
+
+// the log's single writer: Append hands its record over and waits, and the
+// writer appends the records handed over meanwhile together, taking the lock
+// and writing their index entries once per batch rather than once per record,
+// so producers don't contend for it
+type writer struct {
+	// unbuffered, a record's only handed over once the writer takes it, so
+	// none are left behind when it stops
+	requests chan appendRequest
+	stop     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+type appendRequest struct {
+	record *api.Record
+	done   chan appendResult
+}
+
+type appendResult struct {
+	off                uint64
+	rotated, duplicate bool
+	err                error
+}
+
+func (l *Log) startWriter() {
+	w := &writer{
+		requests: make(chan appendRequest),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	l.writer.Store(w)
+	go l.write(w)
+}
+
+// waits for the batch being appended, later appends fail with os.ErrClosed
+func (l *Log) stopWriter() {
+	w := l.writer.Load()
+	w.once.Do(func() {
+		close(w.stop)
+	})
+	<-w.stopped
+}
+
+func (l *Log) write(w *writer) {
+	defer close(w.stopped)
+	batch := make([]appendRequest, 0, maxAppendBatch)
+	for {
+		batch = batch[:0]
+		select {
+		case req := <-w.requests:
+			batch = append(batch, req)
+		case <-w.stop:
+			return
+		}
+	drain:
+		for len(batch) < maxAppendBatch {
+			select {
+			case req := <-w.requests:
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		results := make([]appendResult, len(batch))
+		l.mu.Lock()
+		for i, req := range batch {
+			res := &results[i]
+			res.off, res.rotated, res.duplicate, res.err = l.append(req.record)
+		}
+		// the batch's index entries are written in one pass, before readers
+		// can see the records. appendDeferred made sure they fit
+		if err := l.activeSegment.flushIndex(); err != nil {
+			for i := range results {
+				if results[i].err == nil {
+					results[i].err = err
+				}
+			}
+		}
+		l.mu.Unlock()
+		for i, req := range batch {
+			req.done <- results[i]
+		}
+	}
+}
+
+// hands the record to the writer and waits for it to be appended
+func (l *Log) submit(record *api.Record) appendResult {
+	w := l.writer.Load()
+	req := appendRequest{record: record, done: make(chan appendResult, 1)}
+	select {
+	case w.requests <- req:
+	case <-w.stop:
+		return appendResult{err: os.ErrClosed}
+	}
+	return <-req.done
+}
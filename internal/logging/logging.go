@@ -0,0 +1,129 @@
+// builds the zap logger the node's components log through. each component logs
+// through a named child, e.g. the agent's "server", and can log at its own level
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type Config struct {
+	// console or json, console when empty
+	Format string
+	Levels Levels
+	// stderr when nil
+	Output zapcore.WriteSyncer
+}
+
+// the level every component logs at unless Components has one for it. a
+// component is a logger's name, or what the name starts with up to a dot, so
+// "log" covers "log.replicator" unless that has a level of its own
+type Levels struct {
+	Default    zapcore.Level
+	Components map[string]zapcore.Level
+}
+
+// parses the default level and the components' levels, spelled like
+// "server=debug"
+func ParseLevels(level string, components []string) (Levels, error) {
+	l := Levels{Components: make(map[string]zapcore.Level)}
+	var err error
+	if l.Default, err = zapcore.ParseLevel(level); err != nil {
+		return Levels{}, err
+	}
+	for _, c := range components {
+		name, level, ok := strings.Cut(c, "=")
+		if !ok || name == "" {
+			return Levels{}, fmt.Errorf("logging: %q isn't component=level", c)
+		}
+		if l.Components[name], err = zapcore.ParseLevel(level); err != nil {
+			return Levels{}, err
+		}
+	}
+	return l, nil
+}
+
+func (l Levels) level(name string) zapcore.Level {
+	for name != "" {
+		if level, ok := l.Components[name]; ok {
+			return level
+		}
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return l.Default
+}
+
+func (l Levels) min() zapcore.Level {
+	min := l.Default
+	for _, level := range l.Components {
+		if level < min {
+			min = level
+		}
+	}
+	return min
+}
+
+// a zap logger whose levels SetLevels changes while it's logging
+type Logger struct {
+	*zap.Logger
+	levels *atomic.Pointer[Levels]
+}
+
+func New(c Config) (*Logger, error) {
+	var enc zapcore.Encoder
+	switch c.Format {
+	case "", "console":
+		enc = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	case "json":
+		enc = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	default:
+		return nil, fmt.Errorf("logging: unknown format %q, want console or json", c.Format)
+	}
+	if c.Output == nil {
+		c.Output = zapcore.Lock(os.Stderr)
+	}
+	levels := &atomic.Pointer[Levels]{}
+	levels.Store(&c.Levels)
+	core := &levelCore{
+		Core:   zapcore.NewCore(enc, c.Output, zapcore.DebugLevel),
+		levels: levels,
+	}
+	return &Logger{
+		Logger: zap.New(core, zap.AddCaller()),
+		levels: levels,
+	}, nil
+}
+
+func (l *Logger) SetLevels(levels Levels) {
+	l.levels.Store(&levels)
+}
+
+// drops the entries below their logger's level
+type levelCore struct {
+	zapcore.Core
+	levels *atomic.Pointer[Levels]
+}
+
+func (c *levelCore) Enabled(level zapcore.Level) bool {
+	return level >= c.levels.Load().min()
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), levels: c.levels}
+}
+
+func (c *levelCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if e.Level < c.levels.Load().level(e.LoggerName) {
+		return ce
+	}
+	return c.Core.Check(e, ce)
+}
@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLogger(t *testing.T) {
+	levels, err := ParseLevels("info", []string{"server=debug", "log=warn", "log.replicator=info"})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	l, err := New(Config{
+		Format: "json",
+		Levels: levels,
+		Output: zapcore.AddSync(&out),
+	})
+	require.NoError(t, err)
+
+	l.Named("agent").Debug("dropped")
+	l.Named("agent").Info("kept")
+	l.Named("server").Debug("kept")
+	l.Named("log").Info("dropped")
+	l.Named("log").Named("replicator").Info("kept")
+	l.Named("discovery").With().Info("kept")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 4)
+	for _, line := range lines {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		require.Equal(t, "kept", entry["msg"])
+	}
+
+	out.Reset()
+	l.SetLevels(Levels{Default: zapcore.ErrorLevel})
+	l.Named("server").Warn("dropped")
+	require.Empty(t, out.String())
+
+	_, err = ParseLevels("info", []string{"server"})
+	require.ErrorContains(t, err, "component=level")
+	_, err = ParseLevels("loud", nil)
+	require.Error(t, err)
+	_, err = New(Config{Format: "xml"})
+	require.ErrorContains(t, err, "unknown format")
+}
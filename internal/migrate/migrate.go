@@ -0,0 +1,199 @@
+// upgrades a node's data directory from the on-disk format of an older version
+// to the current one, one step at a time
+
+// The data directory records its format version in a VERSION file. Directories
+// written before the file existed are version 0.
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the format this build reads and writes
+const CurrentVersion = 1
+
+const versionFile = "VERSION"
+
+type Step struct {
+	// the version the step upgrades from, to From+1
+	From        int
+	Description string
+	apply       func(dir string) error
+}
+
+var steps = []Step{
+	{
+		From:        0,
+		Description: "move the log's segments from the data dir into its log directory",
+		apply:       moveSegments,
+	},
+}
+
+// returns the data directory's format version: an empty or missing directory
+// is new, so it's the current version
+func Version(dir string) (int, error) {
+	b, err := os.ReadFile(filepath.Join(dir, versionFile))
+	if err == nil {
+		return strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return CurrentVersion, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return CurrentVersion, nil
+	}
+	return 0, nil
+}
+
+// returns the steps that upgrade the data directory to the current version
+func Plan(dir string) ([]Step, error) {
+	version, err := Version(dir)
+	if err != nil {
+		return nil, err
+	}
+	if version > CurrentVersion {
+		return nil, fmt.Errorf(
+			"migrate: %s has format version %d, newer than this build's %d",
+			dir,
+			version,
+			CurrentVersion,
+		)
+	}
+	var plan []Step
+	for _, step := range steps {
+		if step.From >= version {
+			plan = append(plan, step)
+		}
+	}
+	return plan, nil
+}
+
+// upgrades the data directory to the current version, after copying it to
+// backupDir unless that's empty. each step records the version it upgraded to,
+// so an interrupted migration resumes from the step that failed
+func Migrate(dir, backupDir string) ([]Step, error) {
+	plan, err := Plan(dir)
+	if err != nil || len(plan) == 0 {
+		return nil, err
+	}
+	if backupDir != "" {
+		if err := copyDir(dir, backupDir); err != nil {
+			return nil, fmt.Errorf("migrate: backing up %s: %w", dir, err)
+		}
+	}
+	for _, step := range plan {
+		if err := step.apply(dir); err != nil {
+			return nil, fmt.Errorf("migrate: %s: %w", step.Description, err)
+		}
+		if err := writeVersion(dir, step.From+1); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// fails unless the data directory is at the current version, and marks a new
+// one as such. nodes call it before they open their data
+func Check(dir string) error {
+	version, err := Version(dir)
+	if err != nil {
+		return err
+	}
+	if version != CurrentVersion {
+		return fmt.Errorf(
+			"migrate: %s has format version %d, this build needs %d: run proglog migrate",
+			dir,
+			version,
+			CurrentVersion,
+		)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeVersion(dir, CurrentVersion)
+}
+
+// written through a temporary file so a crash never leaves a torn version
+func writeVersion(dir string, version int) error {
+	tmp := filepath.Join(dir, versionFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(version)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, versionFile))
+}
+
+// version 0 kept the .store and .index files in the data dir itself
+func moveSegments(dir string) error {
+	logDir := filepath.Join(dir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".store" && ext != ".index") {
+			continue
+		}
+		if err := os.Rename(
+			filepath.Join(dir, entry.Name()),
+			filepath.Join(logDir, entry.Name()),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,66 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	// a data dir from before the log moved into its own directory
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	version, err := Version(dir)
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+	require.Error(t, Check(dir))
+
+	plan, err := Plan(dir)
+	require.NoError(t, err)
+	require.Len(t, plan, 1)
+
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	migrated, err := Migrate(dir, backupDir)
+	require.NoError(t, err)
+	require.Len(t, migrated, 1)
+	require.Equal(t, plan[0].Description, migrated[0].Description)
+	require.NoError(t, Check(dir))
+	plan, err = Plan(dir)
+	require.NoError(t, err)
+	require.Empty(t, plan)
+
+	l, err = log.NewLog(filepath.Join(dir, "log"), log.Config{})
+	require.NoError(t, err)
+	record, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.NoError(t, l.Close())
+
+	// the backup is the data dir as it was
+	_, err = os.Stat(filepath.Join(backupDir, "0.store"))
+	require.NoError(t, err)
+}
+
+func TestCheck(t *testing.T) {
+	// new data dirs are created at the current version
+	dir := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, Check(dir))
+	version, err := Version(dir)
+	require.NoError(t, err)
+	require.Equal(t, CurrentVersion, version)
+
+	require.NoError(t, writeVersion(dir, CurrentVersion+1))
+	require.Error(t, Check(dir))
+	_, err = Plan(dir)
+	require.Error(t, err)
+}
@@ -0,0 +1,338 @@
+// mirrors one proglog cluster into another: consumes the source cluster's log
+// and produces every record into the destination cluster, for disaster recovery
+// and read replicas in other regions
+
+// The mirror checkpoints the next source offset to a file so it resumes where it
+// left off after a restart. Records produced after the last checkpoint are mirrored
+// again on restart, so delivery is at-least-once, except for idempotent
+// producers' records, which the destination drops as retries. See proglog
+// mirror.
+//
+// Only committed transactions' records are mirrored, once their transactions
+// commit, as records produced outside a transaction. They're read from the
+// source's leader, the only node that knows which transactions are open.
+//
+// Redactions aren't mirrored: records redacted on the source before they're
+// mirrored are skipped, ones redacted after have to be redacted on the
+// destination too.
+package mirror
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type Config struct {
+	// the cluster records are consumed from, its leader when it has
+	// transactions, only the leader serves read committed consumers
+	SourceAddr        string
+	SourceDialOptions []grpc.DialOption
+	// the cluster records are produced to
+	DestinationAddr        string
+	DestinationDialOptions []grpc.DialOption
+	// the file the next source offset to mirror is persisted to
+	CheckpointPath string
+	// how often the checkpoint is written, it's also written on close
+	CheckpointInterval time.Duration
+	// how often the source's end offset is polled to compute the lag
+	LagInterval time.Duration
+	// registers the mirror's metrics when set
+	Registerer prometheus.Registerer
+}
+
+type Mirror struct {
+	Config
+
+	mu sync.Mutex
+	// the next source offset to mirror
+	offset uint64
+	// the offset the checkpoint file holds
+	checkpointed uint64
+	// the source's end offset the last time it was polled
+	end uint64
+	// set once the source turned out not to have transactions, so it's
+	// consumed read uncommitted
+	uncommitted atomic.Bool
+
+	source      api.LogClient
+	destination api.LogClient
+	conns       []*grpc.ClientConn
+
+	lag     prometheus.Gauge
+	records prometheus.Counter
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	closed bool
+}
+
+func New(config Config) (*Mirror, error) {
+	if config.CheckpointInterval == 0 {
+		config.CheckpointInterval = time.Second
+	}
+	if config.LagInterval == 0 {
+		config.LagInterval = 5 * time.Second
+	}
+	m := &Mirror{
+		Config: config,
+		lag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Subsystem: "mirror",
+			Name:      "lag_records",
+			Help:      "Records in the source log that haven't been mirrored yet.",
+		}),
+		records: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "mirror",
+			Name:      "records_total",
+			Help:      "Records mirrored into the destination log.",
+		}),
+	}
+	if m.Registerer != nil {
+		for _, c := range []prometheus.Collector{m.lag, m.records} {
+			if err := m.Registerer.Register(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var err error
+	if m.offset, err = readCheckpoint(m.CheckpointPath); err != nil {
+		return nil, err
+	}
+	m.checkpointed = m.offset
+
+	src, err := grpc.NewClient(m.SourceAddr, m.SourceDialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := grpc.NewClient(m.DestinationAddr, m.DestinationDialOptions...)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	m.conns = []*grpc.ClientConn{src, dst}
+	m.source = api.NewLogClient(src)
+	m.destination = api.NewLogClient(dst)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.wg.Add(2)
+	go m.run(ctx)
+	go m.track(ctx)
+	return m, nil
+}
+
+// returns the next source offset to mirror
+func (m *Mirror) Offset() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.offset
+}
+
+// returns how many records the mirror is behind the source, as of the last poll
+func (m *Mirror) Lag() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lagLocked()
+}
+
+// stops mirroring and writes the final checkpoint
+func (m *Mirror) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.mu.Unlock()
+
+	m.cancel()
+	m.wg.Wait()
+	if err := m.checkpoint(); err != nil {
+		return err
+	}
+	for _, conn := range m.conns {
+		if err := conn.Close(); err != nil {
+			return err
+		}
+	}
+	if m.Registerer != nil {
+		m.Registerer.Unregister(m.lag)
+		m.Registerer.Unregister(m.records)
+	}
+	return nil
+}
+
+// consumes the source from the last checkpoint and produces each record
+// into the destination, reconnecting with backoff on errors
+func (m *Mirror) run(ctx context.Context) {
+	defer m.wg.Done()
+
+	backoff := 50 * time.Millisecond
+	for {
+		err := m.mirror(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			backoff = 50 * time.Millisecond
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (m *Mirror) mirror(ctx context.Context) error {
+	isolation := api.ConsumeRequest_READ_COMMITTED
+	if m.uncommitted.Load() {
+		isolation = api.ConsumeRequest_READ_UNCOMMITTED
+	}
+	stream, err := m.source.ConsumeStream(
+		ctx,
+		&api.ConsumeRequest{Offset: m.Offset(), Isolation: isolation},
+	)
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if status.Code(err) == codes.Unimplemented && !m.uncommitted.Load() {
+			// the source has no transactions, so every record's committed
+			m.uncommitted.Store(true)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if mirrored(res.Record) {
+			if err := m.produce(ctx, res.Record); err != nil {
+				return err
+			}
+			m.records.Inc()
+		}
+		m.mu.Lock()
+		m.offset = res.Record.Offset + 1
+		m.lag.Set(float64(m.lagLocked()))
+		m.mu.Unlock()
+	}
+}
+
+// whether the record's produced into the destination: transactions' markers
+// aren't, the destination's consumers see the committed transactions' records
+// as records produced outside one. redactions aren't either, their offsets are
+// the source's, and the records they redacted have nothing left to mirror
+func mirrored(record *api.Record) bool {
+	switch record.Control {
+	case api.Record_COMMIT, api.Record_ABORT, api.Record_REDACT:
+		return false
+	}
+	return record.Redacted == 0
+}
+
+func (m *Mirror) produce(ctx context.Context, record *api.Record) error {
+	// the destination assigns its own offsets. the rest's kept: keys,
+	// timestamps, and producer IDs and sequences, so the destination drops
+	// the records mirrored again after a restart as retries
+	record = proto.Clone(record).(*api.Record)
+	record.Offset = 0
+	// the source committed its transaction
+	record.TransactionId = ""
+	_, err := m.destination.Produce(ctx, &api.ProduceRequest{Record: record})
+	return err
+}
+
+// periodically writes the checkpoint and polls the source's end offset
+func (m *Mirror) track(ctx context.Context) {
+	defer m.wg.Done()
+
+	checkpoint := time.NewTicker(m.CheckpointInterval)
+	defer checkpoint.Stop()
+	lag := time.NewTicker(m.LagInterval)
+	defer lag.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-checkpoint.C:
+			// a failed write is retried on the next tick
+			_ = m.checkpoint()
+		case <-lag.C:
+			res, err := m.source.GetOffsets(ctx, &api.GetOffsetsRequest{})
+			if err != nil {
+				continue
+			}
+			m.mu.Lock()
+			m.end = res.EndOffset
+			m.lag.Set(float64(m.lagLocked()))
+			m.mu.Unlock()
+		}
+	}
+}
+
+// callers hold the lock
+func (m *Mirror) lagLocked() uint64 {
+	if m.end <= m.offset {
+		return 0
+	}
+	return m.end - m.offset
+}
+
+// writes the next source offset to the checkpoint file if it moved,
+// through a temporary file so a crash never leaves a torn checkpoint
+func (m *Mirror) checkpoint() error {
+	m.mu.Lock()
+	off := m.offset
+	m.mu.Unlock()
+	if off == m.checkpointed {
+		return nil
+	}
+	tmp := m.CheckpointPath + ".tmp"
+	if err := os.WriteFile(
+		tmp,
+		[]byte(strconv.FormatUint(off, 10)),
+		0644,
+	); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, m.CheckpointPath); err != nil {
+		return err
+	}
+	m.checkpointed = off
+	return nil
+}
+
+// a missing checkpoint means the mirror starts from the beginning
+func readCheckpoint(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
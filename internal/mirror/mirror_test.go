@@ -0,0 +1,222 @@
+package mirror
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+	"proglog/internal/server"
+	"proglog/internal/txn"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMirror(t *testing.T) {
+	// the source hasn't transactions, so it's consumed read uncommitted
+	source, sourceAddr, _ := setupServer(t, false)
+	destination, destinationAddr, _ := setupServer(t, false)
+
+	dir, err := os.MkdirTemp("", "mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := testConfig(sourceAddr, destinationAddr, filepath.Join(dir, "checkpoint"))
+	m, err := New(config)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := source.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	requireMirrored(t, destination, 3)
+	require.Eventually(t, func() bool {
+		return m.Lag() == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	require.NoError(t, m.Close())
+
+	// the mirror resumes from its checkpoint rather than mirroring everything again
+	_, err = source.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Key: []byte("key"), Value: []byte("hello again")},
+	})
+	require.NoError(t, err)
+	m, err = New(config)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), m.Offset())
+	requireMirrored(t, destination, 4)
+	require.NoError(t, m.Close())
+
+	res, err := destination.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello again"), res.Record.Value)
+	// the whole record's mirrored but its offset
+	src, err := source.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	require.NoError(t, err)
+	require.Equal(t, []byte("key"), res.Record.Key)
+	require.Equal(t, src.Record.Timestamp, res.Record.Timestamp)
+}
+
+func TestMirrorTransactions(t *testing.T) {
+	source, sourceAddr, _ := setupServer(t, true)
+	destination, destinationAddr, _ := setupServer(t, false)
+	m, err := New(testConfig(
+		sourceAddr,
+		destinationAddr,
+		filepath.Join(t.TempDir(), "checkpoint"),
+	))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		m.Close()
+	})
+
+	ctx := context.Background()
+	produce := func(value string, commit bool) {
+		begin, err := source.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+		require.NoError(t, err)
+		_, err = source.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:         []byte(value),
+				TransactionId: begin.TransactionId,
+			},
+		})
+		require.NoError(t, err)
+		end := &api.EndTransactionRequest{TransactionId: begin.TransactionId}
+		if commit {
+			_, err = source.CommitTransaction(ctx, end)
+		} else {
+			_, err = source.AbortTransaction(ctx, end)
+		}
+		require.NoError(t, err)
+	}
+	produce("aborted", false)
+	produce("committed", true)
+	_, err = source.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("plain")},
+	})
+	require.NoError(t, err)
+
+	// only the committed transaction's record and the plain one, without the
+	// markers, and the destination needn't have transactions
+	requireMirrored(t, destination, 2)
+	for off, value := range []string{"committed", "plain"} {
+		res, err := destination.Consume(ctx, &api.ConsumeRequest{Offset: uint64(off)})
+		require.NoError(t, err)
+		require.Equal(t, []byte(value), res.Record.Value)
+		require.Empty(t, res.Record.TransactionId)
+	}
+	require.Eventually(t, func() bool {
+		return m.Lag() == 0
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestMirrorRedactions(t *testing.T) {
+	_, sourceAddr, source := setupServer(t, false)
+	destination, destinationAddr, _ := setupServer(t, false)
+	for _, value := range []string{"secret", "public"} {
+		_, err := source.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	redaction, err := proto.Marshal(&api.Redaction{Offsets: []uint64{0}})
+	require.NoError(t, err)
+	_, err = source.Append(&api.Record{Control: api.Record_REDACT, Value: redaction})
+	require.NoError(t, err)
+
+	m, err := New(testConfig(
+		sourceAddr,
+		destinationAddr,
+		filepath.Join(t.TempDir(), "checkpoint"),
+	))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		m.Close()
+	})
+
+	// neither the redacted record nor the redaction's mirrored
+	requireMirrored(t, destination, 1)
+	res, err := destination.Consume(context.Background(), &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("public"), res.Record.Value)
+	require.Eventually(t, func() bool {
+		return m.Offset() == 3
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func testConfig(source, destination, checkpoint string) Config {
+	return Config{
+		SourceAddr: source,
+		SourceDialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		DestinationAddr: destination,
+		DestinationDialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		CheckpointPath:     checkpoint,
+		CheckpointInterval: 10 * time.Millisecond,
+		LagInterval:        10 * time.Millisecond,
+		Registerer:         prometheus.NewRegistry(),
+	}
+}
+
+func requireMirrored(t *testing.T, client api.LogClient, n uint64) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		res, err := client.GetOffsets(
+			context.Background(),
+			&api.GetOffsetsRequest{},
+		)
+		return err == nil && res.EndOffset == n
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func setupServer(t *testing.T, transactions bool) (api.LogClient, string, *log.Log) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "mirror-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config := &server.Config{
+		CommitLog:    clog,
+		OffsetGetter: clog,
+	}
+	if transactions {
+		txns, err := txn.New(clog, txn.Config{})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			txns.Close()
+		})
+		config.Transactions = txns
+	}
+	srv, err := server.NewGPRCServer(config)
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	cc, err := grpc.NewClient(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		cc.Close()
+		srv.Stop()
+		clog.Remove()
+	})
+	return api.NewLogClient(cc), l.Addr().String(), clog
+}
@@ -0,0 +1,145 @@
+// filters connections by the client's IP address before anything else sees
+// them, TLS handshakes included, so a listener's exposure can be narrowed to the
+// networks that need it
+package netfilter
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// the networks a listener allows and denies. a denied address is rejected even
+// when an allowed network contains it, and no allowed networks allows every
+// address that isn't denied
+type Rules struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// parses the allowed and denied networks, as CIDRs or single addresses
+func ParseRules(allow, deny []string) (Rules, error) {
+	var r Rules
+	var err error
+	if r.Allow, err = parsePrefixes(allow); err != nil {
+		return Rules{}, err
+	}
+	if r.Deny, err = parsePrefixes(deny); err != nil {
+		return Rules{}, err
+	}
+	return r, nil
+}
+
+func parsePrefixes(networks []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, n := range networks {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		if !strings.Contains(n, "/") {
+			addr, err := netip.ParseAddr(n)
+			if err != nil {
+				return nil, fmt.Errorf("netfilter: %q isn't an address or a CIDR", n)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(n)
+		if err != nil {
+			return nil, fmt.Errorf("netfilter: %q isn't an address or a CIDR", n)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func (r Rules) allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range r.Deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	for _, p := range r.Allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// applies the Rules it was last given, Update swaps them while connections are
+// being filtered
+type Filter struct {
+	name  string
+	rules atomic.Pointer[Rules]
+}
+
+// the name identifies the listener in the rejections it logs
+func New(name string, rules Rules) *Filter {
+	f := &Filter{name: name}
+	f.rules.Store(&rules)
+	return f
+}
+
+func (f *Filter) Update(rules Rules) {
+	f.rules.Store(&rules)
+}
+
+// reports whether the address is allowed, addresses without an IP, e.g. unix
+// sockets', always are
+func (f *Filter) Allowed(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return true
+	}
+	ap, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	if f.rules.Load().allowed(ap) {
+		return true
+	}
+	zap.L().Named("netfilter").Warn(
+		"rejected a connection",
+		zap.String("listener", f.name),
+		zap.Stringer("addr", addr),
+	)
+	return false
+}
+
+// closes the connections the filter rejects as it accepts them
+func Listener(ln net.Listener, f *Filter) net.Listener {
+	return &listener{Listener: ln, filter: f}
+}
+
+type listener struct {
+	net.Listener
+	filter *Filter
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.filter.Allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
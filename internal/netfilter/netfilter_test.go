@@ -0,0 +1,84 @@
+package netfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"allow and deny":   testAllowDeny,
+		"invalid network":  testInvalidNetwork,
+		"listener updates": testListenerUpdates,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testAllowDeny(t *testing.T) {
+	rules, err := ParseRules([]string{"10.0.0.0/8", "192.168.1.7"}, []string{"10.1.0.0/16"})
+	require.NoError(t, err)
+	f := New("rpc", rules)
+	for ip, allowed := range map[string]bool{
+		"10.2.3.4":         true,
+		"10.1.3.4":         false,
+		"192.168.1.7":      true,
+		"192.168.1.8":      false,
+		"::ffff:10.2.3.4":  true,
+		"2001:db8::1":      false,
+		"::ffff:10.1.3.4":  false,
+		"::ffff:127.0.0.1": false,
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+		require.Equal(t, allowed, f.Allowed(addr), ip)
+	}
+
+	// no allowed networks allows everything that isn't denied
+	f.Update(Rules{Deny: rules.Deny})
+	require.True(t, f.Allowed(&net.UDPAddr{IP: net.ParseIP("2001:db8::1")}))
+	require.False(t, f.Allowed(&net.UDPAddr{IP: net.ParseIP("10.1.0.1")}))
+	require.True(t, f.Allowed(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}))
+}
+
+func testInvalidNetwork(t *testing.T) {
+	_, err := ParseRules([]string{"10.0.0.0/33"}, nil)
+	require.ErrorContains(t, err, "10.0.0.0/33")
+	_, err = ParseRules(nil, []string{"localhost"})
+	require.ErrorContains(t, err, "localhost")
+}
+
+func testListenerUpdates(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	rules, err := ParseRules(nil, []string{"127.0.0.1"})
+	require.NoError(t, err)
+	f := New("rpc", rules)
+	ln := Listener(inner, f)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// a rejected connection is closed before the server sees it
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	conn.Close()
+	require.Empty(t, accepted)
+
+	f.Update(Rules{})
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	(<-accepted).Close()
+}
@@ -0,0 +1,132 @@
+// stores the offsets consumers commit, so they can resume where they left off
+
+// Commits are stored as a commit log, replayed into memory when the store opens.
+// Once enough commits have piled up, the latest commit of every consumer is
+// appended again and the segments before them are removed, so the log doesn't
+// grow with every commit. Each node has its own offsets.
+package offsets
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// how many commits are appended between compactions, beyond one per consumer
+	compactAfter = 10000
+	// a few thousand commits per segment, so compacting removes most of them
+	segmentBytes = 64 << 10
+)
+
+type Store struct {
+	mu        sync.Mutex
+	log       *log.Log
+	committed map[string]*api.CommittedOffset
+	// the commits appended since the last compaction
+	appended int
+}
+
+func New(dir string) (*Store, error) {
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = segmentBytes
+	c.Segment.MaxIndexBytes = segmentBytes
+	l, err := log.NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		log:       l,
+		committed: make(map[string]*api.CommittedOffset),
+	}
+	lowest, end, err := l.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	for off := lowest; off < end; off++ {
+		record, err := l.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		committed := &api.CommittedOffset{}
+		if err := proto.Unmarshal(record.Value, committed); err != nil {
+			return nil, fmt.Errorf("offsets: corrupt record at offset %d: %w", off, err)
+		}
+		s.committed[committed.Consumer] = committed
+	}
+	s.appended = int(end - lowest)
+	return s, nil
+}
+
+// stores the offset the consumer's up to, the next it'll read
+func (s *Store) Commit(consumer string, offset uint64) error {
+	if consumer == "" {
+		return fmt.Errorf("offsets: the consumer has no name")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.put(&api.CommittedOffset{
+		Consumer: consumer,
+		Offset:   offset,
+		Time:     time.Now().UnixNano(),
+	}); err != nil {
+		return err
+	}
+	if s.appended > len(s.committed)+compactAfter {
+		return s.compact()
+	}
+	return nil
+}
+
+// the consumer's latest committed offset, false if it hasn't committed one
+func (s *Store) Committed(consumer string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	committed, ok := s.committed[consumer]
+	if !ok {
+		return 0, false
+	}
+	return committed.Offset, true
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+func (s *Store) put(committed *api.CommittedOffset) error {
+	b, err := proto.Marshal(committed)
+	if err != nil {
+		return err
+	}
+	if _, err := s.log.Append(&api.Record{Value: b}); err != nil {
+		return err
+	}
+	s.committed[committed.Consumer] = committed
+	s.appended++
+	return nil
+}
+
+// appends every consumer's latest commit again, then removes the segments
+// before them. a crash in between leaves the old commits to be replayed first
+func (s *Store) compact() error {
+	start := s.log.NextOffset()
+	for _, committed := range s.committed {
+		if err := s.put(committed); err != nil {
+			return err
+		}
+	}
+	if start > 0 {
+		if err := s.log.Truncate(start - 1); err != nil {
+			return err
+		}
+	}
+	s.appended = len(s.committed)
+	return nil
+}
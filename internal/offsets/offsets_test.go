@@ -0,0 +1,60 @@
+package offsets
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir)
+	require.NoError(t, err)
+
+	_, ok := s.Committed("reader")
+	require.False(t, ok)
+	require.NoError(t, s.Commit("reader", 3))
+	require.NoError(t, s.Commit("reader", 5))
+	require.NoError(t, s.Commit("other", 1))
+	require.Error(t, s.Commit("", 1))
+	offset, ok := s.Committed("reader")
+	require.True(t, ok)
+	require.Equal(t, uint64(5), offset)
+
+	// the commits survive reopening the store
+	require.NoError(t, s.Close())
+	s, err = New(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	offset, ok = s.Committed("reader")
+	require.True(t, ok)
+	require.Equal(t, uint64(5), offset)
+}
+
+func TestStoreCompacts(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir)
+	require.NoError(t, err)
+	for i := 0; i <= compactAfter+2; i++ {
+		require.NoError(t, s.Commit(fmt.Sprintf("consumer-%d", i%2), uint64(i)))
+	}
+	lowest, end, err := s.log.GetOffsets()
+	require.NoError(t, err)
+	require.Less(t, end-lowest, uint64(compactAfter))
+
+	require.NoError(t, s.Close())
+	s, err = New(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	offset, ok := s.Committed("consumer-0")
+	require.True(t, ok)
+	require.Equal(t, uint64(compactAfter+2), offset)
+	offset, ok = s.Committed("consumer-1")
+	require.True(t, ok)
+	require.Equal(t, uint64(compactAfter+1), offset)
+}
@@ -0,0 +1,51 @@
+// verifies OpenID Connect ID tokens so operators can reach proglog's admin
+// endpoints through their organization's SSO
+package oidc
+
+import (
+	"context"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+type Verifier struct {
+	issuer   string
+	verifier *oidc.IDTokenVerifier
+}
+
+// discovers the issuer's endpoints and signing keys. the keys are fetched again
+// whenever a token is signed with one the verifier hasn't seen, so the issuer can
+// rotate them. tokens must be issued for clientID
+func New(ctx context.Context, issuer, clientID string) (*Verifier, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{
+		issuer:   issuer,
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+	}, nil
+}
+
+// checks the token's signature, issuer, audience and expiry and returns who it
+// identifies: their email when the token has one, its subject otherwise
+func (v *Verifier) Verify(ctx context.Context, rawToken string) (string, error) {
+	token, err := v.verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return "", err
+	}
+	var claims struct {
+		Email string `json:"email"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return "", err
+	}
+	if claims.Email != "" {
+		return claims.Email, nil
+	}
+	return token.Subject, nil
+}
+
+func (v *Verifier) Issuer() string {
+	return v.issuer
+}
@@ -0,0 +1,101 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	var keys atomic.Pointer[jose.JSONWebKeySet]
+	keys.Store(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: key.Public(), KeyID: "1", Algorithm: "RS256", Use: "sig"},
+	}})
+
+	mux := http.NewServeMux()
+	issuer := httptest.NewServer(mux)
+	defer issuer.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.URL,
+			"jwks_uri":                              issuer.URL + "/keys",
+			"authorization_endpoint":                issuer.URL + "/auth",
+			"token_endpoint":                        issuer.URL + "/token",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(keys.Load())
+	})
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "1"),
+	)
+	require.NoError(t, err)
+	token := func(claims map[string]interface{}) string {
+		b, err := json.Marshal(claims)
+		require.NoError(t, err)
+		jws, err := signer.Sign(b)
+		require.NoError(t, err)
+		raw, err := jws.CompactSerialize()
+		require.NoError(t, err)
+		return raw
+	}
+	claims := func(aud string, exp time.Time) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": issuer.URL,
+			"sub": "1234",
+			"aud": aud,
+			"exp": exp.Unix(),
+			"iat": time.Now().Unix(),
+		}
+	}
+
+	ctx := context.Background()
+	v, err := New(ctx, issuer.URL, "proglog")
+	require.NoError(t, err)
+	require.Equal(t, issuer.URL, v.Issuer())
+
+	who, err := v.Verify(ctx, token(claims("proglog", time.Now().Add(time.Hour))))
+	require.NoError(t, err)
+	require.Equal(t, "1234", who)
+
+	withEmail := claims("proglog", time.Now().Add(time.Hour))
+	withEmail["email"] = "ops@example.com"
+	who, err = v.Verify(ctx, token(withEmail))
+	require.NoError(t, err)
+	require.Equal(t, "ops@example.com", who)
+
+	_, err = v.Verify(ctx, token(claims("someone-else", time.Now().Add(time.Hour))))
+	require.Error(t, err)
+	_, err = v.Verify(ctx, token(claims("proglog", time.Now().Add(-time.Hour))))
+	require.Error(t, err)
+	_, err = v.Verify(ctx, "not a token")
+	require.Error(t, err)
+
+	// the issuer rotates its key, the verifier fetches the new one
+	key, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keys.Store(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: key.Public(), KeyID: "2", Algorithm: "RS256", Use: "sig"},
+	}})
+	signer, err = jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "2"),
+	)
+	require.NoError(t, err)
+	_, err = v.Verify(ctx, token(claims("proglog", time.Now().Add(time.Hour))))
+	require.NoError(t, err)
+}
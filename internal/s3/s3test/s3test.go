@@ -0,0 +1,138 @@
+// an in-memory S3 bucket served over HTTP, for testing the code that writes to
+// object stores without one. it takes path-style requests, checks they're
+// signed, though not the signatures, and lists at most two objects per page so
+// listings page
+package s3test
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type Server struct {
+	*httptest.Server
+	Bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	// the status the next requests fail with, see FailNext
+	failures []int
+}
+
+// serves an empty bucket until the test's done
+func NewServer(t *testing.T, bucket string) *Server {
+	s := &Server{Bucket: bucket, objects: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// makes the next request fail with status
+func (s *Server) FailNext(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, status)
+}
+
+// the objects' contents by key
+func (s *Server) Objects() map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects := make(map[string][]byte, len(s.objects))
+	for k, v := range s.objects {
+		objects[k] = v
+	}
+	return objects
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		writeError(w, status, "InternalError")
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	switch {
+	case r.Method == http.MethodPut && key != "":
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = b
+	case r.Method == http.MethodGet && key != "":
+		b, ok := s.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Write(b)
+	case r.Method == http.MethodDelete && key != "":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		s.list(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+type object struct {
+	Key  string `xml:"Key"`
+	Size int    `xml:"Size"`
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	after := r.URL.Query().Get("continuation-token")
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var res struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object `xml:"Contents"`
+		IsTruncated           bool     `xml:"IsTruncated"`
+		NextContinuationToken string   `xml:"NextContinuationToken,omitempty"`
+	}
+	for i, key := range keys {
+		if i == 2 {
+			res.IsTruncated = true
+			res.NextContinuationToken = keys[i-1]
+			break
+		}
+		res.Contents = append(res.Contents, object{Key: key, Size: len(s.objects[key])})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: http.StatusText(status)})
+}
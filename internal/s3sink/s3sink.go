@@ -0,0 +1,363 @@
+// tails a proglog cluster's log and exports its records to S3, or a store
+// compatible with it, in batches, for analytics pipelines and long-term
+// retention
+
+// Each object holds a run of records as JSON lines, see Line, gzipped if asked
+// to, and is named after the offsets of its first and last records:
+//
+//	<prefix><first offset>-<last offset>.jsonl[.gz]
+//
+// with the offsets zero-padded so the names sort in the log's order. The objects
+// are the sink's checkpoint: it resumes after the last one's last offset, so
+// every record's exported exactly once, in exactly one object. An object's only
+// written once it's full or old enough, the records of one that isn't are read
+// again after a restart. Those of one whose write failed are written to an
+// object of the same name again, which the failed write may have written after
+// all.
+package s3sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/s3"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+type Config struct {
+	// the cluster records are consumed from
+	SourceAddr        string
+	SourceDialOptions []grpc.DialOption
+	// the bucket the objects are written to, and what their names start with,
+	// e.g. "proglog/"
+	S3     s3.Config
+	Prefix string
+	// an object's written once it holds MaxObjectBytes, or once its first record
+	// was read MaxObjectAge ago, 64MiB and a minute when zero
+	MaxObjectBytes int
+	MaxObjectAge   time.Duration
+	// gzips the objects
+	Gzip bool
+	// registers the sink's metrics when set
+	Registerer prometheus.Registerer
+}
+
+type Sink struct {
+	Config
+
+	mu sync.Mutex
+	// the next offset to export, and whether it was found from the objects yet
+	offset  uint64
+	resumed bool
+	// the last offset of the object whose write failed, while it's retried
+	retryLast uint64
+	retrying  bool
+
+	source api.LogClient
+	conn   *grpc.ClientConn
+	bucket *s3.Client
+
+	objects prometheus.Counter
+	records prometheus.Counter
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// a record, as it's exported
+type Line struct {
+	Offset     uint64    `json:"offset"`
+	Timestamp  time.Time `json:"timestamp"`
+	ProducerID string    `json:"producer_id,omitempty"`
+	Value      []byte    `json:"value"`
+}
+
+func New(config Config) (*Sink, error) {
+	if config.MaxObjectBytes == 0 {
+		config.MaxObjectBytes = 64 << 20
+	}
+	if config.MaxObjectAge == 0 {
+		config.MaxObjectAge = time.Minute
+	}
+	s := &Sink{
+		Config: config,
+		objects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "s3_sink",
+			Name:      "objects_total",
+			Help:      "Objects written to the bucket.",
+		}),
+		records: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "s3_sink",
+			Name:      "records_total",
+			Help:      "Records exported to the bucket.",
+		}),
+	}
+	var err error
+	if s.bucket, err = s3.New(s.S3); err != nil {
+		return nil, err
+	}
+	if s.Registerer != nil {
+		for _, c := range []prometheus.Collector{s.objects, s.records} {
+			if err := s.Registerer.Register(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.conn, err = grpc.NewClient(s.SourceAddr, s.SourceDialOptions...); err != nil {
+		return nil, err
+	}
+	s.source = api.NewLogClient(s.conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(1)
+	go s.run(ctx)
+	return s, nil
+}
+
+// returns the next offset to export
+func (s *Sink) Offset() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.offset
+}
+
+// stops exporting, the records of the object that wasn't written yet are
+// exported after the next start
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	s.cancel()
+	s.wg.Wait()
+	if err := s.conn.Close(); err != nil {
+		return err
+	}
+	if s.Registerer != nil {
+		s.Registerer.Unregister(s.objects)
+		s.Registerer.Unregister(s.records)
+	}
+	return nil
+}
+
+// exports the records after the last object's, starting over with backoff on
+// errors
+func (s *Sink) run(ctx context.Context) {
+	defer s.wg.Done()
+
+	backoff := 50 * time.Millisecond
+	for {
+		err := s.export(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			backoff = 50 * time.Millisecond
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (s *Sink) export(ctx context.Context) error {
+	if err := s.resume(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := s.source.ConsumeStream(
+		ctx,
+		&api.ConsumeRequest{Offset: s.Offset()},
+	)
+	if err != nil {
+		return err
+	}
+	records := make(chan *api.Record)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case records <- res.Record:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var b batch
+	timer := time.NewTimer(s.MaxObjectAge)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			return err
+		case record := <-records:
+			if b.n == 0 {
+				timer.Reset(s.MaxObjectAge)
+			}
+			if err := b.add(record); err != nil {
+				return err
+			}
+			retryLast, retrying := s.retry()
+			if retrying && record.Offset < retryLast {
+				continue
+			}
+			if !retrying && b.buf.Len() < s.MaxObjectBytes {
+				continue
+			}
+		case <-timer.C:
+			if _, retrying := s.retry(); retrying {
+				continue
+			}
+		}
+		if !timer.Stop() {
+			// drains a tick that raced with a full object
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if err := s.write(ctx, &b); err != nil {
+			return err
+		}
+		b = batch{}
+	}
+}
+
+// the records of the object being filled
+type batch struct {
+	buf         bytes.Buffer
+	first, last uint64
+	n           int
+}
+
+func (b *batch) add(record *api.Record) error {
+	line, err := json.Marshal(Line{
+		Offset:     record.Offset,
+		Timestamp:  time.Unix(0, record.Timestamp).UTC(),
+		ProducerID: record.ProducerId,
+		Value:      record.Value,
+	})
+	if err != nil {
+		return err
+	}
+	if b.n == 0 {
+		b.first = record.Offset
+	}
+	b.last = record.Offset
+	b.n++
+	b.buf.Write(line)
+	b.buf.WriteByte('\n')
+	return nil
+}
+
+func (s *Sink) write(ctx context.Context, b *batch) error {
+	body := b.buf.Bytes()
+	name := s.Prefix + fmt.Sprintf("%020d-%020d.jsonl", b.first, b.last)
+	if s.Gzip {
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		body = gz.Bytes()
+		name += ".gz"
+	}
+	if err := s.bucket.Put(ctx, name, body); err != nil {
+		s.mu.Lock()
+		s.retryLast, s.retrying = b.last, true
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Lock()
+	s.offset = b.last + 1
+	s.retrying = false
+	s.mu.Unlock()
+	s.objects.Inc()
+	s.records.Add(float64(b.n))
+	return nil
+}
+
+// the last offset of the object whose write's being retried, if one is
+func (s *Sink) retry() (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.retryLast, s.retrying
+}
+
+// finds the next offset to export from the last object's name, the first time
+func (s *Sink) resume(ctx context.Context) error {
+	s.mu.Lock()
+	resumed := s.resumed
+	s.mu.Unlock()
+	if resumed {
+		return nil
+	}
+	objects, err := s.bucket.List(ctx, s.Prefix)
+	if err != nil {
+		return err
+	}
+	var next uint64
+	for _, o := range objects {
+		last, ok := lastOffset(strings.TrimPrefix(o.Key, s.Prefix))
+		if ok && last+1 > next {
+			next = last + 1
+		}
+	}
+	s.mu.Lock()
+	s.offset, s.resumed = next, true
+	s.mu.Unlock()
+	return nil
+}
+
+// the last offset an object's name says it holds, if it's one of the sink's
+func lastOffset(name string) (uint64, bool) {
+	name, ok := strings.CutSuffix(strings.TrimSuffix(name, ".gz"), ".jsonl")
+	if !ok {
+		return 0, false
+	}
+	first, last, ok := strings.Cut(name, "-")
+	if !ok || len(first) != 20 || len(last) != 20 {
+		return 0, false
+	}
+	off, err := strconv.ParseUint(last, 10, 64)
+	return off, err == nil
+}
@@ -0,0 +1,187 @@
+package s3sink
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+	"proglog/internal/s3"
+	"proglog/internal/s3/s3test"
+	"proglog/internal/server"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestSink(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, source api.LogClient, config Config, bucket *s3test.Server){
+		"objects fill up to their size":         testObjectSize,
+		"objects are written once they age":     testObjectAge,
+		"failed writes are retried":             testRetry,
+		"restarts resume after the last object": testResume,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			source, sourceAddr := setupServer(t)
+			bucket := s3test.NewServer(t, "bucket")
+			config := Config{
+				SourceAddr: sourceAddr,
+				SourceDialOptions: []grpc.DialOption{
+					grpc.WithTransportCredentials(insecure.NewCredentials()),
+				},
+				S3: s3.Config{
+					Endpoint:        bucket.URL,
+					Bucket:          "bucket",
+					AccessKeyID:     "id",
+					SecretAccessKey: "secret",
+					PathStyle:       true,
+				},
+				Prefix:         "proglog/",
+				MaxObjectBytes: 1 << 20,
+				MaxObjectAge:   50 * time.Millisecond,
+				Registerer:     prometheus.NewRegistry(),
+			}
+			fn(t, source, config, bucket)
+		})
+	}
+}
+
+func testObjectSize(t *testing.T, source api.LogClient, config Config, bucket *s3test.Server) {
+	config.MaxObjectBytes = 1
+	config.MaxObjectAge = time.Hour
+	produce(t, source, "a", "b", "c")
+	s := start(t, config, 3)
+	defer s.Close()
+
+	objects := bucket.Objects()
+	require.Len(t, objects, 3)
+	lines := readLines(t, objects["proglog/00000000000000000001-00000000000000000001.jsonl"], false)
+	require.Len(t, lines, 1)
+	require.Equal(t, uint64(1), lines[0].Offset)
+	require.Equal(t, []byte("b"), lines[0].Value)
+	require.False(t, lines[0].Timestamp.IsZero())
+}
+
+func testObjectAge(t *testing.T, source api.LogClient, config Config, bucket *s3test.Server) {
+	config.Gzip = true
+	produce(t, source, "a", "b", "c")
+	s := start(t, config, 3)
+	defer s.Close()
+
+	objects := bucket.Objects()
+	require.Len(t, objects, 1)
+	lines := readLines(t, objects["proglog/00000000000000000000-00000000000000000002.jsonl.gz"], true)
+	require.Len(t, lines, 3)
+	for i, line := range lines {
+		require.Equal(t, uint64(i), line.Offset)
+	}
+}
+
+func testRetry(t *testing.T, source api.LogClient, config Config, bucket *s3test.Server) {
+	produce(t, source, "a", "b")
+	// the listing and then the first write fail
+	bucket.FailNext(http.StatusServiceUnavailable)
+	bucket.FailNext(http.StatusServiceUnavailable)
+	s := start(t, config, 2)
+	defer s.Close()
+
+	require.Len(t, bucket.Objects(), 1)
+	require.Contains(t, bucket.Objects(), "proglog/00000000000000000000-00000000000000000001.jsonl")
+}
+
+func testResume(t *testing.T, source api.LogClient, config Config, bucket *s3test.Server) {
+	produce(t, source, "a", "b")
+	s := start(t, config, 2)
+	require.NoError(t, s.Close())
+
+	produce(t, source, "c")
+	s = start(t, config, 3)
+	defer s.Close()
+	objects := bucket.Objects()
+	require.Len(t, objects, 2)
+	lines := readLines(t, objects["proglog/00000000000000000002-00000000000000000002.jsonl"], false)
+	require.Len(t, lines, 1)
+	require.Equal(t, []byte("c"), lines[0].Value)
+}
+
+// starts a sink and waits for it to export every record before offset
+func start(t *testing.T, config Config, offset uint64) *Sink {
+	t.Helper()
+	s, err := New(config)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return s.Offset() == offset
+	}, 5*time.Second, 10*time.Millisecond)
+	return s
+}
+
+func produce(t *testing.T, source api.LogClient, values ...string) {
+	t.Helper()
+	for _, value := range values {
+		_, err := source.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+}
+
+func readLines(t *testing.T, object []byte, gzipped bool) []Line {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(object)
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		require.NoError(t, err)
+		r = gz
+	}
+	var lines []Line
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var line Line
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.NoError(t, scanner.Err())
+	return lines
+}
+
+func setupServer(t *testing.T) (api.LogClient, string) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "s3sink-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := server.NewGPRCServer(&server.Config{
+		CommitLog:    clog,
+		OffsetGetter: clog,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	cc, err := grpc.NewClient(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		cc.Close()
+		srv.Stop()
+		clog.Remove()
+	})
+	return api.NewLogClient(cc), l.Addr().String()
+}
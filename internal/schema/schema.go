@@ -0,0 +1,254 @@
+// validates the records produced to the log against the schemas registered in a
+// Confluent-compatible schema registry, so producers can't append data their
+// consumers can't read
+//
+// Producers attach a schema ID the way Confluent's serializers do, framing the
+// record's value as a zero byte, the ID as a big-endian uint32, then the
+// payload. Avro payloads are decoded with the schema and JSON ones validated
+// against it, Protobuf ones only need the ID to be registered. Schemas are
+// fetched the first time a record names them and kept, the registry never
+// changes the schema an ID names. Schemas that reference others aren't
+// supported, their records are rejected.
+package schema
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the byte Confluent's wire format starts with
+const magicByte = 0
+
+type Config struct {
+	// the registry's URL, e.g. http://registry:8081
+	URL string
+	// basic auth credentials, none when Username's empty
+	Username string
+	Password string
+	// rejects the records whose values don't carry a schema ID, they're
+	// appended as they are otherwise
+	RequireSchemaID bool
+	// a client with a 10s timeout when nil
+	HTTPClient *http.Client
+	// registers the validator's metrics when set
+	Registerer prometheus.Registerer
+}
+
+type Validator struct {
+	Config
+	base *url.URL
+
+	mu      sync.Mutex
+	schemas map[uint32]validator
+
+	validations *prometheus.CounterVec
+}
+
+// checks a payload against a compiled schema
+type validator func(payload []byte) error
+
+func New(config Config) (*Validator, error) {
+	base, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("schema: registry URL %q needs a scheme and a host", config.URL)
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	v := &Validator{
+		Config:  config,
+		base:    base,
+		schemas: make(map[uint32]validator),
+		validations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "schema",
+			Name:      "validations_total",
+			Help:      "Records checked against their schemas, by result: valid, invalid or error when the registry couldn't be reached.",
+		}, []string{"result"}),
+	}
+	if v.Registerer != nil {
+		if err := v.Registerer.Register(v.validations); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// returns an api.ErrInvalidSchema when the value doesn't match the schema it
+// names, and an Unavailable status when the schema couldn't be fetched
+func (v *Validator) Validate(ctx context.Context, value []byte) error {
+	err := v.validate(ctx, value)
+	var invalid api.ErrInvalidSchema
+	switch {
+	case err == nil:
+		v.validations.WithLabelValues("valid").Inc()
+	case errors.As(err, &invalid):
+		v.validations.WithLabelValues("invalid").Inc()
+	default:
+		v.validations.WithLabelValues("error").Inc()
+	}
+	return err
+}
+
+func (v *Validator) validate(ctx context.Context, value []byte) error {
+	id, payload, ok := SplitValue(value)
+	if !ok {
+		if v.RequireSchemaID {
+			return api.ErrInvalidSchema{Reason: "the value doesn't start with a schema ID"}
+		}
+		return nil
+	}
+	check, err := v.schema(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := check(payload); err != nil {
+		return api.ErrInvalidSchema{SchemaID: id, Reason: err.Error()}
+	}
+	return nil
+}
+
+// splits a value framed with Confluent's wire format into the schema ID and the
+// payload, ok's false when it isn't framed
+func SplitValue(value []byte) (id uint32, payload []byte, ok bool) {
+	if len(value) < 5 || value[0] != magicByte {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint32(value[1:5]), value[5:], true
+}
+
+// frames the payload with Confluent's wire format
+func FrameValue(id uint32, payload []byte) []byte {
+	value := make([]byte, 5, 5+len(payload))
+	value[0] = magicByte
+	binary.BigEndian.PutUint32(value[1:5], id)
+	return append(value, payload...)
+}
+
+// the schema id names, fetched from the registry the first time
+func (v *Validator) schema(ctx context.Context, id uint32) (validator, error) {
+	v.mu.Lock()
+	check, ok := v.schemas[id]
+	v.mu.Unlock()
+	if ok {
+		return check, nil
+	}
+	res, err := v.fetch(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if check, err = compile(id, res); err != nil {
+		return nil, api.ErrInvalidSchema{SchemaID: id, Reason: err.Error()}
+	}
+	v.mu.Lock()
+	v.schemas[id] = check
+	v.mu.Unlock()
+	return check, nil
+}
+
+// the registry's answer to GET /schemas/ids/{id}
+type schemaResponse struct {
+	Schema string `json:"schema"`
+	// AVRO when empty
+	SchemaType string            `json:"schemaType"`
+	References []json.RawMessage `json:"references"`
+}
+
+func (v *Validator) fetch(ctx context.Context, id uint32) (*schemaResponse, error) {
+	u := v.base.JoinPath("schemas", "ids", fmt.Sprint(id))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if v.Username != "" {
+		req.SetBasicAuth(v.Username, v.Password)
+	}
+	res, err := v.HTTPClient.Do(req)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "schema registry: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, api.ErrInvalidSchema{SchemaID: id, Reason: "the schema isn't registered"}
+	}
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return nil, status.Errorf(
+			codes.Unavailable,
+			"schema registry: %s: %s", res.Status, strings.TrimSpace(string(b)),
+		)
+	}
+	var s schemaResponse
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "schema registry: %v", err)
+	}
+	return &s, nil
+}
+
+func compile(id uint32, s *schemaResponse) (validator, error) {
+	if len(s.References) > 0 {
+		return nil, errors.New("schemas with references aren't supported")
+	}
+	switch s.SchemaType {
+	case "", "AVRO":
+		codec, err := goavro.NewCodec(s.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("the Avro schema doesn't compile: %w", err)
+		}
+		return func(payload []byte) error {
+			_, rest, err := codec.NativeFromBinary(payload)
+			if err != nil {
+				return err
+			}
+			if len(rest) > 0 {
+				return fmt.Errorf("%d bytes follow the Avro datum", len(rest))
+			}
+			return nil
+		}, nil
+	case "JSON":
+		c := jsonschema.NewCompiler()
+		name := fmt.Sprintf("schema-%d.json", id)
+		if err := c.AddResource(name, strings.NewReader(s.Schema)); err != nil {
+			return nil, fmt.Errorf("the JSON schema doesn't compile: %w", err)
+		}
+		sch, err := c.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("the JSON schema doesn't compile: %w", err)
+		}
+		return func(payload []byte) error {
+			dec := json.NewDecoder(bytes.NewReader(payload))
+			dec.UseNumber()
+			var doc any
+			if err := dec.Decode(&doc); err != nil {
+				return err
+			}
+			return sch.Validate(doc)
+		}, nil
+	case "PROTOBUF":
+		return func(payload []byte) error { return nil }, nil
+	default:
+		return nil, fmt.Errorf("schema type %q isn't supported", s.SchemaType)
+	}
+}
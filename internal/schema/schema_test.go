@@ -0,0 +1,147 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const avroSchema = `{"type": "record", "name": "User", "fields": [
+	{"name": "name", "type": "string"},
+	{"name": "age", "type": "int"}
+]}`
+
+const jsonSchema = `{"type": "object", "required": ["name"], "properties": {
+	"name": {"type": "string"}
+}}`
+
+func TestValidator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, v *Validator, fetches *atomic.Int64){
+		"avro records are decoded with their schema":   testAvro,
+		"json records are validated with their schema": testJSON,
+		"records naming unknown schemas are rejected":  testUnknown,
+		"unframed records are let through by default":  testUnframed,
+		"registry errors fail as unavailable":          testUnavailable,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			var fetches atomic.Int64
+			registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				user, pass, _ := r.BasicAuth()
+				if user != "user" || pass != "pass" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				var res schemaResponse
+				switch r.URL.Path {
+				case "/schemas/ids/1":
+					res.Schema = avroSchema
+				case "/schemas/ids/2":
+					res = schemaResponse{Schema: jsonSchema, SchemaType: "JSON"}
+				case "/schemas/ids/3":
+					res = schemaResponse{Schema: "syntax = \"proto3\";", SchemaType: "PROTOBUF"}
+				case "/schemas/ids/500":
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				default:
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte(`{"error_code": 40403, "message": "Schema not found"}`))
+					return
+				}
+				json.NewEncoder(w).Encode(res)
+			}))
+			t.Cleanup(registry.Close)
+			v, err := New(Config{
+				URL:        registry.URL,
+				Username:   "user",
+				Password:   "pass",
+				Registerer: prometheus.NewRegistry(),
+			})
+			require.NoError(t, err)
+			fn(t, v, &fetches)
+		})
+	}
+}
+
+func testAvro(t *testing.T, v *Validator, fetches *atomic.Int64) {
+	codec, err := goavro.NewCodec(avroSchema)
+	require.NoError(t, err)
+	payload, err := codec.BinaryFromNative(nil, map[string]any{"name": "ada", "age": 36})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, v.Validate(ctx, FrameValue(1, payload)))
+	// the schema's kept after the first fetch
+	require.NoError(t, v.Validate(ctx, FrameValue(1, payload)))
+	require.Equal(t, int64(1), fetches.Load())
+
+	err = v.Validate(ctx, FrameValue(1, payload[:2]))
+	requireInvalid(t, err, 1)
+	err = v.Validate(ctx, FrameValue(1, append(payload, 0)))
+	requireInvalid(t, err, 1)
+}
+
+func testJSON(t *testing.T, v *Validator, fetches *atomic.Int64) {
+	ctx := context.Background()
+	require.NoError(t, v.Validate(ctx, FrameValue(2, []byte(`{"name": "ada"}`))))
+	requireInvalid(t, v.Validate(ctx, FrameValue(2, []byte(`{"name": 36}`))), 2)
+	requireInvalid(t, v.Validate(ctx, FrameValue(2, []byte(`{"age": 36}`))), 2)
+	requireInvalid(t, v.Validate(ctx, FrameValue(2, []byte(`not json`))), 2)
+	// protobuf schemas only need to be registered
+	require.NoError(t, v.Validate(ctx, FrameValue(3, []byte{0, 1, 2})))
+}
+
+func testUnknown(t *testing.T, v *Validator, fetches *atomic.Int64) {
+	err := v.Validate(context.Background(), FrameValue(42, []byte("{}")))
+	requireInvalid(t, err, 42)
+	require.Contains(t, err.Error(), "isn't registered")
+}
+
+func testUnframed(t *testing.T, v *Validator, fetches *atomic.Int64) {
+	ctx := context.Background()
+	require.NoError(t, v.Validate(ctx, []byte("plain")))
+	require.Equal(t, int64(0), fetches.Load())
+
+	v.RequireSchemaID = true
+	requireInvalid(t, v.Validate(ctx, []byte("plain")), 0)
+}
+
+func testUnavailable(t *testing.T, v *Validator, fetches *atomic.Int64) {
+	err := v.Validate(context.Background(), FrameValue(500, nil))
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	// failures aren't kept, the next record fetches the schema again
+	v.Validate(context.Background(), FrameValue(500, nil))
+	require.Equal(t, int64(2), fetches.Load())
+}
+
+func requireInvalid(t *testing.T, err error, id uint32) {
+	t.Helper()
+	var invalid api.ErrInvalidSchema
+	require.ErrorAs(t, err, &invalid)
+	require.Equal(t, id, invalid.SchemaID)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestSplitValue(t *testing.T) {
+	id, payload, ok := SplitValue(FrameValue(7, []byte("hi")))
+	require.True(t, ok)
+	require.Equal(t, uint32(7), id)
+	require.Equal(t, "hi", string(payload))
+
+	for _, value := range []string{"", "\x00\x00\x00\x01", "{\"a\": 1}"} {
+		_, _, ok := SplitValue([]byte(value))
+		require.False(t, ok, strings.TrimSpace(value))
+	}
+}
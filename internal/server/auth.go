@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"slices"
+	"strings"
+
+	api "proglog/api/v1"
+	"proglog/internal/apikey"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// the client a request came from, as its verified certificate identifies it
+type Principal struct {
+	// false for clients without a verified certificate, e.g. over plain TCP
+	Authenticated bool
+	// the certificate's common name, or who the ID token identifies on admin
+	// RPCs when the server checks them, see requireAdmin
+	Subject string
+	// the ID token's issuer, empty when the subject comes from the certificate
+	Issuer string
+	// the certificate's subject alternative names
+	DNSNames    []string
+	IPAddresses []string
+	URIs        []string
+	// the client's address
+	Addr string
+	// set when the request carried an API key, its scopes are all it may do
+	APIKey *api.APIKey
+}
+
+type principalContextKey struct{}
+
+// returns the principal the server's authentication interceptors attached to a
+// request's context
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(*Principal)
+	return p, ok
+}
+
+// the TLS handshake has already verified the client's certificate against the
+// CA, this only puts what it says about the client into the context
+func authenticate(ctx context.Context) context.Context {
+	principal := &Principal{}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return context.WithValue(ctx, principalContextKey{}, principal)
+	}
+	principal.Addr = p.Addr.String()
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+		setCertificate(principal, info.State.VerifiedChains[0][0])
+	}
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+func setCertificate(p *Principal, cert *x509.Certificate) {
+	p.Authenticated = true
+	p.Subject = cert.Subject.CommonName
+	p.DNSNames = cert.DNSNames
+	for _, ip := range cert.IPAddresses {
+		p.IPAddresses = append(p.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		p.URIs = append(p.URIs, uri.String())
+	}
+}
+
+// the scope an API key needs for each RPC, RPCs not listed need the admin scope
+var apiKeyScopes = map[string]string{
+	api.Log_Produce_FullMethodName:             apikey.ScopeProduce,
+	api.Log_ProduceStream_FullMethodName:       apikey.ScopeProduce,
+	api.Log_BeginTransaction_FullMethodName:    apikey.ScopeProduce,
+	api.Log_CommitTransaction_FullMethodName:   apikey.ScopeProduce,
+	api.Log_AbortTransaction_FullMethodName:    apikey.ScopeProduce,
+	api.Log_Consume_FullMethodName:             apikey.ScopeConsume,
+	api.Log_ConsumeStream_FullMethodName:       apikey.ScopeConsume,
+	api.Log_Replay_FullMethodName:              apikey.ScopeConsume,
+	api.Log_GetByKey_FullMethodName:            apikey.ScopeConsume,
+	api.Log_GetOffsets_FullMethodName:          apikey.ScopeConsume,
+	api.Log_DescribeLog_FullMethodName:         apikey.ScopeConsume,
+	api.Log_DescribeReplication_FullMethodName: apikey.ScopeConsume,
+	api.Log_GetClusterStatus_FullMethodName:    apikey.ScopeConsume,
+	api.Log_ListMembers_FullMethodName:         apikey.ScopeConsume,
+	api.Log_CommitOffset_FullMethodName:        apikey.ScopeConsume,
+	api.Log_GetCommittedOffset_FullMethodName:  apikey.ScopeConsume,
+	healthpb.Health_Check_FullMethodName:       apikey.ScopeConsume,
+	// followers fetch with these, they can fence the leader and hold back its
+	// high watermark, see requireReplica
+	api.Log_Fetch_FullMethodName:              apikey.ScopeAdmin,
+	api.Log_ListSealedSegments_FullMethodName: apikey.ScopeAdmin,
+	api.Log_FetchSegment_FullMethodName:       apikey.ScopeAdmin,
+	api.Log_GetChecksums_FullMethodName:       apikey.ScopeAdmin,
+}
+
+// checks the API key in the x-api-key metadata, if any, and that its scopes
+// allow the RPC. the key becomes the principal, failures and denials are audited
+func (s *grpcServer) authenticateAPIKey(ctx context.Context, method string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get("x-api-key")
+	if len(tokens) == 0 {
+		return nil
+	}
+	if s.APIKeys == nil {
+		return status.Error(codes.Unauthenticated, "API keys aren't enabled")
+	}
+	key, err := s.APIKeys.Authenticate(tokens[0])
+	if err != nil {
+		err = status.Error(codes.Unauthenticated, err.Error())
+		s.audit(ctx, "authenticate", method, err)
+		return err
+	}
+	p, _ := PrincipalFromContext(ctx)
+	p.Authenticated = true
+	p.Subject = key.Name
+	p.APIKey = key
+
+	scope, ok := apiKeyScopes[method]
+	if !ok {
+		scope = apikey.ScopeAdmin
+	}
+	if !slices.Contains(key.Scopes, scope) {
+		err := status.Errorf(codes.PermissionDenied, "API key %s doesn't have the %s scope", key.Id, scope)
+		s.audit(ctx, "authorize", method, err)
+		return err
+	}
+	return nil
+}
+
+func (s *grpcServer) authenticateUnary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx = authenticate(ctx)
+	if err := s.authenticateAPIKey(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *grpcServer) authenticateStream(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx := authenticate(stream.Context())
+	if err := s.authenticateAPIKey(ctx, info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{
+		ServerStream: stream,
+		ctx:          ctx,
+	})
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// admin RPCs need an API key with the admin scope, which authenticateAPIKey has
+// checked already, or an ID token as a bearer token in the authorization
+// metadata when the server has a TokenVerifier, or else a client certificate the
+// TLS handshake verified. the principal becomes who the token identifies, and
+// failures are audited. InsecureAdmin lets every client through
+func (s *grpcServer) requireAdmin(ctx context.Context) error {
+	p, ok := PrincipalFromContext(ctx)
+	if ok && p.APIKey != nil {
+		return nil
+	}
+	if s.TokenVerifier == nil {
+		if s.InsecureAdmin || (ok && p.Authenticated) {
+			return nil
+		}
+		err := status.Error(codes.Unauthenticated, "admin RPCs need a client certificate or an API key")
+		s.audit(ctx, "authenticate", "admin", err)
+		return err
+	}
+	token := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, v := range md.Get("authorization") {
+			if t, ok := strings.CutPrefix(v, "Bearer "); ok {
+				token = t
+			}
+		}
+	}
+	if token == "" {
+		err := status.Error(codes.Unauthenticated, "admin RPCs need a bearer token")
+		s.audit(ctx, "authenticate", "admin", err)
+		return err
+	}
+	subject, err := s.TokenVerifier.Verify(ctx, token)
+	if err != nil {
+		err = status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+		s.audit(ctx, "authenticate", "admin", err)
+		return err
+	}
+	if ok {
+		p.Authenticated = true
+		p.Subject = subject
+		p.Issuer = s.TokenVerifier.Issuer()
+	}
+	return nil
+}
+
+// with ReplicaMembers, a follower's certificate must have a member's name as its
+// common name or one of its DNS names, and a fetch's replica ID must be that
+// name, so clients can't fence the leader or pose as followers. other fetches
+// need an admin API key or InsecureAdmin, the read-only replication RPCs let in
+// whoever requireAdmin does too, e.g. remote backups. without ReplicaMembers,
+// they all need what requireAdmin does
+func (s *grpcServer) requireReplica(ctx context.Context, replicaID string) error {
+	p, ok := PrincipalFromContext(ctx)
+	if s.ReplicaMembers == nil {
+		return s.requireAdmin(ctx)
+	}
+	if ok && p.Authenticated && p.APIKey == nil {
+		for _, name := range append([]string{p.Subject}, p.DNSNames...) {
+			if (replicaID == "" || name == replicaID) && s.ReplicaMembers.IsMember(name) {
+				return nil
+			}
+		}
+	}
+	if replicaID == "" {
+		return s.requireAdmin(ctx)
+	}
+	if (ok && p.APIKey != nil) || s.InsecureAdmin {
+		return nil
+	}
+	err := status.Errorf(codes.PermissionDenied, "fetches need a certificate naming member %s", replicaID)
+	s.audit(ctx, "authorize", "fetch", err)
+	return err
+}
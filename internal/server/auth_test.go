@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+	"proglog/internal/config"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthenticate(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, config.GenerateCerts(dir, []string{"127.0.0.1", "localhost"}))
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	require.NoError(t, err)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+
+	for scenario, tc := range map[string]struct {
+		ctx  context.Context
+		want *Principal
+	}{
+		"verified certificate": {
+			ctx: peer.NewContext(context.Background(), &peer.Peer{
+				Addr: addr,
+				AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{cert}},
+				}},
+			}),
+			want: &Principal{
+				Authenticated: true,
+				Subject:       "server",
+				DNSNames:      []string{"localhost"},
+				IPAddresses:   []string{"127.0.0.1"},
+				Addr:          "127.0.0.1:1234",
+			},
+		},
+		"plain connection": {
+			ctx:  peer.NewContext(context.Background(), &peer.Peer{Addr: addr}),
+			want: &Principal{Addr: "127.0.0.1:1234"},
+		},
+		"no peer": {
+			ctx:  context.Background(),
+			want: &Principal{},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			got, ok := PrincipalFromContext(authenticate(tc.ctx))
+			require.True(t, ok)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	certified := &Principal{Authenticated: true, Subject: "client"}
+	withKey := &Principal{Authenticated: true, Subject: "ci", APIKey: &api.APIKey{Name: "ci"}}
+	for scenario, tc := range map[string]struct {
+		principal *Principal
+		insecure  bool
+		want      codes.Code
+	}{
+		"verified certificate":  {principal: certified, want: codes.OK},
+		"admin api key":         {principal: withKey, want: codes.OK},
+		"plain connection":      {principal: &Principal{Addr: "127.0.0.1:1234"}, want: codes.Unauthenticated},
+		"no principal":          {want: codes.Unauthenticated},
+		"insecure admin opt-in": {principal: &Principal{}, insecure: true, want: codes.OK},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			audit := &auditLog{}
+			srv, err := newgrpcServer(&Config{AuditLog: audit, InsecureAdmin: tc.insecure})
+			require.NoError(t, err)
+			ctx := context.Background()
+			if tc.principal != nil {
+				ctx = context.WithValue(ctx, principalContextKey{}, tc.principal)
+			}
+			err = srv.requireAdmin(ctx)
+			require.Equal(t, tc.want, status.Code(err))
+			if tc.want != codes.OK {
+				// refusals are audited
+				require.Len(t, audit.events, 1)
+				require.Equal(t, "authenticate", audit.events[0].Action)
+				require.False(t, audit.events[0].Allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// the requests the node serves while it drains without tracking them:
+// followers keep replicating, and Drain would wait for itself
+var drainExempt = map[string]bool{
+	api.Log_Drain_FullMethodName:              true,
+	api.Log_Fetch_FullMethodName:              true,
+	api.Log_GetChecksums_FullMethodName:       true,
+	api.Log_ListSealedSegments_FullMethodName: true,
+	api.Log_FetchSegment_FullMethodName:       true,
+	healthpb.Health_Check_FullMethodName:      true,
+}
+
+// how often Drain checks whether the node has settled
+const drainPollInterval = 50 * time.Millisecond
+
+// the streams that follow the log, which would keep the node from settling,
+// so they're ended once it starts draining
+var drainEnded = map[string]bool{
+	api.Log_ConsumeStream_FullMethodName: true,
+	api.Log_Replay_FullMethodName:        true,
+}
+
+// tracks the requests in flight, so a node about to be shut down can stop
+// taking new streams and wait for the ones it's serving, see the Drain RPC.
+// once it's started, the node stays draining until it's shut down
+type Drain struct {
+	mu       sync.Mutex
+	inFlight int
+	draining bool
+	// set once Drain saw the node settle
+	drained bool
+	// closed once draining starts, ends the streams following the log
+	started chan struct{}
+}
+
+func NewDrain() *Drain {
+	return &Drain{started: make(chan struct{})}
+}
+
+// stops the node taking new streams and ends the ones following the log
+func (d *Drain) Start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		d.draining = true
+		close(d.started)
+	}
+}
+
+func (d *Drain) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// whether the node settled after it started draining, it's ready to be shut
+// down then
+func (d *Drain) Drained() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.drained
+}
+
+func (d *Drain) InFlight() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inFlight
+}
+
+func (d *Drain) settled() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.drained = true
+}
+
+// counts the request in flight, refusing it when it's a new stream on a
+// draining node
+func (d *Drain) begin(stream bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if stream && d.draining {
+		return status.Error(codes.Unavailable, "the node is draining")
+	}
+	d.inFlight++
+	return nil
+}
+
+func (d *Drain) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inFlight--
+}
+
+func (d *Drain) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if drainExempt[info.FullMethod] {
+		return handler(ctx, req)
+	}
+	if err := d.begin(false); err != nil {
+		return nil, err
+	}
+	defer d.end()
+	return handler(ctx, req)
+}
+
+func (d *Drain) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if drainExempt[info.FullMethod] {
+		return handler(srv, ss)
+	}
+	if err := d.begin(true); err != nil {
+		return err
+	}
+	defer d.end()
+	if !drainEnded[info.FullMethod] {
+		return handler(srv, ss)
+	}
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.started:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := handler(srv, &drainStream{ServerStream: ss, ctx: ctx})
+	if err == nil && ctx.Err() != nil && ss.Context().Err() == nil {
+		// the client reconnects to another node
+		return status.Error(codes.Unavailable, "the node is draining")
+	}
+	return err
+}
+
+// a stream whose context ends once the node starts draining
+type drainStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *drainStream) Context() context.Context {
+	return s.ctx
+}
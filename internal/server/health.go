@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type HealthReporter interface {
+	Health() Health
+}
+
+// serves the standard gRPC health service: the node's SERVING while it's ready,
+// and the response's header metadata carries the rest of its Health
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+	reporter HealthReporter
+}
+
+func (s *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if req.Service != "" && req.Service != api.Log_ServiceDesc.ServiceName {
+		return nil, status.Errorf(codes.NotFound, "unknown service %s", req.Service)
+	}
+	h := s.reporter.Health()
+	md := metadata.Pairs(
+		"proglog-node", h.Node,
+		"proglog-stage", h.Stage,
+		"proglog-uptime", h.Uptime.String(),
+		"proglog-data-dir-writable", strconv.FormatBool(h.DataDirWritable),
+		"proglog-leader", strconv.FormatBool(h.Leader),
+		"proglog-leader-id", h.LeaderID,
+		"proglog-epoch", strconv.FormatUint(h.Epoch, 10),
+		"proglog-replication-lag", strconv.FormatUint(h.ReplicationLag, 10),
+	)
+	if h.Recovery != nil {
+		md.Set("proglog-recovery", fmt.Sprintf("%d/%d", h.Recovery.SegmentsOpened, h.Recovery.Segments))
+	}
+	if h.LastSync != nil {
+		md.Set("proglog-last-sync", h.LastSync.Format(time.RFC3339Nano))
+	}
+	if err := grpc.SetHeader(ctx, md); err != nil {
+		return nil, err
+	}
+	res := &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}
+	if h.Ready {
+		res.Status = healthpb.HealthCheckResponse_SERVING
+	}
+	return res, nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	api "proglog/api/v1"
+)
+
+// the share of the read slots each lane's waiting requests are given while
+// they're all waiting: out of every 21 slots freed, HIGH gets 16, NORMAL 4
+// and BULK 1, so a backfill keeps going, slowly, without starving the others
+var laneWeights = [...]int{
+	api.ConsumeRequest_NORMAL: 4,
+	api.ConsumeRequest_HIGH:   16,
+	api.ConsumeRequest_BULK:   1,
+}
+
+// the order lanes are served in within a round
+var laneOrder = [...]api.ConsumeRequest_Priority{
+	api.ConsumeRequest_HIGH,
+	api.ConsumeRequest_NORMAL,
+	api.ConsumeRequest_BULK,
+}
+
+// limits the consumers' reads from disk running at once, queueing the rest in
+// lanes by their requests' priority and serving the lanes in weighted rounds,
+// so critical consumers aren't held up behind bulk backfills sharing the
+// node. replication's Fetch and the streams following the in-memory tail
+// don't read through it
+type Lanes struct {
+	mu   sync.Mutex
+	free int
+	// the requests waiting in each lane, oldest first, each is sent a slot by
+	// closing its channel
+	waiting [len(laneWeights)][]chan struct{}
+	// the slots each lane has left in the current round
+	credits [len(laneWeights)]int
+}
+
+// lets slots reads from disk run at once
+func NewLanes(slots int) *Lanes {
+	l := &Lanes{free: slots}
+	l.credits = laneWeights
+	return l
+}
+
+// waits for a read slot in the priority's lane, to be released once the read's
+// done, or until ctx ends
+func (l *Lanes) acquire(ctx context.Context, priority api.ConsumeRequest_Priority) error {
+	i := lane(priority)
+	l.mu.Lock()
+	if l.free > 0 {
+		l.free--
+		l.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	l.waiting[i] = append(l.waiting[i], ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	for j, c := range l.waiting[i] {
+		if c == ready {
+			l.waiting[i] = append(l.waiting[i][:j], l.waiting[i][j+1:]...)
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	l.mu.Unlock()
+	// it was sent a slot as ctx ended, it's passed on
+	l.release()
+	return ctx.Err()
+}
+
+// hands the slot to the next request waiting, or frees it
+func (l *Lanes) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ready := l.next(); ready != nil {
+		close(ready)
+		return
+	}
+	l.free++
+}
+
+// pops the next request waiting in the lane with credits left in the round,
+// starting a new round once the lanes waiting have spent theirs
+func (l *Lanes) next() chan struct{} {
+	for round := 0; round < 2; round++ {
+		for _, p := range laneOrder {
+			if len(l.waiting[p]) > 0 && l.credits[p] > 0 {
+				l.credits[p]--
+				ready := l.waiting[p][0]
+				l.waiting[p] = l.waiting[p][1:]
+				return ready
+			}
+		}
+		l.credits = laneWeights
+	}
+	return nil
+}
+
+// priorities clients don't know of go in the NORMAL lane
+func lane(priority api.ConsumeRequest_Priority) api.ConsumeRequest_Priority {
+	if int(priority) >= len(laneWeights) || priority < 0 {
+		return api.ConsumeRequest_NORMAL
+	}
+	return priority
+}
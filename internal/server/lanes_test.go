@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLanes(t *testing.T) {
+	lanes := NewLanes(1)
+	ctx := context.Background()
+	// the only slot's taken, so the rest wait
+	require.NoError(t, lanes.acquire(ctx, api.ConsumeRequest_NORMAL))
+
+	waiting := func(priority api.ConsumeRequest_Priority) int {
+		lanes.mu.Lock()
+		defer lanes.mu.Unlock()
+		return len(lanes.waiting[priority])
+	}
+	granted := make(chan api.ConsumeRequest_Priority)
+	// queues the requests one at a time, so they wait in order
+	for i := 0; i < 30; i++ {
+		for _, priority := range []api.ConsumeRequest_Priority{
+			api.ConsumeRequest_BULK,
+			api.ConsumeRequest_NORMAL,
+			api.ConsumeRequest_HIGH,
+		} {
+			before := waiting(priority)
+			go func() {
+				if err := lanes.acquire(ctx, priority); err == nil {
+					granted <- priority
+				}
+			}()
+			require.Eventually(t, func() bool {
+				return waiting(priority) == before+1
+			}, time.Second, time.Millisecond)
+		}
+	}
+
+	// a round's shared out by the lanes' weights, the bulk lane isn't starved
+	served := map[api.ConsumeRequest_Priority]int{}
+	for i := 0; i < 21; i++ {
+		lanes.release()
+		served[<-granted]++
+	}
+	require.Equal(t, map[api.ConsumeRequest_Priority]int{
+		api.ConsumeRequest_HIGH:   16,
+		api.ConsumeRequest_NORMAL: 4,
+		api.ConsumeRequest_BULK:   1,
+	}, served)
+
+	// a request that gives up waiting leaves its lane
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- lanes.acquire(ctx, api.ConsumeRequest_Priority(7))
+	}()
+	require.Eventually(t, func() bool {
+		return waiting(api.ConsumeRequest_NORMAL) == 27
+	}, time.Second, time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-errs, context.Canceled)
+	require.Equal(t, 26, waiting(api.ConsumeRequest_NORMAL))
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// what the node reports about itself on /healthz?verbose=1 and in the gRPC
+// health service's metadata
+type Health struct {
+	Node  string `json:"node"`
+	Ready bool   `json:"ready"`
+	// the setup step the node's on while it starts, e.g. "log" while it
+	// recovers its log, "draining" while it shuts down or the Drain RPC readies
+	// it for shutdown, "drained" once it's ready, and empty in between
+	Stage  string        `json:"stage,omitempty"`
+	Uptime time.Duration `json:"uptime_ns"`
+	// while the node recovers its log, how far it's got
+	Recovery *Recovery `json:"recovery,omitempty"`
+	// whether a file could be created and synced in the data directory, checked
+	// at most every few seconds
+	DataDirWritable bool   `json:"data_dir_writable"`
+	DataDirError    string `json:"data_dir_error,omitempty"`
+	// when the log last synced a segment to stable storage, nil if it hasn't
+	LastSync *time.Time `json:"last_sync,omitempty"`
+	Leader   bool       `json:"leader"`
+	LeaderID string     `json:"leader_id,omitempty"`
+	Epoch    uint64     `json:"epoch"`
+	// the records a follower's behind the leader, or on the leader the most
+	// any follower it knows of is behind
+	ReplicationLag uint64 `json:"replication_lag"`
+}
+
+type Recovery struct {
+	SegmentsOpened int `json:"segments_opened"`
+	Segments       int `json:"segments"`
+}
+
+// answers Kubernetes-style probes: /healthz (liveness) succeeds while the process
+// serves it, /readyz (readiness) only while ready reports the node can take
+// traffic, e.g. not while it's recovering its log, when it says how far it's
+// got, or draining.
+// /healthz?verbose=1 describes the node as JSON when health is set
+func NewProbeHandler(ready func() bool, health func() Health) http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if health == nil || r.URL.Query().Get("verbose") == "" {
+			w.Write([]byte("ok\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(health())
+	}).Methods("GET")
+	r.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			msg := "not ready"
+			if health != nil {
+				if h := health(); h.Recovery != nil {
+					msg = fmt.Sprintf("not ready, recovering the log: %d/%d segments opened",
+						h.Recovery.SegmentsOpened, h.Recovery.Segments)
+				}
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}).Methods("GET")
+	return r
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestProbeHandler(t *testing.T) {
+	ready := false
+	h := NewProbeHandler(func() bool { return ready }, func() Health {
+		return Health{Node: "0", Ready: ready, Leader: true, ReplicationLag: 3}
+	})
+
+	probe := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	require.Equal(t, http.StatusOK, probe("/healthz").Code)
+	require.Equal(t, "ok\n", probe("/healthz").Body.String())
+	require.Equal(t, http.StatusServiceUnavailable, probe("/readyz").Code)
+
+	ready = true
+	require.Equal(t, http.StatusOK, probe("/healthz").Code)
+	require.Equal(t, http.StatusOK, probe("/readyz").Code)
+
+	verbose := probe("/healthz?verbose=1")
+	require.Equal(t, http.StatusOK, verbose.Code)
+	require.Equal(t, "application/json", verbose.Header().Get("Content-Type"))
+	var health Health
+	require.NoError(t, json.NewDecoder(verbose.Body).Decode(&health))
+	require.Equal(t, Health{Node: "0", Ready: true, Leader: true, ReplicationLag: 3}, health)
+
+	// while the log's recovered the probe says how far it's got
+	recovering := NewProbeHandler(func() bool { return false }, func() Health {
+		return Health{Node: "0", Stage: "log", Recovery: &Recovery{SegmentsOpened: 3, Segments: 10}}
+	})
+	w := httptest.NewRecorder()
+	recovering.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Contains(t, w.Body.String(), "3/10 segments opened")
+}
+
+func TestHealthServer(t *testing.T) {
+	synced := time.Now()
+	health := Health{
+		Node:            "0",
+		Stage:           "draining",
+		DataDirWritable: true,
+		LastSync:        &synced,
+		Leader:          true,
+		LeaderID:        "0",
+		Epoch:           2,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := NewGPRCServer(&Config{HealthReporter: reporterFunc(func() Health { return health })})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	cc, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		cc.Close()
+	})
+	client := healthpb.NewHealthClient(cc)
+
+	var md metadata.MD
+	res, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}, grpc.Header(&md))
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+	require.Equal(t, []string{"draining"}, md.Get("proglog-stage"))
+	require.Equal(t, []string{"true"}, md.Get("proglog-leader"))
+	require.Equal(t, []string{"2"}, md.Get("proglog-epoch"))
+	require.Equal(t, []string{synced.Format(time.RFC3339Nano)}, md.Get("proglog-last-sync"))
+
+	health.Ready = true
+	res, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "log.v1.Log"})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "other"})
+	require.Error(t, err)
+}
+
+type reporterFunc func() Health
+
+func (f reporterFunc) Health() Health {
+	return f()
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the node's read-only mode: while it's on, produces and transactions are
+// rejected with FailedPrecondition, and consumes, fetches and replication
+// carry on. it's off until Set turns it on, e.g. from the SetReadOnly RPC
+type ReadOnly struct {
+	mu     sync.RWMutex
+	on     bool
+	reason string
+}
+
+func (r *ReadOnly) Set(on bool, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.on = on
+	r.reason = ""
+	if on {
+		r.reason = reason
+	}
+}
+
+func (r *ReadOnly) Get() (on bool, reason string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.on, r.reason
+}
+
+// the status appends are rejected with while the mode's on, nil otherwise
+func (r *ReadOnly) Err() error {
+	on, reason := r.Get()
+	if !on {
+		return nil
+	}
+	if reason == "" {
+		return status.Error(codes.FailedPrecondition, "the node is read-only")
+	}
+	return status.Errorf(codes.FailedPrecondition, "the node is read-only: %s", reason)
+}
@@ -1,15 +1,135 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"time"
 
 	api "proglog/api/v1"
+	// the compressors clients can ask for
+	_ "proglog/internal/compression"
+	"proglog/internal/filter"
 
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type Config struct {
 	CommitLog CommitLog
+	// only set when the commit log is replicated, serves the followers' fetches
+	ReplicaFetcher ReplicaFetcher
+	// only set when the commit log is replicated, serves the sealed segments
+	// followers catching up copy
+	SegmentFetcher SegmentFetcher
+	// only set when the commit log is replicated, serves the followers' repairs
+	Checksummer Checksummer
+	// when set, fetches need a certificate naming one of its members, see
+	// requireReplica
+	ReplicaMembers       ReplicaMembers
+	ReplicationDescriber ReplicationDescriber
+	// only set when the commit log is replicated, linearizable reads are
+	// served once it confirms this node leads
+	LeaderVerifier      LeaderVerifier
+	ClusterStatusGetter ClusterStatusGetter
+	// serves the admin-only DescribeSegments RPC when set
+	SegmentDescriber SegmentDescriber
+	// serves the DescribeLog RPC when set
+	LogDescriber  LogDescriber
+	MemberManager MemberManager
+	OffsetGetter  OffsetGetter
+	// records admin actions and serves the recent audit events
+	AuditLog AuditLog
+	// when set, admin RPCs need an ID token it accepts, see requireAdmin
+	TokenVerifier TokenVerifier
+	// lets clients without a certificate, token or API key call admin RPCs,
+	// only for nodes every client of which is trusted, e.g. in development
+	InsecureAdmin bool
+	// manages API keys and authenticates the requests that carry one
+	APIKeys APIKeyStore
+	// stores the offsets consumers commit
+	ConsumerOffsets ConsumerOffsets
+	// nothing's logged when nil
+	Logger *zap.Logger
+	// Produce and Consume calls that take longer are logged, zero logs none
+	SlowRequestThreshold time.Duration
+	// caps the slow requests logged per second, so a slow disk doesn't flood
+	// the logs, 10 when zero
+	SlowRequestsPerSecond int
+	// when set, the gRPC health service is served and reports what it returns
+	HealthReporter HealthReporter
+	// when set, ConsumeStream calls following the log's head are sent the
+	// records from it, and wait on it for new ones, see Tail
+	Tail *Tail
+	// when set, it limits the consumers' reads from disk running at once,
+	// serving the ones waiting by their priority, see Lanes
+	Lanes *Lanes
+	// when set, records are checked against the schemas their values name
+	// before they're appended, see the schema package
+	SchemaValidator SchemaValidator
+	// when set, rewrite records' values before they're appended, and before
+	// they're sent to consumers, see the transform package
+	ProduceTransformer Transformer
+	ConsumeTransformer Transformer
+	// when set, producers can append records in transactions, and consumers
+	// can read only the committed ones, from the leader, see the txn package
+	Transactions Transactions
+	// when set, records with a message ID appended within its window aren't
+	// appended again, see the dedup package
+	Deduplicator Deduplicator
+	// serves GetByKey when set, see the keyindex package
+	KeyIndex KeyIndex
+	// when set, SetReadOnly switches the node in and out of read-only mode,
+	// see ReadOnly
+	ReadOnly *ReadOnly
+	// when set, produces are refused with the error it returns, e.g. while
+	// the node's disk is almost full, see the diskguard package
+	WriteFence WriteFence
+	// when set, the requests in flight are tracked and the Drain RPC readies
+	// the node for shutdown, waiting for ReplicationSettler too when that's
+	// set, see Drain
+	Drain              *Drain
+	ReplicationSettler ReplicationSettler
+	// serves Redact when set, the ReplicatedLog
+	Redactor Redactor
+	// run in order after a request's authenticated, so they can read its
+	// Principal, for embedders' own auth, metrics or tenancy middleware
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StreamInterceptors []grpc.StreamServerInterceptor
+}
+
+// adds the interceptors to the end of the config's chain, see
+// Config.UnaryInterceptors
+func WithUnaryInterceptor(config *Config, interceptors ...grpc.UnaryServerInterceptor) *Config {
+	config.UnaryInterceptors = append(config.UnaryInterceptors, interceptors...)
+	return config
+}
+
+// adds the interceptors to the end of the config's chain, see
+// Config.StreamInterceptors
+func WithStreamInterceptor(config *Config, interceptors ...grpc.StreamServerInterceptor) *Config {
+	config.StreamInterceptors = append(config.StreamInterceptors, interceptors...)
+	return config
+}
+
+type WriteFence interface {
+	// nil while appends are allowed
+	Err() error
+}
+
+type Redactor interface {
+	Redact(*api.RedactRequest) (*api.RedactResponse, error)
+}
+
+// the Drain RPC waits for the followers to have every record
+type ReplicationSettler interface {
+	Unreplicated() uint64
 }
 
 type CommitLog interface {
@@ -17,34 +137,228 @@ type CommitLog interface {
 	Read(uint64) (*api.Record, error)
 }
 
+// implemented by logs that can read into a caller's record and buffer, see
+// log.Log.ReadInto. streams read through it when the log does, so they don't
+// allocate a record per record they send
+type RecordReader interface {
+	ReadInto(off uint64, record *api.Record, buf []byte) ([]byte, error)
+}
+
+type ReplicaFetcher interface {
+	Fetch(context.Context, *api.FetchRequest) (*api.FetchResponse, error)
+}
+
+type SegmentFetcher interface {
+	SealedSegments(offset uint64) ([]*api.Segment, error)
+	// calls fn with the segment's bytes a chunk at a time and returns their
+	// checksum
+	ReadSegment(ctx context.Context, offset uint64, fn func(chunk []byte) error) (uint32, error)
+}
+
+type ReplicaMembers interface {
+	// reports whether name is a member of the cluster
+	IsMember(name string) bool
+}
+
+type Checksummer interface {
+	Checksums(offset, rangeRecords, ranges uint64) (checksums []uint32, redacted []uint64, err error)
+}
+
+type ReplicationDescriber interface {
+	DescribeReplication() (*api.Replication, error)
+}
+
+type SegmentDescriber interface {
+	DescribeSegments(*api.DescribeSegmentsRequest) (*api.DescribeSegmentsResponse, error)
+}
+
+type LogDescriber interface {
+	DescribeLog() (*api.LogDescription, error)
+}
+
+type LeaderVerifier interface {
+	VerifyLeader() error
+}
+
+type ClusterStatusGetter interface {
+	GetClusterStatus() (*api.ClusterStatus, error)
+}
+
+type MemberManager interface {
+	Members() ([]*api.Member, error)
+	RemoveMember(id string) error
+}
+
+type AuditLog interface {
+	Record(*api.AuditEvent) error
+	Recent(n int) ([]*api.AuditEvent, error)
+}
+
+type TokenVerifier interface {
+	// returns who the token identifies
+	Verify(ctx context.Context, rawToken string) (string, error)
+	Issuer() string
+}
+
+type APIKeyStore interface {
+	Create(name string, scopes []string) (*api.APIKey, string, error)
+	Revoke(id string) error
+	List() []*api.APIKey
+	Authenticate(token string) (*api.APIKey, error)
+}
+
+type ConsumerOffsets interface {
+	Commit(consumer string, offset uint64) error
+	Committed(consumer string) (uint64, bool)
+}
+
+type SchemaValidator interface {
+	Validate(ctx context.Context, value []byte) error
+}
+
+type Transformer interface {
+	// returns the value to use instead, ok's false to drop the record
+	Transform(ctx context.Context, value []byte) (out []byte, ok bool, err error)
+}
+
+type Transactions interface {
+	Begin(timeout time.Duration) (string, error)
+	// appends a record of the open transaction its TransactionId names
+	Append(*api.Record) (uint64, error)
+	Commit(id string) (uint64, error)
+	Abort(id string) (uint64, error)
+	// returns the offset below which every transaction has ended, and, when an
+	// open transaction holds it back, a channel that's closed once one ends
+	StableOffset() (uint64, <-chan struct{}, error)
+	// reports whether the transaction of a record below the stable offset
+	// aborted
+	Aborted(*api.Record) (bool, error)
+}
+
+type Deduplicator interface {
+	// calls fn to append the record with the message ID, unless one was
+	// appended within the window, then it returns that one's offset
+	Append(id string, fn func() (uint64, error)) (offset uint64, duplicate bool, err error)
+}
+
+type KeyIndex interface {
+	// the offset of the key's latest committed record
+	Lookup(key []byte) (uint64, bool)
+}
+
+type OffsetGetter interface {
+	GetOffsets() (lowest, end uint64, err error)
+}
+
+// implemented by logs that append records before consumers can read them, e.g.
+// a replicated log's past its high watermark. GetOffsets reports the end as
+// the log end offset for those that don't
+type LogEndGetter interface {
+	LogEndOffset() uint64
+}
+
 // a compile-time check to ensure that the grpcServer type implements the api.LogServer interface
 var _ api.LogServer = (*grpcServer)(nil)
 
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	// samples the slow requests logged
+	slowLimiter *rate.Limiter
 }
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.SlowRequestsPerSecond == 0 {
+		config.SlowRequestsPerSecond = 10
+	}
 	srv = &grpcServer{
-		Config: config,
+		Config:      config,
+		slowLimiter: rate.NewLimiter(rate.Limit(config.SlowRequestsPerSecond), config.SlowRequestsPerSecond),
 	}
 
 	return srv, nil
 }
 
+// every request's context carries its client's Principal, see PrincipalFromContext
 func NewGPRCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
-	gsrv := grpc.NewServer(opts...)
 	srv, err := newgrpcServer(config)
 	if err != nil {
 		return nil, err
 	}
+	opts = append(
+		opts,
+		grpc.ChainUnaryInterceptor(srv.authenticateUnary),
+		grpc.ChainStreamInterceptor(srv.authenticateStream),
+	)
+	if config.Drain != nil {
+		opts = append(
+			opts,
+			grpc.ChainUnaryInterceptor(config.Drain.unary),
+			grpc.ChainStreamInterceptor(config.Drain.stream),
+		)
+	}
+	opts = append(
+		opts,
+		grpc.ChainUnaryInterceptor(config.UnaryInterceptors...),
+		grpc.ChainStreamInterceptor(config.StreamInterceptors...),
+	)
+	// sends the tail's marshaled responses as they are
+	opts = append(opts, grpc.ForceServerCodec(newCodec()))
+	gsrv := grpc.NewServer(opts...)
 	api.RegisterLogServer(gsrv, srv)
+	if config.HealthReporter != nil {
+		healthpb.RegisterHealthServer(gsrv, &healthServer{reporter: config.HealthReporter})
+	}
 	return gsrv, nil
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	offset, err := s.CommitLog.Append(req.Record)
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	if s.ProduceTransformer != nil && req.Record != nil {
+		value, ok, err := s.ProduceTransformer.Transform(ctx, req.Record.Value)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if !ok {
+			return nil, status.Error(codes.InvalidArgument, "the produce transform rejected the record")
+		}
+		req.Record.Value = value
+	}
+	if s.SchemaValidator != nil {
+		if err := s.SchemaValidator.Validate(ctx, req.Record.GetValue()); err != nil {
+			return nil, err
+		}
+	}
+	if req.Record.GetControl() != api.Record_DATA {
+		return nil, status.Error(codes.InvalidArgument, "only transactions' commits and aborts append control records")
+	}
+	appendRecord := s.CommitLog.Append
+	if req.Record.GetTransactionId() != "" {
+		if s.Transactions == nil {
+			return nil, status.Error(codes.Unimplemented, "transactions aren't enabled")
+		}
+		appendRecord = s.Transactions.Append
+	}
+	if id := req.Record.GetMessageId(); id != "" {
+		if s.Deduplicator == nil {
+			return nil, status.Error(codes.Unimplemented, "deduplication isn't enabled")
+		}
+		appendOnce := appendRecord
+		appendRecord = func(record *api.Record) (uint64, error) {
+			offset, _, err := s.Deduplicator.Append(id, func() (uint64, error) {
+				return appendOnce(record)
+			})
+			return offset, err
+		}
+	}
+	start := time.Now()
+	offset, err := appendRecord(req.Record)
+	s.logSlow(ctx, "produce", start, offset, len(req.Record.GetValue()), err)
 	if err != nil {
 		return nil, err
 	}
@@ -53,17 +367,279 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	record, err := s.CommitLog.Read(req.Offset)
+	if req.Filter != "" {
+		return nil, status.Error(codes.InvalidArgument, "filters only apply to ConsumeStream")
+	}
+	committed := req.Isolation == api.ConsumeRequest_READ_COMMITTED
+	if committed {
+		if s.Transactions == nil {
+			return nil, status.Error(codes.Unimplemented, "transactions aren't enabled")
+		}
+		stable, _, err := s.Transactions.StableOffset()
+		if err != nil {
+			return nil, err
+		}
+		if req.Offset >= stable {
+			return nil, api.ErrOffsetOutOfRange{Offset: req.Offset}
+		}
+	}
+	record, err := s.read(ctx, req, nil)
 	if err != nil {
 		return nil, err
 	}
+	send, err := s.prepare(ctx, record, nil, committed)
+	if err != nil {
+		return nil, err
+	}
+	if !send {
+		if committed && (record.Control != api.Record_DATA || record.TransactionId != "") {
+			return nil, status.Errorf(codes.NotFound, "the record at %d is a transaction's marker, or its transaction aborted", req.Offset)
+		}
+		return nil, status.Errorf(codes.NotFound, "the consume transform dropped the record at %d", req.Offset)
+	}
 
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// applies the consume transform and the stream's filter, which may be nil, to
+// the record, reporting whether it's sent. read committed consumers aren't sent
+// transactions' markers, or the records of those that aborted
+func (s *grpcServer) prepare(ctx context.Context, record *api.Record, f *filter.Filter, committed bool) (bool, error) {
+	if committed {
+		if record.Control != api.Record_DATA {
+			return false, nil
+		}
+		if record.TransactionId != "" {
+			aborted, err := s.Transactions.Aborted(record)
+			if err != nil || aborted {
+				return false, err
+			}
+		}
+	}
+	if s.ConsumeTransformer != nil {
+		value, ok, err := s.ConsumeTransformer.Transform(ctx, record.Value)
+		if err != nil {
+			return false, status.Error(codes.Internal, err.Error())
+		}
+		if !ok {
+			return false, nil
+		}
+		record.Value = value
+	}
+	return f == nil || f.Match(record), nil
+}
+
+// reads the record Consume asks for. given a buffer, which needs the log to be
+// a RecordReader, the record's read with the buffer, and the buffer's grown
+// when it's too small
+func (s *grpcServer) read(ctx context.Context, req *api.ConsumeRequest, buf *[]byte) (*api.Record, error) {
+	if req.Consistency == api.ConsumeRequest_LINEARIZABLE && s.LeaderVerifier != nil {
+		if err := s.LeaderVerifier.VerifyLeader(); err != nil {
+			return nil, err
+		}
+	}
+	release, err := s.readSlot(ctx, req.Priority)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	start := time.Now()
+	var record *api.Record
+	if buf != nil {
+		record = &api.Record{}
+		if *buf, err = s.CommitLog.(RecordReader).ReadInto(req.Offset, record, *buf); err != nil {
+			record = nil
+		}
+	} else {
+		record, err = s.CommitLog.Read(req.Offset)
+	}
+	s.logSlow(ctx, "consume", start, req.Offset, len(record.GetValue()), err)
+	return record, err
+}
+
+// waits for a read slot in the priority's lane when the reads from disk are
+// limited, see Lanes, returning the func that releases it
+func (s *grpcServer) readSlot(ctx context.Context, priority api.ConsumeRequest_Priority) (func(), error) {
+	if s.Lanes == nil {
+		return func() {}, nil
+	}
+	if err := s.Lanes.acquire(ctx, priority); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	return s.Lanes.release, nil
+}
+
+func (s *grpcServer) Fetch(ctx context.Context, req *api.FetchRequest) (*api.FetchResponse, error) {
+	if s.ReplicaFetcher == nil {
+		return nil, status.Error(codes.Unimplemented, "replication isn't enabled")
+	}
+	if err := s.requireReplica(ctx, req.ReplicaId); err != nil {
+		return nil, err
+	}
+	return s.ReplicaFetcher.Fetch(ctx, req)
+}
+
+func (s *grpcServer) ListSealedSegments(ctx context.Context, req *api.ListSealedSegmentsRequest) (*api.ListSealedSegmentsResponse, error) {
+	if s.SegmentFetcher == nil {
+		return nil, status.Error(codes.Unimplemented, "replication isn't enabled")
+	}
+	if err := s.requireReplica(ctx, ""); err != nil {
+		return nil, err
+	}
+	segments, err := s.SegmentFetcher.SealedSegments(req.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListSealedSegmentsResponse{Segments: segments}, nil
+}
+
+func (s *grpcServer) FetchSegment(req *api.FetchSegmentRequest, stream api.Log_FetchSegmentServer) error {
+	if s.SegmentFetcher == nil {
+		return status.Error(codes.Unimplemented, "replication isn't enabled")
+	}
+	if err := s.requireReplica(stream.Context(), ""); err != nil {
+		return err
+	}
+	checksum, err := s.SegmentFetcher.ReadSegment(stream.Context(), req.Offset, func(chunk []byte) error {
+		return stream.Send(&api.FetchSegmentResponse{Chunk: chunk})
+	})
+	if err != nil {
+		return err
+	}
+	return stream.Send(&api.FetchSegmentResponse{Last: true, Checksum: checksum})
+}
+
+func (s *grpcServer) GetChecksums(ctx context.Context, req *api.GetChecksumsRequest) (*api.GetChecksumsResponse, error) {
+	if s.Checksummer == nil {
+		return nil, status.Error(codes.Unimplemented, "replication isn't enabled")
+	}
+	if err := s.requireReplica(ctx, ""); err != nil {
+		return nil, err
+	}
+	checksums, redacted, err := s.Checksummer.Checksums(req.Offset, req.RangeRecords, req.Ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.GetChecksumsResponse{Checksums: checksums, Redacted: redacted}, nil
+}
+
+func (s *grpcServer) DescribeReplication(ctx context.Context, req *api.DescribeReplicationRequest) (*api.DescribeReplicationResponse, error) {
+	if s.ReplicationDescriber == nil {
+		return nil, status.Error(codes.Unimplemented, "replication isn't enabled")
+	}
+	replication, err := s.ReplicationDescriber.DescribeReplication()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.DescribeReplicationResponse{Replication: replication}, nil
+}
+
+func (s *grpcServer) GetClusterStatus(ctx context.Context, req *api.GetClusterStatusRequest) (*api.GetClusterStatusResponse, error) {
+	if s.ClusterStatusGetter == nil {
+		return nil, status.Error(codes.Unimplemented, "replication isn't enabled")
+	}
+	clusterStatus, err := s.ClusterStatusGetter.GetClusterStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.GetClusterStatusResponse{Status: clusterStatus}, nil
+}
+
+func (s *grpcServer) ListMembers(ctx context.Context, req *api.ListMembersRequest) (*api.ListMembersResponse, error) {
+	if s.MemberManager == nil {
+		return nil, status.Error(codes.Unimplemented, "membership isn't enabled")
+	}
+	members, err := s.MemberManager.Members()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ListMembersResponse{Members: members}, nil
+}
+
+func (s *grpcServer) RemoveMember(ctx context.Context, req *api.RemoveMemberRequest) (*api.RemoveMemberResponse, error) {
+	if s.MemberManager == nil {
+		return nil, status.Error(codes.Unimplemented, "membership isn't enabled")
+	}
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	err := s.MemberManager.RemoveMember(req.Id)
+	s.audit(ctx, "remove_member", req.Id, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.RemoveMemberResponse{}, nil
+}
+
+func (s *grpcServer) ListAuditEvents(ctx context.Context, req *api.ListAuditEventsRequest) (*api.ListAuditEventsResponse, error) {
+	if s.AuditLog == nil {
+		return nil, status.Error(codes.Unimplemented, "auditing isn't enabled")
+	}
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = 100
+	}
+	events, err := s.AuditLog.Recent(limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ListAuditEventsResponse{Events: events}, nil
+}
+
+// records an admin action taken by the request's client, a failed action counts
+// as not allowed
+func (s *grpcServer) audit(ctx context.Context, action, resource string, err error) {
+	if s.AuditLog == nil {
+		return
+	}
+	e := &api.AuditEvent{
+		Action:   action,
+		Resource: resource,
+		Allowed:  err == nil,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if p, ok := PrincipalFromContext(ctx); ok {
+		e.Principal = p.Subject
+		e.Addr = p.Addr
+	}
+	if err := s.AuditLog.Record(e); err != nil {
+		s.Logger.Error("recording an audit event", zap.Error(err))
+	}
+}
+
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	if s.OffsetGetter == nil {
+		return nil, status.Error(codes.Unimplemented, "offsets aren't available")
+	}
+	lowest, end, err := s.OffsetGetter.GetOffsets()
+	if err != nil {
+		return nil, err
+	}
+	logEnd := end
+	if l, ok := s.OffsetGetter.(LogEndGetter); ok {
+		logEnd = l.LogEndOffset()
+	}
+
+	return &api.GetOffsetsResponse{LowestOffset: lowest, EndOffset: end, LogEndOffset: logEnd}, nil
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -78,23 +654,475 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	// when the log can read into a buffer the stream's records are read with
+	// the same one. the records aren't reused, though the node's done with them
+	// once Send returns, an interceptor may hold on to them
+	var buf *[]byte
+	if _, ok := s.CommitLog.(RecordReader); ok {
+		buf = new([]byte)
+	}
+	// linearizable reads verify the leader for each record, they don't go
+	// through the tail
+	tail := s.Tail
+	if req.Consistency == api.ConsumeRequest_LINEARIZABLE {
+		tail = nil
+	}
+	var f *filter.Filter
+	if req.Filter != "" {
+		var err error
+		if f, err = filter.Compile(req.Filter); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	committed := req.Isolation == api.ConsumeRequest_READ_COMMITTED
+	if committed && s.Transactions == nil {
+		return status.Error(codes.Unimplemented, "transactions aren't enabled")
+	}
+	// read committed streams read the records below the stable offset
+	var stable uint64
 	for {
+		if req.EndOffset != 0 && req.Offset >= req.EndOffset {
+			return nil
+		}
 		select {
 		case <-stream.Context().Done():
 			return nil
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			if committed && req.Offset >= stable {
+				var ended <-chan struct{}
+				var err error
+				if stable, ended, err = s.Transactions.StableOffset(); err != nil {
+					return err
+				}
+				if req.Offset >= stable {
+					// an open transaction holds the stream back, or it's caught
+					// up and waits for the next commit
+					if ended == nil && tail != nil {
+						if _, c, ok := tail.get(req.Offset); !ok {
+							ended = c
+						}
+					}
+					if ended != nil {
+						select {
+						case <-ended:
+						case <-stream.Context().Done():
+						}
+					}
+					continue
+				}
+			}
+			var changed <-chan struct{}
+			if tail != nil {
+				b, c, ok := tail.get(req.Offset)
+				if ok {
+					if err := s.sendTail(stream, b, f, committed); err != nil {
+						return err
+					}
+					req.Offset++
+					continue
+				}
+				changed = c
+			}
+			record, err := s.read(stream.Context(), req, buf)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				// caught up, with a tail the stream waits for the next commit
+				if changed != nil {
+					select {
+					case <-changed:
+					case <-stream.Context().Done():
+					}
+				}
 				continue
 			default:
 				return err
 			}
-			if err = stream.Send(res); err != nil {
+			send, err := s.prepare(stream.Context(), record, f, committed)
+			if err == nil && send {
+				err = stream.Send(&api.ConsumeResponse{Record: record})
+			}
+			if err != nil {
 				return err
 			}
 			req.Offset++
 		}
 	}
 }
+
+// sends the tail's marshaled response, unless the record has to be transformed
+// or filtered, or checked it's committed, first
+func (s *grpcServer) sendTail(stream api.Log_ConsumeStreamServer, b []byte, f *filter.Filter, committed bool) error {
+	if f == nil && s.ConsumeTransformer == nil && !committed {
+		return stream.SendMsg(marshaled(b))
+	}
+	res := &api.ConsumeResponse{}
+	if err := proto.Unmarshal(b, res); err != nil {
+		return err
+	}
+	send, err := s.prepare(stream.Context(), res.Record, f, committed)
+	if err != nil || !send {
+		return err
+	}
+	if s.ConsumeTransformer == nil {
+		return stream.SendMsg(marshaled(b))
+	}
+	return stream.Send(res)
+}
+
+func (s *grpcServer) Replay(req *api.ReplayRequest, stream api.Log_ReplayServer) error {
+	if s.OffsetGetter == nil {
+		return status.Error(codes.Unimplemented, "offsets aren't available")
+	}
+	committed := req.Isolation == api.ConsumeRequest_READ_COMMITTED
+	if committed && s.Transactions == nil {
+		return status.Error(codes.Unimplemented, "transactions aren't enabled")
+	}
+	lowest, end, err := s.OffsetGetter.GetOffsets()
+	if err != nil {
+		return err
+	}
+	// read committed replays read the records below the stable offset
+	if committed {
+		stable, _, err := s.Transactions.StableOffset()
+		if err != nil {
+			return err
+		}
+		end = min(end, stable)
+	}
+	start := max(req.StartOffset, lowest)
+	if req.EndOffset != 0 {
+		end = min(end, req.EndOffset)
+	}
+	ctx := stream.Context()
+	if req.StartTime != 0 {
+		if start, err = s.offsetAt(ctx, req.Priority, start, end, req.StartTime); err != nil {
+			return err
+		}
+	}
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if req.RecordsPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(req.RecordsPerSecond), 1)
+	}
+	for off := start; off < end; off++ {
+		release, err := s.readSlot(ctx, req.Priority)
+		if err != nil {
+			return err
+		}
+		record, err := s.CommitLog.Read(off)
+		release()
+		if err != nil {
+			return err
+		}
+		if req.EndTime != 0 && record.Timestamp >= req.EndTime {
+			return nil
+		}
+		send, err := s.prepare(ctx, record, nil, committed)
+		if err != nil {
+			return err
+		}
+		if !send {
+			continue
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		if err := stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finds the first offset in [start, end) whose record was appended at or after
+// the time, end when none was. it searches the offsets, taking the records'
+// timestamps to be in order, and records without one to be older. the reads
+// wait in the priority's lane like the replay's
+func (s *grpcServer) offsetAt(ctx context.Context, priority api.ConsumeRequest_Priority, start, end uint64, timestamp int64) (uint64, error) {
+	for start < end {
+		mid := start + (end-start)/2
+		release, err := s.readSlot(ctx, priority)
+		if err != nil {
+			return 0, err
+		}
+		record, err := s.CommitLog.Read(mid)
+		release()
+		if err != nil {
+			return 0, err
+		}
+		if record.Timestamp < timestamp {
+			start = mid + 1
+		} else {
+			end = mid
+		}
+	}
+	return start, nil
+}
+
+func (s *grpcServer) GetByKey(ctx context.Context, req *api.GetByKeyRequest) (*api.GetByKeyResponse, error) {
+	if s.KeyIndex == nil {
+		return nil, status.Error(codes.Unimplemented, "keys aren't indexed")
+	}
+	off, ok := s.KeyIndex.Lookup(req.Key)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no record has the key %q", req.Key)
+	}
+	record, err := s.CommitLog.Read(off)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return nil, status.Errorf(codes.NotFound, "the key %q's latest record, at %d, was removed", req.Key, off)
+	}
+	if err != nil {
+		return nil, err
+	}
+	send, err := s.prepare(ctx, record, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if !send {
+		return nil, status.Errorf(codes.NotFound, "the consume transform dropped the record at %d", off)
+	}
+	return &api.GetByKeyResponse{Record: record}, nil
+}
+
+func (s *grpcServer) BeginTransaction(ctx context.Context, req *api.BeginTransactionRequest) (*api.BeginTransactionResponse, error) {
+	if s.Transactions == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't enabled")
+	}
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	id, err := s.Transactions.Begin(time.Duration(req.TimeoutMs) * time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTransactionResponse{TransactionId: id}, nil
+}
+
+func (s *grpcServer) CommitTransaction(ctx context.Context, req *api.EndTransactionRequest) (*api.EndTransactionResponse, error) {
+	if s.Transactions == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't enabled")
+	}
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	off, err := s.Transactions.Commit(req.TransactionId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.EndTransactionResponse{Offset: off}, nil
+}
+
+func (s *grpcServer) AbortTransaction(ctx context.Context, req *api.EndTransactionRequest) (*api.EndTransactionResponse, error) {
+	if s.Transactions == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions aren't enabled")
+	}
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	off, err := s.Transactions.Abort(req.TransactionId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.EndTransactionResponse{Offset: off}, nil
+}
+
+func (s *grpcServer) CreateAPIKey(ctx context.Context, req *api.CreateAPIKeyRequest) (*api.CreateAPIKeyResponse, error) {
+	if s.APIKeys == nil {
+		return nil, status.Error(codes.Unimplemented, "API keys aren't enabled")
+	}
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	key, token, err := s.APIKeys.Create(req.Name, req.Scopes)
+	resource := req.Name
+	if key != nil {
+		resource = key.Id
+	}
+	s.audit(ctx, "create_api_key", resource, err)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return &api.CreateAPIKeyResponse{Key: key, Token: token}, nil
+}
+
+func (s *grpcServer) RevokeAPIKey(ctx context.Context, req *api.RevokeAPIKeyRequest) (*api.RevokeAPIKeyResponse, error) {
+	if s.APIKeys == nil {
+		return nil, status.Error(codes.Unimplemented, "API keys aren't enabled")
+	}
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	err := s.APIKeys.Revoke(req.Id)
+	s.audit(ctx, "revoke_api_key", req.Id, err)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return &api.RevokeAPIKeyResponse{}, nil
+}
+
+func (s *grpcServer) ListAPIKeys(ctx context.Context, req *api.ListAPIKeysRequest) (*api.ListAPIKeysResponse, error) {
+	if s.APIKeys == nil {
+		return nil, status.Error(codes.Unimplemented, "API keys aren't enabled")
+	}
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	return &api.ListAPIKeysResponse{Keys: s.APIKeys.List()}, nil
+}
+
+func (s *grpcServer) DescribeSegments(ctx context.Context, req *api.DescribeSegmentsRequest) (*api.DescribeSegmentsResponse, error) {
+	if s.SegmentDescriber == nil {
+		return nil, status.Error(codes.Unimplemented, "describing segments isn't enabled")
+	}
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	res, err := s.SegmentDescriber.DescribeSegments(req)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return res, nil
+}
+
+func (s *grpcServer) DescribeLog(ctx context.Context, req *api.DescribeLogRequest) (*api.DescribeLogResponse, error) {
+	if s.LogDescriber == nil {
+		return nil, status.Error(codes.Unimplemented, "describing the log isn't enabled")
+	}
+	d, err := s.LogDescriber.DescribeLog()
+	if err != nil {
+		return nil, err
+	}
+	if s.ReadOnly != nil {
+		d.ReadOnly, d.ReadOnlyReason = s.ReadOnly.Get()
+	}
+
+	return &api.DescribeLogResponse{Log: d}, nil
+}
+
+func (s *grpcServer) SetReadOnly(ctx context.Context, req *api.SetReadOnlyRequest) (*api.SetReadOnlyResponse, error) {
+	if s.ReadOnly == nil {
+		return nil, status.Error(codes.Unimplemented, "read-only mode isn't enabled")
+	}
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	s.ReadOnly.Set(req.ReadOnly, req.Reason)
+	action := "disable_read_only"
+	if req.ReadOnly {
+		action = "enable_read_only"
+	}
+	s.audit(ctx, action, "", nil)
+
+	return &api.SetReadOnlyResponse{}, nil
+}
+
+func (s *grpcServer) Redact(ctx context.Context, req *api.RedactRequest) (*api.RedactResponse, error) {
+	if s.Redactor == nil {
+		return nil, status.Error(codes.Unimplemented, "redaction isn't enabled")
+	}
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if len(req.StartKey) == 0 && req.StartOffset >= req.EndOffset {
+		return nil, status.Errorf(codes.InvalidArgument, "the offset range [%d, %d) is empty", req.StartOffset, req.EndOffset)
+	}
+	if len(req.StartKey) > 0 && len(req.EndKey) > 0 && bytes.Compare(req.StartKey, req.EndKey) >= 0 {
+		return nil, status.Error(codes.InvalidArgument, "the key range is empty")
+	}
+	// redactions are appended as control records, so they're refused like
+	// produces are while the node's read-only or fenced
+	var res *api.RedactResponse
+	err := s.writable()
+	if err == nil {
+		res, err = s.Redactor.Redact(req)
+	}
+	// the keys are what's being erased, so they're kept out of the audit log
+	resource := "key range"
+	if len(req.StartKey) == 0 {
+		resource = fmt.Sprintf("offsets [%d, %d)", req.StartOffset, req.EndOffset)
+	}
+	if res != nil {
+		resource = fmt.Sprintf("%s: %d records", resource, len(res.Offsets))
+	}
+	s.audit(ctx, "redact", resource, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *grpcServer) Drain(ctx context.Context, req *api.DrainRequest) (*api.DrainResponse, error) {
+	if s.Config.Drain == nil {
+		return nil, status.Error(codes.Unimplemented, "draining isn't enabled")
+	}
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	s.audit(ctx, "drain", "", nil)
+	s.Config.Drain.Start()
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		res := &api.DrainResponse{InFlight: uint32(s.Config.Drain.InFlight())}
+		if s.ReplicationSettler != nil {
+			res.Unreplicated = s.ReplicationSettler.Unreplicated()
+		}
+		if res.InFlight == 0 && res.Unreplicated == 0 {
+			res.Settled = true
+			s.Config.Drain.settled()
+			return res, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return res, nil
+		}
+	}
+}
+
+// the status produces are rejected with while the node's read-only or fenced
+func (s *grpcServer) writable() error {
+	if s.ReadOnly != nil {
+		if err := s.ReadOnly.Err(); err != nil {
+			return err
+		}
+	}
+	if s.WriteFence != nil {
+		return s.WriteFence.Err()
+	}
+	return nil
+}
+
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if s.ConsumerOffsets == nil {
+		return nil, status.Error(codes.Unimplemented, "committing offsets isn't enabled")
+	}
+	if req.Consumer == "" {
+		return nil, status.Error(codes.InvalidArgument, "the consumer has no name")
+	}
+	if err := s.ConsumerOffsets.Commit(req.Consumer, req.Offset); err != nil {
+		return nil, err
+	}
+
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) GetCommittedOffset(ctx context.Context, req *api.GetCommittedOffsetRequest) (*api.GetCommittedOffsetResponse, error) {
+	if s.ConsumerOffsets == nil {
+		return nil, status.Error(codes.Unimplemented, "committing offsets isn't enabled")
+	}
+	offset, found := s.ConsumerOffsets.Committed(req.Consumer)
+
+	return &api.GetCommittedOffsetResponse{Offset: offset, Found: found}, nil
+}
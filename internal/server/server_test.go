@@ -1,17 +1,33 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	api "proglog/api/v1"
+	"proglog/internal/apikey"
 	"proglog/internal/config"
+	"proglog/internal/dedup"
+	"proglog/internal/keyindex"
 	"proglog/internal/log"
+	"proglog/internal/txn"
 
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"github.com/stretchr/testify/require"
@@ -26,6 +42,25 @@ func TestServer(t *testing.T) {
 		"produce|consume a message to|from the log succeeds": testProduceConsume,
 		"produce|consume stream succeeds":                    testProduceConsumeStream,
 		"consume past log boundary fails":                    testConsumePastBoundary,
+		"get offsets returns the log's range":                testGetOffsets,
+		"linearizable consume needs the leader":              testLinearizableConsume,
+		"admin actions are audited":                          testAuditAdminActions,
+		"admin rpcs need a token when verified":              testAdminToken,
+		"api keys are limited to their scopes":               testAPIKeyScopes,
+		"slow requests are logged":                           testSlowRequests,
+		"segments are described":                             testDescribeSegments,
+		"consume stream follows the tail":                    testConsumeStreamTail,
+		"consume stream filters records":                     testConsumeStreamFilter,
+		"transforms rewrite and drop records":                testTransforms,
+		"read committed consumers see whole transactions":    testTransactions,
+		"records with a seen message id are dropped":         testDeduplication,
+		"replay re-sends a range at a rate":                  testReplay,
+		"get by key returns the key's latest record":         testGetByKey,
+		"the log is described":                               testDescribeLog,
+		"read-only nodes reject produces":                    testReadOnly,
+		"fenced nodes reject produces":                       testWriteFence,
+		"redacted records are consumed erased":               testRedact,
+		"reads from disk wait in their lanes":                testLanes,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			client, config, teardown := setupTest(t, nil)
@@ -35,6 +70,166 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestInterceptors(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	called := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, name)
+	}
+	got := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), calls...)
+	}
+	unary := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			// they run after the request's authenticated
+			p, ok := PrincipalFromContext(ctx)
+			require.True(t, ok)
+			require.True(t, p.Authenticated)
+			called(name)
+			return handler(ctx, req)
+		}
+	}
+	client, _, teardown := setupTest(t, func(config *Config) {
+		WithUnaryInterceptor(config, unary("first"), unary("second"))
+		WithStreamInterceptor(config, func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			called(info.FullMethod)
+			return handler(srv, ss)
+		})
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"first", "second"}, got())
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, []string{"first", "second", "/log.v1.Log/ProduceStream"}, got())
+}
+
+func TestConsumeStreamRetainedRecords(t *testing.T) {
+	// an interceptor holding on to the sent responses, e.g. to log them later
+	var mu sync.Mutex
+	var sent []*api.ConsumeResponse
+	client, config, teardown := setupTest(t, func(config *Config) {
+		WithStreamInterceptor(config, func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return handler(srv, &retainingStream{ServerStream: ss, retain: func(res *api.ConsumeResponse) {
+				mu.Lock()
+				defer mu.Unlock()
+				sent = append(sent, res)
+			}})
+		})
+	})
+	defer teardown()
+	// the log reads into the stream's buffer
+	_, ok := config.CommitLog.(RecordReader)
+	require.True(t, ok)
+
+	values := []string{"first", "second", "a longer third value"}
+	for _, value := range values {
+		_, err := config.CommitLog.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{EndOffset: uint64(len(values))})
+	require.NoError(t, err)
+	for range values {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// the records read after them didn't overwrite them
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, sent, len(values))
+	for i, value := range values {
+		require.Equal(t, uint64(i), sent[i].Record.Offset)
+		require.Equal(t, []byte(value), sent[i].Record.Value)
+	}
+}
+
+type retainingStream struct {
+	grpc.ServerStream
+	retain func(*api.ConsumeResponse)
+}
+
+func (s *retainingStream) SendMsg(m interface{}) error {
+	if res, ok := m.(*api.ConsumeResponse); ok {
+		s.retain(res)
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func TestDrain(t *testing.T) {
+	drain := NewDrain()
+	settler := &settler{}
+	settler.unreplicated.Store(3)
+	client, _, teardown := setupTest(t, func(config *Config) {
+		config.Drain = drain
+		config.ReplicationSettler = settler
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+	consume, err := client.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = consume.Recv()
+	require.NoError(t, err)
+	produce, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, produce.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}}))
+	_, err = produce.Recv()
+	require.NoError(t, err)
+
+	res, err := client.Drain(ctx, &api.DrainRequest{TimeoutMs: 200})
+	require.NoError(t, err)
+	require.False(t, res.Settled)
+	require.Equal(t, uint32(1), res.InFlight)
+	require.Equal(t, uint64(3), res.Unreplicated)
+	require.True(t, drain.Draining())
+	require.False(t, drain.Drained())
+	// the stream following the log was ended, and new ones are refused
+	for err == nil {
+		_, err = consume.Recv()
+	}
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	consume, err = client.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = consume.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	// requests are still served
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+
+	require.NoError(t, produce.CloseSend())
+	_, err = produce.Recv()
+	require.Equal(t, io.EOF, err)
+	settler.unreplicated.Store(0)
+	res, err = client.Drain(ctx, &api.DrainRequest{TimeoutMs: 1000})
+	require.NoError(t, err)
+	require.True(t, res.Settled)
+	require.True(t, drain.Drained())
+}
+
+type settler struct {
+	unreplicated atomic.Uint64
+}
+
+func (s *settler) Unreplicated() uint64 {
+	return s.unreplicated.Load()
+}
+
 func setupTest(t *testing.T, fn func(*Config)) (
 	client api.LogClient,
 	cfg *Config,
@@ -83,7 +278,8 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	require.NoError(t, err)
 
 	cfg = &Config{
-		CommitLog: clog,
+		CommitLog:    clog,
+		OffsetGetter: clog,
 	}
 	if fn != nil {
 		fn(cfg)
@@ -213,10 +409,817 @@ func testProduceConsumeStream(
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			// the log stamps records with the time it appended them
+			require.NotZero(t, res.Record.Timestamp)
 		}
 	}
 }
+
+
+func testGetOffsets(t *testing.T, client api.LogClient, config *Config) {
+	t.Helper()
+
+	ctx := context.Background()
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.EndOffset)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	offsets, err = client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.LowestOffset)
+	require.Equal(t, uint64(1), offsets.EndOffset)
+	// a log that isn't replicated commits what it appends
+	require.Equal(t, uint64(1), offsets.LogEndOffset)
+}
+
+func testLinearizableConsume(t *testing.T, client api.LogClient, config *Config) {
+	t.Helper()
+
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	req := &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		Consistency: api.ConsumeRequest_LINEARIZABLE,
+	}
+	// a log that isn't replicated is always up to date
+	_, err = client.Consume(ctx, req)
+	require.NoError(t, err)
+
+	config.LeaderVerifier = notLeader{}
+	_, err = client.Consume(ctx, req)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// default reads don't check
+	req.Consistency = api.ConsumeRequest_DEFAULT
+	_, err = client.Consume(ctx, req)
+	require.NoError(t, err)
+}
+
+type notLeader struct{}
+
+func (notLeader) VerifyLeader() error {
+	return api.ErrNotLeader{LeaderAddr: "127.0.0.1:0"}
+}
+
+func testAuditAdminActions(t *testing.T, client api.LogClient, config *Config) {
+	t.Helper()
+
+	ctx := context.Background()
+	_, err := client.ListAuditEvents(ctx, &api.ListAuditEventsRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	config.MemberManager = members{}
+	config.AuditLog = &auditLog{}
+	_, err = client.RemoveMember(ctx, &api.RemoveMemberRequest{Id: "node-1"})
+	require.NoError(t, err)
+	_, err = client.RemoveMember(ctx, &api.RemoveMemberRequest{Id: "unknown"})
+	require.Error(t, err)
+
+	res, err := client.ListAuditEvents(ctx, &api.ListAuditEventsRequest{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, res.Events, 1)
+	event := res.Events[0]
+	require.Equal(t, "remove_member", event.Action)
+	require.Equal(t, "unknown", event.Resource)
+	require.False(t, event.Allowed)
+	require.NotEmpty(t, event.Error)
+	// the client's certificate identifies it
+	require.NotEmpty(t, event.Principal)
+	require.NotEmpty(t, event.Addr)
+}
+
+func TestReplicaIdentity(t *testing.T) {
+	leader, err := log.NewReplicatedLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer leader.Remove()
+
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.ReplicaFetcher = leader
+		c.ReplicationDescriber = leader
+		c.ReplicaMembers = replicaMembers{"client"}
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// the client's certificate names a member, but not the replica it claims
+	_, err = client.Fetch(ctx, &api.FetchRequest{ReplicaId: "follower-0", Epoch: 100})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.NoError(t, leader.CheckLeader())
+	res, err := client.DescribeReplication(ctx, &api.DescribeReplicationRequest{})
+	require.NoError(t, err)
+	require.Empty(t, res.Replication.Replicas)
+
+	// nor can it fetch once it's no longer a member
+	client, _, teardown = setupTest(t, func(c *Config) {
+		c.ReplicaFetcher = leader
+		c.ReplicaMembers = replicaMembers{"follower-0"}
+	})
+	defer teardown()
+	_, err = client.Fetch(ctx, &api.FetchRequest{ReplicaId: "client", Epoch: 100})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.NoError(t, leader.CheckLeader())
+
+	client, _, teardown = setupTest(t, func(c *Config) {
+		c.ReplicaFetcher = leader
+		c.ReplicationDescriber = leader
+		c.ReplicaMembers = replicaMembers{"client"}
+	})
+	defer teardown()
+	_, err = client.Fetch(ctx, &api.FetchRequest{ReplicaId: "client"})
+	require.NoError(t, err)
+	res, err = client.DescribeReplication(ctx, &api.DescribeReplicationRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Replication.Replicas, 1)
+}
+
+// the members whose certificates may fetch
+type replicaMembers []string
+
+func (m replicaMembers) IsMember(name string) bool {
+	return slices.Contains(m, name)
+}
+
+type members struct{}
+
+func (members) Members() ([]*api.Member, error) {
+	return nil, nil
+}
+
+func (members) RemoveMember(id string) error {
+	if id == "unknown" {
+		return status.Error(codes.NotFound, "no such member")
+	}
+	return nil
+}
+
+type auditLog struct {
+	events []*api.AuditEvent
+}
+
+func (l *auditLog) Record(e *api.AuditEvent) error {
+	l.events = append(l.events, e)
+	return nil
+}
+
+func (l *auditLog) Recent(n int) ([]*api.AuditEvent, error) {
+	if len(l.events) > n {
+		return l.events[len(l.events)-n:], nil
+	}
+	return l.events, nil
+}
+
+func testAdminToken(t *testing.T, client api.LogClient, config *Config) {
+	t.Helper()
+
+	audit := &auditLog{}
+	config.MemberManager = members{}
+	config.AuditLog = audit
+	config.TokenVerifier = tokenVerifier{}
+	req := &api.RemoveMemberRequest{Id: "node-1"}
+
+	_, err := client.RemoveMember(context.Background(), req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer forged")
+	_, err = client.RemoveMember(ctx, req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer valid")
+	_, err = client.RemoveMember(ctx, req)
+	require.NoError(t, err)
+
+	require.Len(t, audit.events, 3)
+	require.Equal(t, "authenticate", audit.events[0].Action)
+	require.False(t, audit.events[1].Allowed)
+	// the token identifies who acted
+	require.Equal(t, "remove_member", audit.events[2].Action)
+	require.Equal(t, "ops@example.com", audit.events[2].Principal)
+}
+
+type tokenVerifier struct{}
+
+func (tokenVerifier) Verify(ctx context.Context, rawToken string) (string, error) {
+	if rawToken != "valid" {
+		return "", errors.New("bad signature")
+	}
+	return "ops@example.com", nil
+}
+
+func (tokenVerifier) Issuer() string {
+	return "https://sso.example.com"
+}
+
+func testAPIKeyScopes(t *testing.T, client api.LogClient, config *Config) {
+	t.Helper()
+
+	keys, err := apikey.New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		keys.Close()
+	})
+	audit := &auditLog{}
+	config.APIKeys = keys
+	config.AuditLog = audit
+	ctx := context.Background()
+
+	res, err := client.CreateAPIKey(ctx, &api.CreateAPIKeyRequest{
+		Name:   "dashboard",
+		Scopes: []string{apikey.ScopeConsume},
+	})
+	require.NoError(t, err)
+	withKey := metadata.AppendToOutgoingContext(ctx, "x-api-key", res.Token)
+
+	_, err = client.GetOffsets(withKey, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	_, err = client.Produce(withKey, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.ListAPIKeys(withKey, &api.ListAPIKeysRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	event := audit.events[len(audit.events)-1]
+	require.Equal(t, "authorize", event.Action)
+	require.Equal(t, "dashboard", event.Principal)
+
+	_, err = client.RevokeAPIKey(ctx, &api.RevokeAPIKeyRequest{Id: res.Key.Id})
+	require.NoError(t, err)
+	_, err = client.GetOffsets(withKey, &api.GetOffsetsRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	list, err := client.ListAPIKeys(ctx, &api.ListAPIKeysRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Keys, 1)
+	require.True(t, list.Keys[0].Revoked)
+}
+
+func testSlowRequests(t *testing.T, client api.LogClient, config *Config) {
+	t.Helper()
+
+	core, logs := observer.New(zap.WarnLevel)
+	config.Logger = zap.New(core)
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Zero(t, logs.Len())
+
+	config.SlowRequestThreshold = time.Nanosecond
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	require.Equal(t, "consume", fields["rpc"])
+	require.Equal(t, uint64(0), fields["offset"])
+	require.Equal(t, int64(11), fields["bytes"])
+	require.Equal(t, "client", fields["principal"])
+	require.NotEmpty(t, fields["peer"])
+}
+
+func testDescribeSegments(t *testing.T, client api.LogClient, config *Config) {
+	t.Helper()
+
+	ctx := context.Background()
+	_, err := client.DescribeSegments(ctx, &api.DescribeSegmentsRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	config.SegmentDescriber = config.CommitLog.(*log.Log)
+	for i := 0; i < 2; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	res, err := client.DescribeSegments(ctx, &api.DescribeSegmentsRequest{IndexEntries: true})
+	require.NoError(t, err)
+	require.Len(t, res.Segments, 1)
+	require.Equal(t, uint64(2), res.Segments[0].NextOffset)
+	require.True(t, res.Segments[0].Active)
+	require.Len(t, res.IndexEntries, 2)
+	require.Equal(t, uint32(1), res.IndexEntries[1].RelativeOffset)
+	require.Greater(t, res.IndexEntries[1].Position, uint64(0))
+
+	_, err = client.DescribeSegments(ctx, &api.DescribeSegmentsRequest{IndexEntries: true, BaseOffset: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testDescribeLog(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.DescribeLog(ctx, &api.DescribeLogRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	config.LogDescriber = config.CommitLog.(*log.Log)
+	res, err := client.DescribeLog(ctx, &api.DescribeLogRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Log.LogEndOffset)
+	require.Zero(t, res.Log.NewestTimestamp)
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	res, err = client.DescribeLog(ctx, &api.DescribeLogRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Log.HighWatermark)
+	require.Equal(t, uint64(2), res.Log.LogEndOffset)
+	require.Equal(t, uint32(1), res.Log.Segments)
+	require.Greater(t, res.Log.SizeBytes, uint64(0))
+	require.Empty(t, res.Log.LeaderId)
+}
+
+func testWriteFence(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	fence := &writeFence{}
+	config.WriteFence = fence
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+	_, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+
+	fence.err = status.Error(codes.ResourceExhausted, "the disk's full")
+	_, err = client.Produce(ctx, req)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+}
+
+func testRedact(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Redact(ctx, &api.RedactRequest{EndOffset: 1})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	audit := &auditLog{}
+	config.AuditLog = audit
+	config.Redactor = redactor{config.CommitLog.(*log.Log)}
+	for _, key := range []string{"alice", "bob"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Key: []byte(key), Value: []byte("hello " + key)},
+		})
+		require.NoError(t, err)
+	}
+
+	_, err = client.Redact(ctx, &api.RedactRequest{StartOffset: 1, EndOffset: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Redact(ctx, &api.RedactRequest{StartKey: []byte("b"), EndKey: []byte("a")})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	res, err := client.Redact(ctx, &api.RedactRequest{StartKey: []byte("bob")})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, res.Offsets)
+	consumed, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Empty(t, consumed.Record.Key)
+	require.Empty(t, consumed.Record.Value)
+	require.NotZero(t, consumed.Record.Redacted)
+	consumed, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello alice"), consumed.Record.Value)
+
+	// the erased keys aren't audited
+	require.Len(t, audit.events, 1)
+	require.Equal(t, "redact", audit.events[0].Action)
+	require.Equal(t, "key range: 1 records", audit.events[0].Resource)
+
+	// read-only nodes don't append redactions
+	config.ReadOnly = &ReadOnly{}
+	_, err = client.SetReadOnly(ctx, &api.SetReadOnlyRequest{ReadOnly: true, Reason: "migrating"})
+	require.NoError(t, err)
+	_, err = client.Redact(ctx, &api.RedactRequest{StartKey: []byte("alice")})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	consumed, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello alice"), consumed.Record.Value)
+	require.False(t, audit.events[len(audit.events)-1].Allowed)
+}
+
+func testLanes(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+
+	config.Lanes = NewLanes(1)
+	// a backfill holds the only slot
+	require.NoError(t, config.Lanes.acquire(ctx, api.ConsumeRequest_BULK))
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = client.Consume(waitCtx, &api.ConsumeRequest{Offset: 0, Priority: api.ConsumeRequest_HIGH})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// so does finding where a replay starts, even when it sends nothing
+	waitCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	stream, err := client.Replay(waitCtx, &api.ReplayRequest{
+		StartTime: time.Now().Add(time.Hour).UnixNano(),
+		Priority:  api.ConsumeRequest_HIGH,
+	})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	config.Lanes.release()
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, Priority: api.ConsumeRequest_HIGH})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+	stream, err = client.Replay(ctx, &api.ReplayRequest{EndOffset: 1, Priority: api.ConsumeRequest_BULK})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+}
+
+// redacts the records in the request's offsets, or with its start key, on a
+// log that isn't replicated
+type redactor struct {
+	log *log.Log
+}
+
+func (r redactor) Redact(req *api.RedactRequest) (*api.RedactResponse, error) {
+	res := &api.RedactResponse{}
+	for off := uint64(0); off < r.log.NextOffset(); off++ {
+		record, err := r.log.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		if len(req.StartKey) > 0 && !bytes.Equal(record.Key, req.StartKey) ||
+			len(req.StartKey) == 0 && (off < req.StartOffset || off >= req.EndOffset) {
+			continue
+		}
+		if ok, err := r.log.Redact(off); err != nil || !ok {
+			return nil, err
+		}
+		res.Offsets = append(res.Offsets, off)
+	}
+	return res, nil
+}
+
+type writeFence struct {
+	err error
+}
+
+func (f *writeFence) Err() error {
+	return f.err
+}
+
+func testReadOnly(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.SetReadOnly(ctx, &api.SetReadOnlyRequest{ReadOnly: true})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	config.ReadOnly = &ReadOnly{}
+	config.LogDescriber = config.CommitLog.(*log.Log)
+	produce := func() error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		return err
+	}
+	require.NoError(t, produce())
+
+	_, err = client.SetReadOnly(ctx, &api.SetReadOnlyRequest{ReadOnly: true, Reason: "migrating"})
+	require.NoError(t, err)
+	err = produce()
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.ErrorContains(t, err, "migrating")
+	// consumers carry on
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := client.DescribeLog(ctx, &api.DescribeLogRequest{})
+	require.NoError(t, err)
+	require.True(t, res.Log.ReadOnly)
+	require.Equal(t, "migrating", res.Log.ReadOnlyReason)
+
+	_, err = client.SetReadOnly(ctx, &api.SetReadOnlyRequest{})
+	require.NoError(t, err)
+	require.NoError(t, produce())
+	res, err = client.DescribeLog(ctx, &api.DescribeLogRequest{})
+	require.NoError(t, err)
+	require.False(t, res.Log.ReadOnly)
+	require.Empty(t, res.Log.ReadOnlyReason)
+}
+
+func testConsumeStreamTail(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	// the tail holds different values than the log, to tell where records
+	// were read from
+	tail := NewTail(2)
+	for off := uint64(0); off < 3; off++ {
+		tail.Append(off, &api.Record{Value: []byte(fmt.Sprintf("tail %d", off)), Offset: off})
+	}
+	tail.Commit(3)
+	config.Tail = tail
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for _, want := range []string{"record 0", "tail 1", "tail 2"} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, string(res.Record.Value))
+	}
+
+	// the caught up stream's woken by the commit
+	tail.Append(3, &api.Record{Value: []byte("tail 3"), Offset: 3})
+	tail.Commit(4)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "tail 3", string(res.Record.Value))
+	require.Equal(t, uint64(3), res.Record.Offset)
+}
+
+func testConsumeStreamFilter(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i, level := range []string{"info", "error", "info", "error"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf(`{"level": %q, "n": %d}`, level, i))},
+		})
+		require.NoError(t, err)
+	}
+	// the newest records are matched from the tail
+	tail := NewTail(2)
+	for off := uint64(2); off < 4; off++ {
+		record, err := config.CommitLog.Read(off)
+		require.NoError(t, err)
+		tail.Append(off, record)
+	}
+	tail.Commit(4)
+	config.Tail = tail
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Filter: `json.level == "error"`})
+	require.NoError(t, err)
+	for _, want := range []uint64{1, 3} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+	}
+
+	// a stream with an end ends even when the last records don't match
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Filter: `json.n == 0`, EndOffset: 4})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Filter: `json.level ==`})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Filter: `true`})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+type transformFunc func(value []byte) ([]byte, bool, error)
+
+func (f transformFunc) Transform(ctx context.Context, value []byte) ([]byte, bool, error) {
+	return f(value)
+}
+
+func testTransforms(t *testing.T, client api.LogClient, config *Config) {
+	config.ProduceTransformer = transformFunc(func(value []byte) ([]byte, bool, error) {
+		if string(value) == "reject" {
+			return nil, false, nil
+		}
+		return append(value, "!"...), true, nil
+	})
+	config.ConsumeTransformer = transformFunc(func(value []byte) ([]byte, bool, error) {
+		if string(value) == "drop!" {
+			return nil, false, nil
+		}
+		return bytes.ToUpper(value), true, nil
+	})
+	ctx := context.Background()
+	for _, value := range []string{"hello", "drop", "world"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+	}
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("reject")}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the log holds what the produce transform returned
+	record, err := config.CommitLog.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "hello!", string(record.Value))
+
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, "HELLO!", string(res.Record.Value))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{EndOffset: 3})
+	require.NoError(t, err)
+	for _, want := range []string{"HELLO!", "WORLD!"} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, string(res.Record.Value))
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func testTransactions(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	coordinator, err := txn.New(config.CommitLog.(txn.Log), txn.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { coordinator.Close() })
+	config.Transactions = coordinator
+
+	produce := func(value, id string) {
+		t.Helper()
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value), TransactionId: id},
+		})
+		require.NoError(t, err)
+	}
+	produce("before", "")
+	begin, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	committed := begin.TransactionId
+	produce("a", committed)
+	produce("b", committed)
+	produce("outside", "")
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:    0,
+		Isolation: api.ConsumeRequest_READ_COMMITTED,
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "before", string(res.Record.Value))
+
+	// the open transaction holds back its records and the ones after them
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 3, Isolation: api.ConsumeRequest_READ_COMMITTED})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	end, err := client.CommitTransaction(ctx, &api.EndTransactionRequest{TransactionId: committed})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), end.Offset)
+
+	begin, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	produce("aborted", begin.TransactionId)
+	_, err = client.AbortTransaction(ctx, &api.EndTransactionRequest{TransactionId: begin.TransactionId})
+	require.NoError(t, err)
+	produce("after", "")
+
+	for _, want := range []string{"a", "b", "outside", "after"} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, string(res.Record.Value))
+	}
+
+	// read uncommitted consumers see everything, markers included
+	res2, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 4})
+	require.NoError(t, err)
+	require.Equal(t, api.Record_COMMIT, res2.Record.Control)
+	for _, off := range []uint64{4, 5, 6} {
+		_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: off, Isolation: api.ConsumeRequest_READ_COMMITTED})
+		require.Equal(t, codes.NotFound, status.Code(err), off)
+	}
+
+	// replays filter them the same way, and stop at the open transactions
+	begin, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	produce("open", begin.TransactionId)
+	produce("held", "")
+	replay := func(isolation api.ConsumeRequest_Isolation) []string {
+		t.Helper()
+		stream, err := client.Replay(ctx, &api.ReplayRequest{Isolation: isolation})
+		require.NoError(t, err)
+		var values []string
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return values
+			}
+			require.NoError(t, err)
+			values = append(values, string(res.Record.Value))
+		}
+	}
+	require.Equal(t, []string{"before", "a", "b", "outside", "after"}, replay(api.ConsumeRequest_READ_COMMITTED))
+	require.Equal(t, []string{"before", "a", "b", "outside", "", "aborted", "", "after", "open", "held"}, replay(api.ConsumeRequest_READ_UNCOMMITTED))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("late"), TransactionId: committed},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{TransactionId: committed, Control: api.Record_COMMIT},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testDeduplication(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce := func(id string) (uint64, error) {
+		res, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(id), MessageId: id},
+		})
+		return res.GetOffset(), err
+	}
+	_, err := produce("a")
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	store, err := dedup.New(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	config.Deduplicator = store
+	for want, id := range []string{"a", "b"} {
+		for range 2 {
+			off, err := produce(id)
+			require.NoError(t, err)
+			require.Equal(t, uint64(want), off)
+		}
+	}
+	_, end, err := config.OffsetGetter.GetOffsets()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), end)
+}
+
+func testReplay(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	appended := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 6 {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{
+			Value:     []byte(fmt.Sprint(i)),
+			Timestamp: appended.Add(time.Duration(i) * time.Second).UnixNano(),
+		}})
+		require.NoError(t, err)
+	}
+	replay := func(req *api.ReplayRequest) []string {
+		t.Helper()
+		stream, err := client.Replay(ctx, req)
+		require.NoError(t, err)
+		var values []string
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return values
+			}
+			require.NoError(t, err)
+			values = append(values, string(res.Record.Value))
+		}
+	}
+
+	start := time.Now()
+	require.Equal(t, []string{"1", "2", "3"}, replay(&api.ReplayRequest{
+		StartOffset:      1,
+		EndOffset:        4,
+		RecordsPerSecond: 20,
+	}))
+	// the first record's sent at once, the others 50ms apart
+	require.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+
+	require.Equal(t, []string{"2", "3"}, replay(&api.ReplayRequest{
+		StartTime: appended.Add(2 * time.Second).UnixNano(),
+		EndTime:   appended.Add(4 * time.Second).UnixNano(),
+	}))
+	require.Equal(t, []string{"5"}, replay(&api.ReplayRequest{StartOffset: 5}))
+	require.Empty(t, replay(&api.ReplayRequest{StartTime: appended.Add(time.Hour).UnixNano()}))
+}
+
+func testGetByKey(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.GetByKey(ctx, &api.GetByKeyRequest{Key: []byte("a")})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	index, err := keyindex.New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { index.Close() })
+	config.KeyIndex = index
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"a", "3"}} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Key: []byte(kv[0]), Value: []byte(kv[1])},
+		})
+		require.NoError(t, err)
+	}
+	// the log isn't replicated, so the test commits what it appended
+	require.NoError(t, index.CatchUp(config.CommitLog.(keyindex.Log)))
+
+	res, err := client.GetByKey(ctx, &api.GetByKeyRequest{Key: []byte("a")})
+	require.NoError(t, err)
+	require.Equal(t, "3", string(res.Record.Value))
+	require.Equal(t, uint64(2), res.Record.Offset)
+	_, err = client.GetByKey(ctx, &api.GetByKeyRequest{Key: []byte("c")})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// logs a Produce or Consume that started at start and took longer than
+// SlowRequestThreshold, with what it read or wrote and who asked, so tail
+// latency outliers can be tied to a client or a record. some are dropped when
+// there are more than SlowRequestsPerSecond
+func (s *grpcServer) logSlow(ctx context.Context, rpc string, start time.Time, offset uint64, size int, err error) {
+	took := time.Since(start)
+	if s.SlowRequestThreshold == 0 || took < s.SlowRequestThreshold || !s.slowLimiter.Allow() {
+		return
+	}
+	fields := []zap.Field{
+		zap.String("rpc", rpc),
+		zap.Duration("took", took),
+		zap.Uint64("offset", offset),
+		zap.Int("bytes", size),
+	}
+	if p, ok := PrincipalFromContext(ctx); ok {
+		fields = append(fields, zap.String("peer", p.Addr), zap.String("principal", p.Subject))
+	}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	s.Logger.Warn("slow request", fields...)
+}
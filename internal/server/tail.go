@@ -0,0 +1,202 @@
+package server
+
+import (
+	"sync"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/grpc/encoding"
+	protoenc "google.golang.org/grpc/encoding/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// the newest records, kept in memory as marshaled ConsumeResponses, so the
+// ConsumeStream calls following the log's head are sent each record as it's
+// committed without each of them reading and marshaling it. streams that fall
+// further behind than the tail holds read the log as usual.
+//
+// the log feeds it through its hooks: Append from OnAppend, Commit from
+// OnCommit, Truncate from OnTruncate and Replace from OnRedact. a log that
+// isn't replicated commits what it appends, so its OnAppend calls Commit with
+// the next offset too
+type Tail struct {
+	mu sync.RWMutex
+	// the responses, the one for offset off at off % len(ring)
+	ring [][]byte
+	// the tail holds the offsets [first, next), the ones below committed can
+	// be sent
+	first, next, committed uint64
+	// closed and replaced when records are committed, so caught up streams wake
+	changed chan struct{}
+	// the records appended past next, held until the ones before them are:
+	// concurrent appends' hooks can run out of order
+	pending map[uint64][]byte
+}
+
+// keeps the newest records records in memory
+func NewTail(records int) *Tail {
+	return &Tail{
+		ring:    make([][]byte, records),
+		changed: make(chan struct{}),
+		pending: make(map[uint64][]byte),
+	}
+}
+
+// marshals the record appended at offset into the tail, evicting the oldest
+// once it's full. concurrent appends' hooks can run out of order: a record past
+// the next offset waits for the ones before it, and a late one right before the
+// oldest is added in front of it while the tail has room. once more records
+// are waiting than the tail holds, the ones before them are taken to be
+// missing, e.g. the log skipped ahead, and the tail starts over from the
+// waiting ones. an offset the tail holds already, appended again without the
+// log being truncated, starts it over too
+func (t *Tail) Append(offset uint64, record *api.Record) {
+	b, err := proto.Marshal(&api.ConsumeResponse{Record: record})
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.first == t.next:
+		t.restart(offset)
+	case offset < t.first:
+		if offset+1 == t.first && t.next-t.first < uint64(len(t.ring)) {
+			t.ring[offset%uint64(len(t.ring))] = b
+			t.first = offset
+		}
+		// streams read older ones from the log
+		return
+	case offset < t.next:
+		// the newer records waiting were appended before it
+		clear(t.pending)
+		t.restart(offset)
+	case offset > t.next:
+		t.pending[offset] = b
+		if len(t.pending) <= len(t.ring) {
+			return
+		}
+		for off := range t.pending {
+			offset = min(offset, off)
+		}
+		b = t.pending[offset]
+		t.restart(offset)
+	}
+	t.push(b)
+	for {
+		b, ok := t.pending[t.next]
+		if !ok {
+			return
+		}
+		delete(t.pending, t.next)
+		t.push(b)
+	}
+}
+
+// empties the tail, the next record pushed is the one appended at offset, and
+// forgets the records waiting before it
+func (t *Tail) restart(offset uint64) {
+	t.first, t.next = offset, offset
+	t.committed = min(t.committed, offset)
+	for off := range t.pending {
+		if off <= offset {
+			delete(t.pending, off)
+		}
+	}
+}
+
+// adds the record at next to the tail
+func (t *Tail) push(b []byte) {
+	t.ring[t.next%uint64(len(t.ring))] = b
+	t.next++
+	if t.next-t.first > uint64(len(t.ring)) {
+		t.first = t.next - uint64(len(t.ring))
+	}
+}
+
+// makes the records below highWatermark available to the streams
+func (t *Tail) Commit(highWatermark uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if highWatermark <= t.committed {
+		return
+	}
+	t.committed = highWatermark
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// swaps the record at offset for the one the log now stores, e.g. once it's
+// redacted, if the tail holds it
+func (t *Tail) Replace(offset uint64, record *api.Record) {
+	b, err := proto.Marshal(&api.ConsumeResponse{Record: record})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.pending[offset]; ok {
+		if err != nil {
+			delete(t.pending, offset)
+		} else {
+			t.pending[offset] = b
+		}
+		return
+	}
+	if offset < t.first || offset >= t.next {
+		return
+	}
+	if err != nil {
+		// streams read it from the log instead
+		t.first = offset + 1
+		return
+	}
+	t.ring[offset%uint64(len(t.ring))] = b
+}
+
+// drops the records in [from, to) the log removed
+func (t *Tail) Truncate(from, to uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if from <= t.first {
+		// the oldest records went, the tail keeps whatever's newer
+		t.first = min(max(t.first, to), t.next)
+		return
+	}
+	// a replica's newest records diverged from its leader's
+	t.next = min(t.next, from)
+	t.committed = min(t.committed, from)
+	for off := range t.pending {
+		if off >= from {
+			delete(t.pending, off)
+		}
+	}
+}
+
+// returns the marshaled response for offset if the tail holds it and it's
+// committed, and a channel that's closed once more records are
+func (t *Tail) get(offset uint64) ([]byte, <-chan struct{}, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if offset < t.first || offset >= t.next || offset >= t.committed {
+		return nil, t.changed, false
+	}
+	return t.ring[offset%uint64(len(t.ring))], t.changed, true
+}
+
+// a message that's already marshaled, the server's codec sends it as is
+type marshaled []byte
+
+// the server's codec, it's the proto codec except that it sends marshaled
+// messages as they are
+type codec struct {
+	encoding.Codec
+}
+
+func newCodec() codec {
+	return codec{encoding.GetCodec(protoenc.Name)}
+}
+
+func (c codec) Marshal(v any) ([]byte, error) {
+	if m, ok := v.(marshaled); ok {
+		return m, nil
+	}
+	return c.Codec.Marshal(v)
+}
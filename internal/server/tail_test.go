@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTail(t *testing.T) {
+	tail := NewTail(3)
+	value := func(off uint64) string {
+		b, _, ok := tail.get(off)
+		if !ok {
+			return ""
+		}
+		res := &api.ConsumeResponse{}
+		require.NoError(t, proto.Unmarshal(b, res))
+		return string(res.Record.Value)
+	}
+	for off := uint64(0); off < 4; off++ {
+		tail.Append(off, &api.Record{Value: []byte(fmt.Sprintf("record %d", off))})
+	}
+	// nothing's sent until it's committed
+	require.Equal(t, "", value(3))
+
+	_, changed, _ := tail.get(3)
+	tail.Commit(4)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("commit didn't wake the streams")
+	}
+	// the oldest record was evicted
+	require.Equal(t, "", value(0))
+	for off := uint64(1); off < 4; off++ {
+		require.Equal(t, fmt.Sprintf("record %d", off), value(off))
+	}
+
+	// retention removed the oldest segment
+	tail.Truncate(0, 2)
+	require.Equal(t, "", value(1))
+	require.Equal(t, "record 2", value(2))
+
+	// the newest record diverged from the leader's
+	tail.Truncate(3, 4)
+	require.Equal(t, "", value(3))
+	tail.Append(3, &api.Record{Value: []byte("leader's 3")})
+	require.Equal(t, "", value(3))
+	tail.Commit(4)
+	require.Equal(t, "leader's 3", value(3))
+	require.Equal(t, "record 2", value(2))
+}
+
+func TestTailOutOfOrder(t *testing.T) {
+	tail := NewTail(4)
+	value := func(off uint64) string {
+		b, _, ok := tail.get(off)
+		if !ok {
+			return ""
+		}
+		res := &api.ConsumeResponse{}
+		require.NoError(t, proto.Unmarshal(b, res))
+		return string(res.Record.Value)
+	}
+	record := func(off uint64) *api.Record {
+		return &api.Record{Value: []byte(fmt.Sprintf("record %d", off))}
+	}
+	// the hooks of concurrent appends ran out of order
+	for _, off := range []uint64{0, 2, 3, 1} {
+		tail.Append(off, record(off))
+	}
+	tail.Commit(4)
+	for off := uint64(0); off < 4; off++ {
+		require.Equal(t, fmt.Sprintf("record %d", off), value(off))
+	}
+
+	// the records before the waiting ones never come, e.g. the log skipped
+	// ahead, so once more are waiting than the tail holds it starts over
+	for off := uint64(10); off < 15; off++ {
+		tail.Append(off, record(off))
+	}
+	tail.Commit(15)
+	require.Equal(t, "", value(3))
+	require.Equal(t, "", value(10))
+	for off := uint64(11); off < 15; off++ {
+		require.Equal(t, fmt.Sprintf("record %d", off), value(off))
+	}
+}
+
+func TestTailConcurrentAppends(t *testing.T) {
+	const goroutines, appends = 16, 500
+	tail := NewTail(goroutines*appends + 1)
+	c := log.Config{}
+	c.Hooks.OnAppend = tail.Append
+	clog, err := log.NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		clog.Close()
+	})
+
+	// the tail starts from the first record it's fed, it's fed one alone so
+	// none of the concurrent ones can come before it
+	_, err = clog.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < appends; i++ {
+				_, err := clog.Append(&api.Record{Value: []byte(fmt.Sprintf("%d-%d", g, i))})
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	tail.Commit(clog.NextOffset())
+
+	// the tail holds every record, each at its offset
+	for off := uint64(0); off <= goroutines*appends; off++ {
+		b, _, ok := tail.get(off)
+		require.True(t, ok, "offset %d", off)
+		res := &api.ConsumeResponse{}
+		require.NoError(t, proto.Unmarshal(b, res))
+		record, err := clog.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, res.Record.Value)
+	}
+}
@@ -0,0 +1,425 @@
+// receives syslog messages and appends each to the log as a record, so servers
+// can ship their logs to proglog like to any remote syslog sink
+
+// Messages are RFC 5424 ones, over UDP one per datagram (RFC 5426) and over TCP
+// or TLS (RFC 5425) either octet counted, "<length> <message>", or one per line
+// (RFC 6587). Each's appended as its parsed fields encoded as JSON, see Message.
+// Messages that don't parse are dropped, and so are those the log won't take, as
+// syslog has no way to tell the sender: only the leader appends, so senders
+// should be pointed at it.
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// the longest message taken, longer ones close the connection they're sent on
+const maxMessageBytes = 64 << 10
+
+// what the messages are appended to
+type Appender interface {
+	Append(*api.Record) (uint64, error)
+}
+
+type Config struct {
+	// the addresses to listen on, none's listened on when empty
+	UDPAddr string
+	TCPAddr string
+	TLSAddr string
+	// secures the connections to TLSAddr
+	TLSConfig *tls.Config
+	Appender  Appender
+	// nothing's logged when nil
+	Logger *zap.Logger
+	// registers the messages' counts when set
+	Registerer prometheus.Registerer
+}
+
+type Server struct {
+	Config
+
+	udp       net.PacketConn
+	listeners []net.Listener
+	messages  *prometheus.CounterVec
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// listens on the config's addresses and serves them until Close
+func New(config Config) (*Server, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.TLSAddr != "" && config.TLSConfig == nil {
+		return nil, errors.New("syslog: listening for TLS needs a TLS config")
+	}
+	s := &Server{
+		Config: config,
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "syslog",
+			Name:      "messages_total",
+			Help:      "Syslog messages received, by whether they were appended, malformed or failed to append.",
+		}, []string{"result"}),
+		conns: map[net.Conn]struct{}{},
+	}
+	if s.Registerer != nil {
+		if err := s.Registerer.Register(s.messages); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.listen(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.udp != nil {
+		s.wg.Add(1)
+		go s.serveUDP()
+	}
+	for _, ln := range s.listeners {
+		s.wg.Add(1)
+		go s.serveStream(ln)
+	}
+	return s, nil
+}
+
+func (s *Server) listen() error {
+	var err error
+	if s.UDPAddr != "" {
+		if s.udp, err = net.ListenPacket("udp", s.UDPAddr); err != nil {
+			return err
+		}
+	}
+	if s.TCPAddr != "" {
+		ln, err := net.Listen("tcp", s.TCPAddr)
+		if err != nil {
+			return err
+		}
+		s.listeners = append(s.listeners, ln)
+	}
+	if s.TLSAddr != "" {
+		ln, err := net.Listen("tcp", s.TLSAddr)
+		if err != nil {
+			return err
+		}
+		s.listeners = append(s.listeners, tls.NewListener(ln, s.TLSConfig))
+	}
+	return nil
+}
+
+// the addresses listened on, empty for those that aren't, e.g. to find the
+// ports picked for ":0"
+func (s *Server) Addrs() (udp, tcp, tlsAddr string) {
+	if s.udp != nil {
+		udp = s.udp.LocalAddr().String()
+	}
+	i := 0
+	if s.TCPAddr != "" {
+		tcp = s.listeners[i].Addr().String()
+		i++
+	}
+	if s.TLSAddr != "" {
+		tlsAddr = s.listeners[i].Addr().String()
+	}
+	return udp, tcp, tlsAddr
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxMessageBytes)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.Logger.Error("failed to read a datagram", zap.Error(err))
+			}
+			return
+		}
+		s.append(buf[:n])
+	}
+}
+
+func (s *Server) serveStream(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.Logger.Error("failed to accept a connection", zap.Error(err))
+			}
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReaderSize(conn, maxMessageBytes)
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.Logger.Warn(
+					"closing the connection",
+					zap.String("remote_addr", conn.RemoteAddr().String()),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+		s.append(frame)
+	}
+}
+
+// reads the next message off a stream, whichever way it's framed. empty lines
+// are skipped
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] >= '1' && b[0] <= '9' {
+			// octet counted, messages start with '<' so they can't be confused
+			length, err := r.ReadSlice(' ')
+			if err != nil {
+				return nil, fmt.Errorf("reading a message's length: %w", err)
+			}
+			n, err := strconv.Atoi(string(length[:len(length)-1]))
+			if err != nil {
+				return nil, fmt.Errorf("reading a message's length: %w", err)
+			}
+			if n > maxMessageBytes {
+				return nil, fmt.Errorf("message of %d bytes is over %d", n, maxMessageBytes)
+			}
+			frame := make([]byte, n)
+			if _, err := io.ReadFull(r, frame); err != nil {
+				return nil, err
+			}
+			return frame, nil
+		}
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, fmt.Errorf("message is over %d bytes", maxMessageBytes)
+		}
+		if err == io.EOF && len(line) > 0 {
+			// the last message needn't end with a newline
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+			// the reader reuses its buffer
+			return bytes.Clone(line), nil
+		}
+	}
+}
+
+func (s *Server) append(b []byte) {
+	m, err := Parse(b)
+	if err != nil {
+		s.messages.WithLabelValues("malformed").Inc()
+		s.Logger.Debug("dropped a malformed message", zap.Error(err))
+		return
+	}
+	value, err := json.Marshal(m)
+	if err != nil {
+		s.messages.WithLabelValues("malformed").Inc()
+		return
+	}
+	if _, err := s.Appender.Append(&api.Record{Value: value}); err != nil {
+		s.messages.WithLabelValues("failed").Inc()
+		s.Logger.Warn("failed to append a message", zap.Error(err))
+		return
+	}
+	s.messages.WithLabelValues("appended").Inc()
+}
+
+// stops listening, closes the open connections and waits for the messages
+// they're appending
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	var errs []error
+	if s.udp != nil {
+		errs = append(errs, s.udp.Close())
+	}
+	for _, ln := range s.listeners {
+		errs = append(errs, ln.Close())
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// a syslog message's fields, as they're appended. the nil value, "-", leaves a
+// field out
+type Message struct {
+	Facility       int                          `json:"facility"`
+	Severity       int                          `json:"severity"`
+	Timestamp      *time.Time                   `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	AppName        string                       `json:"app_name,omitempty"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Message        string                       `json:"message,omitempty"`
+}
+
+// parses an RFC 5424 message:
+//
+//	<PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func Parse(b []byte) (*Message, error) {
+	m := &Message{}
+	if len(b) == 0 || b[0] != '<' {
+		return nil, errors.New("syslog: message doesn't start with a priority")
+	}
+	end := bytes.IndexByte(b, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("syslog: malformed priority")
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri > 191 {
+		return nil, errors.New("syslog: malformed priority")
+	}
+	m.Facility, m.Severity = pri/8, pri%8
+	b = b[end+1:]
+
+	version, b := field(b)
+	if version != "1" {
+		return nil, fmt.Errorf("syslog: unsupported version %q", version)
+	}
+	timestamp, b := field(b)
+	if timestamp != "" {
+		t, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("syslog: malformed timestamp: %w", err)
+		}
+		m.Timestamp = &t
+	}
+	m.Hostname, b = field(b)
+	m.AppName, b = field(b)
+	m.ProcID, b = field(b)
+	m.MsgID, b = field(b)
+	if m.StructuredData, b, err = parseStructuredData(b); err != nil {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if b[0] != ' ' {
+			return nil, errors.New("syslog: malformed structured data")
+		}
+		m.Message = string(bytes.TrimPrefix(b[1:], []byte("\xef\xbb\xbf")))
+	}
+	return m, nil
+}
+
+// the header field b starts with, "" for the nil value, and what follows it
+func field(b []byte) (string, []byte) {
+	end := bytes.IndexByte(b, ' ')
+	if end < 0 {
+		end = len(b)
+	}
+	f := string(b[:end])
+	if end < len(b) {
+		end++
+	}
+	if f == "-" {
+		f = ""
+	}
+	return f, b[end:]
+}
+
+// parses the structured data elements, [id name="value" ...], b starts with
+func parseStructuredData(b []byte) (map[string]map[string]string, []byte, error) {
+	if len(b) > 0 && b[0] == '-' {
+		return nil, b[1:], nil
+	}
+	malformed := errors.New("syslog: malformed structured data")
+	sd := map[string]map[string]string{}
+	for len(b) > 0 && b[0] == '[' {
+		end := bytes.IndexAny(b, " ]")
+		if end < 2 {
+			return nil, nil, malformed
+		}
+		id := string(b[1:end])
+		b = b[end:]
+		params := map[string]string{}
+		for len(b) > 0 && b[0] == ' ' {
+			eq := bytes.IndexByte(b, '=')
+			if eq < 2 || eq+1 >= len(b) || b[eq+1] != '"' {
+				return nil, nil, malformed
+			}
+			name := string(b[1:eq])
+			b = b[eq+2:]
+			var value []byte
+			closed := false
+			for i := 0; i < len(b) && !closed; i++ {
+				switch {
+				case b[i] == '\\' && i+1 < len(b) && bytes.IndexByte([]byte(`"\]`), b[i+1]) >= 0:
+					i++
+					value = append(value, b[i])
+				case b[i] == '"':
+					closed = true
+					b = b[i+1:]
+				default:
+					value = append(value, b[i])
+				}
+			}
+			if !closed {
+				return nil, nil, malformed
+			}
+			params[name] = string(value)
+		}
+		if len(b) == 0 || b[0] != ']' {
+			return nil, nil, malformed
+		}
+		b = b[1:]
+		sd[id] = params
+	}
+	if len(sd) == 0 {
+		return nil, nil, malformed
+	}
+	return sd, b, nil
+}
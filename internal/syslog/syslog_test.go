@@ -0,0 +1,178 @@
+package syslog
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	timestamp := time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC)
+	for scenario, tc := range map[string]struct {
+		message string
+		want    *Message
+	}{
+		"every field": {
+			message: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"][examplePriority@32473 class="high"] An application event log entry...`,
+			want: &Message{
+				Facility:  20,
+				Severity:  5,
+				Timestamp: &timestamp,
+				Hostname:  "mymachine.example.com",
+				AppName:   "evntslog",
+				MsgID:     "ID47",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473":     {"iut": "3", "eventSource": "Application"},
+					"examplePriority@32473": {"class": "high"},
+				},
+				Message: "An application event log entry...",
+			},
+		},
+		"nil values": {
+			message: "<0>1 - - - - - -",
+			want:    &Message{},
+		},
+		"utf-8 message": {
+			message: "<34>1 - host su - - - \xef\xbb\xbf'su root' failed",
+			want: &Message{
+				Facility: 4,
+				Severity: 2,
+				Hostname: "host",
+				AppName:  "su",
+				Message:  "'su root' failed",
+			},
+		},
+		"escaped parameters": {
+			message: `<13>1 - - - - - [id a="\"quoted\"" b="back\\slash" c="\]"]`,
+			want: &Message{
+				Facility: 1,
+				Severity: 5,
+				StructuredData: map[string]map[string]string{
+					"id": {"a": `"quoted"`, "b": `back\slash`, "c": "]"},
+				},
+			},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			got, err := Parse([]byte(tc.message))
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+
+	for scenario, message := range map[string]string{
+		"no priority":             "1 - - - - - -",
+		"priority out of range":   "<192>1 - - - - - -",
+		"BSD syslog":              "<13>Oct 11 22:14:15 mymachine su: 'su root' failed",
+		"malformed timestamp":     "<13>1 yesterday - - - - -",
+		"unterminated parameter":  `<13>1 - - - - - [id a="b]`,
+		"missing structured data": "<13>1 - - - -",
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			_, err := Parse([]byte(message))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestServer(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ClientCertFile,
+		KeyFile:       config.ClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	appender := &appender{}
+	registry := prometheus.NewRegistry()
+	s, err := New(Config{
+		UDPAddr:    "127.0.0.1:0",
+		TCPAddr:    "127.0.0.1:0",
+		TLSAddr:    "127.0.0.1:0",
+		TLSConfig:  serverTLSConfig,
+		Appender:   appender,
+		Registerer: registry,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	udpAddr, tcpAddr, tlsAddr := s.Addrs()
+
+	udp, err := net.Dial("udp", udpAddr)
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("<13>1 - host app - - - over udp"))
+	require.NoError(t, err)
+	appender.wait(t, 1)
+
+	tcp, err := net.Dial("tcp", tcpAddr)
+	require.NoError(t, err)
+	defer tcp.Close()
+	_, err = fmt.Fprint(tcp,
+		"<13>1 - host app - - - one per line\n"+
+			"not syslog\n"+
+			"25 <13>1 - - - - - - counted")
+	require.NoError(t, err)
+	appender.wait(t, 3)
+
+	conn, err := tls.Dial("tcp", tlsAddr, clientTLSConfig)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprint(conn, "27 <13>1 - - - - - - over tls!")
+	require.NoError(t, err)
+	appender.wait(t, 4)
+
+	var got []string
+	for _, record := range appender.records {
+		var m Message
+		require.NoError(t, json.Unmarshal(record.Value, &m))
+		got = append(got, m.Message)
+	}
+	require.Equal(t, []string{"over udp", "one per line", "counted", "over tls!"}, got)
+	require.Equal(t, float64(1), testutil.ToFloat64(s.messages.WithLabelValues("malformed")))
+	require.Equal(t, float64(4), testutil.ToFloat64(s.messages.WithLabelValues("appended")))
+
+	require.NoError(t, s.Close())
+}
+
+type appender struct {
+	mu      sync.Mutex
+	records []*api.Record
+}
+
+func (a *appender) Append(record *api.Record) (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.records = append(a.records, record)
+	return uint64(len(a.records) - 1), nil
+}
+
+func (a *appender) wait(t *testing.T, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.records) == n
+	}, 3*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,77 @@
+// talks to systemd when it supervises the process (Type=notify services), so it
+// knows when the node is up and can restart it if it hangs
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	Ready     = "READY=1"
+	Stopping  = "STOPPING=1"
+	Watchdog  = "WATCHDOG=1"
+	socketEnv = "NOTIFY_SOCKET"
+)
+
+// sends the state to systemd, it's a no-op returning false when the process
+// isn't run by systemd
+func Notify(state string) (bool, error) {
+	socket := os.Getenv(socketEnv)
+	if socket == "" {
+		return false, nil
+	}
+	// a leading @ names a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: socket,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// returns how often systemd expects a watchdog heartbeat, zero when the watchdog
+// is off or meant for another process
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// sends watchdog heartbeats at half the interval systemd expects while healthy
+// reports the process is, until done is closed
+func RunWatchdog(interval time.Duration, healthy func() bool, done <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if healthy() {
+				// a missed heartbeat is retried on the next tick
+				_, _ = Notify(Watchdog)
+			}
+		}
+	}
+}
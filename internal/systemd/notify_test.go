@@ -0,0 +1,63 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv(socketEnv, "")
+	sent, err := Notify(Ready)
+	require.NoError(t, err)
+	require.False(t, sent)
+
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+	t.Setenv(socketEnv, socket)
+
+	sent, err = Notify(Ready)
+	require.NoError(t, err)
+	require.True(t, sent)
+	requireReceived(t, conn, Ready)
+
+	done := make(chan struct{})
+	defer close(done)
+	go RunWatchdog(20*time.Millisecond, func() bool { return true }, done)
+	requireReceived(t, conn, Watchdog)
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	interval, err := WatchdogInterval()
+	require.NoError(t, err)
+	require.Zero(t, interval)
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "1")
+	interval, err = WatchdogInterval()
+	require.NoError(t, err)
+	require.Zero(t, interval)
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	interval, err = WatchdogInterval()
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, interval)
+}
+
+func requireReceived(t *testing.T, conn *net.UnixConn, state string) {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, state, string(b[:n]))
+}
@@ -0,0 +1,156 @@
+// sets up OpenTelemetry's trace and metric exporters for a node: stdout while
+// developing, an OTLP collector in production
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+type Config struct {
+	// none, stdout or otlp, none when empty
+	Exporter string
+	// the OTLP collector's gRPC endpoint, e.g. localhost:4317
+	OTLPEndpoint string
+	// talk to the collector without TLS
+	OTLPInsecure bool
+	// the fraction of traces sampled, traces a client sampled are always kept
+	SampleRatio float64
+	// samples every trace, for debugging
+	AlwaysSample bool
+	// how often metrics are exported, 60s when zero
+	MetricInterval time.Duration
+	// identify the node in the exported telemetry
+	ServiceName string
+	NodeName    string
+	// where the stdout exporter writes, os.Stdout when nil
+	Output io.Writer
+}
+
+// parses the exporter's name, empty meaning none
+func ParseExporter(name string) (string, error) {
+	switch name {
+	case "", ExporterNone:
+		return ExporterNone, nil
+	case ExporterStdout, ExporterOTLP:
+		return name, nil
+	}
+	return "", fmt.Errorf("telemetry: unknown exporter %q, want none, stdout or otlp", name)
+}
+
+// the providers the node's components get their tracers and meters from, no-ops
+// when telemetry is off
+type Telemetry struct {
+	TracerProvider trace.TracerProvider
+	MeterProvider  metric.MeterProvider
+	shutdown       []func(context.Context) error
+}
+
+// builds the providers and makes them OpenTelemetry's global ones, along with
+// the W3C trace context propagator
+func New(ctx context.Context, c Config) (*Telemetry, error) {
+	exporter, err := ParseExporter(c.Exporter)
+	if err != nil {
+		return nil, err
+	}
+	if exporter == ExporterNone {
+		return &Telemetry{
+			TracerProvider: tracenoop.NewTracerProvider(),
+			MeterProvider:  metricnoop.NewMeterProvider(),
+		}, nil
+	}
+	if c.MetricInterval == 0 {
+		c.MetricInterval = time.Minute
+	}
+	if c.Output == nil {
+		c.Output = os.Stdout
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = "proglog"
+	}
+
+	var spans sdktrace.SpanExporter
+	var metrics sdkmetric.Exporter
+	switch exporter {
+	case ExporterStdout:
+		if spans, err = stdouttrace.New(stdouttrace.WithWriter(c.Output)); err != nil {
+			return nil, err
+		}
+		if metrics, err = stdoutmetric.New(stdoutmetric.WithWriter(c.Output)); err != nil {
+			return nil, err
+		}
+	case ExporterOTLP:
+		traceOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(c.OTLPEndpoint)}
+		metricOpts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(c.OTLPEndpoint)}
+		if c.OTLPInsecure {
+			traceOpts = append(traceOpts, otlptracegrpc.WithInsecure())
+			metricOpts = append(metricOpts, otlpmetricgrpc.WithInsecure())
+		}
+		if spans, err = otlptracegrpc.New(ctx, traceOpts...); err != nil {
+			return nil, err
+		}
+		if metrics, err = otlpmetricgrpc.New(ctx, metricOpts...); err != nil {
+			return nil, err
+		}
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", c.ServiceName),
+		attribute.String("service.instance.id", c.NodeName),
+	)
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))
+	if c.AlwaysSample {
+		sampler = sdktrace.AlwaysSample()
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spans),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(res),
+	)
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metrics, sdkmetric.WithInterval(c.MetricInterval))),
+		sdkmetric.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return &Telemetry{
+		TracerProvider: tp,
+		MeterProvider:  mp,
+		shutdown:       []func(context.Context) error{tp.Shutdown, mp.Shutdown},
+	}, nil
+}
+
+// flushes what hasn't been exported yet and stops the exporters
+func (t *Telemetry) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, fn := range t.shutdown {
+		errs = append(errs, fn(ctx))
+	}
+	return errors.Join(errs...)
+}
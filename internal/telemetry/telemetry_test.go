@@ -0,0 +1,48 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTelemetry(t *testing.T) {
+	var out bytes.Buffer
+	tel, err := New(context.Background(), Config{
+		Exporter:     ExporterStdout,
+		AlwaysSample: true,
+		NodeName:     "node-0",
+		Output:       &out,
+	})
+	require.NoError(t, err)
+
+	_, span := tel.TracerProvider.Tracer("test").Start(context.Background(), "produce")
+	span.End()
+	counter, err := tel.MeterProvider.Meter("test").Int64Counter("records")
+	require.NoError(t, err)
+	counter.Add(context.Background(), 3)
+
+	// shutting down flushes the span and the metric
+	require.NoError(t, tel.Shutdown(context.Background()))
+	require.Contains(t, out.String(), `"Name":"produce"`)
+	require.Contains(t, out.String(), `"Name":"records"`)
+	require.Contains(t, out.String(), "node-0")
+
+	// nothing's sampled at a zero ratio
+	out.Reset()
+	tel, err = New(context.Background(), Config{Exporter: ExporterStdout, Output: &out})
+	require.NoError(t, err)
+	_, span = tel.TracerProvider.Tracer("test").Start(context.Background(), "produce")
+	span.End()
+	require.NoError(t, tel.Shutdown(context.Background()))
+	require.NotContains(t, out.String(), `"Name":"produce"`)
+
+	tel, err = New(context.Background(), Config{})
+	require.NoError(t, err)
+	require.NoError(t, tel.Shutdown(context.Background()))
+
+	_, err = ParseExporter("jaeger")
+	require.ErrorContains(t, err, "unknown exporter")
+}
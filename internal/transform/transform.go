@@ -0,0 +1,183 @@
+// runs WASM modules that rewrite records' values, so operators can mask PII on
+// the consume path, or validate and enrich records on the produce path, without
+// forking the server
+//
+// A module exports its memory and two functions:
+//
+//	alloc(size i32) i32                 reserves size bytes for the input, returning where they start
+//	transform(ptr i32, len i32) i64     rewrites the value at ptr
+//
+// transform returns where the new value starts in the high 32 bits and its
+// length in the low ones, or -1 to drop the record: consumers skip it, and
+// producers have it rejected. The host copies the value out before the next
+// call, so a module can reuse its memory on every call. Modules built for WASI
+// (e.g. with GOOS=wasip1 and -buildmode=c-shared) get its imports, without
+// access to the filesystem or the network, and their _initialize function's run
+// first.
+//
+// An instance handles one call at a time, a transformer runs up to MaxInstances
+// of them. A call that traps or runs out of time closes its instance, the next
+// call starts a new one.
+package transform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	wasmapi "github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+type Config struct {
+	// the module's WASM binary
+	Module []byte
+	// how many instances run calls at once, GOMAXPROCS when zero
+	MaxInstances int
+	// how long a call can take, 100ms when zero
+	Timeout time.Duration
+	// caps an instance's memory, in 64KiB pages, 256 (16MiB) when zero
+	MaxMemoryPages uint32
+}
+
+type Transformer struct {
+	Config
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	// the idle instances, and a token for every instance that's running
+	idle  chan *instance
+	slots chan struct{}
+}
+
+type instance struct {
+	module    wasmapi.Module
+	alloc     wasmapi.Function
+	transform wasmapi.Function
+}
+
+// compiles the module and checks it exports what transformers call
+func New(ctx context.Context, config Config) (*Transformer, error) {
+	if config.MaxInstances == 0 {
+		config.MaxInstances = runtime.GOMAXPROCS(0)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 100 * time.Millisecond
+	}
+	if config.MaxMemoryPages == 0 {
+		config.MaxMemoryPages = 256
+	}
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(config.MaxMemoryPages),
+	)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	compiled, err := r.CompileModule(ctx, config.Module)
+	if err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("transform: %w", err)
+	}
+	exports := compiled.ExportedFunctions()
+	for _, name := range []string{"alloc", "transform"} {
+		if _, ok := exports[name]; !ok {
+			r.Close(ctx)
+			return nil, fmt.Errorf("transform: the module doesn't export %s", name)
+		}
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		r.Close(ctx)
+		return nil, errors.New("transform: the module doesn't export its memory")
+	}
+	return &Transformer{
+		Config:   config,
+		runtime:  r,
+		compiled: compiled,
+		idle:     make(chan *instance, config.MaxInstances),
+		slots:    make(chan struct{}, config.MaxInstances),
+	}, nil
+}
+
+// returns the value the module rewrote, ok's false when it dropped the record
+func (t *Transformer) Transform(ctx context.Context, value []byte) (out []byte, ok bool, err error) {
+	in, err := t.get(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+	out, ok, err = in.call(ctx, value)
+	if err != nil {
+		// a trap can leave the instance in any state
+		in.module.Close(context.Background())
+		<-t.slots
+		return nil, false, fmt.Errorf("transform: %w", err)
+	}
+	t.idle <- in
+	return out, ok, nil
+}
+
+// takes an idle instance, or starts one when there's a slot for it
+func (t *Transformer) get(ctx context.Context) (*instance, error) {
+	select {
+	case in := <-t.idle:
+		return in, nil
+	default:
+	}
+	select {
+	case in := <-t.idle:
+		return in, nil
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	module, err := t.runtime.InstantiateModule(
+		ctx,
+		t.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"),
+	)
+	if err != nil {
+		<-t.slots
+		return nil, fmt.Errorf("transform: %w", err)
+	}
+	return &instance{
+		module:    module,
+		alloc:     module.ExportedFunction("alloc"),
+		transform: module.ExportedFunction("transform"),
+	}, nil
+}
+
+func (in *instance) call(ctx context.Context, value []byte) ([]byte, bool, error) {
+	res, err := in.alloc.Call(ctx, uint64(len(value)))
+	if err != nil {
+		return nil, false, err
+	}
+	ptr := uint32(res[0])
+	memory := in.module.Memory()
+	if !memory.Write(ptr, value) {
+		return nil, false, fmt.Errorf("alloc returned %d, outside the module's memory", ptr)
+	}
+	if res, err = in.transform.Call(ctx, uint64(ptr), uint64(len(value))); err != nil {
+		return nil, false, err
+	}
+	if int64(res[0]) == -1 {
+		return nil, false, nil
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	b, ok := memory.Read(outPtr, outLen)
+	if !ok {
+		return nil, false, fmt.Errorf("transform returned %d bytes at %d, outside the module's memory", outLen, outPtr)
+	}
+	// the module reuses its memory on the next call
+	return append([]byte(nil), b...), true, nil
+}
+
+// closes the module's instances, calls in flight fail
+func (t *Transformer) Close(ctx context.Context) error {
+	return t.runtime.Close(ctx)
+}
@@ -0,0 +1,114 @@
+package transform
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransformer(t *testing.T) {
+	ctx := context.Background()
+	tr, err := New(ctx, Config{Module: testModule(), MaxInstances: 2, Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	t.Cleanup(func() { tr.Close(ctx) })
+
+	out, ok, err := tr.Transform(ctx, []byte("secret"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "*ecret", string(out))
+
+	_, ok, err = tr.Transform(ctx, []byte("xdropped"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// traps and calls that run out of time fail, and their instances are
+	// replaced
+	_, _, err = tr.Transform(ctx, []byte("trap"))
+	require.Error(t, err)
+	_, _, err = tr.Transform(ctx, []byte("loop"))
+	require.Error(t, err)
+
+	// more calls than instances wait for one
+	var wg sync.WaitGroup
+	outs := make([]string, 8)
+	for i := range outs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, _, _ := tr.Transform(ctx, []byte("value"))
+			outs[i] = string(out)
+		}()
+	}
+	wg.Wait()
+	for _, out := range outs {
+		require.Equal(t, "*alue", out)
+	}
+}
+
+func TestNewChecksExports(t *testing.T) {
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	_, err := New(context.Background(), Config{Module: module})
+	require.ErrorContains(t, err, "doesn't export alloc")
+	_, err = New(context.Background(), Config{Module: []byte("not wasm")})
+	require.Error(t, err)
+}
+
+// a module that masks a value's first byte with *, drops values starting with
+// x, traps on ones starting with t and spins on ones starting with l. it's
+// assembled by hand so the tests don't need a WASM toolchain
+func testModule() []byte {
+	// checks the value's first byte, running then when it's c
+	ifFirst := func(c byte, then ...byte) []byte {
+		b := []byte{
+			0x02, 0x40, // block
+			0x20, 0x00, // local.get 0
+			0x2d, 0x00, 0x00, // i32.load8_u
+			0x41, c | 0x80, c >> 7, // i32.const c
+			0x47,       // i32.ne
+			0x0d, 0x00, // br_if 0
+		}
+		b = append(b, then...)
+		return append(b, 0x0b) // end
+	}
+	var transform []byte
+	transform = append(transform, ifFirst('x', 0x42, 0x7f, 0x0f)...)             // i64.const -1, return
+	transform = append(transform, ifFirst('t', 0x00)...)                         // unreachable
+	transform = append(transform, ifFirst('l', 0x03, 0x40, 0x0c, 0x00, 0x0b)...) // loop br 0 end
+	transform = append(transform,
+		0x20, 0x00, 0x41, '*', 0x3a, 0x00, 0x00, // i32.store8 ptr '*'
+		0x20, 0x00, 0xad, 0x42, 0x20, 0x86, // i64.extend_i32_u(ptr) << 32
+		0x20, 0x01, 0xad, 0x84, // | i64.extend_i32_u(len)
+		0x0b,
+	)
+	alloc := []byte{0x41, 0x80, 0x08, 0x0b} // i32.const 1024
+
+	section := func(id byte, content ...byte) []byte {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+	body := func(code []byte) []byte {
+		return append([]byte{byte(len(code) + 1), 0x00}, code...)
+	}
+	name := func(s string) []byte {
+		return append([]byte{byte(len(s))}, s...)
+	}
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	module = append(module, section(0x01,
+		0x02,
+		0x60, 0x01, 0x7f, 0x01, 0x7f, // (i32) -> i32
+		0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, // (i32, i32) -> i64
+	)...)
+	module = append(module, section(0x03, 0x02, 0x00, 0x01)...)
+	module = append(module, section(0x05, 0x01, 0x00, 0x01)...)
+	var exports []byte
+	exports = append(exports, 0x03)
+	exports = append(append(exports, name("memory")...), 0x02, 0x00)
+	exports = append(append(exports, name("alloc")...), 0x00, 0x00)
+	exports = append(append(exports, name("transform")...), 0x00, 0x01)
+	module = append(module, section(0x07, exports...)...)
+	code := append([]byte{0x02}, body(alloc)...)
+	code = append(code, body(transform)...)
+	return append(module, section(0x0a, code...)...)
+}
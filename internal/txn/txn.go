@@ -0,0 +1,409 @@
+// coordinates transactions, so a producer can append several records that read
+// committed consumers see all of, or none of
+//
+// A transaction's records are appended to the log as they're produced, carrying
+// its ID, and it ends with a marker record, COMMIT or ABORT, the coordinator
+// appends. Read committed consumers only read up to the stable offset, below
+// which every transaction has ended, and skip the records of aborted ones.
+//
+// The coordinator keeps the open transactions in memory, on the leader, so only
+// the leader's knows the stable offset and serves read committed consumers.
+// Those open when it stops never get a marker, their records are taken as
+// aborted: once a transaction's ended the coordinator remembers how, and
+// otherwise it looks for the marker after the record, giving up once the
+// records are past the longest a transaction can take.
+package txn
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// how many ended transactions' outcomes are remembered
+const maxOutcomes = 10000
+
+// how much later than a transaction can take its marker's looked for, for the
+// coordinator's expiry ticks and clocks that disagree
+const markerGrace = time.Minute
+
+type Log interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
+	GetOffsets() (lowest, end uint64, err error)
+}
+
+// implemented by replicated logs, only the leader's coordinator knows which
+// transactions are open
+type leaderLog interface {
+	CheckLeader() error
+}
+
+type Config struct {
+	// how long a transaction that doesn't say may take, a minute when zero
+	DefaultTimeout time.Duration
+	// the longest a transaction may take, 15m when zero
+	MaxTimeout time.Duration
+	// registers the coordinator's metrics when set
+	Registerer prometheus.Registerer
+}
+
+type Coordinator struct {
+	Config
+	log Log
+
+	mu   sync.Mutex
+	open map[string]*transaction
+	// how the transactions that ended did, true when they were aborted, and
+	// their IDs oldest first, to forget the oldest
+	outcomes map[string]bool
+	ended    []string
+	// for the transactions whose outcome isn't known yet, where Aborted's last
+	// look for their marker reached the log's end, so the next resumes there
+	scanned map[string]uint64
+	// closed and replaced when a transaction ends
+	changed chan struct{}
+
+	transactions *prometheus.CounterVec
+	openGauge    prometheus.GaugeFunc
+
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+type transaction struct {
+	// serializes the transaction's appends and its end, so no record's
+	// appended after its marker
+	mu       sync.Mutex
+	deadline time.Time
+	// the lowest offset its records can be at, once it's appended one. it's
+	// read under the coordinator's lock
+	first    uint64
+	appended bool
+	// the marker an end tried to append, a retry, or the expiry, appends the
+	// same one since the first may have been appended after all
+	decided api.Record_Control
+	ended   bool
+}
+
+func New(log Log, config Config) (*Coordinator, error) {
+	if config.DefaultTimeout == 0 {
+		config.DefaultTimeout = time.Minute
+	}
+	if config.MaxTimeout == 0 {
+		config.MaxTimeout = 15 * time.Minute
+	}
+	if config.DefaultTimeout > config.MaxTimeout {
+		return nil, fmt.Errorf("txn: the default timeout %s is longer than the max %s", config.DefaultTimeout, config.MaxTimeout)
+	}
+	c := &Coordinator{
+		Config:   config,
+		log:      log,
+		open:     make(map[string]*transaction),
+		outcomes: make(map[string]bool),
+		scanned:  make(map[string]uint64),
+		changed:  make(chan struct{}),
+		transactions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "transactions",
+			Name:      "ended_total",
+			Help:      "Transactions that ended, by outcome: committed, aborted or expired.",
+		}, []string{"outcome"}),
+		shutdown: make(chan struct{}),
+	}
+	c.openGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "proglog",
+		Subsystem: "transactions",
+		Name:      "open",
+		Help:      "Transactions that began and haven't ended.",
+	}, func() float64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return float64(len(c.open))
+	})
+	if c.Registerer != nil {
+		for _, collector := range []prometheus.Collector{c.transactions, c.openGauge} {
+			if err := c.Registerer.Register(collector); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c.wg.Add(1)
+	go c.expire()
+	return c, nil
+}
+
+// opens a transaction that's aborted unless it ends within timeout, the
+// default timeout when zero
+func (c *Coordinator) Begin(timeout time.Duration) (string, error) {
+	if timeout == 0 {
+		timeout = c.DefaultTimeout
+	}
+	if timeout > c.MaxTimeout {
+		return "", status.Errorf(codes.InvalidArgument, "transactions can take %s at most", c.MaxTimeout)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	c.mu.Lock()
+	c.open[id] = &transaction{deadline: time.Now().Add(timeout)}
+	c.mu.Unlock()
+	return id, nil
+}
+
+// appends a record of the transaction its TransactionId names
+func (c *Coordinator) Append(record *api.Record) (uint64, error) {
+	t, err := c.get(record.TransactionId)
+	if err != nil {
+		return 0, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended || t.decided != api.Record_DATA {
+		return 0, api.ErrTransactionNotOpen{TransactionId: record.TransactionId}
+	}
+	if !t.appended {
+		// the record can't be appended before the end. records appended
+		// meanwhile may come first, so it's a lower bound for the transaction's
+		// records, which is all the stable offset needs
+		_, end, err := c.log.GetOffsets()
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		t.first, t.appended = end, true
+		c.mu.Unlock()
+	}
+	record.Control = api.Record_DATA
+	return c.log.Append(record)
+}
+
+// appends the transaction's COMMIT marker, and returns its offset, zero when
+// the transaction had no records
+func (c *Coordinator) Commit(id string) (uint64, error) {
+	return c.end(id, api.Record_COMMIT, "committed")
+}
+
+// appends the transaction's ABORT marker, and returns its offset, zero when
+// the transaction had no records
+func (c *Coordinator) Abort(id string) (uint64, error) {
+	return c.end(id, api.Record_ABORT, "aborted")
+}
+
+func (c *Coordinator) end(id string, control api.Record_Control, outcome string) (uint64, error) {
+	t, err := c.get(id)
+	if err != nil {
+		return 0, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended {
+		return 0, api.ErrTransactionNotOpen{TransactionId: id}
+	}
+	if t.decided != api.Record_DATA && t.decided != control {
+		return 0, status.Errorf(
+			codes.FailedPrecondition,
+			"transaction %s is being %s, retry that",
+			id, map[api.Record_Control]string{api.Record_COMMIT: "committed", api.Record_ABORT: "aborted"}[t.decided],
+		)
+	}
+	var off uint64
+	if t.appended {
+		t.decided = control
+		if off, err = c.log.Append(&api.Record{TransactionId: id, Control: control}); err != nil {
+			return 0, err
+		}
+	}
+	t.ended = true
+	c.mu.Lock()
+	delete(c.open, id)
+	c.remember(id, control == api.Record_ABORT)
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+	c.transactions.WithLabelValues(outcome).Inc()
+	return off, nil
+}
+
+func (c *Coordinator) get(id string) (*transaction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.open[id]
+	if !ok {
+		return nil, api.ErrTransactionNotOpen{TransactionId: id}
+	}
+	return t, nil
+}
+
+// returns the offset below which every transaction has ended, and, when an
+// open transaction holds it back from the log's end, a channel that's closed
+// once a transaction ends. a follower's coordinator would take the log's end for
+// it, so it returns the log's ErrNotLeader instead
+func (c *Coordinator) StableOffset() (uint64, <-chan struct{}, error) {
+	if l, ok := c.log.(leaderLog); ok {
+		if err := l.CheckLeader(); err != nil {
+			return 0, nil, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, end, err := c.log.GetOffsets()
+	if err != nil {
+		return 0, nil, err
+	}
+	stable := end
+	for _, t := range c.open {
+		if t.appended && t.first < stable {
+			stable = t.first
+		}
+	}
+	if stable == end {
+		return end, nil, nil
+	}
+	return stable, c.changed, nil
+}
+
+// reports whether the transaction of a record below the stable offset was
+// aborted
+func (c *Coordinator) Aborted(record *api.Record) (bool, error) {
+	id := record.TransactionId
+	c.mu.Lock()
+	aborted, ok := c.outcomes[id]
+	scanned := c.scanned[id]
+	c.mu.Unlock()
+	if ok {
+		return aborted, nil
+	}
+	// the transaction ended before the coordinator started, or it never did
+	limit := record.Timestamp + int64(c.MaxTimeout+markerGrace)
+	// its marker, or records past the longest it can take, settle how it
+	// ended. reaching the log's end doesn't, the marker may still come, so its
+	// records are taken as aborted for now but that's not remembered. where the
+	// look stopped is, so the transaction's other records don't look through
+	// the same records again
+	start := record.Offset + 1
+	if scanned > start {
+		// unless the log's been truncated since
+		if _, end, err := c.log.GetOffsets(); err != nil {
+			return false, err
+		} else if scanned <= end {
+			start = scanned
+		}
+	}
+	aborted, settled := true, false
+	off := start
+	for ; ; off++ {
+		next, err := c.log.Read(off)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if next.TransactionId == id && next.Control != api.Record_DATA {
+			aborted, settled = next.Control == api.Record_ABORT, true
+			break
+		}
+		if next.Timestamp > limit {
+			settled = true
+			break
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if settled {
+		c.remember(id, aborted)
+		return aborted, nil
+	}
+	if _, ok := c.scanned[id]; !ok && len(c.scanned) >= maxOutcomes {
+		// it's only a shortcut, any one can go
+		for id := range c.scanned {
+			delete(c.scanned, id)
+			break
+		}
+	}
+	if off > c.scanned[id] {
+		c.scanned[id] = off
+	}
+	return aborted, nil
+}
+
+// notes how the transaction ended, forgetting the oldest outcome when there are
+// too many, under the lock
+func (c *Coordinator) remember(id string, aborted bool) {
+	delete(c.scanned, id)
+	if _, ok := c.outcomes[id]; ok {
+		return
+	}
+	if len(c.ended) >= maxOutcomes {
+		delete(c.outcomes, c.ended[0])
+		c.ended = c.ended[1:]
+	}
+	c.outcomes[id] = aborted
+	c.ended = append(c.ended, id)
+}
+
+// aborts the transactions that ran out of time, or appends the marker of those
+// whose ends failed
+func (c *Coordinator) expire() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.shutdown:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			var expired []string
+			for id, t := range c.open {
+				if now.After(t.deadline) {
+					expired = append(expired, id)
+				}
+			}
+			c.mu.Unlock()
+			for _, id := range expired {
+				// retried on the next tick when it fails
+				c.expireOne(id)
+			}
+		}
+	}
+}
+
+func (c *Coordinator) expireOne(id string) {
+	t, err := c.get(id)
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	control := t.decided
+	t.mu.Unlock()
+	if control == api.Record_COMMIT {
+		c.end(id, control, "committed")
+		return
+	}
+	c.end(id, api.Record_ABORT, "expired")
+}
+
+// stops expiring transactions, those open stay open until the next coordinator
+// takes them as aborted
+func (c *Coordinator) Close() error {
+	close(c.shutdown)
+	c.wg.Wait()
+	if c.Registerer != nil {
+		c.Registerer.Unregister(c.transactions)
+		c.Registerer.Unregister(c.openGauge)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package txn
+
+import (
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCoordinator(t *testing.T) {
+	l, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	registry := prometheus.NewRegistry()
+	c, err := New(l, Config{Registerer: registry})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	_, err = l.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+
+	committed, err := c.Begin(0)
+	require.NoError(t, err)
+	aborted, err := c.Begin(0)
+	require.NoError(t, err)
+
+	// transactions that haven't appended anything don't hold the log back
+	stable, ended, err := c.StableOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), stable)
+	require.Nil(t, ended)
+
+	off, err := c.Append(&api.Record{Value: []byte("a"), TransactionId: committed})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	_, err = c.Append(&api.Record{Value: []byte("b"), TransactionId: aborted})
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("outside")})
+	require.NoError(t, err)
+
+	stable, ended, err = c.StableOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), stable)
+	require.NotNil(t, ended)
+	require.Equal(t, float64(2), testutil.ToFloat64(c.openGauge))
+
+	off, err = c.Commit(committed)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	require.Eventually(t, func() bool {
+		select {
+		case <-ended:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+	marker, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, api.Record_COMMIT, marker.Control)
+	require.Equal(t, committed, marker.TransactionId)
+
+	// the aborted transaction still holds back its record
+	stable, _, err = c.StableOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), stable)
+	_, err = c.Abort(aborted)
+	require.NoError(t, err)
+	stable, ended, err = c.StableOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), stable)
+	require.Nil(t, ended)
+
+	for off, want := range map[uint64]bool{1: false, 2: true} {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		got, err := c.Aborted(record)
+		require.NoError(t, err)
+		require.Equal(t, want, got, off)
+	}
+
+	// ended transactions take no more records, and don't end again
+	_, err = c.Append(&api.Record{Value: []byte("late"), TransactionId: committed})
+	require.ErrorAs(t, err, &api.ErrTransactionNotOpen{})
+	_, err = c.Abort(committed)
+	require.ErrorAs(t, err, &api.ErrTransactionNotOpen{})
+
+	_, err = c.Begin(time.Hour)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	require.Equal(t, float64(1), testutil.ToFloat64(c.transactions.WithLabelValues("committed")))
+	require.Equal(t, float64(1), testutil.ToFloat64(c.transactions.WithLabelValues("aborted")))
+	require.Equal(t, float64(0), testutil.ToFloat64(c.openGauge))
+}
+
+func TestAbortedAfterRestart(t *testing.T) {
+	l, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	c, err := New(l, Config{})
+	require.NoError(t, err)
+
+	committed, err := c.Begin(0)
+	require.NoError(t, err)
+	_, err = c.Append(&api.Record{Value: []byte("a"), TransactionId: committed})
+	require.NoError(t, err)
+	open, err := c.Begin(0)
+	require.NoError(t, err)
+	_, err = c.Append(&api.Record{Value: []byte("b"), TransactionId: open})
+	require.NoError(t, err)
+	_, err = c.Commit(committed)
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	// the next coordinator finds the commit marker, and takes the transaction
+	// that never ended as aborted
+	c, err = New(l, Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	stable, _, err := c.StableOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), stable)
+	for off, want := range map[uint64]bool{0: false, 1: true} {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		got, err := c.Aborted(record)
+		require.NoError(t, err)
+		require.Equal(t, want, got, off)
+	}
+}
+
+func TestAbortedBeforeMarker(t *testing.T) {
+	l, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	c, err := New(l, Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	// doesn't know the transaction, as a coordinator that started after it
+	// began
+	other, err := New(l, Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { other.Close() })
+
+	id, err := c.Begin(0)
+	require.NoError(t, err)
+	_, err = c.Append(&api.Record{Value: []byte("a"), TransactionId: id})
+	require.NoError(t, err)
+	record, err := l.Read(0)
+	require.NoError(t, err)
+
+	// without a marker the record's taken as aborted, but that's not settled
+	aborted, err := other.Aborted(record)
+	require.NoError(t, err)
+	require.True(t, aborted)
+
+	_, err = c.Commit(id)
+	require.NoError(t, err)
+	aborted, err = other.Aborted(record)
+	require.NoError(t, err)
+	require.False(t, aborted)
+}
+
+func TestAbortedResumesLook(t *testing.T) {
+	l, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	c, err := New(l, Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	reads := &countingLog{Log: l}
+	other, err := New(reads, Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { other.Close() })
+
+	id, err := c.Begin(0)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = c.Append(&api.Record{Value: []byte("a"), TransactionId: id})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("b")})
+		require.NoError(t, err)
+	}
+	aborted := func(off uint64) bool {
+		t.Helper()
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		aborted, err := other.Aborted(record)
+		require.NoError(t, err)
+		return aborted
+	}
+
+	// the first record's look reads up to the log's end, the next ones resume
+	// there rather than read the same records again
+	require.True(t, aborted(0))
+	require.Equal(t, 13, reads.reads)
+	require.True(t, aborted(1))
+	require.Equal(t, 14, reads.reads)
+
+	_, err = c.Commit(id)
+	require.NoError(t, err)
+	require.False(t, aborted(2))
+	require.Equal(t, 15, reads.reads)
+	// and once it's settled it's remembered
+	require.False(t, aborted(0))
+	require.Equal(t, 15, reads.reads)
+}
+
+type countingLog struct {
+	*log.Log
+	reads int
+}
+
+func (l *countingLog) Read(off uint64) (*api.Record, error) {
+	l.reads++
+	return l.Log.Read(off)
+}
+
+func TestStableOffsetOnFollower(t *testing.T) {
+	l, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	c, err := New(follower{l}, Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	_, _, err = c.StableOffset()
+	require.Equal(t, api.ErrNotLeader{LeaderAddr: "127.0.0.1:0"}, err)
+}
+
+// a log whose node follows another
+type follower struct {
+	*log.Log
+}
+
+func (follower) CheckLeader() error {
+	return api.ErrNotLeader{LeaderAddr: "127.0.0.1:0"}
+}
+
+func TestExpiry(t *testing.T) {
+	l, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	c, err := New(l, Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	id, err := c.Begin(time.Millisecond)
+	require.NoError(t, err)
+	_, err = c.Append(&api.Record{Value: []byte("a"), TransactionId: id})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, end, err := l.GetOffsets()
+		return err == nil && end == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	marker, err := l.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, api.Record_ABORT, marker.Control)
+	_, err = c.Commit(id)
+	require.ErrorAs(t, err, &api.ErrTransactionNotOpen{})
+	require.Equal(t, float64(1), testutil.ToFloat64(c.transactions.WithLabelValues("expired")))
+}
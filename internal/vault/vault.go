@@ -0,0 +1,229 @@
+// issues the node's TLS certificates from HashiCorp Vault's PKI secrets engine
+// and renews them before they expire, so nodes don't need long-lived
+// certificates distributed to them. a Source issues a certificate when it's
+// created and again once two thirds of its lifetime has passed, TLS configs pick
+// the current one up through its GetCertificate and GetClientCertificate
+// callbacks, so renewals apply to new connections without touching open ones
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	// Vault's address, e.g. https://vault.example.com:8200
+	Addr  string
+	Token string
+	// where the PKI engine is mounted, pki when empty, and the role to issue as
+	Mount string
+	Role  string
+	// what the certificate is for: its common name and subject alternative names
+	CommonName string
+	AltNames   []string
+	IPSANs     []string
+	// the certificate's lifetime, the role's default when zero
+	TTL time.Duration
+	// http.DefaultClient when nil
+	HTTPClient *http.Client
+	// how long to wait before retrying a failed renewal, 10s when zero
+	RetryInterval time.Duration
+	// logs failed renewals, nothing's logged when nil
+	Logger *zap.Logger
+}
+
+type Source struct {
+	Config
+
+	mu sync.RWMutex
+	// the current certificate and the CA that issued it
+	cert *tls.Certificate
+	ca   *x509.CertPool
+	// when the current certificate was issued and expires
+	issued, expires time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// issues the first certificate and starts renewing it
+func NewSource(ctx context.Context, c Config) (*Source, error) {
+	if c.Mount == "" {
+		c.Mount = "pki"
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = http.DefaultClient
+	}
+	if c.RetryInterval == 0 {
+		c.RetryInterval = 10 * time.Second
+	}
+	if c.Logger == nil {
+		c.Logger = zap.NewNop()
+	}
+	s := &Source{
+		Config: c,
+		done:   make(chan struct{}),
+	}
+	if err := s.issue(ctx); err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.renew()
+	return s, nil
+}
+
+func (s *Source) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+func (s *Source) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+// the CA that issued the first certificate, for verifying peers' certificates
+func (s *Source) CAPool() *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ca
+}
+
+// the current certificate's expiry
+func (s *Source) Expires() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.expires
+}
+
+// stops renewing
+func (s *Source) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Source) renew() {
+	defer s.wg.Done()
+	for {
+		s.mu.RLock()
+		wait := time.Until(s.issued.Add(s.expires.Sub(s.issued) * 2 / 3))
+		s.mu.RUnlock()
+		// a certificate that's already expired mustn't renew in a busy loop
+		if wait <= 0 {
+			wait = s.RetryInterval
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(wait):
+		}
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), s.RetryInterval)
+			err := s.issue(ctx)
+			cancel()
+			if err == nil {
+				break
+			}
+			s.Logger.Error(
+				"renewing the certificate",
+				zap.Time("expires", s.Expires()),
+				zap.Error(err),
+			)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(s.RetryInterval):
+			}
+		}
+	}
+}
+
+// the parts of Vault's response to pki/issue/:role the Source uses
+type issueResponse struct {
+	Data struct {
+		Certificate string   `json:"certificate"`
+		PrivateKey  string   `json:"private_key"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+		Expiration  int64    `json:"expiration"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+func (s *Source) issue(ctx context.Context) error {
+	body := map[string]interface{}{
+		"common_name": s.CommonName,
+	}
+	if len(s.AltNames) > 0 {
+		body["alt_names"] = strings.Join(s.AltNames, ",")
+	}
+	if len(s.IPSANs) > 0 {
+		body["ip_sans"] = strings.Join(s.IPSANs, ",")
+	}
+	if s.TTL > 0 {
+		body["ttl"] = s.TTL.String()
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v1/%s/issue/%s", strings.TrimSuffix(s.Addr, "/"), s.Mount, s.Role)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.Token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var issued issueResponse
+	if err := json.NewDecoder(res.Body).Decode(&issued); err != nil {
+		return fmt.Errorf("vault: decoding the response (status %d): %w", res.StatusCode, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault: issuing a certificate: status %d: %s", res.StatusCode, strings.Join(issued.Errors, "; "))
+	}
+
+	// the certificate's chain up to, but not including, the root
+	chain := issued.Data.Certificate
+	for _, ca := range issued.Data.CAChain {
+		if ca != issued.Data.IssuingCA {
+			chain += "\n" + ca
+		}
+	}
+	cert, err := tls.X509KeyPair([]byte(chain), []byte(issued.Data.PrivateKey))
+	if err != nil {
+		return err
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM([]byte(issued.Data.IssuingCA)) {
+		return errors.New("vault: parsing the issuing CA")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = &cert
+	if s.ca == nil {
+		s.ca = ca
+	}
+	s.issued = time.Now()
+	s.expires = time.Unix(issued.Data.Expiration, 0)
+	return nil
+}
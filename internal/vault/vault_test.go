@@ -0,0 +1,110 @@
+package vault
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSource(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vault CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+
+	// a PKI engine issuing certificates that expire in 2s
+	var issued atomic.Int64
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "secret" || r.URL.Path != "/v1/pki/issue/proglog" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		var body struct {
+			CommonName string `json:"common_name"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		expires := time.Now().Add(2 * time.Second)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(issued.Add(1) + 1),
+			Subject:      pkix.Name{CommonName: body.CommonName},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     expires,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}, ca, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		res := map[string]interface{}{"data": map[string]interface{}{
+			"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			"private_key": string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+			"issuing_ca":  caPEM,
+			"ca_chain":    []string{caPEM},
+			"expiration":  expires.Unix(),
+		}}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer vault.Close()
+
+	_, err = NewSource(context.Background(), Config{
+		Addr:  vault.URL,
+		Token: "wrong",
+		Role:  "proglog",
+	})
+	require.ErrorContains(t, err, "permission denied")
+
+	s, err := NewSource(context.Background(), Config{
+		Addr:          vault.URL,
+		Token:         "secret",
+		Role:          "proglog",
+		CommonName:    "node-0",
+		RetryInterval: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	first, err := s.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(first.Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, "node-0", leaf.Subject.CommonName)
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:     s.CAPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	require.NoError(t, err)
+
+	// renewed before it expires
+	require.Eventually(t, func() bool {
+		return issued.Load() >= 2
+	}, 3*time.Second, 50*time.Millisecond)
+	renewed, err := s.GetClientCertificate(nil)
+	require.NoError(t, err)
+	require.NotEqual(t, first.Certificate[0], renewed.Certificate[0])
+}
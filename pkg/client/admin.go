@@ -0,0 +1,242 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// typed calls for the cluster's admin RPCs, retried with the client's
+// RetryPolicy. the log has no topics, so there's nothing to create or delete:
+// it's the cluster, its members and the log's offsets that are managed.
+//
+// calls only the leader answers, e.g. DescribeReplication, are sent on to the
+// leader the client's node reports, over a connection the Admin dials with the
+// client's Config. with TLS, the config has to trust the leader's certificate
+type Admin struct {
+	client *Client
+
+	mu sync.Mutex
+	// dialed once a call was sent on, nil until then
+	leader *Client
+}
+
+func (c *Client) NewAdmin() *Admin {
+	return &Admin{client: c}
+}
+
+// the cluster as the client's node sees it
+func (a *Admin) ClusterStatus(ctx context.Context) (*api.ClusterStatus, error) {
+	var clusterStatus *api.ClusterStatus
+	err := a.client.do(ctx, a.client.Retry, "GetClusterStatus", func(ctx context.Context) error {
+		res, err := a.client.log.GetClusterStatus(ctx, &api.GetClusterStatusRequest{})
+		if err != nil {
+			return err
+		}
+		clusterStatus = res.Status
+		return nil
+	})
+	return clusterStatus, err
+}
+
+// the in-sync set and how far behind each follower is, from the leader
+func (a *Admin) DescribeReplication(ctx context.Context) (*api.Replication, error) {
+	var replication *api.Replication
+	err := a.onLeader(ctx, "DescribeReplication", func(ctx context.Context, c *Client) error {
+		res, err := c.log.DescribeReplication(ctx, &api.DescribeReplicationRequest{})
+		if err != nil {
+			return err
+		}
+		replication = res.Replication
+		return nil
+	})
+	return replication, err
+}
+
+func (a *Admin) Members(ctx context.Context) ([]*api.Member, error) {
+	var members []*api.Member
+	err := a.client.do(ctx, a.client.Retry, "ListMembers", func(ctx context.Context) error {
+		res, err := a.client.log.ListMembers(ctx, &api.ListMembersRequest{})
+		if err != nil {
+			return err
+		}
+		members = res.Members
+		return nil
+	})
+	return members, err
+}
+
+// removes the member from the cluster, e.g. one that failed for good
+func (a *Admin) RemoveMember(ctx context.Context, id string) error {
+	return a.client.do(ctx, a.client.Retry, "RemoveMember", func(ctx context.Context) error {
+		_, err := a.client.log.RemoveMember(ctx, &api.RemoveMemberRequest{Id: id})
+		return err
+	})
+}
+
+// the offset of the oldest record still in the log and the offset the next
+// record visible to consumers will get
+func (a *Admin) Offsets(ctx context.Context) (lowest, end uint64, err error) {
+	err = a.client.do(ctx, a.client.Retry, "GetOffsets", func(ctx context.Context) error {
+		res, err := a.client.log.GetOffsets(ctx, &api.GetOffsetsRequest{})
+		if err != nil {
+			return err
+		}
+		lowest, end = res.LowestOffset, res.EndOffset
+		return nil
+	})
+	return lowest, end, err
+}
+
+// the node's high watermark, below which records are committed and consumers
+// can read them, and its log end offset, where its next appended record goes
+func (a *Admin) Watermarks(ctx context.Context) (highWatermark, logEnd uint64, err error) {
+	err = a.client.do(ctx, a.client.Retry, "GetOffsets", func(ctx context.Context) error {
+		res, err := a.client.log.GetOffsets(ctx, &api.GetOffsetsRequest{})
+		if err != nil {
+			return err
+		}
+		highWatermark, logEnd = res.EndOffset, res.LogEndOffset
+		return nil
+	})
+	return highWatermark, logEnd, err
+}
+
+// the node's offsets, size on disk, newest record and the nodes holding the
+// log as it knows them
+func (a *Admin) DescribeLog(ctx context.Context) (*api.LogDescription, error) {
+	var d *api.LogDescription
+	err := a.client.do(ctx, a.client.Retry, "DescribeLog", func(ctx context.Context) error {
+		res, err := a.client.log.DescribeLog(ctx, &api.DescribeLogRequest{})
+		if err != nil {
+			return err
+		}
+		d = res.Log
+		return nil
+	})
+	return d, err
+}
+
+// puts the client's node in or out of read-only mode, where it rejects
+// produces with the reason and keeps serving consumers
+func (a *Admin) SetReadOnly(ctx context.Context, readOnly bool, reason string) error {
+	return a.client.do(ctx, a.client.Retry, "SetReadOnly", func(ctx context.Context) error {
+		_, err := a.client.log.SetReadOnly(ctx, &api.SetReadOnlyRequest{ReadOnly: readOnly, Reason: reason})
+		return err
+	})
+}
+
+// readies the client's node for shutdown and waits up to timeout for it to
+// settle, see the Drain RPC. the node stays unready until it's restarted
+func (a *Admin) Drain(ctx context.Context, timeout time.Duration) (*api.DrainResponse, error) {
+	var res *api.DrainResponse
+	err := a.client.do(ctx, a.client.Retry, "Drain", func(ctx context.Context) error {
+		var err error
+		res, err = a.client.log.Drain(ctx, &api.DrainRequest{TimeoutMs: uint32(timeout.Milliseconds())})
+		return err
+	})
+	return res, err
+}
+
+// erases the keys and values of the records req picks on every replica, for
+// legal deletion requests, see the Redact RPC. retrying is safe, the records
+// already erased are skipped
+func (a *Admin) Redact(ctx context.Context, req *api.RedactRequest) (*api.RedactResponse, error) {
+	var res *api.RedactResponse
+	err := a.client.do(ctx, a.client.Retry, "Redact", func(ctx context.Context) error {
+		var err error
+		res, err = a.client.log.Redact(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// the offset the consumer last committed, found is false when it never has
+func (a *Admin) CommittedOffset(ctx context.Context, consumer string) (offset uint64, found bool, err error) {
+	err = a.client.do(ctx, a.client.Retry, "GetCommittedOffset", func(ctx context.Context) error {
+		res, err := a.client.log.GetCommittedOffset(ctx, &api.GetCommittedOffsetRequest{Consumer: consumer})
+		if err != nil {
+			return err
+		}
+		offset, found = res.Offset, res.Found
+		return nil
+	})
+	return offset, found, err
+}
+
+// closes the connection to the leader, if one was dialed. it doesn't close the client
+func (a *Admin) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closeLeader()
+	return nil
+}
+
+// calls fn with the client for the leader, the client's node until a call
+// fails because it isn't the leader, then the one the node reports
+func (a *Admin) onLeader(ctx context.Context, call string, fn func(context.Context, *Client) error) error {
+	return a.client.do(ctx, a.client.Retry, call, func(ctx context.Context) error {
+		a.mu.Lock()
+		c := a.leader
+		a.mu.Unlock()
+		if c == nil {
+			c = a.client
+		}
+		err := fn(ctx, c)
+		if status.Code(err) != codes.FailedPrecondition {
+			return err
+		}
+		leader, lerr := a.findLeader(ctx, c)
+		if lerr != nil || leader == nil {
+			return err
+		}
+		return fn(ctx, leader)
+	})
+}
+
+// the client for the leader the client's node reports, nil when c is already
+// it or the node doesn't know the leader
+func (a *Admin) findLeader(ctx context.Context, c *Client) (*Client, error) {
+	res, err := a.client.log.GetClusterStatus(ctx, &api.GetClusterStatusRequest{})
+	if err != nil {
+		return nil, err
+	}
+	addr := res.Status.LeaderAddr
+	if res.Status.IsLeader {
+		addr = a.client.Addr
+	}
+	if addr == "" || addr == c.Addr {
+		return nil, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.leader != nil && a.leader.Addr == addr {
+		return a.leader, nil
+	}
+	if addr == a.client.Addr {
+		a.closeLeader()
+		return a.client, nil
+	}
+	config := a.client.Config
+	config.Addr = addr
+	leader, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	a.closeLeader()
+	a.leader = leader
+	return leader, nil
+}
+
+// holds mu
+func (a *Admin) closeLeader() {
+	if a.leader != nil {
+		a.leader.Close()
+		a.leader = nil
+	}
+}
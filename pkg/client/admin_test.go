@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	api "proglog/api/v1"
+	"proglog/internal/server"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminOffsets(t *testing.T) {
+	client, _ := setupTest(t)
+	admin := client.NewAdmin()
+	t.Cleanup(func() {
+		admin.Close()
+	})
+	ctx := context.Background()
+	_, err := client.ProduceBatch(ctx, [][]byte{[]byte("a"), []byte("b")})
+	require.NoError(t, err)
+
+	lowest, end, err := admin.Offsets(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	require.Equal(t, uint64(2), end)
+	hw, logEnd, err := admin.Watermarks(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), hw)
+	require.Equal(t, uint64(2), logEnd)
+
+	_, found, err := admin.CommittedOffset(ctx, "reader")
+	require.NoError(t, err)
+	require.False(t, found)
+	_, err = client.API().CommitOffset(ctx, &api.CommitOffsetRequest{Consumer: "reader", Offset: 1})
+	require.NoError(t, err)
+	offset, found, err := admin.CommittedOffset(ctx, "reader")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(1), offset)
+}
+
+func TestAdminFindsLeader(t *testing.T) {
+	leaderAddr := serve(t, &server.Config{
+		ReplicationDescriber: stubReplication{replication: &api.Replication{LeaderId: "leader"}},
+		ClusterStatusGetter:  stubClusterStatus{&api.ClusterStatus{NodeId: "leader", IsLeader: true}},
+	})
+	followerAddr := serve(t, &server.Config{
+		ReplicationDescriber: stubReplication{err: api.ErrNotLeader{LeaderAddr: leaderAddr}},
+		ClusterStatusGetter: stubClusterStatus{&api.ClusterStatus{
+			NodeId:     "follower",
+			LeaderId:   "leader",
+			LeaderAddr: leaderAddr,
+		}},
+	})
+	client, err := New(Config{Addr: followerAddr})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	admin := client.NewAdmin()
+	t.Cleanup(func() {
+		admin.Close()
+	})
+
+	ctx := context.Background()
+	clusterStatus, err := admin.ClusterStatus(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "follower", clusterStatus.NodeId)
+
+	for i := 0; i < 2; i++ {
+		replication, err := admin.DescribeReplication(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "leader", replication.LeaderId)
+	}
+	require.Equal(t, leaderAddr, admin.leader.Addr)
+}
+
+type stubReplication struct {
+	replication *api.Replication
+	err         error
+}
+
+func (s stubReplication) DescribeReplication() (*api.Replication, error) {
+	return s.replication, s.err
+}
+
+type stubClusterStatus struct {
+	status *api.ClusterStatus
+}
+
+func (s stubClusterStatus) GetClusterStatus() (*api.ClusterStatus, error) {
+	return s.status, nil
+}
+
+// serves the config on a local port and returns its address
+func serve(t *testing.T, config *server.Config) string {
+	t.Helper()
+	srv, err := server.NewGPRCServer(config)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String()
+}
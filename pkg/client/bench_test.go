@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// end to end, through a node's gRPC server over a local connection
+
+func BenchmarkProduce(b *testing.B) {
+	client, _ := setupTest(b)
+	value := make([]byte, 1<<10)
+	b.SetBytes(int64(len(value)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := client.Produce(context.Background(), value)
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkProduceBatch(b *testing.B) {
+	for _, batch := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			client, _ := setupTest(b)
+			values := make([][]byte, batch)
+			for i := range values {
+				values[i] = make([]byte, 1<<10)
+			}
+			// per record, so the batch sizes compare
+			b.SetBytes(1 << 10)
+			b.ResetTimer()
+			for i := 0; i < b.N; i += batch {
+				_, err := client.ProduceBatch(context.Background(), values[:min(batch, b.N-i)])
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkProducer(b *testing.B) {
+	client, _ := setupTest(b)
+	p := client.NewProducer(ProducerConfig{})
+	b.Cleanup(func() {
+		p.Close()
+	})
+	value := make([]byte, 1<<10)
+	results := make(chan Result, b.N)
+	b.SetBytes(int64(len(value)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := p.SendAsync(value, func(r Result) {
+			results <- r
+		})
+		require.NoError(b, err)
+	}
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, (<-results).Err)
+	}
+}
+
+func BenchmarkConsume(b *testing.B) {
+	client, _ := setupTest(b)
+	const records = 1000
+	values := make([][]byte, records)
+	for i := range values {
+		values[i] = make([]byte, 1<<10)
+	}
+	_, err := client.ProduceBatch(context.Background(), values)
+	require.NoError(b, err)
+	b.SetBytes(1 << 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := client.Consume(context.Background(), uint64(i%records))
+		require.NoError(b, err)
+	}
+}
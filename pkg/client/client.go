@@ -0,0 +1,449 @@
+// a Go client for a proglog node's gRPC API, so programs don't have to dial
+// and call the api/v1 stubs themselves. a Client holds a pool of connections,
+// see Config.Connections, which gRPC reconnects as needed, and retries calls that fail with the codes its
+// RetryPolicy lists. Produce and ProduceBatch are retried too, so a record whose
+// first attempt was appended before the error reached the client is appended
+// twice, a Producer's records carry sequence numbers so they never are
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"slices"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/compression"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/credentials/oauth"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+type Config struct {
+	// the node's RPC address
+	Addr string
+	// dials without TLS when nil
+	TLSConfig *tls.Config
+	// an API key sent in the x-api-key metadata, in place of a client
+	// certificate, needs TLS
+	APIKey string
+	// an ID token for nodes that check admin RPCs' callers, needs TLS
+	Token string
+	Retry RetryPolicy
+	// tunes calls by name, e.g. "Produce", "Consume" or "CommitOffset", the
+	// names the metrics use. calls without a policy have no timeout and are
+	// retried with Retry
+	Calls map[string]CallPolicy
+	// added to the options the client dials with
+	DialOptions []grpc.DialOption
+	// how many connections the client's calls are spread over, 1 when zero.
+	// gRPC multiplexes a connection's calls, more connections help when one's
+	// throughput is the limit
+	Connections int
+	// compresses the requests, and asks the node to compress its responses,
+	// with gzip, snappy or zstd, see compression.Names. nothing's compressed
+	// when empty. it saves bandwidth on slow links at the cost of CPU
+	Compression string
+	// how long a connection can keep failing to connect before it's replaced
+	// with a new one, 30s when zero
+	EvictAfter time.Duration
+	// collects the client's request latencies, retries, batch sizes and
+	// connection states, nothing's collected when nil
+	Metrics MetricsCollector
+}
+
+// how failed calls are retried: after InitialBackoff, doubling up to
+// MaxBackoff, with up to half of each backoff added as jitter
+type RetryPolicy struct {
+	// including the first, 1 (no retries) when zero
+	MaxAttempts int
+	// 100ms and 2s when zero
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// the codes retried, Unavailable when empty
+	Codes []codes.Code
+}
+
+// the Client's calls that read and write the log, so programs can depend on
+// this rather than a *Client and test against clienttest's in-memory Log
+type Log interface {
+	Produce(ctx context.Context, value []byte) (uint64, error)
+	ProduceBatch(ctx context.Context, values [][]byte) ([]uint64, error)
+	Consume(ctx context.Context, offset uint64) (*api.Record, error)
+	ConsumeStream(ctx context.Context, offset uint64, fn func(*api.Record) error) error
+	Close() error
+}
+
+var _ Log = (*Client)(nil)
+
+type Client struct {
+	Config
+
+	pool    *pool
+	log     api.LogClient
+	metrics MetricsCollector
+	// the followers Consume's hedged reads go to, see HedgePolicy
+	hedges []*Client
+}
+
+func (r RetryPolicy) withDefaults() RetryPolicy {
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = 1
+	}
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = 100 * time.Millisecond
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = 2 * time.Second
+	}
+	if len(r.Codes) == 0 {
+		r.Codes = []codes.Code{codes.Unavailable}
+	}
+	return r
+}
+
+// the options the client dials its node with: the TLS config, the token or
+// API key, the compression and DialOptions, for code that makes its own
+// connections, e.g. a mirror's
+func (c Config) ConnectOptions() ([]grpc.DialOption, error) {
+	creds := insecure.NewCredentials()
+	if c.TLSConfig != nil {
+		creds = credentials.NewTLS(c.TLSConfig)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if c.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(oauth.TokenSource{
+			TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: c.Token}),
+		}))
+	}
+	if c.APIKey != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(apiKeyCredentials(c.APIKey)))
+	}
+	if c.Compression != "" {
+		if encoding.GetCompressor(c.Compression) == nil {
+			return nil, fmt.Errorf("client: unknown compression %q, want one of %v", c.Compression, compression.Names)
+		}
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(c.Compression)))
+	}
+	return append(opts, c.DialOptions...), nil
+}
+
+func New(c Config) (*Client, error) {
+	c.Retry = c.Retry.withDefaults()
+	c.Calls = maps.Clone(c.Calls)
+	for call, policy := range c.Calls {
+		if policy.Retry.MaxAttempts != 0 {
+			policy.Retry = policy.Retry.withDefaults()
+			c.Calls[call] = policy
+		}
+	}
+	if c.Connections == 0 {
+		c.Connections = 1
+	}
+	if c.EvictAfter == 0 {
+		c.EvictAfter = 30 * time.Second
+	}
+	opts, err := c.ConnectOptions()
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{Config: c, metrics: c.Metrics}
+	if c.Metrics == nil {
+		client.metrics = nopMetrics{}
+	} else {
+		opts = append(opts,
+			grpc.WithChainUnaryInterceptor(client.unaryMetrics),
+			grpc.WithChainStreamInterceptor(client.streamMetrics),
+		)
+	}
+	pool, err := newPool(
+		c.Addr,
+		opts,
+		c.Connections,
+		c.EvictAfter,
+		client.metrics,
+	)
+	if err != nil {
+		return nil, err
+	}
+	client.pool = pool
+	client.log = api.NewLogClient(pool)
+	if err := client.dialHedges(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// the generated client on the same connections, for the RPCs the Client doesn't
+// wrap, e.g. the admin ones. its calls aren't retried
+func (c *Client) API() api.LogClient {
+	return c.log
+}
+
+func (c *Client) Close() error {
+	errs := []error{c.pool.close()}
+	for _, hedge := range c.hedges {
+		errs = append(errs, hedge.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// appends a record and returns its offset
+func (c *Client) Produce(ctx context.Context, value []byte) (uint64, error) {
+	var offset uint64
+	err := c.do(ctx, c.Retry, "Produce", func(ctx context.Context) error {
+		res, err := c.log.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: value},
+		})
+		if err != nil {
+			return err
+		}
+		offset = res.Offset
+		return nil
+	})
+	return offset, err
+}
+
+// appends the value with the message ID, on nodes that deduplicate: retries,
+// and later calls with the same ID within the node's window, return the
+// offset the first one was appended at rather than appending it again
+func (c *Client) ProduceMessage(ctx context.Context, id string, value []byte) (uint64, error) {
+	var offset uint64
+	err := c.do(ctx, c.Retry, "ProduceMessage", func(ctx context.Context) error {
+		res, err := c.log.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: value, MessageId: id},
+		})
+		if err != nil {
+			return err
+		}
+		offset = res.Offset
+		return nil
+	})
+	return offset, err
+}
+
+// appends the value with the key, on nodes that index keys GetByKey returns
+// the key's latest record
+func (c *Client) ProduceKeyed(ctx context.Context, key, value []byte) (uint64, error) {
+	var offset uint64
+	err := c.do(ctx, c.Retry, "ProduceKeyed", func(ctx context.Context) error {
+		res, err := c.log.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Key: key, Value: value},
+		})
+		if err != nil {
+			return err
+		}
+		offset = res.Offset
+		return nil
+	})
+	return offset, err
+}
+
+// appends the records, in order, over one ProduceStream and returns their
+// offsets. a retry resends the records that weren't acknowledged, when it
+// fails the offsets returned are those of the records appended
+func (c *Client) ProduceBatch(ctx context.Context, values [][]byte) ([]uint64, error) {
+	records := make([]*api.Record, len(values))
+	for i, value := range values {
+		records[i] = &api.Record{Value: value}
+	}
+	return c.produceBatch(ctx, c.Retry, "ProduceBatch", records)
+}
+
+func (c *Client) produceBatch(ctx context.Context, retry RetryPolicy, call string, records []*api.Record) ([]uint64, error) {
+	var bytes int
+	for _, record := range records {
+		bytes += len(record.Value)
+	}
+	c.metrics.ObserveBatch(len(records), bytes)
+	offsets := make([]uint64, 0, len(records))
+	err := c.do(ctx, retry, call, func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream, err := c.log.ProduceStream(ctx)
+		if err != nil {
+			return err
+		}
+		pending := records[len(offsets):]
+		// the node answers each request in turn, so the sends can run ahead
+		sent := make(chan error, 1)
+		go func() {
+			for _, record := range pending {
+				err := stream.Send(&api.ProduceRequest{Record: record})
+				if err != nil {
+					sent <- err
+					return
+				}
+			}
+			sent <- stream.CloseSend()
+		}()
+		for range pending {
+			res, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			offsets = append(offsets, res.Offset)
+		}
+		if err := <-sent; err != nil {
+			return err
+		}
+		// waits for the stream to end, so its status is observed. the records
+		// are all acknowledged, so the status doesn't fail the call
+		stream.Recv()
+		return nil
+	})
+	return offsets, err
+}
+
+// reads the record at offset
+func (c *Client) Consume(ctx context.Context, offset uint64) (*api.Record, error) {
+	var record *api.Record
+	err := c.do(ctx, c.Retry, "Consume", func(ctx context.Context) error {
+		var err error
+		record, err = c.hedgedConsume(ctx, offset)
+		return err
+	})
+	return record, err
+}
+
+// reads the key's latest committed record, from a node that indexes keys
+func (c *Client) GetByKey(ctx context.Context, key []byte) (*api.Record, error) {
+	var record *api.Record
+	err := c.do(ctx, c.Retry, "GetByKey", func(ctx context.Context) error {
+		res, err := c.log.GetByKey(ctx, &api.GetByKeyRequest{Key: key})
+		if err != nil {
+			return err
+		}
+		record = res.Record
+		return nil
+	})
+	return record, err
+}
+
+// calls fn with each record from offset on, waiting for new ones once it's
+// read the whole log. it returns when ctx is done, with nil, or when fn or the
+// stream fails. a retried stream resumes after the last record fn was called with
+func (c *Client) ConsumeStream(ctx context.Context, offset uint64, fn func(*api.Record) error) error {
+	return c.consumeStream(ctx, offset, api.ConsumeRequest_READ_UNCOMMITTED, api.ConsumeRequest_NORMAL, fn)
+}
+
+// calls fn like ConsumeStream, but only with the records of committed
+// transactions and those produced outside one, skipping the markers. records
+// are sent once every transaction before them has ended
+func (c *Client) ConsumeCommitted(ctx context.Context, offset uint64, fn func(*api.Record) error) error {
+	return c.consumeStream(ctx, offset, api.ConsumeRequest_READ_COMMITTED, api.ConsumeRequest_NORMAL, fn)
+}
+
+func (c *Client) consumeStream(
+	ctx context.Context,
+	offset uint64,
+	isolation api.ConsumeRequest_Isolation,
+	priority api.ConsumeRequest_Priority,
+	fn func(*api.Record) error,
+) error {
+	err := c.do(ctx, c.Retry, "ConsumeStream", func(ctx context.Context) error {
+		stream, err := c.log.ConsumeStream(ctx, &api.ConsumeRequest{
+			Offset:    offset,
+			Isolation: isolation,
+			Priority:  priority,
+		})
+		if err != nil {
+			return err
+		}
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			// records already received aren't handled once ctx is done
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(res.Record); err != nil {
+				return permanent{err}
+			}
+			offset = res.Record.Offset + 1
+		}
+	})
+	if ctx.Err() != nil || errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// wraps errors that mustn't be retried, e.g. the ones returned by callbacks
+type permanent struct {
+	error
+}
+
+func (p permanent) Unwrap() error {
+	return p.error
+}
+
+// retries the client's call with r, or the call's CallPolicy's retry policy
+// when it has one, observing each retry. fn's given a context that ends with
+// the attempt's timeout
+func (c *Client) do(ctx context.Context, r RetryPolicy, call string, fn func(context.Context) error) error {
+	policy := c.Calls[call]
+	if policy.Retry.MaxAttempts != 0 {
+		r = policy.Retry
+	}
+	attempt := func() error {
+		if policy.Timeout == 0 {
+			return fn(ctx)
+		}
+		ctx, cancel := context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+		return fn(ctx)
+	}
+	return r.do(ctx, attempt, func(err error) {
+		c.metrics.ObserveRetry(call, status.Code(err))
+	})
+}
+
+// calls fn until it succeeds, fails with an error that isn't retried, or
+// runs out of attempts. retried is called with each error that's retried
+func (r RetryPolicy) do(ctx context.Context, fn func() error, retried func(error)) error {
+	backoff := r.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		var p permanent
+		if errors.As(err, &p) {
+			return p.error
+		}
+		if err == nil || attempt >= r.MaxAttempts || !slices.Contains(r.Codes, status.Code(err)) {
+			return err
+		}
+		retried(err)
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, r.MaxBackoff)
+	}
+}
+
+// sends an API key in the x-api-key metadata
+type apiKeyCredentials string
+
+func (k apiKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"x-api-key": string(k)}, nil
+}
+
+func (apiKeyCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+	"proglog/internal/offsets"
+	"proglog/internal/server"
+	"proglog/internal/txn"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClient(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		client *Client,
+		srv *testServer,
+	){
+		"produce and consume records":     testProduceConsume,
+		"produce a batch over a stream":   testProduceBatch,
+		"consume a stream until canceled": testConsumeStream,
+		"unavailable calls are retried":   testRetry,
+		"other errors aren't retried":     testNoRetry,
+		"retries stop after max attempts": testMaxAttempts,
+		"callback errors end the stream":  testConsumeStreamCallbackError,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, srv := setupTest(t)
+			fn(t, client, srv)
+		})
+	}
+}
+
+func testProduceConsume(t *testing.T, client *Client, _ *testServer) {
+	ctx := context.Background()
+	offset, err := client.Produce(ctx, []byte("hello world"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+
+	record, err := client.Consume(ctx, offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	_, err = client.Consume(ctx, 1)
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+func testProduceBatch(t *testing.T, client *Client, _ *testServer) {
+	ctx := context.Background()
+	offsets, err := client.ProduceBatch(ctx, [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offsets)
+
+	record, err := client.Consume(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), record.Value)
+}
+
+func testConsumeStream(t *testing.T, client *Client, _ *testServer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := client.ProduceBatch(ctx, [][]byte{[]byte("a"), []byte("b")})
+	require.NoError(t, err)
+
+	var values []string
+	err = client.ConsumeStream(ctx, 0, func(record *api.Record) error {
+		values = append(values, string(record.Value))
+		if len(values) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, values)
+}
+
+func testConsumeStreamCallbackError(t *testing.T, client *Client, _ *testServer) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, []byte("a"))
+	require.NoError(t, err)
+
+	want := errors.New("stop")
+	err = client.ConsumeStream(ctx, 0, func(*api.Record) error {
+		return want
+	})
+	require.Equal(t, want, err)
+}
+
+func testRetry(t *testing.T, client *Client, srv *testServer) {
+	srv.failures.Store(2)
+	offset, err := client.Produce(context.Background(), []byte("hello world"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+	require.Equal(t, int32(0), srv.failures.Load())
+}
+
+func testNoRetry(t *testing.T, client *Client, srv *testServer) {
+	_, err := client.Consume(context.Background(), 10)
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+func testMaxAttempts(t *testing.T, client *Client, srv *testServer) {
+	srv.failures.Store(5)
+	_, err := client.Produce(context.Background(), []byte("hello world"))
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	// three attempts were made
+	require.Equal(t, int32(2), srv.failures.Load())
+}
+
+// a log whose unary calls fail with Unavailable while failures is positive
+type testServer struct {
+	failures atomic.Int32
+	// the ProduceStream calls served
+	produceStreams atomic.Int32
+	// while positive, ProduceStream appends the records but fails rather than
+	// acknowledging them
+	lostAcks atomic.Int32
+}
+
+type lossyStream struct {
+	grpc.ServerStream
+	lostAcks *atomic.Int32
+}
+
+func (s *lossyStream) SendMsg(m interface{}) error {
+	if s.lostAcks.Add(-1) >= 0 {
+		return status.Error(codes.Unavailable, "connection lost")
+	}
+	s.lostAcks.Store(0)
+	return s.ServerStream.SendMsg(m)
+}
+
+func setupTest(t testing.TB) (*Client, *testServer) {
+	t.Helper()
+
+	// segments a node would use, so the benchmarks don't sync every few records
+	lc := log.Config{}
+	lc.Segment.MaxStoreBytes = 64 << 20
+	lc.Segment.MaxIndexBytes = 1 << 20
+	clog, err := log.NewLog(t.TempDir(), lc)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		clog.Close()
+	})
+	ts := &testServer{}
+	flaky := func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if ts.failures.Add(-1) >= 0 {
+			return nil, status.Error(codes.Unavailable, "try again")
+		}
+		ts.failures.Store(0)
+		return handler(ctx, req)
+	}
+	counter := func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if info.FullMethod == api.Log_ProduceStream_FullMethodName {
+			ts.produceStreams.Add(1)
+			stream = &lossyStream{ServerStream: stream, lostAcks: &ts.lostAcks}
+		}
+		return handler(srv, stream)
+	}
+	consumerOffsets, err := offsets.New(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		consumerOffsets.Close()
+	})
+	transactions, err := txn.New(clog, txn.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		transactions.Close()
+	})
+	srv, err := server.NewGPRCServer(
+		&server.Config{
+			CommitLog:       clog,
+			OffsetGetter:    clog,
+			ConsumerOffsets: consumerOffsets,
+			Transactions:    transactions,
+		},
+		grpc.ChainUnaryInterceptor(flaky),
+		grpc.ChainStreamInterceptor(counter),
+	)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	client, err := New(Config{
+		Addr: l.Addr().String(),
+		Retry: RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: 10 * time.Millisecond,
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client, ts
+}
@@ -0,0 +1,204 @@
+// an in-memory client.Log for unit testing programs that use proglog, without
+// running a node. its offsets and errors are the ones a node's client sees: a
+// record's offset is the number of records before it, reading past the end
+// fails with the status api.ErrOffsetOutOfRange carries, and calls made once
+// ctx is done or the Log's closed fail with Canceled or DeadlineExceeded.
+// nothing's retried, a call fails with the error FailNext gave it
+package clienttest
+
+import (
+	"context"
+	"sync"
+
+	api "proglog/api/v1"
+	"proglog/pkg/client"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ client.Log = (*Log)(nil)
+
+// a Log's zero value is empty and ready to use
+type Log struct {
+	mu      sync.Mutex
+	records []*api.Record
+	// the calls' next errors, see FailNext
+	failures map[string][]error
+	closed   bool
+	// closed and replaced when a record's appended or the Log's closed, wakes
+	// the streams waiting for records
+	changed chan struct{}
+}
+
+// makes the next call of method, e.g. "Produce" or "ConsumeStream", fail with
+// err, e.g. an api error or a status.Error. calls queue up their failures
+func (l *Log) FailNext(method string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failures == nil {
+		l.failures = make(map[string][]error)
+	}
+	l.failures[method] = append(l.failures[method], err)
+}
+
+// a copy of the records appended so far
+func (l *Log) Records() []*api.Record {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := make([]*api.Record, len(l.records))
+	for i := range l.records {
+		records[i] = l.read(uint64(i))
+	}
+	return records
+}
+
+func (l *Log) Produce(ctx context.Context, value []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.check(ctx, "Produce"); err != nil {
+		return 0, err
+	}
+	return l.append(nil, value), nil
+}
+
+// appends the value with the key, like Client.ProduceKeyed
+func (l *Log) ProduceKeyed(ctx context.Context, key, value []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.check(ctx, "ProduceKeyed"); err != nil {
+		return 0, err
+	}
+	return l.append(key, value), nil
+}
+
+func (l *Log) ProduceBatch(ctx context.Context, values [][]byte) ([]uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.check(ctx, "ProduceBatch"); err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, len(values))
+	for i, value := range values {
+		offsets[i] = l.append(nil, value)
+	}
+	return offsets, nil
+}
+
+func (l *Log) Consume(ctx context.Context, offset uint64) (*api.Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.check(ctx, "Consume"); err != nil {
+		return nil, err
+	}
+	if offset >= uint64(len(l.records)) {
+		return nil, outOfRange(offset)
+	}
+	return l.read(offset), nil
+}
+
+// calls fn with each record from offset on, waiting for new ones, until ctx
+// is done, when it returns nil, or fn fails
+func (l *Log) ConsumeStream(ctx context.Context, offset uint64, fn func(*api.Record) error) error {
+	l.mu.Lock()
+	err := l.check(ctx, "ConsumeStream")
+	l.mu.Unlock()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return errClosing
+		}
+		var record *api.Record
+		if offset < uint64(len(l.records)) {
+			record = l.read(offset)
+		}
+		changed := l.wait()
+		l.mu.Unlock()
+		if record == nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-changed:
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+		offset++
+	}
+}
+
+// later calls fail with Canceled, as a closed client's do
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.wait())
+	}
+	return nil
+}
+
+var errClosing = status.Error(codes.Canceled, "grpc: the client connection is closing")
+
+// the error the call fails with, if any. holds mu
+func (l *Log) check(ctx context.Context, method string) error {
+	if l.closed {
+		return errClosing
+	}
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	if failures := l.failures[method]; len(failures) > 0 {
+		l.failures[method] = failures[1:]
+		return status.Convert(failures[0]).Err()
+	}
+	return nil
+}
+
+// holds mu
+func (l *Log) append(key, value []byte) uint64 {
+	offset := uint64(len(l.records))
+	var k []byte
+	if key != nil {
+		k = append([]byte(nil), key...)
+	}
+	l.records = append(l.records, &api.Record{
+		Key:    k,
+		Value:  append([]byte(nil), value...),
+		Offset: offset,
+	})
+	close(l.wait())
+	l.changed = make(chan struct{})
+	return offset
+}
+
+// a copy, so callers can't change the log. holds mu
+func (l *Log) read(offset uint64) *api.Record {
+	record := l.records[offset]
+	return &api.Record{Key: record.Key, Value: record.Value, Offset: record.Offset}
+}
+
+// holds mu
+func (l *Log) wait() chan struct{} {
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	return l.changed
+}
+
+// what a node's out of range error looks like once it's crossed the wire
+func outOfRange(offset uint64) error {
+	return api.ErrOffsetOutOfRange{Offset: offset}.GRPCStatus().Err()
+}
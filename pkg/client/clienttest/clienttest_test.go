@@ -0,0 +1,108 @@
+package clienttest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLog(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"produce and consume records":     testProduceConsume,
+		"consume a stream until canceled": testConsumeStream,
+		"failures are injected":           testFailNext,
+		"closed logs fail calls":          testClose,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t, &Log{})
+		})
+	}
+}
+
+func testProduceConsume(t *testing.T, log *Log) {
+	ctx := context.Background()
+	offset, err := log.Produce(ctx, []byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+	offsets, err := log.ProduceBatch(ctx, [][]byte{[]byte("b"), []byte("c")})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2}, offsets)
+
+	record, err := log.Consume(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), record.Value)
+	require.Equal(t, uint64(1), record.Offset)
+
+	offset, err = log.ProduceKeyed(ctx, []byte("k"), []byte("d"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+	record, err = log.Consume(ctx, 3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("k"), record.Key)
+	require.Equal(t, []byte("d"), record.Value)
+
+	_, err = log.Consume(ctx, 4)
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+	require.Len(t, log.Records(), 4)
+}
+
+func testConsumeStream(t *testing.T, log *Log) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := log.Produce(ctx, []byte("a"))
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		log.Produce(context.Background(), []byte("b"))
+	}()
+
+	var values []string
+	err = log.ConsumeStream(ctx, 0, func(record *api.Record) error {
+		values = append(values, string(record.Value))
+		if len(values) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, values)
+
+	want := errors.New("stop")
+	err = log.ConsumeStream(context.Background(), 1, func(record *api.Record) error {
+		return want
+	})
+	require.Equal(t, want, err)
+}
+
+func testFailNext(t *testing.T, log *Log) {
+	ctx := context.Background()
+	log.FailNext("Produce", api.ErrNotEnoughReplicas{InSync: 1, MinInSync: 2})
+	_, err := log.Produce(ctx, []byte("a"))
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	offset, err := log.Produce(ctx, []byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+}
+
+func testClose(t *testing.T, log *Log) {
+	done := make(chan error)
+	go func() {
+		done <- log.ConsumeStream(context.Background(), 0, func(*api.Record) error {
+			return nil
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, log.Close())
+	require.Equal(t, codes.Canceled, status.Code(<-done))
+
+	_, err := log.Produce(context.Background(), []byte("a"))
+	require.Equal(t, codes.Canceled, status.Code(err))
+}
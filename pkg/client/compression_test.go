@@ -0,0 +1,32 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"proglog/internal/compression"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	c, _ := setupTest(t)
+	value := bytes.Repeat([]byte("hello world "), 1000)
+	for i, name := range compression.Names {
+		client, err := New(Config{Addr: c.Addr, Compression: name})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			client.Close()
+		})
+		offset, err := client.Produce(context.Background(), value)
+		require.NoError(t, err, name)
+		require.Equal(t, uint64(i), offset)
+		record, err := client.Consume(context.Background(), offset)
+		require.NoError(t, err, name)
+		require.Equal(t, value, record.Value)
+	}
+
+	_, err := New(Config{Addr: c.Addr, Compression: "lz4"})
+	require.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+)
+
+type ConsumerConfig struct {
+	// identifies the consumer's committed offset on the node, required
+	Name string
+	// how often the consumer's position is committed while it runs, 5s when
+	// zero, never when negative, e.g. to only commit through Commit
+	CommitInterval time.Duration
+	// where a consumer that hasn't committed an offset starts
+	StartOffset uint64
+	// only reads committed transactions' records, see Client.ConsumeCommitted
+	ReadCommitted bool
+	// the lane the node's reads from disk for the consumer wait in while
+	// they're limited, HIGH for critical consumers and BULK for backfills
+	Priority api.ConsumeRequest_Priority
+}
+
+// reads the log from where it last committed it was up to. it delivers records
+// at least once: its position only moves past a record once the handler's
+// returned for it, and it's committed periodically and when Run returns, so a
+// consumer that crashes reads the records since its last commit again.
+// committed offsets are kept by the node the client's connected to
+type Consumer struct {
+	ConsumerConfig
+	client *Client
+
+	mu sync.Mutex
+	// the next offset to process and the last one committed
+	position, committed uint64
+	started             bool
+}
+
+func (c *Client) NewConsumer(config ConsumerConfig) (*Consumer, error) {
+	if config.Name == "" {
+		return nil, errors.New("client: the consumer has no name")
+	}
+	if config.CommitInterval == 0 {
+		config.CommitInterval = 5 * time.Second
+	}
+	return &Consumer{
+		ConsumerConfig: config,
+		client:         c,
+	}, nil
+}
+
+// calls fn with each record from the committed offset on, waiting for new
+// records once it's read the whole log, until ctx is done or fn fails. it
+// commits the position it got to before returning
+func (c *Consumer) Run(ctx context.Context, fn func(*api.Record) error) error {
+	res, err := c.client.log.GetCommittedOffset(ctx, &api.GetCommittedOffsetRequest{Consumer: c.Name})
+	if err != nil {
+		return err
+	}
+	start := c.StartOffset
+	if res.Found {
+		start = res.Offset
+	}
+	c.mu.Lock()
+	c.position, c.committed, c.started = start, start, true
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	if c.CommitInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(c.CommitInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					// a failed commit is retried on the next tick
+					c.Commit(ctx)
+				}
+			}
+		}()
+	}
+	isolation := api.ConsumeRequest_READ_UNCOMMITTED
+	if c.ReadCommitted {
+		isolation = api.ConsumeRequest_READ_COMMITTED
+	}
+	err = c.client.consumeStream(ctx, start, isolation, c.Priority, func(record *api.Record) error {
+		if err := fn(record); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.position = record.Offset + 1
+		c.mu.Unlock()
+		return nil
+	})
+	close(done)
+	wg.Wait()
+	// ctx may be done, but the position should still be committed
+	commitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	return errors.Join(err, c.Commit(commitCtx))
+}
+
+// the next offset the consumer will process
+func (c *Consumer) Position() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.position
+}
+
+// commits the consumer's position, unless it's already committed
+func (c *Consumer) Commit(ctx context.Context) error {
+	c.mu.Lock()
+	position, committed, started := c.position, c.committed, c.started
+	c.mu.Unlock()
+	if !started || position == committed {
+		return nil
+	}
+	err := c.client.do(ctx, c.client.Retry, "CommitOffset", func(ctx context.Context) error {
+		_, err := c.client.log.CommitOffset(ctx, &api.CommitOffsetRequest{
+			Consumer: c.Name,
+			Offset:   position,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.committed = max(c.committed, position)
+	c.mu.Unlock()
+	return nil
+}
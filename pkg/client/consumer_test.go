@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumer(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, client *Client){
+		"resumes from the committed offset":  testConsumerResume,
+		"commits periodically while it runs": testConsumerCommitInterval,
+		"failed records aren't committed":    testConsumerHandlerError,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, _ := setupTest(t)
+			_, err := client.ProduceBatch(context.Background(), [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+			require.NoError(t, err)
+			fn(t, client)
+		})
+	}
+}
+
+// runs the consumer until it's processed n records
+func consume(t *testing.T, c *Consumer, n int) []string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var values []string
+	err := c.Run(ctx, func(record *api.Record) error {
+		values = append(values, string(record.Value))
+		if len(values) == n {
+			cancel()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return values
+}
+
+func testConsumerResume(t *testing.T, client *Client) {
+	_, err := client.NewConsumer(ConsumerConfig{})
+	require.Error(t, err)
+
+	c, err := client.NewConsumer(ConsumerConfig{Name: "reader", CommitInterval: -1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, consume(t, c, 2))
+	require.Equal(t, uint64(2), c.Position())
+
+	// a new consumer with the same name carries on where the first stopped
+	c, err = client.NewConsumer(ConsumerConfig{Name: "reader", CommitInterval: -1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"c"}, consume(t, c, 1))
+
+	// while one with another name starts from its start offset
+	c, err = client.NewConsumer(ConsumerConfig{Name: "other", StartOffset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, consume(t, c, 1))
+}
+
+func testConsumerCommitInterval(t *testing.T, client *Client) {
+	c, err := client.NewConsumer(ConsumerConfig{Name: "reader", CommitInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx, func(*api.Record) error { return nil })
+	}()
+	require.Eventually(t, func() bool {
+		res, err := client.API().GetCommittedOffset(ctx, &api.GetCommittedOffsetRequest{Consumer: "reader"})
+		return err == nil && res.Found && res.Offset == 3
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func testConsumerHandlerError(t *testing.T, client *Client) {
+	c, err := client.NewConsumer(ConsumerConfig{Name: "reader", CommitInterval: -1})
+	require.NoError(t, err)
+	want := errors.New("can't process b")
+	err = c.Run(context.Background(), func(record *api.Record) error {
+		if string(record.Value) == "b" {
+			return want
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, want)
+
+	// b is delivered again
+	c, err = client.NewConsumer(ConsumerConfig{Name: "reader", CommitInterval: -1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, consume(t, c, 1))
+}
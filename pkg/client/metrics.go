@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// what a Client reports about itself, set Config.Metrics to collect it.
+// the methods are called from the client's goroutines, so they must be safe
+// for concurrent use and shouldn't block
+type MetricsCollector interface {
+	// each RPC attempt, by its full method name, with how long it took. a
+	// stream's counted from when it's opened until it ends
+	ObserveRequest(method string, code codes.Code, d time.Duration)
+	// an attempt of one of the Client's calls (e.g. "Produce" or
+	// "ProduceBatch") that failed with a code the RetryPolicy retries
+	ObserveRetry(call string, code codes.Code)
+	// each batch of records produced, by ProduceBatch or a Producer
+	ObserveBatch(records, bytes int)
+	// the state of the client's connections to the node, the best of them
+	// when it has several, e.g. Ready while any of them is
+	ObserveConnState(state connectivity.State)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveRequest(string, codes.Code, time.Duration) {}
+func (nopMetrics) ObserveRetry(string, codes.Code)                  {}
+func (nopMetrics) ObserveBatch(int, int)                            {}
+func (nopMetrics) ObserveConnState(connectivity.State)              {}
+
+// a MetricsCollector that's a prometheus.Collector too, register it with the
+// registry the program serves
+type PrometheusMetrics struct {
+	requests     *prometheus.HistogramVec
+	retries      *prometheus.CounterVec
+	batchRecords prometheus.Histogram
+	batchBytes   prometheus.Histogram
+	connState    *prometheus.GaugeVec
+}
+
+var _ MetricsCollector = (*PrometheusMetrics)(nil)
+
+var connStates = []connectivity.State{
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proglog_client_request_duration_seconds",
+			Help:    "How long the client's RPC attempts took, by method and code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "code"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proglog_client_retries_total",
+			Help: "The client's calls retried, by call and the code the attempt failed with.",
+		}, []string{"call", "code"}),
+		batchRecords: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proglog_client_batch_records",
+			Help:    "The records in each batch the client produced.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}),
+		batchBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proglog_client_batch_bytes",
+			Help:    "The bytes of record values in each batch the client produced.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		}),
+		connState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proglog_client_connection_state",
+			Help: "1 for the best state the client's connections to the node are in, 0 for the others.",
+		}, []string{"state"}),
+	}
+	for _, s := range connStates {
+		m.connState.WithLabelValues(s.String())
+	}
+	return m
+}
+
+func (m *PrometheusMetrics) ObserveRequest(method string, code codes.Code, d time.Duration) {
+	m.requests.WithLabelValues(method, code.String()).Observe(d.Seconds())
+}
+
+func (m *PrometheusMetrics) ObserveRetry(call string, code codes.Code) {
+	m.retries.WithLabelValues(call, code.String()).Inc()
+}
+
+func (m *PrometheusMetrics) ObserveBatch(records, bytes int) {
+	m.batchRecords.Observe(float64(records))
+	m.batchBytes.Observe(float64(bytes))
+}
+
+func (m *PrometheusMetrics) ObserveConnState(state connectivity.State) {
+	for _, s := range connStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		m.connState.WithLabelValues(s.String()).Set(v)
+	}
+}
+
+func (m *PrometheusMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.retries.Describe(ch)
+	m.batchRecords.Describe(ch)
+	m.batchBytes.Describe(ch)
+	m.connState.Describe(ch)
+}
+
+func (m *PrometheusMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.retries.Collect(ch)
+	m.batchRecords.Collect(ch)
+	m.batchBytes.Collect(ch)
+	m.connState.Collect(ch)
+}
+
+func (c *Client) unaryMetrics(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	c.metrics.ObserveRequest(method, status.Code(err), time.Since(start))
+	return err
+}
+
+func (c *Client) streamMetrics(
+	ctx context.Context,
+	desc *grpc.StreamDesc,
+	cc *grpc.ClientConn,
+	method string,
+	streamer grpc.Streamer,
+	opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	start := time.Now()
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		c.metrics.ObserveRequest(method, status.Code(err), time.Since(start))
+		return nil, err
+	}
+	return &observedStream{
+		ClientStream: stream,
+		observe: func(err error) {
+			c.metrics.ObserveRequest(method, status.Code(err), time.Since(start))
+		},
+	}, nil
+}
+
+// observes the stream once, when a receive fails or hits the end of it
+type observedStream struct {
+	grpc.ClientStream
+	observe  func(error)
+	observed bool
+}
+
+func (s *observedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil && !s.observed {
+		s.observed = true
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		s.observe(err)
+	}
+	return err
+}
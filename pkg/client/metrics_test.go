@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	c, srv := setupTest(t)
+	metrics := NewPrometheusMetrics()
+	client, err := New(Config{
+		Addr:    c.Addr,
+		Retry:   c.Retry,
+		Metrics: metrics,
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	srv.failures.Store(1)
+	_, err = client.Produce(ctx, []byte("hello"))
+	require.NoError(t, err)
+	_, err = client.ProduceBatch(ctx, [][]byte{[]byte("a"), []byte("bc")})
+	require.NoError(t, err)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.retries.WithLabelValues("Produce", "Unavailable")))
+	// Produce's failed and successful attempts and ProduceStream's
+	require.Equal(t, 3, testutil.CollectAndCount(metrics.requests))
+	requests := &dto.Metric{}
+	err = metrics.requests.WithLabelValues(api.Log_ProduceStream_FullMethodName, "OK").(prometheus.Histogram).Write(requests)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), requests.Histogram.GetSampleCount())
+	batchBytes := &dto.Metric{}
+	require.NoError(t, metrics.batchBytes.Write(batchBytes))
+	require.Equal(t, uint64(1), batchBytes.Histogram.GetSampleCount())
+	require.Equal(t, 3.0, batchBytes.Histogram.GetSampleSum())
+	// the watch sees the connection's state changes after the calls do
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.connState.WithLabelValues(connectivity.Ready.String())) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client.Close())
+	require.Equal(t, 0.0, testutil.ToFloat64(metrics.connState.WithLabelValues(connectivity.Ready.String())))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.connState.WithLabelValues(connectivity.Shutdown.String())))
+}
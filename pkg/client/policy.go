@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	api "proglog/api/v1"
+)
+
+// how one of the client's calls is made
+type CallPolicy struct {
+	// how long each attempt can take, none when zero. a ConsumeStream attempt
+	// lasts as long as the stream, so its timeout cuts the stream off
+	Timeout time.Duration
+	// the call's retries, in place of Config.Retry, when MaxAttempts isn't zero
+	Retry RetryPolicy
+	// only for Consume
+	Hedge HedgePolicy
+}
+
+// hedged reads cut Consume's tail latency: when the client's node hasn't
+// answered after Delay, the read's sent to the next of Addrs too, and so on,
+// and the first record back is returned. followers serve what they've
+// replicated, a record they don't have yet fails the read on them, and the
+// client's node's error is returned when none of them has it
+type HedgePolicy struct {
+	// the followers' RPC addresses, dialed with the client's Config. there's
+	// no hedging when empty
+	Addrs []string
+	// 10ms when zero
+	Delay time.Duration
+}
+
+func (c *Client) dialHedges() error {
+	policy, ok := c.Calls["Consume"]
+	if !ok || len(policy.Hedge.Addrs) == 0 {
+		return nil
+	}
+	if policy.Hedge.Delay == 0 {
+		policy.Hedge.Delay = 10 * time.Millisecond
+		c.Calls["Consume"] = policy
+	}
+	for _, addr := range policy.Hedge.Addrs {
+		config := c.Config
+		config.Addr = addr
+		config.Calls = nil
+		hedge, err := New(config)
+		if err != nil {
+			return err
+		}
+		c.hedges = append(c.hedges, hedge)
+	}
+	return nil
+}
+
+// reads the record at offset from the client's node, hedged with its followers
+// when Consume's policy says so
+func (c *Client) hedgedConsume(ctx context.Context, offset uint64) (*api.Record, error) {
+	if len(c.hedges) == 0 {
+		res, err := c.log.Consume(ctx, &api.ConsumeRequest{Offset: offset})
+		return res.GetRecord(), err
+	}
+	targets := []api.LogClient{c.log}
+	for _, hedge := range c.hedges {
+		targets = append(targets, hedge.log)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	// stops the reads still going once one's returned
+	defer cancel()
+	type result struct {
+		target int
+		record *api.Record
+		err    error
+	}
+	results := make(chan result, len(targets))
+	read := func(i int) {
+		res, err := targets[i].Consume(ctx, &api.ConsumeRequest{Offset: offset})
+		results <- result{target: i, record: res.GetRecord(), err: err}
+	}
+	go read(0)
+	sent, failed := 1, 0
+	var primaryErr error
+	delay := time.NewTimer(c.Calls["Consume"].Hedge.Delay)
+	defer delay.Stop()
+	for {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				return r.record, nil
+			}
+			if r.target == 0 {
+				primaryErr = r.err
+			}
+			failed++
+			if failed == len(targets) {
+				return nil, primaryErr
+			}
+			// a failed read's hedged right away
+			if sent < len(targets) {
+				go read(sent)
+				sent++
+			}
+		case <-delay.C:
+			if sent < len(targets) {
+				go read(sent)
+				sent++
+				delay.Reset(c.Calls["Consume"].Hedge.Delay)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+	"proglog/internal/server"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCallPolicy(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"attempts time out":                testCallTimeout,
+		"calls' retries override config's": testCallRetry,
+		"hedged reads return the fastest":  testHedgeFastest,
+		"hedged reads fall back":           testHedgeFallback,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testCallTimeout(t *testing.T) {
+	addr := serveSlowLog(t, time.Second, "a")
+	client, err := New(Config{
+		Addr:  addr,
+		Calls: map[string]CallPolicy{"Consume": {Timeout: 20 * time.Millisecond}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	start := time.Now()
+	_, err = client.Consume(context.Background(), 0)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func testCallRetry(t *testing.T) {
+	c, srv := setupTest(t)
+	client, err := New(Config{
+		Addr:  c.Addr,
+		Retry: c.Retry,
+		Calls: map[string]CallPolicy{"Produce": {Retry: RetryPolicy{MaxAttempts: 1}}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	srv.failures.Store(1)
+	_, err = client.Produce(context.Background(), []byte("a"))
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// Consume keeps the config's retries
+	srv.failures.Store(1)
+	_, err = client.Consume(context.Background(), 0)
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+func testHedgeFastest(t *testing.T) {
+	leader := serveSlowLog(t, time.Second, "a")
+	follower := serveSlowLog(t, 0, "a")
+	client, err := New(Config{
+		Addr: leader,
+		Calls: map[string]CallPolicy{"Consume": {
+			Hedge: HedgePolicy{Addrs: []string{follower}},
+		}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	start := time.Now()
+	record, err := client.Consume(context.Background(), 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), record.Value)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func testHedgeFallback(t *testing.T) {
+	leader := serveSlowLog(t, 50*time.Millisecond, "a")
+	// hasn't replicated the record yet
+	follower := serveSlowLog(t, 0)
+	client, err := New(Config{
+		Addr: leader,
+		Calls: map[string]CallPolicy{"Consume": {
+			Hedge: HedgePolicy{Addrs: []string{follower}},
+		}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	record, err := client.Consume(context.Background(), 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), record.Value)
+
+	_, err = client.Consume(context.Background(), 1)
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+// serves a log with the values whose reads take delay, and returns its address
+func serveSlowLog(t *testing.T, delay time.Duration, values ...string) string {
+	t.Helper()
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		clog.Close()
+	})
+	for _, value := range values {
+		_, err := clog.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	return serve(t, &server.Config{CommitLog: slowLog{Log: clog, delay: delay}})
+}
+
+type slowLog struct {
+	*log.Log
+	delay time.Duration
+}
+
+func (l slowLog) Read(offset uint64) (*api.Record, error) {
+	time.Sleep(l.delay)
+	return l.Log.Read(offset)
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// the client's connections to its node. calls are spread over them round
+// robin, skipping the ones failing to connect while another's usable, and a
+// connection that keeps failing for evictAfter is replaced with a new one, so
+// its backoff doesn't hold the client back once the node's reachable again
+type pool struct {
+	target     string
+	opts       []grpc.DialOption
+	evictAfter time.Duration
+	metrics    MetricsCollector
+
+	next atomic.Uint64
+	mu   sync.Mutex
+	// replaced in place when a connection's evicted
+	conns []*grpc.ClientConn
+
+	// stops the watches
+	ctx     context.Context
+	cancel  context.CancelFunc
+	watches sync.WaitGroup
+}
+
+var _ grpc.ClientConnInterface = (*pool)(nil)
+
+func newPool(
+	target string,
+	opts []grpc.DialOption,
+	size int,
+	evictAfter time.Duration,
+	metrics MetricsCollector,
+) (*pool, error) {
+	p := &pool{
+		target:     target,
+		opts:       opts,
+		evictAfter: evictAfter,
+		metrics:    metrics,
+		conns:      make([]*grpc.ClientConn, size),
+	}
+	for i := range p.conns {
+		conn, err := grpc.NewClient(target, opts...)
+		if err != nil {
+			for _, conn := range p.conns[:i] {
+				conn.Close()
+			}
+			return nil, err
+		}
+		p.conns[i] = conn
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	for i := range p.conns {
+		p.watches.Add(1)
+		go func() {
+			defer p.watches.Done()
+			p.watch(i)
+		}()
+	}
+	return p, nil
+}
+
+func (p *pool) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	return p.pick().Invoke(ctx, method, args, reply, opts...)
+}
+
+func (p *pool) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return p.pick().NewStream(ctx, desc, method, opts...)
+}
+
+// the next connection that isn't failing, or just the next when they all are
+func (p *pool) pick() *grpc.ClientConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := p.next.Add(1)
+	n := uint64(len(p.conns))
+	for i := uint64(0); i < n; i++ {
+		conn := p.conns[(start+i)%n]
+		if conn.GetState() != connectivity.TransientFailure {
+			return conn
+		}
+	}
+	return p.conns[start%n]
+}
+
+// follows the i'th connection's states until the pool's closed, replacing it
+// once it's failed for evictAfter
+func (p *pool) watch(i int) {
+	for {
+		p.mu.Lock()
+		conn := p.conns[i]
+		p.mu.Unlock()
+		state := conn.GetState()
+		p.observe()
+		if state != connectivity.TransientFailure {
+			if !conn.WaitForStateChange(p.ctx, state) {
+				return
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, p.evictAfter)
+		changed := conn.WaitForStateChange(ctx, state)
+		cancel()
+		if p.ctx.Err() != nil {
+			return
+		}
+		if !changed {
+			p.replace(i, conn)
+		}
+	}
+}
+
+// a new connection in conn's place, conn's kept when it can't be dialed
+func (p *pool) replace(i int, conn *grpc.ClientConn) {
+	fresh, err := grpc.NewClient(p.target, p.opts...)
+	if err != nil {
+		return
+	}
+	fresh.Connect()
+	p.mu.Lock()
+	p.conns[i] = fresh
+	p.mu.Unlock()
+	conn.Close()
+}
+
+// reports the best of the connections' states, Ready when any of them is
+func (p *pool) observe() {
+	rank := map[connectivity.State]int{
+		connectivity.Shutdown:         0,
+		connectivity.TransientFailure: 1,
+		connectivity.Idle:             2,
+		connectivity.Connecting:       3,
+		connectivity.Ready:            4,
+	}
+	best := connectivity.Shutdown
+	p.mu.Lock()
+	for _, conn := range p.conns {
+		if state := conn.GetState(); rank[state] > rank[best] {
+			best = state
+		}
+	}
+	p.mu.Unlock()
+	p.metrics.ObserveConnState(best)
+}
+
+func (p *pool) close() error {
+	p.cancel()
+	p.watches.Wait()
+	var errs []error
+	p.mu.Lock()
+	for _, conn := range p.conns {
+		errs = append(errs, conn.Close())
+	}
+	p.mu.Unlock()
+	p.metrics.ObserveConnState(connectivity.Shutdown)
+	return errors.Join(errs...)
+}
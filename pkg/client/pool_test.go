@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+	"proglog/internal/server"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+func TestPoolSpreadsCalls(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		clog.Close()
+	})
+	var mu sync.Mutex
+	peers := map[string]int{}
+	record := func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if p, ok := peer.FromContext(ctx); ok {
+			mu.Lock()
+			peers[p.Addr.String()]++
+			mu.Unlock()
+		}
+		return handler(ctx, req)
+	}
+	srv, err := server.NewGPRCServer(
+		&server.Config{CommitLog: clog},
+		grpc.ChainUnaryInterceptor(record),
+	)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	client, err := New(Config{Addr: l.Addr().String(), Connections: 3})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	for i := 0; i < 9; i++ {
+		_, err := client.Produce(context.Background(), []byte("hello"))
+		require.NoError(t, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, peers, 3)
+	for _, calls := range peers {
+		require.Equal(t, 3, calls)
+	}
+}
+
+func TestPoolEvictsFailingConns(t *testing.T) {
+	// nothing listens, so the connection keeps failing
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	client, err := New(Config{Addr: addr, EvictAfter: 50 * time.Millisecond})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	client.pool.mu.Lock()
+	first := client.pool.conns[0]
+	client.pool.mu.Unlock()
+	first.Connect()
+
+	require.Eventually(t, func() bool {
+		client.pool.mu.Lock()
+		defer client.pool.mu.Unlock()
+		return client.pool.conns[0] != first
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// calls go to the new connection, and succeed once the node's back
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		clog.Close()
+	})
+	srv, err := server.NewGPRCServer(&server.Config{CommitLog: clog})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	require.Eventually(t, func() bool {
+		_, err := client.API().Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello")},
+		})
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	ErrProducerClosed = errors.New("client: producer closed")
+	// returned by sends when the in-flight window is full and FailFast is set
+	ErrProducerFull = errors.New("client: producer's in-flight window is full")
+)
+
+type ProducerConfig struct {
+	// a batch is sent once its values add up to BatchBytes, 16KiB when zero
+	BatchBytes int
+	// or once its first record has waited Linger, 5ms when zero
+	Linger time.Duration
+	// how many records can be in flight, queued or being sent, before sends
+	// block, which bounds the producer's memory, 1000 when zero
+	MaxInFlight int
+	// makes sends fail with ErrProducerFull rather than block when the
+	// in-flight window's full
+	FailFast bool
+	// how batches are retried, 5 attempts on Unavailable (e.g. too few in-sync
+	// replicas or a lost connection) and DeadlineExceeded (e.g. a replication
+	// timeout) when MaxAttempts is zero. a node that isn't the leader fails with
+	// FailedPrecondition, that isn't retried since the client only has one address
+	Retry RetryPolicy
+}
+
+// what became of a record: its offset, or why it wasn't appended
+type Result struct {
+	Offset uint64
+	Err    error
+}
+
+// batches the records sent to it, so a chatty producer doesn't pay for a round
+// trip per record. batches are sent one at a time over ProduceStream, so records
+// are appended in the order they're sent.
+//
+// the producer's idempotent: its records carry its ID and a sequence number, and
+// the log returns a retried record's first offset rather than appending it
+// again. a batch that fails for good moves the producer to a new ID, so the
+// sequences it lost don't fail the batches after it
+type Producer struct {
+	ProducerConfig
+	client *Client
+	// only used by run
+	id       string
+	sequence uint64
+
+	// sends hold the read lock while they queue a record, Close the write lock
+	// while it closes records
+	mu     sync.RWMutex
+	closed bool
+	// holds a token for each record in flight
+	window  chan struct{}
+	records chan pending
+	flushes chan chan struct{}
+	done    chan struct{}
+}
+
+type pending struct {
+	value   []byte
+	deliver func(Result)
+}
+
+func (c *Client) NewProducer(config ProducerConfig) *Producer {
+	if config.BatchBytes == 0 {
+		config.BatchBytes = 16 << 10
+	}
+	if config.Linger == 0 {
+		config.Linger = 5 * time.Millisecond
+	}
+	if config.MaxInFlight == 0 {
+		config.MaxInFlight = 1000
+	}
+	if config.Retry.MaxAttempts == 0 {
+		config.Retry.MaxAttempts = 5
+		if len(config.Retry.Codes) == 0 {
+			config.Retry.Codes = []codes.Code{codes.Unavailable, codes.DeadlineExceeded}
+		}
+	}
+	config.Retry = config.Retry.withDefaults()
+	p := &Producer{
+		ProducerConfig: config,
+		client:         c,
+		id:             newProducerID(),
+		window:         make(chan struct{}, config.MaxInFlight),
+		// never full, the window lets fewer records in
+		records: make(chan pending, config.MaxInFlight),
+		flushes: make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// queues the value to be appended with the next batch. the record's Result is
+// delivered on the returned channel once its batch has been sent, or right away
+// when it couldn't be queued, e.g. because ctx was done before the in-flight
+// window had room
+func (p *Producer) Send(ctx context.Context, value []byte) <-chan Result {
+	result := make(chan Result, 1)
+	err := p.send(ctx, value, func(r Result) {
+		result <- r
+	})
+	if err != nil {
+		result <- Result{Err: err}
+	}
+	return result
+}
+
+// queues the value to be appended with the next batch, blocking while the
+// in-flight window's full unless FailFast is set, and calls cb with the
+// record's Result once its batch has been sent. callbacks run one at a time on
+// the producer's goroutine, a slow one holds up the batches after it. cb isn't
+// called when the value couldn't be queued
+func (p *Producer) SendAsync(value []byte, cb func(Result)) error {
+	return p.send(context.Background(), value, cb)
+}
+
+func (p *Producer) send(ctx context.Context, value []byte, deliver func(Result)) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrProducerClosed
+	}
+	if p.FailFast {
+		select {
+		case p.window <- struct{}{}:
+		default:
+			return ErrProducerFull
+		}
+	} else {
+		select {
+		case p.window <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	p.records <- pending{value: value, deliver: deliver}
+	return nil
+}
+
+// sends the records queued so far without waiting for their batches to fill
+// up, and waits until they've been sent
+func (p *Producer) Flush(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case p.flushes <- ack:
+	case <-p.done:
+		return ErrProducerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sends the records queued and stops, later sends fail with ErrProducerClosed.
+// it doesn't close the client
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.records)
+	}
+	p.mu.Unlock()
+	<-p.done
+	return nil
+}
+
+func (p *Producer) run() {
+	defer close(p.done)
+	var batch []pending
+	var size int
+	linger := time.NewTimer(p.Linger)
+	linger.Stop()
+	send := func() {
+		linger.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		records := make([]*api.Record, len(batch))
+		for i, r := range batch {
+			records[i] = &api.Record{
+				Value:      r.value,
+				ProducerId: p.id,
+				Sequence:   p.sequence,
+			}
+			p.sequence++
+		}
+		offsets, err := p.client.produceBatch(context.Background(), p.Retry, "Producer", records)
+		if err != nil {
+			p.id, p.sequence = newProducerID(), 0
+		}
+		for i, r := range batch {
+			result := Result{Err: err}
+			if i < len(offsets) {
+				result = Result{Offset: offsets[i]}
+			}
+			// the window's freed first, so a callback can send again
+			<-p.window
+			r.deliver(result)
+		}
+		batch, size = nil, 0
+	}
+	for {
+		select {
+		case r, ok := <-p.records:
+			if !ok {
+				send()
+				return
+			}
+			if len(batch) == 0 {
+				linger.Reset(p.Linger)
+			}
+			batch = append(batch, r)
+			size += len(r.value)
+			if size >= p.BatchBytes {
+				send()
+			}
+		case <-linger.C:
+			send()
+		case ack := <-p.flushes:
+			// the records queued before the flush may still be buffered
+			for n := len(p.records); n > 0; n-- {
+				r, ok := <-p.records
+				if !ok {
+					break
+				}
+				batch = append(batch, r)
+			}
+			send()
+			close(ack)
+		}
+	}
+}
+
+func newProducerID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
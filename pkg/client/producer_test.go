@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProducer(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, client *Client, srv *testServer){
+		"full batches are sent together":   testProducerBatchBytes,
+		"batches are sent after lingering": testProducerLinger,
+		"flush sends what's queued":        testProducerFlush,
+		"close sends what's queued":        testProducerClose,
+		"retries don't duplicate records":  testProducerIdempotentRetry,
+		"async sends call back":            testProducerSendAsync,
+		"full window fails fast":           testProducerFailFast,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, srv := setupTest(t)
+			fn(t, client, srv)
+		})
+	}
+}
+
+func testProducerBatchBytes(t *testing.T, client *Client, srv *testServer) {
+	p := client.NewProducer(ProducerConfig{BatchBytes: 10, Linger: time.Hour})
+	t.Cleanup(func() {
+		p.Close()
+	})
+	var results []<-chan Result
+	for i := 0; i < 10; i++ {
+		results = append(results, p.Send(context.Background(), []byte("value")))
+	}
+	for i, result := range results {
+		r := <-result
+		require.NoError(t, r.Err)
+		require.Equal(t, uint64(i), r.Offset)
+	}
+	// two 5 byte values fill a batch
+	require.Equal(t, int32(5), srv.produceStreams.Load())
+}
+
+func testProducerLinger(t *testing.T, client *Client, srv *testServer) {
+	p := client.NewProducer(ProducerConfig{Linger: 50 * time.Millisecond})
+	t.Cleanup(func() {
+		p.Close()
+	})
+	start := time.Now()
+	first := p.Send(context.Background(), []byte("a"))
+	second := p.Send(context.Background(), []byte("b"))
+	require.Equal(t, uint64(0), (<-first).Offset)
+	require.Equal(t, uint64(1), (<-second).Offset)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Equal(t, int32(1), srv.produceStreams.Load())
+}
+
+func testProducerFlush(t *testing.T, client *Client, srv *testServer) {
+	p := client.NewProducer(ProducerConfig{Linger: time.Hour})
+	t.Cleanup(func() {
+		p.Close()
+	})
+	var results []<-chan Result
+	for i := 0; i < 3; i++ {
+		results = append(results, p.Send(context.Background(), []byte(fmt.Sprint(i))))
+	}
+	require.NoError(t, p.Flush(context.Background()))
+	for i, result := range results {
+		select {
+		case r := <-result:
+			require.NoError(t, r.Err)
+			require.Equal(t, uint64(i), r.Offset)
+		default:
+			t.Fatalf("record %d wasn't sent by the flush", i)
+		}
+	}
+	require.Equal(t, int32(1), srv.produceStreams.Load())
+}
+
+func testProducerClose(t *testing.T, client *Client, _ *testServer) {
+	p := client.NewProducer(ProducerConfig{Linger: time.Hour})
+	result := p.Send(context.Background(), []byte("a"))
+	require.NoError(t, p.Close())
+	require.NoError(t, (<-result).Err)
+
+	r := <-p.Send(context.Background(), []byte("b"))
+	require.Equal(t, ErrProducerClosed, r.Err)
+	require.Equal(t, ErrProducerClosed, p.Flush(context.Background()))
+}
+
+func testProducerIdempotentRetry(t *testing.T, client *Client, srv *testServer) {
+	p := client.NewProducer(ProducerConfig{
+		Linger: time.Hour,
+		Retry:  RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond},
+	})
+	t.Cleanup(func() {
+		p.Close()
+	})
+	// the first record's appended but its acknowledgement is lost
+	srv.lostAcks.Store(1)
+	first := p.Send(context.Background(), []byte("a"))
+	second := p.Send(context.Background(), []byte("b"))
+	require.NoError(t, p.Flush(context.Background()))
+	require.Equal(t, Result{Offset: 0}, <-first)
+	require.Equal(t, Result{Offset: 1}, <-second)
+	require.Equal(t, int32(2), srv.produceStreams.Load())
+
+	record, err := client.Consume(context.Background(), 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), record.Value)
+	_, err = client.Consume(context.Background(), 2)
+	require.Error(t, err)
+}
+
+func testProducerSendAsync(t *testing.T, client *Client, _ *testServer) {
+	p := client.NewProducer(ProducerConfig{MaxInFlight: 2})
+	t.Cleanup(func() {
+		p.Close()
+	})
+	results := make(chan Result, 10)
+	for i := 0; i < 10; i++ {
+		// blocks while two records are in flight
+		err := p.SendAsync([]byte(fmt.Sprint(i)), func(r Result) {
+			results <- r
+		})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 10; i++ {
+		r := <-results
+		require.NoError(t, r.Err)
+		require.Equal(t, uint64(i), r.Offset)
+	}
+}
+
+func testProducerFailFast(t *testing.T, client *Client, _ *testServer) {
+	p := client.NewProducer(ProducerConfig{
+		Linger:      time.Hour,
+		MaxInFlight: 1,
+		FailFast:    true,
+	})
+	results := make(chan Result, 1)
+	err := p.SendAsync([]byte("a"), func(r Result) {
+		results <- r
+	})
+	require.NoError(t, err)
+	err = p.SendAsync([]byte("b"), func(Result) {
+		t.Fatal("callback called for a record that wasn't queued")
+	})
+	require.ErrorIs(t, err, ErrProducerFull)
+	r := <-p.Send(context.Background(), []byte("c"))
+	require.ErrorIs(t, r.Err, ErrProducerFull)
+
+	require.NoError(t, p.Close())
+	require.Equal(t, uint64(0), (<-results).Offset)
+	err = p.SendAsync([]byte("d"), func(Result) {})
+	require.ErrorIs(t, err, ErrProducerClosed)
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	api "proglog/api/v1"
+
+	"google.golang.org/grpc"
+)
+
+// groups the records it produces, so consumers reading committed records see
+// all of them once it commits, or none if it aborts. the node aborts it when it
+// doesn't end within its timeout, and when the node restarts
+type Transaction struct {
+	ID     string
+	client *Client
+}
+
+// begins a transaction the node aborts unless it ends within timeout, the
+// node's default when zero
+func (c *Client) BeginTransaction(ctx context.Context, timeout time.Duration) (*Transaction, error) {
+	var id string
+	err := c.do(ctx, c.Retry, "BeginTransaction", func(ctx context.Context) error {
+		res, err := c.log.BeginTransaction(ctx, &api.BeginTransactionRequest{
+			TimeoutMs: uint64(timeout.Milliseconds()),
+		})
+		if err != nil {
+			return err
+		}
+		id = res.TransactionId
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Transaction{ID: id, client: c}, nil
+}
+
+// appends the value in the transaction. it isn't retried, a record whose first
+// attempt was appended would be committed twice
+func (t *Transaction) Produce(ctx context.Context, value []byte) (uint64, error) {
+	res, err := t.client.log.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: value, TransactionId: t.ID},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Offset, nil
+}
+
+// makes the transaction's records visible to consumers reading committed
+// records, returning the offset of its commit marker
+func (t *Transaction) Commit(ctx context.Context) (uint64, error) {
+	return t.end(ctx, "CommitTransaction", t.client.log.CommitTransaction)
+}
+
+// drops the transaction's records, consumers reading committed records skip
+// them
+func (t *Transaction) Abort(ctx context.Context) (uint64, error) {
+	return t.end(ctx, "AbortTransaction", t.client.log.AbortTransaction)
+}
+
+func (t *Transaction) end(
+	ctx context.Context,
+	call string,
+	fn func(context.Context, *api.EndTransactionRequest, ...grpc.CallOption) (*api.EndTransactionResponse, error),
+) (uint64, error) {
+	var offset uint64
+	// a retried end appends the same marker, the node refuses the other one
+	err := t.client.do(ctx, t.client.Retry, call, func(ctx context.Context) error {
+		res, err := fn(ctx, &api.EndTransactionRequest{TransactionId: t.ID})
+		if err != nil {
+			return err
+		}
+		offset = res.Offset
+		return nil
+	})
+	return offset, err
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction(t *testing.T) {
+	client, _ := setupTest(t)
+	ctx := context.Background()
+
+	aborted, err := client.BeginTransaction(ctx, 0)
+	require.NoError(t, err)
+	_, err = aborted.Produce(ctx, []byte("dropped"))
+	require.NoError(t, err)
+	committed, err := client.BeginTransaction(ctx, 0)
+	require.NoError(t, err)
+	for _, value := range []string{"a", "b"} {
+		_, err = committed.Produce(ctx, []byte(value))
+		require.NoError(t, err)
+	}
+	_, err = aborted.Abort(ctx)
+	require.NoError(t, err)
+	_, err = committed.Commit(ctx)
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, []byte("c"))
+	require.NoError(t, err)
+
+	done := errors.New("done")
+	var values []string
+	err = client.ConsumeCommitted(ctx, 0, func(record *api.Record) error {
+		values = append(values, string(record.Value))
+		if len(values) == 3 {
+			return done
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, done)
+	require.Equal(t, []string{"a", "b", "c"}, values)
+}
@@ -0,0 +1,113 @@
+// reads a node's records straight from its data directory, without running the
+// node, e.g. for batch analytics or to look into a backup. the directory's only
+// read, so it has to be one no node's appending to: a stopped node's or a copy.
+//
+// records are read from the segments' store files, their indexes aren't
+// needed. a store that ends partway through a record, as one can after a
+// crash, is read up to that record, as the node would when it opened it
+package reader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+)
+
+// stops a Scan early without failing it
+var ErrStop = errors.New("reader: stop scanning")
+
+type Reader struct {
+	// the log's directory
+	Dir string
+	// the segments' base offsets, in order
+	segments []uint64
+}
+
+// opens a node's data directory, or its log directory
+func Open(dir string) (*Reader, error) {
+	if _, err := os.Stat(filepath.Join(dir, "log")); err == nil {
+		dir = filepath.Join(dir, "log")
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{Dir: dir}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".store")
+		if !ok {
+			continue
+		}
+		// segments' files are named after their base offset
+		baseOffset, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s isn't named after a base offset: %w", file.Name(), err)
+		}
+		r.segments = append(r.segments, baseOffset)
+	}
+	if len(r.segments) == 0 {
+		return nil, fmt.Errorf("no segments in %s", dir)
+	}
+	sort.Slice(r.segments, func(i, j int) bool {
+		return r.segments[i] < r.segments[j]
+	})
+	return r, nil
+}
+
+// the offset of the oldest record in the directory and the offset the next
+// record appended would get. it reads the newest segment to count its records
+func (r *Reader) Offsets() (lowest, next uint64, err error) {
+	last := r.segments[len(r.segments)-1]
+	next = last
+	err = r.scanSegment(last, func(*api.Record) error {
+		next++
+		return nil
+	})
+	return r.segments[0], next, err
+}
+
+// calls fn with each record from offset on, in order, until it's read the
+// newest one or fn fails. fn can return ErrStop to stop without an error
+func (r *Reader) Scan(offset uint64, fn func(*api.Record) error) error {
+	for i, baseOffset := range r.segments {
+		// the next segment starts at or before offset, this one's all older
+		if i+1 < len(r.segments) && r.segments[i+1] <= offset {
+			continue
+		}
+		err := r.scanSegment(baseOffset, func(record *api.Record) error {
+			if record.Offset < offset {
+				return nil
+			}
+			return fn(record)
+		})
+		if errors.Is(err, ErrStop) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reader) scanSegment(baseOffset uint64, fn func(*api.Record) error) error {
+	path := filepath.Join(r.Dir, fmt.Sprintf("%d.store", baseOffset))
+	err := log.ScanStore(path, func(e log.StoreEntry) error {
+		if e.Err != nil {
+			return fmt.Errorf("%s: record at position %d doesn't decode: %w", path, e.Pos, e.Err)
+		}
+		return fn(e.Record)
+	})
+	var torn log.ErrTornStore
+	if errors.As(err, &torn) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package reader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "proglog/api/v1"
+	"proglog/internal/log"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"offsets span the segments":     testOffsets,
+		"scan from an offset":           testScan,
+		"scans stop early":              testStop,
+		"torn stores are read up to it": testTorn,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir := setupTest(t)
+			fn(t, dir)
+		})
+	}
+}
+
+// a node's data directory with 10 records spread over several segments
+func setupTest(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 128
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "log"), 0755))
+	l, err := log.NewLog(filepath.Join(dir, "log"), c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+	return dir
+}
+
+func testOffsets(t *testing.T, dir string) {
+	r, err := Open(dir)
+	require.NoError(t, err)
+	require.Greater(t, len(r.segments), 1)
+	lowest, next, err := r.Offsets()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	require.Equal(t, uint64(10), next)
+}
+
+func testScan(t *testing.T, dir string) {
+	// the log directory opens too
+	r, err := Open(filepath.Join(dir, "log"))
+	require.NoError(t, err)
+	var offsets []uint64
+	err = r.Scan(4, func(record *api.Record) error {
+		require.Equal(t, fmt.Sprintf("record %d", record.Offset), string(record.Value))
+		offsets = append(offsets, record.Offset)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{4, 5, 6, 7, 8, 9}, offsets)
+}
+
+func testStop(t *testing.T, dir string) {
+	r, err := Open(dir)
+	require.NoError(t, err)
+	var n int
+	err = r.Scan(0, func(*api.Record) error {
+		n++
+		if n == 3 {
+			return ErrStop
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+}
+
+func testTorn(t *testing.T, dir string) {
+	r, err := Open(dir)
+	require.NoError(t, err)
+	// the newest store with records in it, the newest one can be empty
+	var last string
+	var size int64
+	for _, baseOffset := range r.segments {
+		path := filepath.Join(r.Dir, fmt.Sprintf("%d.store", baseOffset))
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		if info.Size() > 0 {
+			last, size = path, info.Size()
+		}
+	}
+	require.NoError(t, os.Truncate(last, size-1))
+
+	var n int
+	err = r.Scan(0, func(*api.Record) error {
+		n++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 9, n)
+}